@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hvac-proxy/hvac"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// activityLog keeps the most recent proxied requests and notable events in
+// memory for the dashboard.
+type activityLog struct {
+	size int
+
+	mu      sync.Mutex
+	traffic []trafficEntry
+	events  []activityEvent
+}
+
+// trafficEntry is a proxied thermostat request.
+type trafficEntry struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"` // 0 when no response was received
+	Duration float64   `json:"durationMs"`
+	Note     string    `json:"note,omitempty"`
+}
+
+// activityEvent is a notable change, such as a breaker trip or a config reload.
+type activityEvent struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+}
+
+// activity holds the recent requests and events shown on the dashboard.
+var activity = newActivityLog(50)
+
+func newActivityLog(size int) *activityLog {
+	return &activityLog{size: size}
+}
+
+// Request records a proxied request.
+func (a *activityLog) Request(r *http.Request, status int, elapsed time.Duration, note string) {
+	e := trafficEntry{
+		Time:     time.Now(),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Status:   status,
+		Duration: float64(elapsed.Microseconds()) / 1000,
+		Note:     note,
+	}
+	a.mu.Lock()
+	a.traffic = appendRing(a.traffic, e, a.size)
+	a.mu.Unlock()
+}
+
+// Event records an event and publishes it to the event stream.
+func (a *activityLog) Event(kind, format string, args ...any) {
+	e := activityEvent{Time: time.Now(), Kind: kind, Message: fmt.Sprintf(format, args...)}
+	a.mu.Lock()
+	a.events = appendRing(a.events, e, a.size)
+	a.mu.Unlock()
+	hvac.Events.Publish("event", e)
+}
+
+// activitySink records equipment changes and faults published by the hvac
+// package as dashboard events.
+type activitySink struct {
+	log *activityLog
+}
+
+func (s activitySink) Accepts(e hvac.Event) bool {
+	return e.Type == "inventory" || e.Type == "fault"
+}
+
+func (s activitySink) Write(ctx context.Context, events []hvac.Event) error {
+	for _, e := range events {
+		s.log.Event(e.Type, "%s", e.Data)
+	}
+	return nil
+}
+
+// Snapshot returns the recorded requests and events, newest first.
+func (a *activityLog) Snapshot() ([]trafficEntry, []activityEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return reversed(a.traffic), reversed(a.events)
+}
+
+// appendRing appends v, dropping the oldest entry once s holds size entries.
+func appendRing[T any](s []T, v T, size int) []T {
+	if len(s) >= size {
+		s = append(s[:0], s[len(s)-size+1:]...)
+	}
+	return append(s, v)
+}
+
+func reversed[T any](s []T) []T {
+	out := make([]T, len(s))
+	for i, v := range s {
+		out[len(s)-1-i] = v
+	}
+	return out
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"hvac-proxy/hvac"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// AdminConfig controls the optional listener for metrics, the API, health
+// checks and the UI. When Addr is empty these routes are served on the
+// proxy port instead.
+type AdminConfig struct {
+	Addr    string `yaml:"addr"`    // Listen address, e.g. ":9090" or "127.0.0.1:9090"
+	TLSCert string `yaml:"tlsCert"` // PEM certificate file; enables HTTPS with TLSKey
+	TLSKey  string `yaml:"tlsKey"`  // PEM private key file
+}
+
+// adminRoutes are the path prefixes handled by the admin mux. They are also
+// registered on the proxy port when no admin listener is configured.
+var adminRoutes = []string{"/metrics", "/healthz", "/readyz", "/api/v1/", "/ui/"}
+
+// ready is true while the proxy is accepting thermostat requests.
+var ready atomic.Bool
+
+// newAdminMux returns the handler for metrics, the API, health checks and the
+// dashboard, behind authentication when it is configured.
+func newAdminMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", hvac.HandleMetrics)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.Handle("/ui/", handleUI())
+	mux.Handle("/{$}", http.RedirectHandler("/ui/", http.StatusFound))
+	mux.HandleFunc("GET /api/v1/status", handleStatus)
+	mux.HandleFunc("GET /api/v1/history", handleHistory)
+	mux.HandleFunc("GET /api/v1/diagnostics", handleDiagnostics)
+	mux.HandleFunc("GET /api/v1/inventory", handleInventory)
+	mux.HandleFunc("GET /api/v1/faults", handleFaults)
+	mux.HandleFunc("GET /api/v1/energy", handleEnergy)
+	mux.HandleFunc("GET /api/v1/energy/history", handleEnergyHistory)
+	mux.HandleFunc("GET /api/v1/activity", handleActivity)
+	mux.HandleFunc("GET /api/v1/stream", handleStream)
+	if injector != nil {
+		mux.HandleFunc("GET /api/v1/schedules", handleSchedules)
+		mux.HandleFunc("GET /api/v1/zones/{zone}/schedule", handleSchedule)
+		mux.HandleFunc("DELETE /api/v1/zones/{zone}/schedule", handleDiscardSchedule)
+		mux.HandleFunc("PUT /api/v1/zones/{zone}/schedule/{day}", handlePutScheduleDay)
+		mux.HandleFunc("POST /api/v1/zones/{zone}/schedule/{day}/periods", handleAddPeriod)
+		mux.HandleFunc("PUT /api/v1/zones/{zone}/schedule/{day}/periods/{period}", handlePutPeriod)
+		mux.HandleFunc("DELETE /api/v1/zones/{zone}/schedule/{day}/periods/{period}", handleDeletePeriod)
+	}
+	if backups != nil {
+		mux.HandleFunc("GET /api/v1/config/versions", handleConfigVersions)
+		mux.HandleFunc("GET /api/v1/config/versions/{version}", handleConfigVersion)
+		mux.HandleFunc("GET /api/v1/config/versions/{version}/diff", handleConfigDiff)
+		if injector != nil {
+			mux.HandleFunc("POST /api/v1/config/versions/{version}/restore", handleConfigRestore)
+		}
+	}
+	if messages != nil {
+		mux.HandleFunc("GET /api/v1/messages", handleMessages)
+		mux.HandleFunc("POST /api/v1/messages", handleAddMessage)
+		mux.HandleFunc("DELETE /api/v1/messages/{id}", handleDeleteMessage)
+	}
+	if capture != nil {
+		mux.Handle("/api/v1/capture", capture)
+	}
+	return requireAuth(mux)
+}
+
+// newProxyMux returns the handler for the thermostat-facing port. With
+// withAdmin set, the admin routes are served there too.
+func newProxyMux(admin http.Handler, withAdmin bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", proxyHandler)
+	if withAdmin {
+		for _, route := range adminRoutes {
+			mux.Handle(route, admin)
+		}
+	}
+	return mux
+}
+
+// handleHealthz reports that the process is alive.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the proxy is accepting thermostat requests.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ready\n"))
+}
+
+// listenAdmin opens the admin listener, wrapping it in TLS when a
+// certificate is configured. With clientCA set, client certificates signed
+// by it are verified for authentication.
+func listenAdmin(cfg AdminConfig, clientCA string) (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load admin TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		if clientCA != "" {
+			if err := clientCertConfig(tlsConfig, clientCA); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return ln, nil
+}
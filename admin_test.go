@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyMux_DedicatedToProxying(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	mux := newProxyMux(newAdminMux(), false)
+	for _, path := range []string{"/metrics", "/healthz", "/api/v1/capture"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		assert.Equal(t, "upstream "+path, rr.Body.String(), "%s is forwarded to the Carrier host", path)
+	}
+}
+
+func TestProxyMux_WithAdminRoutes(t *testing.T) {
+	mux := newProxyMux(newAdminMux(), true)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "ok\n", rr.Body.String())
+}
+
+func TestHandleReadyz(t *testing.T) {
+	defer ready.Store(false)
+
+	rr := httptest.NewRecorder()
+	handleReadyz(rr, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	ready.Store(true)
+	rr = httptest.NewRecorder()
+	handleReadyz(rr, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and returns
+// the certificate and key file paths.
+func writeTestCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hvac-proxy test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestListenAdmin_TLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	ln, err := listenAdmin(AdminConfig{Addr: "127.0.0.1:0", TLSCert: certFile, TLSKey: keyFile}, "")
+	require.NoError(t, err)
+
+	srv := newServer(ln.Addr().String(), newAdminMux(), defaultServerConfig())
+	go func() { _ = srv.Serve(ln) }()
+	defer func() { _ = srv.Close() }()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/healthz")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "ok\n", string(body))
+
+	_, err = listenAdmin(AdminConfig{Addr: "127.0.0.1:0", TLSCert: certFile, TLSKey: certFile}, "")
+	assert.ErrorContains(t, err, "admin TLS certificate")
+}
+
+func TestConfig_ValidateAdmin(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Admin = AdminConfig{Addr: ":8080", TLSCert: "cert.pem"}
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "different port")
+	assert.Contains(t, err.Error(), "set together")
+
+	cfg.Admin = AdminConfig{Addr: "9090"}
+	assert.ErrorContains(t, cfg.Validate(), "admin.addr")
+
+	cfg.Admin = AdminConfig{Addr: "127.0.0.1:9090"}
+	assert.NoError(t, cfg.Validate())
+}
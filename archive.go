@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hvac-proxy/hvac"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ArchiveConfig controls the optional file archive sink, which appends
+// events from the bus as JSON lines to one file per day.
+type ArchiveConfig struct {
+	Enabled bool     `yaml:"enabled"` // Archive events to disk
+	Dir     string   `yaml:"dir"`     // Where daily files are written; defaults to DATA_DIR/archive
+	Events  []string `yaml:"events"`  // Event types to archive; empty archives all
+	MaxDays int      `yaml:"maxDays"` // Daily files kept; 0 keeps all
+}
+
+// defaultArchiveConfig returns the settings used when nothing is configured.
+func defaultArchiveConfig() ArchiveConfig {
+	return ArchiveConfig{MaxDays: 30}
+}
+
+// archiveDateLayout names the daily files, e.g. 2024-04-05.jsonl.
+const archiveDateLayout = "2006-01-02"
+
+// archiveSink appends events to DIR/YYYY-MM-DD.jsonl by event date.
+type archiveSink struct {
+	cfg ArchiveConfig
+}
+
+func (s *archiveSink) Accepts(e hvac.Event) bool {
+	return len(s.cfg.Events) == 0 || slices.Contains(s.cfg.Events, e.Type)
+}
+
+func (s *archiveSink) Write(ctx context.Context, events []hvac.Event) error {
+	if err := os.MkdirAll(s.cfg.Dir, 0755); err != nil {
+		return err
+	}
+	// Group by day so a batch spanning midnight lands in both files
+	var day string
+	var buf []byte
+	for _, e := range events {
+		d := e.Time.Format(archiveDateLayout)
+		if d != day && len(buf) > 0 {
+			if err := s.append(day, buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		day = d
+		line, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if len(buf) > 0 {
+		return s.append(day, buf)
+	}
+	return nil
+}
+
+// append adds lines to a day's file, pruning old files when a new one is
+// started.
+func (s *archiveSink) append(day string, lines []byte) error {
+	path := filepath.Join(s.cfg.Dir, day+".jsonl")
+	_, statErr := os.Stat(path)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(lines); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if os.IsNotExist(statErr) {
+		s.prune()
+	}
+	return nil
+}
+
+// prune removes daily files beyond MaxDays, oldest first.
+func (s *archiveSink) prune() {
+	if s.cfg.MaxDays <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(s.cfg.Dir, "*.jsonl"))
+	if err != nil {
+		return
+	}
+	var days []string
+	for _, f := range files {
+		day := strings.TrimSuffix(filepath.Base(f), ".jsonl")
+		if _, err := time.Parse(archiveDateLayout, day); err == nil {
+			days = append(days, f)
+		}
+	}
+	slices.Sort(days)
+	for len(days) > s.cfg.MaxDays {
+		if err := os.Remove(days[0]); err != nil {
+			log.Printf("[ARCHIVE] Failed to remove %s: %v", days[0], err)
+		}
+		days = days[1:]
+	}
+}
+
+// initArchive enables the archive sink when configured.
+func initArchive(cfg ArchiveConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	hvac.Events.AddSink("archive", &archiveSink{cfg: cfg}, hvac.SinkConfig{
+		QueueSize:     500,
+		BatchSize:     50,
+		FlushInterval: 5 * time.Second,
+		Timeout:       10 * time.Second,
+		Retries:       2,
+		RetryBackoff:  time.Second,
+	})
+	fmt.Printf("Archiving events to %s\n", cfg.Dir)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"hvac-proxy/hvac"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveSink_DailyFiles(t *testing.T) {
+	s := &archiveSink{cfg: ArchiveConfig{Dir: t.TempDir()}}
+	day := time.Date(2024, 4, 5, 23, 59, 0, 0, time.Local)
+	require.NoError(t, s.Write(t.Context(), []hvac.Event{
+		{ID: 1, Type: "status", Time: day, Data: "a"},
+		{ID: 2, Type: "alert", Time: day.Add(2 * time.Minute), Data: "b"},
+	}))
+	require.NoError(t, s.Write(t.Context(), []hvac.Event{
+		{ID: 3, Type: "status", Time: day.Add(3 * time.Minute), Data: "c"},
+	}))
+
+	first, err := os.ReadFile(filepath.Join(s.cfg.Dir, "2024-04-05.jsonl"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(first), "\n"))
+	second, err := os.ReadFile(filepath.Join(s.cfg.Dir, "2024-04-06.jsonl"))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(second)), "\n")
+	require.Len(t, lines, 2, "appended to the day's file")
+
+	var event struct {
+		ID   uint64 `json:"id"`
+		Type string `json:"type"`
+		Data string `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(t, uint64(2), event.ID)
+	assert.Equal(t, "alert", event.Type)
+	assert.Equal(t, "b", event.Data)
+}
+
+func TestArchiveSink_Filter(t *testing.T) {
+	s := &archiveSink{cfg: ArchiveConfig{Events: []string{"alert"}}}
+	assert.True(t, s.Accepts(hvac.Event{Type: "alert"}))
+	assert.False(t, s.Accepts(hvac.Event{Type: "status"}))
+
+	s.cfg.Events = nil
+	assert.True(t, s.Accepts(hvac.Event{Type: "status"}), "empty archives all")
+}
+
+func TestArchiveSink_Prune(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"2024-04-01.jsonl", "2024-04-02.jsonl", "2024-04-03.jsonl", "notes.jsonl"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0644))
+	}
+	s := &archiveSink{cfg: ArchiveConfig{Dir: dir, MaxDays: 2}}
+	require.NoError(t, s.Write(t.Context(), []hvac.Event{
+		{Type: "status", Time: time.Date(2024, 4, 4, 12, 0, 0, 0, time.Local), Data: "a"},
+	}))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{"2024-04-03.jsonl", "2024-04-04.jsonl", "notes.jsonl"}, names)
+}
+
+func TestArchiveConfig_Env(t *testing.T) {
+	t.Setenv("ARCHIVE_ENABLED", "true")
+	t.Setenv("ARCHIVE_EVENTS", "status, alert")
+	t.Setenv("ARCHIVE_MAX_DAYS", "7")
+	cfg, err := loadConfig("")
+	require.NoError(t, err)
+
+	assert.True(t, cfg.Archive.Enabled)
+	assert.Equal(t, []string{"status", "alert"}, cfg.Archive.Events)
+	assert.Equal(t, 7, cfg.Archive.MaxDays)
+
+	cfg.DataDir = "/srv/hvac"
+	require.NoError(t, cfg.prepare())
+	assert.Equal(t, "/srv/hvac/archive", cfg.Archive.Dir)
+
+	cfg.Archive.MaxDays = -1
+	assert.ErrorContains(t, cfg.Validate(), "archive.maxDays: must not be negative")
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"hvac-proxy/hvac"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Scopes granted to principals. Control implies read.
+const (
+	scopeRead    = "read"
+	scopeControl = "control"
+)
+
+// AuthConfig controls authentication of the admin and API endpoints. Auth is
+// enabled when any tokens, users or client certificates are configured.
+type AuthConfig struct {
+	Tokens      []AuthToken `yaml:"tokens"`      // Static bearer tokens
+	Users       []AuthUser  `yaml:"users"`       // HTTP basic auth users
+	ClientCA    string      `yaml:"clientCA"`    // PEM CA bundle for verifying client certificates
+	ClientCerts []AuthCert  `yaml:"clientCerts"` // Client certificates accepted, by common name
+	AuditLog    string      `yaml:"auditLog"`    // JSON-lines audit file; defaults to DATA_DIR/audit.log
+}
+
+// AuthToken is a static bearer token.
+type AuthToken struct {
+	Name   string   `yaml:"name"`   // Principal recorded in the audit log
+	Token  string   `yaml:"token"`  // Secret sent as "Authorization: Bearer <token>"
+	Scopes []string `yaml:"scopes"` // read and/or control
+}
+
+// AuthUser is an HTTP basic auth user.
+type AuthUser struct {
+	Name         string   `yaml:"name"`         // Username and audit principal
+	PasswordHash string   `yaml:"passwordHash"` // bcrypt hash of the password
+	Scopes       []string `yaml:"scopes"`       // read and/or control
+}
+
+// AuthCert maps a client certificate common name onto scopes.
+type AuthCert struct {
+	Name   string   `yaml:"name"`   // Certificate subject common name
+	Scopes []string `yaml:"scopes"` // read and/or control
+}
+
+// Enabled reports whether any credentials are configured.
+func (c *AuthConfig) Enabled() bool {
+	return len(c.Tokens) > 0 || len(c.Users) > 0 || len(c.ClientCerts) > 0
+}
+
+// parseAuthCerts parses "name[:scope+scope]" entries separated by commas, as
+// used by AUTH_CLIENT_CERTS. Scopes default to read.
+func parseAuthCerts(s string) []AuthCert {
+	var certs []AuthCert
+	for _, part := range strings.Split(s, ",") {
+		name, scopes, _ := strings.Cut(strings.TrimSpace(part), ":")
+		if name == "" {
+			continue
+		}
+		if scopes == "" {
+			scopes = scopeRead
+		}
+		certs = append(certs, AuthCert{Name: name, Scopes: strings.Split(scopes, "+")})
+	}
+	return certs
+}
+
+// parseAuthEntries parses "name:secret:scope+scope" entries separated by
+// commas, as used by AUTH_TOKENS and AUTH_USERS. Scopes default to read.
+func parseAuthEntries(s string) ([][3]string, error) {
+	var entries [][3]string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.SplitN(part, ":", 3)
+		if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected name:secret[:scope+scope]", fields[0])
+		}
+		scopes := scopeRead
+		if len(fields) == 3 && fields[2] != "" {
+			scopes = fields[2]
+		}
+		entries = append(entries, [3]string{fields[0], fields[1], scopes})
+	}
+	return entries, nil
+}
+
+// validateAuth checks the credentials and reports every problem found.
+func validateAuth(c *AuthConfig, check func(ok bool, field, format string, args ...any)) {
+	names := map[string]bool{}
+	checkScopes := func(field string, scopes []string) {
+		check(len(scopes) > 0, field, "at least one scope is required")
+		for _, s := range scopes {
+			check(s == scopeRead || s == scopeControl, field, "unknown scope %q, expected read or control", s)
+		}
+	}
+	for i, t := range c.Tokens {
+		field := fmt.Sprintf("auth.tokens[%d]", i)
+		check(t.Name != "" && !names[t.Name], field+".name", "must be set and unique")
+		check(len(t.Token) >= 16, field+".token", "must be at least 16 characters")
+		checkScopes(field+".scopes", t.Scopes)
+		names[t.Name] = true
+	}
+	for i, u := range c.Users {
+		field := fmt.Sprintf("auth.users[%d]", i)
+		check(u.Name != "" && !names[u.Name], field+".name", "must be set and unique")
+		_, err := bcrypt.Cost([]byte(u.PasswordHash))
+		check(err == nil, field+".passwordHash", "must be a bcrypt hash")
+		checkScopes(field+".scopes", u.Scopes)
+		names[u.Name] = true
+	}
+	for i, cert := range c.ClientCerts {
+		field := fmt.Sprintf("auth.clientCerts[%d]", i)
+		check(cert.Name != "", field+".name", "must be set")
+		checkScopes(field+".scopes", cert.Scopes)
+	}
+	check(len(c.ClientCerts) == 0 || c.ClientCA != "", "auth.clientCA", "required when clientCerts are configured")
+}
+
+// principal is an authenticated caller.
+type principal struct {
+	Name   string
+	Method string // token, basic, cert or none
+	Scopes []string
+}
+
+func (p *principal) allowed(scope string) bool {
+	return slices.Contains(p.Scopes, scope) || (scope == scopeRead && slices.Contains(p.Scopes, scopeControl))
+}
+
+// authenticator checks admin requests against the configured credentials.
+// The credentials can be swapped at runtime by a config reload.
+type authenticator struct {
+	cfg atomic.Pointer[AuthConfig]
+}
+
+func newAuthenticator(cfg AuthConfig) *authenticator {
+	a := &authenticator{}
+	a.cfg.Store(&cfg)
+	return a
+}
+
+// reconfigure replaces the credentials used for subsequent requests.
+func (a *authenticator) reconfigure(cfg AuthConfig) {
+	a.cfg.Store(&cfg)
+}
+
+// authenticate returns the principal for a request, or nil if it carries no
+// valid credentials.
+func (a *authenticator) authenticate(r *http.Request) *principal {
+	cfg := a.cfg.Load()
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, c := range cfg.ClientCerts {
+			if c.Name == cn {
+				return &principal{Name: cn, Method: "cert", Scopes: c.Scopes}
+			}
+		}
+	}
+
+	header := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		for _, t := range cfg.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				return &principal{Name: t.Name, Method: "token", Scopes: t.Scopes}
+			}
+		}
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		for _, u := range cfg.Users {
+			if u.Name == user && bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(pass)) == nil {
+				return &principal{Name: u.Name, Method: "basic", Scopes: u.Scopes}
+			}
+		}
+	}
+	return nil
+}
+
+// requiredScope returns the scope needed for a request: reads need read,
+// anything that changes state needs control.
+func requiredScope(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return scopeRead
+	}
+	return scopeControl
+}
+
+// requireAuth wraps the admin handler. Health checks stay open so container
+// probes work without credentials. Control requests are recorded in the
+// audit log whether or not they are allowed.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scope := requiredScope(r)
+
+		// Without credentials configured, anyone who can reach the port may
+		// read but not change anything
+		p := &principal{Name: "anonymous", Method: "none", Scopes: []string{scopeRead}}
+		if auth != nil {
+			p = auth.authenticate(r)
+			if p == nil {
+				if scope == scopeControl {
+					audit.Record(r, &principal{Name: "unauthenticated", Method: "none"}, http.StatusUnauthorized)
+				}
+				w.Header().Add("WWW-Authenticate", `Bearer realm="hvac-proxy"`)
+				w.Header().Add("WWW-Authenticate", `Basic realm="hvac-proxy"`)
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+				return
+			}
+		}
+		if !p.allowed(scope) {
+			if scope == scopeControl {
+				audit.Record(r, p, http.StatusForbidden)
+			}
+			msg := fmt.Sprintf("%s scope required", scope)
+			if auth == nil {
+				msg += "; configure admin tokens, users or client certificates to enable control requests"
+			}
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+
+		if scope != scopeControl {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		audit.Record(r, p, rec.status)
+	})
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// clientCertConfig adds client certificate verification to the admin TLS
+// config. Certificates are optional so token and basic auth keep working.
+func clientCertConfig(tlsConfig *tls.Config, caFile string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in client CA %s", caFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	Auth      string    `json:"auth"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Remote    string    `json:"remote"`
+	Status    int       `json:"status"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// auditLog appends control actions to a JSON-lines file.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: path}
+}
+
+// Record appends an entry for a control request. It is a no-op on a nil log.
+func (l *auditLog) Record(r *http.Request, p *principal, status int) {
+	l.write(auditEntry{
+		Principal: p.Name,
+		Auth:      p.Method,
+		Method:    r.Method,
+		Path:      r.URL.RequestURI(),
+		Remote:    remoteHost(r),
+		Status:    status,
+	})
+}
+
+func (l *auditLog) write(e auditEntry) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	hvac.Events.Publish("control", e)
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Printf("Failed to write audit log: %v\n", err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	_, _ = f.Write(append(line, '\n'))
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
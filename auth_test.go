@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testToken        = "0123456789abcdef-read"
+	testControlToken = "0123456789abcdef-ctrl"
+)
+
+// useAuth enables auth and a temp audit log for the duration of a test and
+// returns the audit log path.
+func useAuth(t *testing.T, cfg AuthConfig) string {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	prevAuth, prevAudit := auth, audit
+	auth, audit = newAuthenticator(cfg), newAuditLog(path)
+	t.Cleanup(func() { auth, audit = prevAuth, prevAudit })
+	return path
+}
+
+// useControl enables auth with a control token for the duration of a test
+// and returns a function adding it to requests.
+func useControl(t *testing.T) func(*http.Request) *http.Request {
+	useAuth(t, AuthConfig{Tokens: []AuthToken{{Name: "automation", Token: testControlToken, Scopes: []string{scopeControl}}}})
+	return func(r *http.Request) *http.Request {
+		r.Header.Set("Authorization", "Bearer "+testControlToken)
+		return r
+	}
+}
+
+func readAudit(t *testing.T, path string) []auditEntry {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e auditEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func testAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/api/v1/thing", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		_, _ = w.Write([]byte("thing"))
+	})
+	return requireAuth(mux)
+}
+
+func TestRequireAuth_Tokens(t *testing.T) {
+	auditPath := useAuth(t, AuthConfig{Tokens: []AuthToken{
+		{Name: "grafana", Token: testToken, Scopes: []string{scopeRead}},
+		{Name: "automation", Token: testControlToken, Scopes: []string{scopeControl}},
+	}})
+	h := testAdminHandler()
+
+	do := func(method, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/thing", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("GET", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Len(t, rr.Header().Values("WWW-Authenticate"), 2)
+
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "wrong").Code)
+	assert.Equal(t, http.StatusOK, do("GET", testToken).Code)
+	assert.Equal(t, http.StatusForbidden, do("POST", testToken).Code, "read scope cannot control")
+	assert.Equal(t, http.StatusOK, do("GET", testControlToken).Code, "control implies read")
+	assert.Equal(t, http.StatusAccepted, do("POST", testControlToken).Code)
+
+	entries := readAudit(t, auditPath)
+	require.Len(t, entries, 2, "only control requests are audited")
+	assert.Equal(t, "grafana", entries[0].Principal)
+	assert.Equal(t, http.StatusForbidden, entries[0].Status)
+	assert.Equal(t, "automation", entries[1].Principal)
+	assert.Equal(t, "token", entries[1].Auth)
+	assert.Equal(t, "POST", entries[1].Method)
+	assert.Equal(t, "/api/v1/thing", entries[1].Path)
+	assert.Equal(t, http.StatusAccepted, entries[1].Status)
+}
+
+func TestRequireAuth_Basic(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	useAuth(t, AuthConfig{Users: []AuthUser{{Name: "admin", PasswordHash: string(hash), Scopes: []string{scopeControl}}}})
+	h := testAdminHandler()
+
+	req := httptest.NewRequest("POST", "/api/v1/thing", nil)
+	req.SetBasicAuth("admin", "s3cret")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	req.SetBasicAuth("admin", "guess")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestRequireAuth_HealthOpen(t *testing.T) {
+	useAuth(t, AuthConfig{Tokens: []AuthToken{{Name: "grafana", Token: testToken, Scopes: []string{scopeRead}}}})
+	rr := httptest.NewRecorder()
+	testAdminHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestRequireAuth_DisabledRejectsControl(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	prev := audit
+	audit = newAuditLog(path)
+	defer func() { audit = prev }()
+
+	rr := httptest.NewRecorder()
+	testAdminHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/thing", nil))
+	assert.Equal(t, http.StatusOK, rr.Code, "reads stay open")
+
+	rr = httptest.NewRecorder()
+	testAdminHandler().ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/thing", nil))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "configure admin tokens")
+	entries := readAudit(t, path)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "anonymous", entries[0].Principal)
+	assert.Equal(t, http.StatusForbidden, entries[0].Status)
+}
+
+func TestRequireAuth_DisabledRejectsMessages(t *testing.T) {
+	useMessages(t, MessagesConfig{}, time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC))
+
+	rr := httptest.NewRecorder()
+	newAdminMux().ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/messages", strings.NewReader(`{"title": "Hi"}`)))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Empty(t, messages.List())
+}
+
+func TestRequireAuth_ClientCert(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	useAuth(t, AuthConfig{ClientCA: certFile, ClientCerts: []AuthCert{{Name: "hvac-proxy test", Scopes: []string{scopeRead}}}})
+
+	ln, err := listenAdmin(AdminConfig{Addr: "127.0.0.1:0", TLSCert: certFile, TLSKey: keyFile}, certFile)
+	require.NoError(t, err)
+	srv := newServer(ln.Addr().String(), testAdminHandler(), defaultServerConfig())
+	go func() { _ = srv.Serve(ln) }()
+	defer func() { _ = srv.Close() }()
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	get := func(certs []tls.Certificate) int {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		}}}
+		resp, err := client.Get("https://" + ln.Addr().String() + "/api/v1/thing")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get([]tls.Certificate{cert}))
+	assert.Equal(t, http.StatusUnauthorized, get(nil), "certificates are optional at the TLS layer")
+}
+
+func TestAuthConfig_Env(t *testing.T) {
+	t.Setenv("AUTH_TOKENS", "grafana:"+testToken+",ha:0123456789abcdef-ctrl:read+control")
+	t.Setenv("AUTH_CLIENT_CERTS", "thermostat-app:control")
+
+	cfg, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, []AuthToken{
+		{Name: "grafana", Token: testToken, Scopes: []string{"read"}},
+		{Name: "ha", Token: testControlToken, Scopes: []string{"read", "control"}},
+	}, cfg.Auth.Tokens)
+	assert.Equal(t, []AuthCert{{Name: "thermostat-app", Scopes: []string{"control"}}}, cfg.Auth.ClientCerts)
+
+	t.Setenv("AUTH_TOKENS", ":nope")
+	_, err = loadConfig("")
+	assert.ErrorContains(t, err, "AUTH_TOKENS")
+}
+
+func TestAuthConfig_Validate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Auth = AuthConfig{
+		Tokens:      []AuthToken{{Name: "a", Token: "short", Scopes: []string{"admin"}}},
+		Users:       []AuthUser{{Name: "a", PasswordHash: "plaintext", Scopes: []string{"read"}}},
+		ClientCerts: []AuthCert{{Name: "cn", Scopes: []string{"read"}}},
+	}
+	err := cfg.Validate()
+	require.Error(t, err)
+	for _, msg := range []string{"auth.tokens[0].token", "unknown scope \"admin\"", "auth.users[0].name", "bcrypt", "auth.clientCA"} {
+		assert.Contains(t, err.Error(), msg)
+	}
+
+	out := cfg.Redacted()
+	assert.Equal(t, "REDACTED", out.Auth.Tokens[0].Token)
+	assert.Equal(t, "REDACTED", out.Auth.Users[0].PasswordHash)
+	assert.Equal(t, "short", cfg.Auth.Tokens[0].Token, "original is unchanged")
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hvac-proxy/hvac"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// BackupConfig controls the versioned history of the thermostat's config
+// document and what can be restored from it.
+type BackupConfig struct {
+	Versions        int      `yaml:"versions"`        // Config document versions kept
+	RestoreSections []string `yaml:"restoreSections"` // Elements a restore may change, in each zone or at the top level
+}
+
+// defaultBackupConfig returns the settings used when nothing is configured.
+// The restorable sections are the weekly programs, the comfort activities,
+// the humidity settings and the vacation set point limits.
+func defaultBackupConfig() BackupConfig {
+	return BackupConfig{
+		Versions:        200,
+		RestoreSections: []string{"program", "activities", "humidityHome", "humidityAway", "humidityVacation", "vacmint", "vacmaxt"},
+	}
+}
+
+// xmlName matches element names allowed as restore sections.
+var xmlName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// validateBackup checks the backup settings.
+func validateBackup(c *BackupConfig, check func(bool, string, string, ...any)) {
+	check(c.Versions > 0, "backup.versions", "must be positive")
+	check(len(c.RestoreSections) > 0, "backup.restoreSections", "must not be empty")
+	for _, s := range c.RestoreSections {
+		check(xmlName.MatchString(s), "backup.restoreSections", "invalid element name %q", s)
+	}
+}
+
+// configBackups restores sections of stored config versions through config
+// injection.
+type configBackups struct {
+	dataDir  string
+	sections []string
+}
+
+// backups restores stored config versions.
+var backups *configBackups
+
+// initBackups sets up restoring from the config versions in the data
+// directory. The versions themselves are stored by the hvac package.
+func initBackups(cfg BackupConfig, dataDir string) {
+	backups = &configBackups{dataDir: dataDir, sections: cfg.RestoreSections}
+	hvac.RegisterMetrics("backup", backups.metrics)
+}
+
+// restoreRequest selects what a restore changes.
+type restoreRequest struct {
+	Sections []string `json:"sections"` // Sections to restore; all restorable ones if empty
+	Zones    []int    `json:"zones"`    // Zones to restore; all if empty
+}
+
+// restoreResult lists the changes a restore queued, or would queue.
+type restoreResult struct {
+	Version int           `json:"version"`
+	Patches []configPatch `json:"patches"`
+	Changes []string      `json:"changes"` // Values changed by the patches, e.g. "zone 1 program: day[Monday]/period[1]/time: 06:30 → 06:00"
+}
+
+// restore returns the patches that bring the sections of the latest config
+// document back to a stored version. Sections that already match are
+// skipped, as are sections the latest document lacks, since there is no
+// element to replace.
+func (b *configBackups) restore(version int, req restoreRequest) (*restoreResult, error) {
+	for _, s := range req.Sections {
+		if !slices.Contains(b.sections, s) {
+			return nil, fmt.Errorf("%w: %q can't be restored, only %s", errRestore, s, strings.Join(b.sections, ", "))
+		}
+	}
+	sections := req.Sections
+	if len(sections) == 0 {
+		sections = b.sections
+	}
+	doc, err := hvac.ReadConfigSnapshot(b.dataDir, version)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := hvac.ParseSystemConfig(doc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: version %d: %v", errRestore, version, err)
+	}
+	list, err := hvac.ListConfigSnapshots(b.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no config version %d", version)
+	}
+	current, err := hvac.ReadConfigSnapshot(b.dataDir, list[len(list)-1].Version)
+	if err != nil {
+		return nil, err
+	}
+
+	zones := []int{0}
+	for _, z := range snapshot.Zones {
+		if len(req.Zones) == 0 || slices.Contains(req.Zones, z.ID) {
+			zones = append(zones, z.ID)
+		}
+	}
+	result := &restoreResult{Version: version, Patches: []configPatch{}, Changes: []string{}}
+	for _, zone := range zones {
+		for _, name := range sections {
+			start, end, ok := elementSpan(doc, zone, name)
+			if !ok {
+				continue
+			}
+			cstart, cend, ok := elementSpan(current, zone, name)
+			if !ok || hvac.CanonicalXML(doc[start:end]) == hvac.CanonicalXML(current[cstart:cend]) {
+				continue
+			}
+			p := configPatch{Zone: zone, Element: name, XML: string(doc[start:end]), Source: "restore"}
+			result.Patches = append(result.Patches, p)
+			for _, c := range hvac.DiffConfig(wrapElement(current[cstart:cend]), wrapElement(doc[start:end])) {
+				result.Changes = append(result.Changes, p.String()+": "+c)
+			}
+		}
+	}
+	return result, nil
+}
+
+// errRestore marks restore requests that can't be carried out as asked.
+var errRestore = errors.New("invalid restore")
+
+// wrapElement puts an element in a document of its own, so DiffConfig
+// names its values relative to it.
+func wrapElement(elem []byte) []byte {
+	return slices.Concat([]byte("<section>"), elem, []byte("</section>"))
+}
+
+// metrics renders the stored config versions for "/metrics".
+func (b *configBackups) metrics() string {
+	list, _ := hvac.ListConfigSnapshots(b.dataDir)
+	var s strings.Builder
+	s.WriteString("# HELP hvac_config_versions config document versions stored\n")
+	s.WriteString("# TYPE hvac_config_versions gauge\n")
+	s.WriteString(fmt.Sprintf("hvac_config_versions %d\n", len(list)))
+	if n := len(list); n > 0 {
+		s.WriteString("# HELP hvac_config_last_change_timestamp_seconds time the latest config version was stored\n")
+		s.WriteString("# TYPE hvac_config_last_change_timestamp_seconds gauge\n")
+		s.WriteString(fmt.Sprintf("hvac_config_last_change_timestamp_seconds %d\n", list[n-1].Time.Unix()))
+	}
+	return s.String()
+}
+
+// handleConfigVersions lists the stored config versions, newest first.
+func handleConfigVersions(w http.ResponseWriter, r *http.Request) {
+	list, err := hvac.ListConfigSnapshots(backups.dataDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slices.Reverse(list)
+	writeJSON(w, list)
+}
+
+// versionParam parses the version in the request path.
+func versionParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return 0, false
+	}
+	return v, true
+}
+
+// handleConfigVersion serves the document of a stored config version.
+func handleConfigVersion(w http.ResponseWriter, r *http.Request) {
+	v, ok := versionParam(w, r)
+	if !ok {
+		return
+	}
+	doc, err := hvac.ReadConfigSnapshot(backups.dataDir, v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(doc)
+}
+
+// previousVersion returns the version v's changes are listed against: the
+// one before from the same source, or else the one before.
+func previousVersion(dataDir string, v int) int {
+	list, _ := hvac.ListConfigSnapshots(dataDir)
+	i := slices.IndexFunc(list, func(s hvac.ConfigSnapshot) bool { return s.Version == v })
+	if i < 0 {
+		return v - 1
+	}
+	if prev, ok := hvac.LatestConfigSnapshot(list[:i], list[i].Source); ok {
+		return prev.Version
+	}
+	if i > 0 {
+		return list[i-1].Version
+	}
+	return v - 1
+}
+
+// handleConfigDiff serves the changes from another version, by default the
+// previous one from the same source, to a stored config version.
+func handleConfigDiff(w http.ResponseWriter, r *http.Request) {
+	v, ok := versionParam(w, r)
+	if !ok {
+		return
+	}
+	against := previousVersion(backups.dataDir, v)
+	if s := r.URL.Query().Get("against"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "invalid against version", http.StatusBadRequest)
+			return
+		}
+		against = n
+	}
+	changes, err := diffConfigVersions(backups.dataDir, against, v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]any{"version": v, "against": against, "changes": changes})
+}
+
+// diffConfigVersions summarizes the changes between two stored versions.
+func diffConfigVersions(dataDir string, from, to int) ([]string, error) {
+	prev, err := hvac.ReadConfigSnapshot(dataDir, from)
+	if err != nil {
+		return nil, err
+	}
+	next, err := hvac.ReadConfigSnapshot(dataDir, to)
+	if err != nil {
+		return nil, err
+	}
+	return hvac.DiffConfig(prev, next), nil
+}
+
+// handleConfigRestore queues the sections of a stored config version that
+// differ from the latest document, or with ?preview=true only lists them.
+func handleConfigRestore(w http.ResponseWriter, r *http.Request) {
+	v, ok := versionParam(w, r)
+	if !ok {
+		return
+	}
+	var req restoreRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid restore JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := backups.restore(v, req)
+	if errors.Is(err, errRestore) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("preview") == "true" || len(result.Patches) == 0 {
+		writeJSON(w, result)
+		return
+	}
+	injector.Queue(result.Patches...)
+	activity.Event("restore", "Queued restore of %d config sections from version %d", len(result.Patches), v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, result)
+}
+
+// runBackups implements the "backups" subcommand.
+func runBackups(args []string) int {
+	usage := "Usage: hvac-proxy backups list|show|diff|restore [flags] [version]"
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return 2
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("backups "+cmd, flag.ContinueOnError)
+	flags := addConfigFlags(fs)
+	against := fs.Int("against", 0, "diff: version to compare with (default: the one before from the same source)")
+	url := fs.String("url", "http://localhost:8080", "restore: admin address of the running proxy")
+	token := fs.String("token", os.Getenv("HVAC_PROXY_TOKEN"), "restore: API token with the control scope (default $HVAC_PROXY_TOKEN)")
+	sections := fs.String("sections", "", "restore: comma-separated sections to restore (default: all restorable)")
+	zones := fs.String("zones", "", "restore: comma-separated zones to restore (default: all)")
+	preview := fs.Bool("preview", false, "restore: list the changes without queueing them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	version := 0
+	if cmd != "list" {
+		v, err := strconv.Atoi(fs.Arg(0))
+		if err != nil {
+			fs.Usage()
+			return 2
+		}
+		version = v
+	}
+
+	if cmd == "restore" {
+		req := restoreRequest{}
+		if *sections != "" {
+			req.Sections = strings.Split(*sections, ",")
+		}
+		for _, z := range strings.Split(*zones, ",") {
+			if n, err := strconv.Atoi(strings.TrimSpace(z)); err == nil {
+				req.Zones = append(req.Zones, n)
+			}
+		}
+		return restoreRemote(*url, *token, version, req, *preview)
+	}
+
+	cfg, err := flags.load()
+	if err != nil {
+		fmt.Printf("Configuration is invalid:\n%v\n", err)
+		return 1
+	}
+	if cfg.DataDir == "" {
+		fmt.Println("Set the data directory with -data-dir or $DATA_DIR")
+		return 2
+	}
+	switch cmd {
+	case "list":
+		list, err := hvac.ListConfigSnapshots(cfg.DataDir)
+		if err != nil {
+			fmt.Printf("Failed to read config versions: %v\n", err)
+			return 1
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tTIME\tSOURCE\tCHANGES")
+		for _, s := range slices.Backward(list) {
+			summary := s.Changes[0]
+			if len(s.Changes) > 1 {
+				summary += fmt.Sprintf(" (+%d more)", len(s.Changes)-1)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Version, s.Time.Local().Format(time.DateTime), s.Source, summary)
+		}
+		_ = tw.Flush()
+	case "show":
+		doc, err := hvac.ReadConfigSnapshot(cfg.DataDir, version)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		_, _ = os.Stdout.Write(hvac.PrettifyXML(doc))
+		fmt.Println()
+	case "diff":
+		from := *against
+		if from == 0 {
+			from = previousVersion(cfg.DataDir, version)
+		}
+		changes, err := diffConfigVersions(cfg.DataDir, from, version)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("Changes from version %d to %d:\n", from, version)
+		for _, c := range changes {
+			fmt.Println("  " + c)
+		}
+	default:
+		fmt.Println(usage)
+		return 2
+	}
+	return 0
+}
+
+// restoreRemote asks the running proxy to restore a version, since only it
+// can deliver the change to the thermostat.
+func restoreRemote(url, token string, version int, req restoreRequest, preview bool) int {
+	body, _ := json.Marshal(req)
+	target := fmt.Sprintf("%s/api/v1/config/versions/%d/restore", strings.TrimSuffix(url, "/"), version)
+	if preview {
+		target += "?preview=true"
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Invalid proxy URL: %v\n", err)
+		return 2
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		fmt.Printf("Restore failed: %v\n", err)
+		return 1
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		fmt.Printf("Restore failed: %s: %s\n", resp.Status, strings.TrimSpace(string(data)))
+		return 1
+	}
+	var result restoreResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		fmt.Printf("Unexpected response: %v\n", err)
+		return 1
+	}
+	switch {
+	case len(result.Patches) == 0:
+		fmt.Printf("Nothing to restore: the thermostat's config matches version %d\n", version)
+		return 0
+	case preview:
+		fmt.Printf("Restoring version %d would change:\n", version)
+	default:
+		fmt.Printf("Queued %d sections of version %d for the thermostat:\n", len(result.Patches), version)
+	}
+	for _, c := range result.Changes {
+		fmt.Println("  " + c)
+	}
+	return 0
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"hvac-proxy/hvac"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useBackups enables restoring config versions for the duration of a test.
+func useBackups(t *testing.T, dataDir string) {
+	prev := backups
+	backups = &configBackups{dataDir: dataDir, sections: defaultBackupConfig().RestoreSections}
+	t.Cleanup(func() { backups = prev })
+}
+
+func TestBackupConfig_Env(t *testing.T) {
+	t.Setenv("BACKUP_VERSIONS", "50")
+	t.Setenv("BACKUP_RESTORE_SECTIONS", "program, activities")
+	cfg, err := loadConfig("")
+	require.NoError(t, err)
+
+	assert.Equal(t, BackupConfig{Versions: 50, RestoreSections: []string{"program", "activities"}}, cfg.Backup)
+	assert.Equal(t, 50, cfg.hvac().ConfigVersions)
+	require.NoError(t, cfg.Validate())
+
+	cfg.Backup.RestoreSections = []string{"a b"}
+	assert.ErrorContains(t, cfg.Validate(), `backup.restoreSections: invalid element name "a b"`)
+}
+
+func TestConfigBackups_API(t *testing.T) {
+	dir := useDataDir(t)
+	t.Cleanup(hvac.LoadSystemConfig)
+	edited := strings.NewReplacer("<htsp>68</htsp>", "<htsp>70</htsp>", `<day id="Monday"><period id="1"><activity>home</activity><time>06:00</time>`, `<day id="Monday"><period id="1"><activity>home</activity><time>07:00</time>`).Replace(testScheduleConfig)
+	for i, doc := range []string{testScheduleConfig, testScheduleConfig, edited} {
+		req := httptest.NewRequest("GET", "/systems/123/config", nil)
+		hvac.SaveBody(req, []byte(doc), i == 0)
+	}
+	c := useInjector(t)
+	useBackups(t, dir)
+	authorize := useControl(t)
+	admin := newAdminMux()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, authorize(httptest.NewRequest(method, path, strings.NewReader(body))))
+		return rr
+	}
+
+	var list []hvac.ConfigSnapshot
+	require.NoError(t, json.Unmarshal(do("GET", "/api/v1/config/versions", "").Body.Bytes(), &list))
+	require.Len(t, list, 2, "unchanged documents aren't stored again")
+	assert.Equal(t, 2, list[0].Version, "newest first")
+	assert.Equal(t, "cloud", list[0].Source)
+	assert.Equal(t, []string{"first version"}, list[1].Changes)
+	assert.Equal(t, "thermostat", list[1].Source)
+
+	rr := do("GET", "/api/v1/config/versions/1", "")
+	assert.Equal(t, testScheduleConfig, rr.Body.String())
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/v1/config/versions/9", "").Code)
+
+	var diff struct{ Changes []string }
+	require.NoError(t, json.Unmarshal(do("GET", "/api/v1/config/versions/2/diff", "").Body.Bytes(), &diff))
+	assert.Equal(t, []string{"zone[1]/activity[home]/htsp: 68 → 70", "zone[1]/day[Monday]/period[1]/time: 06:00 → 07:00"}, diff.Changes)
+
+	rr = do("POST", "/api/v1/config/versions/1/restore", `{"sections": ["mode"]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"mode" can't be restored`)
+
+	var result restoreResult
+	rr = do("POST", "/api/v1/config/versions/1/restore?preview=true", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Equal(t, []string{"zone 1 program: day[Monday]/period[1]/time: 07:00 → 06:00", "zone 1 activities: activity[home]/htsp: 70 → 68"}, result.Changes)
+	assert.Empty(t, c.Pending(""))
+
+	rr = do("POST", "/api/v1/config/versions/1/restore", `{"sections": ["program"], "zones": [1]}`)
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	pending := c.Pending("restore")
+	require.Len(t, pending, 1)
+	assert.Equal(t, "zone 1 program", pending[0].String())
+	s, _, err := currentSchedule(1)
+	require.NoError(t, err)
+	assert.True(t, s.Pending, "restored programs show in the schedule API")
+	assert.Equal(t, "Monday: 06:00 home, 22:00 sleep", s.Summary[0])
+
+	rr = do("POST", "/api/v1/config/versions/2/restore", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Empty(t, result.Patches, "already the current version")
+}
+
+func TestRunBackups(t *testing.T) {
+	dir := useDataDir(t)
+	t.Cleanup(hvac.LoadSystemConfig)
+	req := httptest.NewRequest("GET", "/systems/123/config", nil)
+	hvac.SaveBody(req, []byte(testScheduleConfig), false)
+
+	assert.Equal(t, 0, runBackups([]string{"list", "-data-dir", dir}))
+	assert.Equal(t, 0, runBackups([]string{"show", "-data-dir", dir, "1"}))
+	assert.Equal(t, 1, runBackups([]string{"diff", "-data-dir", dir, "1"}), "no version before the first")
+	assert.Equal(t, 2, runBackups([]string{"show", "-data-dir", dir}))
+	assert.Equal(t, 2, runBackups([]string{"prune", "-data-dir", dir}))
+	assert.Equal(t, 2, runBackups(nil))
+}
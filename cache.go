@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hvac-proxy/hvac"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig controls the on-disk cache of upstream GET responses.
+type CacheConfig struct {
+	Enabled  bool          `yaml:"enabled"`  // Cache upstream GET responses
+	Dir      string        `yaml:"dir"`      // Directory holding cache entries
+	TTLs     []CacheTTL    `yaml:"ttls"`     // Per-endpoint freshness, taking precedence over cache headers
+	MaxStale time.Duration `yaml:"maxStale"` // How long an expired entry may be served when upstream fails
+}
+
+// CacheTTL sets the freshness lifetime for paths matching Pattern.
+type CacheTTL struct {
+	Pattern string        `yaml:"pattern"` // path.Match pattern, e.g. "/weather/*/forecast"
+	TTL     time.Duration `yaml:"ttl"`     // Freshness lifetime
+}
+
+// defaultCacheTTLs covers the slowly-changing documents the thermostat
+// polls. Config is deliberately absent: it is only served from cache when
+// upstream fails, so changes made in the app are never masked.
+var defaultCacheTTLs = []CacheTTL{
+	{Pattern: "/manifest", TTL: 24 * time.Hour},
+	{Pattern: "/releaseNotes/*", TTL: 24 * time.Hour},
+	{Pattern: "/weather/*/forecast", TTL: 30 * time.Minute},
+}
+
+// parseCacheTTLs parses "pattern=duration" pairs separated by commas.
+func parseCacheTTLs(s string) ([]CacheTTL, error) {
+	var ttls []CacheTTL
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid cache TTL %q, expected pattern=duration", part)
+		}
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return nil, fmt.Errorf("invalid cache TTL pattern %q: %w", pattern, err)
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache TTL duration %q: %w", value, err)
+		}
+		ttls = append(ttls, CacheTTL{Pattern: pattern, TTL: ttl})
+	}
+	return ttls, nil
+}
+
+// cacheEntry is a stored upstream response.
+type cacheEntry struct {
+	Key     string      `json:"key"`
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+}
+
+// responseCache stores GET responses on disk, keyed by method, host and path.
+type responseCache struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	cfg   CacheConfig    // Dir is fixed; TTLs and MaxStale may be reconfigured
+	stats map[string]int // Lookups by result: hit, miss, stale
+	saves int
+}
+
+func newResponseCache(cfg CacheConfig) *responseCache {
+	if cfg.MaxStale <= 0 {
+		cfg.MaxStale = 7 * 24 * time.Hour
+	}
+	return &responseCache{cfg: cfg, now: time.Now, stats: map[string]int{}}
+}
+
+// reconfigure applies new TTLs and MaxStale to subsequent lookups and stores.
+func (c *responseCache) reconfigure(cfg CacheConfig) {
+	if cfg.MaxStale <= 0 {
+		cfg.MaxStale = 7 * 24 * time.Hour
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg.TTLs, c.cfg.MaxStale = cfg.TTLs, cfg.MaxStale
+}
+
+// cacheKey identifies a request in the cache.
+func cacheKey(r *http.Request) string {
+	return r.Method + " " + r.Host + r.URL.RequestURI()
+}
+
+func (c *responseCache) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.cfg.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *responseCache) load(r *http.Request) *cacheEntry {
+	if r.Method != http.MethodGet {
+		return nil
+	}
+	key := cacheKey(r)
+	data, err := os.ReadFile(c.file(key))
+	if err != nil {
+		return nil
+	}
+	var e cacheEntry
+	if json.Unmarshal(data, &e) != nil || e.Key != key {
+		return nil
+	}
+	return &e
+}
+
+func (c *responseCache) count(result string) {
+	c.mu.Lock()
+	c.stats[result]++
+	c.mu.Unlock()
+}
+
+// Fresh returns a cached response that is still fresh, or nil.
+func (c *responseCache) Fresh(r *http.Request) *cacheEntry {
+	if r.Method != http.MethodGet {
+		return nil
+	}
+	e := c.load(r)
+	if e == nil || !c.now().Before(e.Expires) {
+		c.count("miss")
+		return nil
+	}
+	c.count("hit")
+	return e
+}
+
+// Stale returns a cached response that expired less than MaxStale ago, for
+// use when upstream has failed, or nil.
+func (c *responseCache) Stale(r *http.Request) *cacheEntry {
+	e := c.load(r)
+	c.mu.Lock()
+	maxStale := c.cfg.MaxStale
+	c.mu.Unlock()
+	if e == nil || c.now().Sub(e.Expires) > maxStale {
+		return nil
+	}
+	c.count("stale")
+	return e
+}
+
+// Store saves a successful GET response unless upstream forbids it.
+func (c *responseCache) Store(r *http.Request, resp *http.Response, body []byte) {
+	if r.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return
+	}
+	ttl, ok := c.ttl(r.URL.Path, resp.Header)
+	if !ok {
+		return
+	}
+
+	now := c.now()
+	e := cacheEntry{
+		Key:     cacheKey(r),
+		Status:  resp.StatusCode,
+		Header:  resp.Header.Clone(),
+		Body:    body,
+		Stored:  now,
+		Expires: now.Add(ttl),
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(c.cfg.Dir, 0755); err != nil {
+		fmt.Printf("Failed to create cache directory: %v\n", err)
+		return
+	}
+	file := c.file(e.Key)
+	if err := hvac.WriteFileAtomic(file, data); err != nil {
+		fmt.Printf("Failed to write cache entry: %v\n", err)
+		return
+	}
+	c.mu.Lock()
+	c.saves++
+	c.mu.Unlock()
+}
+
+// ttl returns the freshness lifetime for a response. Configured endpoint
+// TTLs win over cache headers; ok is false if the response must not be stored.
+func (c *responseCache) ttl(p string, h http.Header) (time.Duration, bool) {
+	c.mu.Lock()
+	ttls := c.cfg.TTLs
+	c.mu.Unlock()
+	for _, t := range ttls {
+		if ok, _ := path.Match(t.Pattern, p); ok {
+			return t.TTL, true
+		}
+	}
+
+	cc := strings.ToLower(h.Get("Cache-Control"))
+	if strings.Contains(cc, "no-store") {
+		return 0, false
+	}
+	if strings.Contains(cc, "no-cache") {
+		return 0, true
+	}
+	for _, directive := range strings.Split(cc, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name == "max-age" || name == "s-maxage" {
+			if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+				return time.Duration(secs) * time.Second, true
+			}
+		}
+	}
+	if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+		return max(0, expires.Sub(c.now())), true
+	}
+	return 0, true
+}
+
+// serve writes a cached entry to the thermostat.
+func (e *cacheEntry) serve(w http.ResponseWriter, result string) {
+	if ct := e.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("X-Hvac-Proxy-Cache", result)
+	w.WriteHeader(e.Status)
+	_, _ = w.Write(e.Body)
+}
+
+// metrics renders the cache counters for "/metrics".
+func (c *responseCache) metrics() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP hvac_proxy_cache_requests_total response cache lookups by result\n")
+	b.WriteString("# TYPE hvac_proxy_cache_requests_total counter\n")
+	for _, result := range []string{"hit", "miss", "stale"} {
+		b.WriteString(fmt.Sprintf("hvac_proxy_cache_requests_total{result=%q} %d\n", result, c.stats[result]))
+	}
+	b.WriteString("# HELP hvac_proxy_cache_stores_total responses written to the cache\n")
+	b.WriteString("# TYPE hvac_proxy_cache_stores_total counter\n")
+	b.WriteString(fmt.Sprintf("hvac_proxy_cache_stores_total %d\n", c.saves))
+	return b.String()
+}
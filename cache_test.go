@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useCache enables the package response cache for the duration of a test.
+func useCache(t *testing.T, cfg CacheConfig) *responseCache {
+	cfg.Dir = t.TempDir()
+	prev := cache
+	cache = newResponseCache(cfg)
+	t.Cleanup(func() { cache = prev })
+	return cache
+}
+
+func TestParseCacheTTLs(t *testing.T) {
+	ttls, err := parseCacheTTLs("/manifest=24h, /weather/*/forecast=30m")
+	require.NoError(t, err)
+	assert.Equal(t, []CacheTTL{{"/manifest", 24 * time.Hour}, {"/weather/*/forecast", 30 * time.Minute}}, ttls)
+
+	_, err = parseCacheTTLs("/manifest")
+	assert.Error(t, err)
+	_, err = parseCacheTTLs("/manifest=soon")
+	assert.Error(t, err)
+}
+
+func TestResponseCache_TTL(t *testing.T) {
+	c := newResponseCache(CacheConfig{TTLs: []CacheTTL{{"/manifest", time.Hour}}})
+
+	ttl, ok := c.ttl("/manifest", http.Header{"Cache-Control": {"no-store"}})
+	assert.True(t, ok)
+	assert.Equal(t, time.Hour, ttl, "configured TTL wins")
+
+	ttl, ok = c.ttl("/other", http.Header{"Cache-Control": {"public, max-age=60"}})
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, ttl)
+
+	_, ok = c.ttl("/other", http.Header{"Cache-Control": {"no-store"}})
+	assert.False(t, ok)
+
+	ttl, ok = c.ttl("/other", http.Header{})
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), ttl, "stored for stale-if-error only")
+}
+
+func TestProxyHandler_CacheHitAndStale(t *testing.T) {
+	useDataDir(t)
+
+	var calls atomic.Int32
+	var healthy atomic.Bool
+	healthy.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte("<manifest/>"))
+	}))
+	defer srv.Close()
+
+	cfg := testUpstreamConfig()
+	cfg.Retries = 0
+	useUpstream(t, cfg)
+	c := useCache(t, CacheConfig{TTLs: []CacheTTL{{"/manifest", time.Hour}}})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/manifest", nil)
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		return rr
+	}
+
+	rr := get()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("X-Hvac-Proxy-Cache"))
+
+	rr = get()
+	assert.Equal(t, "HIT", rr.Header().Get("X-Hvac-Proxy-Cache"))
+	assert.Equal(t, "application/xml", rr.Header().Get("Content-Type"))
+	assert.Equal(t, int32(1), calls.Load(), "fresh hit does not go upstream")
+
+	// Once expired, upstream failures are answered from the stale entry
+	now = now.Add(2 * time.Hour)
+	healthy.Store(false)
+	rr = get()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "STALE", rr.Header().Get("X-Hvac-Proxy-Cache"))
+	assert.Equal(t, "<manifest/>", rr.Body.String())
+	assert.Equal(t, int32(2), calls.Load())
+
+	m := c.metrics()
+	assert.Contains(t, m, `hvac_proxy_cache_requests_total{result="hit"} 1`)
+	assert.Contains(t, m, `hvac_proxy_cache_requests_total{result="miss"} 2`)
+	assert.Contains(t, m, `hvac_proxy_cache_requests_total{result="stale"} 1`)
+	assert.Contains(t, m, "hvac_proxy_cache_stores_total 1")
+}
+
+func TestResponseCache_MaxStale(t *testing.T) {
+	c := newResponseCache(CacheConfig{Dir: t.TempDir(), MaxStale: time.Hour})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	req := httptest.NewRequest("GET", "/systems/1/config", nil)
+	c.Store(req, &http.Response{StatusCode: 200, Header: http.Header{}}, []byte("<config/>"))
+	assert.Nil(t, c.Fresh(req))
+	assert.NotNil(t, c.Stale(req))
+
+	now = now.Add(2 * time.Hour)
+	assert.Nil(t, c.Stale(req))
+
+	post := httptest.NewRequest("POST", "/systems/1/config", nil)
+	assert.Nil(t, c.Stale(post), "only GET responses are cached")
+}
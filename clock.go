@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"hvac-proxy/hvac"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TimeConfig controls the thermostat's clock: serving the time endpoint from
+// the host clock and watching the time the thermostat reports.
+type TimeConfig struct {
+	Timezone string        `yaml:"timezone"` // IANA timezone of the thermostat, e.g. "America/Chicago"; empty disables clock checks
+	Serve    bool          `yaml:"serve"`    // Answer /time from the host clock instead of upstream
+	MaxSkew  time.Duration `yaml:"maxSkew"`  // Skew beyond which a warning is logged and an alert raised
+	Correct  bool          `yaml:"correct"`  // Ask the thermostat to resync when the skew exceeds MaxSkew
+}
+
+// defaultTimeConfig returns the settings used when nothing is configured.
+func defaultTimeConfig() TimeConfig {
+	return TimeConfig{MaxSkew: 2 * time.Minute}
+}
+
+// validateTime checks the clock settings.
+func validateTime(c *TimeConfig, check func(bool, string, string, ...any)) {
+	if c.Timezone != "" {
+		_, err := time.LoadLocation(c.Timezone)
+		check(err == nil, "time.timezone", "unknown timezone %q", c.Timezone)
+	}
+	check(c.Timezone != "" || (!c.Serve && !c.Correct), "time.timezone", "required to serve or correct the time")
+	check(c.MaxSkew > 0, "time.maxSkew", "must be positive")
+}
+
+// correctionInterval is how long to wait for the thermostat to resync
+// before asking again.
+const correctionInterval = time.Hour
+
+// skewLogInterval is how often an unchanged skew is logged.
+const skewLogInterval = time.Hour
+
+// clockMonitor serves the time endpoint and tracks how far the thermostat's
+// clock is off.
+type clockMonitor struct {
+	cfg TimeConfig
+	loc *time.Location
+	now func() time.Time
+
+	mu          sync.Mutex
+	skew        time.Duration // Thermostat wall clock minus the real one
+	offsetOK    bool          // Whether the reported UTC offset matched the timezone
+	observed    bool          // Whether a localTime has been seen
+	logged      time.Time     // When the skew was last logged
+	loggedSkew  time.Duration
+	alerting    bool      // Whether the skew alert is raised
+	pending     bool      // Whether a correction is waiting for a status response
+	corrected   time.Time // When a correction was last sent
+	corrections int
+	served      int // /time responses served
+}
+
+// clock watches the thermostat's clock when a timezone is configured.
+var clock *clockMonitor
+
+func newClockMonitor(cfg TimeConfig) (*clockMonitor, error) {
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	return &clockMonitor{cfg: cfg, loc: loc, now: time.Now, offsetOK: true}, nil
+}
+
+// reconfigure applies a new skew threshold; the other settings need a
+// restart.
+func (c *clockMonitor) reconfigure(cfg TimeConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg.MaxSkew = cfg.MaxSkew
+}
+
+// initClock enables clock checks when a timezone is configured.
+func initClock(cfg TimeConfig) error {
+	if cfg.Timezone == "" {
+		return nil
+	}
+	c, err := newClockMonitor(cfg)
+	if err != nil {
+		return err
+	}
+	clock = c
+	hvac.RegisterMetrics("clock", clock.metrics)
+	fmt.Printf("Checking the thermostat clock against %s\n", cfg.Timezone)
+	return nil
+}
+
+// isTimeRequest reports whether r asks for the time.
+func isTimeRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && (r.URL.Path == "/time" || r.URL.Path == "/time/")
+}
+
+// answer writes a time document from the host clock and returns it, or
+// returns nil if r is not a time request or serving is disabled. The
+// document has the UTC time upstream sends, and the local time in the
+// configured timezone.
+func (c *clockMonitor) answer(w http.ResponseWriter, r *http.Request) []byte {
+	if !c.cfg.Serve || !isTimeRequest(r) {
+		return nil
+	}
+	now := c.now()
+	doc := fmt.Appendf(nil, `<time version="1.9"><utc>%s</utc><localTime>%s</localTime></time>`,
+		now.UTC().Format("2006-01-02T15:04:05"), now.In(c.loc).Format(time.RFC3339))
+	c.mu.Lock()
+	c.served++
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Hvac-Proxy-Time", "local")
+	_, _ = w.Write(doc)
+	return doc
+}
+
+// observe compares the localTime of a status document posted by the
+// thermostat with the real time. The thermostat's wall clock is compared
+// with the wall clock in the configured timezone, so a wrong DST setting
+// shows up as an hour of skew whatever offset it reports.
+func (c *clockMonitor) observe(body []byte) {
+	var status struct {
+		LocalTime string `xml:"localTime"`
+	}
+	if xml.Unmarshal(body, &status) != nil || status.LocalTime == "" {
+		return
+	}
+	reported, err := hvac.ParseLocalTime(status.LocalTime)
+	if err != nil {
+		return
+	}
+	now := c.now().In(c.loc)
+	y, mo, d := reported.Date()
+	h, mi, s := reported.Clock()
+	wall := time.Date(y, mo, d, h, mi, s, 0, c.loc)
+	skew := wall.Sub(now).Round(time.Second)
+	_, offset := now.Zone()
+	_, reportedOffset := reported.Zone()
+	offsetOK := !strings.ContainsAny(status.LocalTime[len("2006-01-02T15:04:05"):], "+-Z") || reportedOffset == offset
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.skew, c.offsetOK, c.observed = skew, offsetOK, true
+	over := skew.Abs() > c.cfg.MaxSkew
+
+	if now.Sub(c.logged) >= skewLogInterval || (skew-c.loggedSkew).Abs() >= time.Minute || over != c.alerting {
+		c.logged, c.loggedSkew = now, skew
+		if !offsetOK {
+			log.Printf("[TIME] Thermostat clock skew %v (reported %s, expected UTC offset %s)", skew, status.LocalTime, now.Format("-07:00"))
+		} else {
+			log.Printf("[TIME] Thermostat clock skew %v (reported %s)", skew, status.LocalTime)
+		}
+	}
+	if over != c.alerting {
+		c.alerting = over
+		msg := fmt.Sprintf("Thermostat clock is off by %v", skew)
+		if !over {
+			msg = "Thermostat clock is back in sync"
+		}
+		hvac.Events.Publish("alert", hvac.Alert{Source: "clock", Severity: "warning", Active: over, Message: msg})
+		activity.Event("clock", "%s", msg)
+	}
+	c.pending = over && c.cfg.Correct && now.Sub(c.corrected) >= correctionInterval
+}
+
+// correct asks the thermostat to resync when a correction is pending, by
+// setting serverHasChanges in a status response so it checks in with the
+// server and fetches the time. It returns the response to send.
+func (c *clockMonitor) correct(r *http.Request, body []byte) []byte {
+	if !strings.HasSuffix(r.URL.Path, "/status") {
+		return body
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.pending {
+		return body
+	}
+	c.pending = false
+	c.corrected = c.now()
+	c.corrections++
+	log.Printf("[TIME] Asking the thermostat to resync its clock (skew %v)", c.skew)
+	return setElement(body, "serverHasChanges", "true")
+}
+
+// metrics renders the clock skew and the corrections and time responses
+// served for "/metrics".
+func (c *clockMonitor) metrics() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b strings.Builder
+	if c.observed {
+		b.WriteString("# HELP hvac_thermostat_clock_skew_seconds thermostat wall clock minus the real time in the configured timezone\n")
+		b.WriteString("# TYPE hvac_thermostat_clock_skew_seconds gauge\n")
+		b.WriteString(fmt.Sprintf("hvac_thermostat_clock_skew_seconds %d\n", int(c.skew.Seconds())))
+		b.WriteString("# HELP hvac_thermostat_clock_offset_mismatch 1 if the thermostat reports a UTC offset other than the timezone's\n")
+		b.WriteString("# TYPE hvac_thermostat_clock_offset_mismatch gauge\n")
+		mismatch := 0
+		if !c.offsetOK {
+			mismatch = 1
+		}
+		b.WriteString(fmt.Sprintf("hvac_thermostat_clock_offset_mismatch %d\n", mismatch))
+	}
+	b.WriteString("# HELP hvac_thermostat_clock_corrections_total requests for the thermostat to resync its clock\n")
+	b.WriteString("# TYPE hvac_thermostat_clock_corrections_total counter\n")
+	b.WriteString(fmt.Sprintf("hvac_thermostat_clock_corrections_total %d\n", c.corrections))
+	b.WriteString("# HELP hvac_time_responses_served_total time requests answered from the host clock\n")
+	b.WriteString("# TYPE hvac_time_responses_served_total counter\n")
+	b.WriteString(fmt.Sprintf("hvac_time_responses_served_total %d\n", c.served))
+	return b.String()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"hvac-proxy/hvac"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useClock enables clock checks for the duration of a test, with the real
+// time fixed at now.
+func useClock(t *testing.T, cfg TimeConfig, now time.Time) *clockMonitor {
+	if cfg.MaxSkew == 0 {
+		cfg.MaxSkew = 2 * time.Minute
+	}
+	c, err := newClockMonitor(cfg)
+	require.NoError(t, err)
+	c.now = func() time.Time { return now }
+	prev := clock
+	clock = c
+	t.Cleanup(func() { clock = prev })
+	return c
+}
+
+func TestClock_ServesTime(t *testing.T) {
+	now := time.Date(2024, 7, 4, 17, 30, 0, 0, time.UTC)
+	useClock(t, TimeConfig{Timezone: "America/Chicago", Serve: true}, now)
+
+	rr := httptest.NewRecorder()
+	proxyHandler(rr, httptest.NewRequest("GET", "/time", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "local", rr.Header().Get("X-Hvac-Proxy-Time"))
+	assert.Equal(t, `<time version="1.9"><utc>2024-07-04T17:30:00</utc><localTime>2024-07-04T12:30:00-05:00</localTime></time>`, rr.Body.String(),
+		"daylight saving time applies in July")
+	assert.Contains(t, clock.metrics(), "hvac_time_responses_served_total 1")
+}
+
+func TestClock_Skew(t *testing.T) {
+	now := time.Date(2024, 11, 21, 19, 49, 44, 0, time.FixedZone("CST", -6*3600))
+	c := useClock(t, TimeConfig{Timezone: "America/Chicago"}, now)
+	_, events, cancel := hvac.Events.Subscribe(0)
+	defer cancel()
+	nextAlert := func() hvac.Alert {
+		for e := range events {
+			if e.Type == "alert" {
+				return e.Data.(hvac.Alert)
+			}
+		}
+		return hvac.Alert{}
+	}
+
+	c.observe([]byte(`<status><localTime>2024-11-21T19:50:14-06:00</localTime></status>`))
+	m := c.metrics()
+	assert.Contains(t, m, "hvac_thermostat_clock_skew_seconds 30\n")
+	assert.Contains(t, m, "hvac_thermostat_clock_offset_mismatch 0\n")
+
+	// A thermostat still on daylight saving time is an hour ahead
+	c.observe([]byte(`<status><localTime>2024-11-21T20:49:44-05:00</localTime></status>`))
+	m = c.metrics()
+	assert.Contains(t, m, "hvac_thermostat_clock_skew_seconds 3600\n")
+	assert.Contains(t, m, "hvac_thermostat_clock_offset_mismatch 1\n")
+	assert.True(t, nextAlert().Active)
+
+	// Malformed offsets and times without one compare by wall clock
+	c.observe([]byte(`<status><localTime>2024-11-21T19:49:40-05:58</localTime></status>`))
+	assert.Contains(t, c.metrics(), "hvac_thermostat_clock_skew_seconds -4\n")
+	assert.False(t, nextAlert().Active)
+	c.observe([]byte(`<status><localTime>2024-11-21T19:49:44</localTime></status>`))
+	m = c.metrics()
+	assert.Contains(t, m, "hvac_thermostat_clock_skew_seconds 0\n")
+	assert.Contains(t, m, "hvac_thermostat_clock_offset_mismatch 0\n")
+}
+
+func TestClock_Correct(t *testing.T) {
+	useDataDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<status version="1.37"><pingRate>12</pingRate><serverHasChanges>false</serverHasChanges></status>`))
+	}))
+	defer srv.Close()
+	useUpstream(t, testUpstreamConfig())
+	now := time.Date(2024, 11, 21, 19, 49, 44, 0, time.UTC)
+	c := useClock(t, TimeConfig{Timezone: "UTC", Correct: true}, now)
+
+	post := func(localTime string) string {
+		req := httptest.NewRequest("POST", "/systems/123/status", strings.NewReader(`<status><localTime>`+localTime+`</localTime></status>`))
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		return rr.Body.String()
+	}
+
+	assert.Contains(t, post("2024-11-21T19:49:50Z"), "<serverHasChanges>false</serverHasChanges>", "within the maximum skew")
+	assert.Contains(t, post("2024-11-21T19:59:44Z"), "<serverHasChanges>true</serverHasChanges>")
+	assert.Contains(t, post("2024-11-21T19:59:44Z"), "<serverHasChanges>false</serverHasChanges>", "asked once per hour")
+
+	c.now = func() time.Time { return now.Add(2 * time.Hour) }
+	assert.Contains(t, post("2024-11-21T21:59:44Z"), "<serverHasChanges>true</serverHasChanges>")
+	assert.Contains(t, c.metrics(), "hvac_thermostat_clock_corrections_total 2")
+}
+
+func TestClock_CorrectFromCache(t *testing.T) {
+	useDataDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<status version="1.37"><pingRate>12</pingRate><serverHasChanges>false</serverHasChanges></status>`))
+	}))
+	defer srv.Close()
+	useUpstream(t, testUpstreamConfig())
+	useCache(t, CacheConfig{TTLs: []CacheTTL{{"/systems/*/status", time.Hour}}})
+	now := time.Date(2024, 11, 21, 19, 49, 44, 0, time.UTC)
+	c := useClock(t, TimeConfig{Timezone: "UTC", Correct: true}, now)
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/systems/123/status", nil)
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		return rr
+	}
+	get()
+	c.observe([]byte(`<status><localTime>2024-11-21T19:59:44Z</localTime></status>`))
+	rr := get()
+	assert.Equal(t, "HIT", rr.Header().Get("X-Hvac-Proxy-Cache"))
+	assert.Contains(t, rr.Body.String(), "<serverHasChanges>true</serverHasChanges>")
+}
+
+func TestClock_CorrectFormEncoded(t *testing.T) {
+	useDataDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<status version="1.37"><pingRate>12</pingRate><serverHasChanges>false</serverHasChanges></status>`))
+	}))
+	defer srv.Close()
+	useUpstream(t, testUpstreamConfig())
+	now := time.Date(2024, 11, 21, 19, 49, 44, 0, time.UTC)
+	c := useClock(t, TimeConfig{Timezone: "UTC", Correct: true}, now)
+
+	// The thermostat posts status as a form with the document in "data"
+	body := "data=" + url.QueryEscape(`<status><localTime>2024-11-21T19:59:44Z</localTime></status>`)
+	req := httptest.NewRequest("POST", "/systems/123/status", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Host = strings.TrimPrefix(srv.URL, "http://")
+	rr := httptest.NewRecorder()
+	proxyHandler(rr, req)
+
+	assert.Contains(t, rr.Body.String(), "<serverHasChanges>true</serverHasChanges>")
+	m := c.metrics()
+	assert.Contains(t, m, "hvac_thermostat_clock_skew_seconds 600\n")
+	assert.Contains(t, m, "hvac_thermostat_clock_corrections_total 1")
+}
+
+func TestTimeConfig_Env(t *testing.T) {
+	t.Setenv("TIME_ZONE", "Europe/Berlin")
+	t.Setenv("TIME_SERVE", "true")
+	t.Setenv("TIME_MAX_SKEW", "5m")
+	t.Setenv("TIME_CORRECT", "true")
+	cfg, err := loadConfig("")
+	require.NoError(t, err)
+
+	assert.Equal(t, TimeConfig{Timezone: "Europe/Berlin", Serve: true, MaxSkew: 5 * time.Minute, Correct: true}, cfg.Time)
+	require.NoError(t, cfg.Validate())
+
+	cfg.Time.Timezone = "Mars/Olympus_Mons"
+	assert.ErrorContains(t, cfg.Validate(), `time.timezone: unknown timezone "Mars/Olympus_Mons"`)
+	cfg.Time.Timezone = ""
+	assert.ErrorContains(t, cfg.Validate(), "time.timezone: required to serve or correct the time")
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"hvac-proxy/hvac"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete proxy configuration. It is built from defaults,
+// then an optional YAML file, then environment variables, then command line
+// flags, each overriding the previous.
+type Config struct {
+	Port          int                `yaml:"port"`          // Listen port for the proxy
+	DataDir       string             `yaml:"dataDir"`       // Directory for saved bodies and metrics; a temp dir if empty
+	BlockUpdates  bool               `yaml:"blockUpdates"`  // Remove <update> blocks from saved content
+	LogLevel      string             `yaml:"logLevel"`      // "info" logs every request and response, "warn" only problems
+	WatchInterval time.Duration      `yaml:"watchInterval"` // How often to check the config file for changes; 0 disables
+	Server        ServerConfig       `yaml:"server"`
+	Admin         AdminConfig        `yaml:"admin"`
+	Auth          AuthConfig         `yaml:"auth"`
+	Upstream      UpstreamConfig     `yaml:"upstream"`
+	Cache         CacheConfig        `yaml:"cache"`
+	Capture       hvac.CaptureConfig `yaml:"capture"`
+	MQTT          hvac.MQTTConfig    `yaml:"mqtt"`
+	Influx        InfluxConfig       `yaml:"influx"`
+	OTLP          OTLPConfig         `yaml:"otlp"`
+	Webhooks      WebhookConfig      `yaml:"webhooks"`
+	Archive       ArchiveConfig      `yaml:"archive"`
+	Faults        FaultsConfig       `yaml:"faults"`
+	Weather       WeatherConfig      `yaml:"weather"`
+	Time          TimeConfig         `yaml:"time"`
+	Messages      MessagesConfig     `yaml:"messages"`
+	Backup        BackupConfig       `yaml:"backup"`
+}
+
+// defaultConfig returns the configuration used when nothing is configured.
+func defaultConfig() Config {
+	return Config{
+		Port:          8080,
+		LogLevel:      "info",
+		WatchInterval: 5 * time.Second,
+		Server:        defaultServerConfig(),
+		Upstream:      defaultUpstreamConfig(),
+		Cache: CacheConfig{
+			TTLs:     defaultCacheTTLs,
+			MaxStale: 7 * 24 * time.Hour,
+		},
+		Capture: hvac.CaptureConfig{
+			BufferSize:  500,
+			FileEntries: 100,
+		},
+		MQTT:     hvac.DefaultMQTTConfig(),
+		Influx:   defaultInfluxConfig(),
+		OTLP:     defaultOTLPConfig(),
+		Webhooks: defaultWebhookConfig(),
+		Archive:  defaultArchiveConfig(),
+		Weather:  defaultWeatherConfig(),
+		Time:     defaultTimeConfig(),
+		Messages: defaultMessagesConfig(),
+		Backup:   defaultBackupConfig(),
+	}
+}
+
+// loadConfig builds the configuration from defaults, the YAML file at path
+// (if not empty) and the environment. It does not validate the result.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return cfg, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides settings from environment variables. Values that cannot
+// be parsed are reported rather than ignored.
+func (c *Config) applyEnv() error {
+	e := envReader{}
+	e.int("PORT", &c.Port)
+	e.string("DATA_DIR", &c.DataDir)
+	e.bool("BLOCK_UPDATES", &c.BlockUpdates)
+	e.string("LOG_LEVEL", &c.LogLevel)
+	e.duration("CONFIG_WATCH_INTERVAL", &c.WatchInterval)
+
+	e.duration("SERVER_READ_HEADER_TIMEOUT", &c.Server.ReadHeaderTimeout)
+	e.duration("SERVER_READ_TIMEOUT", &c.Server.ReadTimeout)
+	e.duration("SERVER_WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	e.duration("SERVER_IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	e.duration("SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+
+	e.string("ADMIN_ADDR", &c.Admin.Addr)
+	e.string("ADMIN_TLS_CERT", &c.Admin.TLSCert)
+	e.string("ADMIN_TLS_KEY", &c.Admin.TLSKey)
+
+	if v, ok := e.lookup("AUTH_TOKENS"); ok {
+		entries, err := parseAuthEntries(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("AUTH_TOKENS: %w", err))
+		}
+		c.Auth.Tokens = nil
+		for _, en := range entries {
+			c.Auth.Tokens = append(c.Auth.Tokens, AuthToken{Name: en[0], Token: en[1], Scopes: strings.Split(en[2], "+")})
+		}
+	}
+	if v, ok := e.lookup("AUTH_USERS"); ok {
+		entries, err := parseAuthEntries(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("AUTH_USERS: %w", err))
+		}
+		c.Auth.Users = nil
+		for _, en := range entries {
+			c.Auth.Users = append(c.Auth.Users, AuthUser{Name: en[0], PasswordHash: en[1], Scopes: strings.Split(en[2], "+")})
+		}
+	}
+	e.string("AUTH_CLIENT_CA", &c.Auth.ClientCA)
+	if v, ok := e.lookup("AUTH_CLIENT_CERTS"); ok {
+		c.Auth.ClientCerts = parseAuthCerts(v)
+	}
+	e.string("AUTH_AUDIT_LOG", &c.Auth.AuditLog)
+
+	e.duration("UPSTREAM_CONNECT_TIMEOUT", &c.Upstream.ConnectTimeout)
+	e.duration("UPSTREAM_TLS_TIMEOUT", &c.Upstream.TLSTimeout)
+	e.duration("UPSTREAM_RESPONSE_TIMEOUT", &c.Upstream.ResponseHeaderTimeout)
+	e.int("UPSTREAM_RETRIES", &c.Upstream.Retries)
+	e.duration("UPSTREAM_RETRY_BACKOFF", &c.Upstream.RetryBackoff)
+	e.int("BREAKER_THRESHOLD", &c.Upstream.BreakerThreshold)
+	e.duration("BREAKER_COOLDOWN", &c.Upstream.BreakerCooldown)
+	e.bool("UPSTREAM_FALLBACK", &c.Upstream.Fallback)
+
+	e.bool("CACHE_ENABLED", &c.Cache.Enabled)
+	e.string("CACHE_DIR", &c.Cache.Dir)
+	e.duration("CACHE_MAX_STALE", &c.Cache.MaxStale)
+	if v, ok := os.LookupEnv("CACHE_TTLS"); ok && v != "" {
+		ttls, err := parseCacheTTLs(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("CACHE_TTLS: %w", err))
+		} else {
+			c.Cache.TTLs = ttls
+		}
+	}
+
+	e.bool("CAPTURE_ENABLED", &c.Capture.Enabled)
+	e.string("CAPTURE_DIR", &c.Capture.Dir)
+	e.int("CAPTURE_BUFFER", &c.Capture.BufferSize)
+	e.int("CAPTURE_FILE_ENTRIES", &c.Capture.FileEntries)
+	e.int("CAPTURE_MAX_FILES", &c.Capture.MaxFiles)
+
+	e.string("MQTT_BROKER", &c.MQTT.Broker)
+	e.string("MQTT_CLIENT_ID", &c.MQTT.ClientID)
+	e.string("MQTT_USER", &c.MQTT.User)
+	e.string("MQTT_PASSWORD", &c.MQTT.Password)
+	e.string("MQTT_TOPIC", &c.MQTT.Topic)
+	e.string("MQTT_DIAGNOSTICS_TOPIC", &c.MQTT.DiagnosticsTopic)
+	e.string("MQTT_FAULTS_TOPIC", &c.MQTT.FaultsTopic)
+	e.string("MQTT_AVAILABILITY_TOPIC", &c.MQTT.AvailabilityTopic)
+	if v, ok := os.LookupEnv("MQTT_QOS"); ok && v != "" {
+		q, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("MQTT_QOS: invalid value %q", v))
+		} else {
+			c.MQTT.QoS = byte(q)
+		}
+	}
+	e.bool("MQTT_RETAINED", &c.MQTT.Retained)
+	if v := os.Getenv("MQTT_DEBUG"); v != "" {
+		c.MQTT.Debug = true
+	}
+
+	e.string("INFLUX_URL", &c.Influx.URL)
+	e.string("INFLUX_ORG", &c.Influx.Org)
+	e.string("INFLUX_BUCKET", &c.Influx.Bucket)
+	e.string("INFLUX_TOKEN", &c.Influx.Token)
+	e.int("INFLUX_BATCH_SIZE", &c.Influx.BatchSize)
+	e.duration("INFLUX_FLUSH_INTERVAL", &c.Influx.FlushInterval)
+	e.duration("INFLUX_TIMEOUT", &c.Influx.Timeout)
+	e.int("INFLUX_RETRIES", &c.Influx.Retries)
+	e.duration("INFLUX_RETRY_BACKOFF", &c.Influx.RetryBackoff)
+	e.string("INFLUX_BUFFER_FILE", &c.Influx.BufferFile)
+	e.int("INFLUX_BUFFER_MAX_BYTES", &c.Influx.BufferMaxBytes)
+
+	e.string("OTEL_EXPORTER_OTLP_ENDPOINT", &c.OTLP.Endpoint)
+	e.string("OTEL_EXPORTER_OTLP_PROTOCOL", &c.OTLP.Protocol)
+	if v, ok := e.lookup("OTEL_EXPORTER_OTLP_HEADERS"); ok {
+		headers, err := parseOTLPHeaders(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: %w", err))
+		} else {
+			c.OTLP.Headers = headers
+		}
+	}
+	e.string("OTEL_SERVICE_NAME", &c.OTLP.ServiceName)
+	e.bool("OTLP_METRICS", &c.OTLP.Metrics)
+	e.bool("OTLP_TRACES", &c.OTLP.Traces)
+	e.duration("OTLP_METRICS_INTERVAL", &c.OTLP.MetricsInterval)
+	e.duration("OTLP_TIMEOUT", &c.OTLP.Timeout)
+
+	if v, ok := e.lookup("WEBHOOK_URLS"); ok {
+		var events []string
+		e.list("WEBHOOK_EVENTS", &events)
+		secret, _ := e.lookup("WEBHOOK_SECRET")
+		c.Webhooks.Endpoints = nil
+		for _, u := range strings.Split(v, ",") {
+			c.Webhooks.Endpoints = append(c.Webhooks.Endpoints, WebhookEndpoint{URL: strings.TrimSpace(u), Events: events, Secret: secret})
+		}
+	}
+	e.int("WEBHOOK_QUEUE_SIZE", &c.Webhooks.QueueSize)
+	e.duration("WEBHOOK_TIMEOUT", &c.Webhooks.Timeout)
+	e.int("WEBHOOK_RETRIES", &c.Webhooks.Retries)
+	e.duration("WEBHOOK_RETRY_BACKOFF", &c.Webhooks.RetryBackoff)
+
+	e.bool("ARCHIVE_ENABLED", &c.Archive.Enabled)
+	e.string("ARCHIVE_DIR", &c.Archive.Dir)
+	e.list("ARCHIVE_EVENTS", &c.Archive.Events)
+	e.int("ARCHIVE_MAX_DAYS", &c.Archive.MaxDays)
+
+	e.string("FAULT_CATALOG", &c.Faults.Catalog)
+
+	e.string("WEATHER_FILE", &c.Weather.File)
+	e.string("WEATHER_TOPIC", &c.Weather.Topic)
+	e.bool("WEATHER_MERGE", &c.Weather.Merge)
+	e.duration("WEATHER_MAX_AGE", &c.Weather.MaxAge)
+
+	e.string("TIME_ZONE", &c.Time.Timezone)
+	e.bool("TIME_SERVE", &c.Time.Serve)
+	e.duration("TIME_MAX_SKEW", &c.Time.MaxSkew)
+	e.bool("TIME_CORRECT", &c.Time.Correct)
+
+	e.string("MESSAGES_PATH", &c.Messages.Path)
+	e.string("MESSAGES_TOPIC", &c.Messages.Topic)
+	e.int("MESSAGES_MAX", &c.Messages.Max)
+
+	e.int("BACKUP_VERSIONS", &c.Backup.Versions)
+	e.list("BACKUP_RESTORE_SECTIONS", &c.Backup.RestoreSections)
+
+	return errors.Join(e.errs...)
+}
+
+// envReader parses environment variables into config fields, collecting
+// errors for values that are set but invalid. Unset or empty variables keep
+// the current value.
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) lookup(name string) (string, bool) {
+	v, ok := os.LookupEnv(name)
+	return v, ok && v != ""
+}
+
+func (e *envReader) string(name string, dst *string) {
+	if v, ok := e.lookup(name); ok {
+		*dst = v
+	}
+}
+
+func (e *envReader) int(name string, dst *int) {
+	if v, ok := e.lookup(name); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid integer %q", name, v))
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envReader) bool(name string, dst *bool) {
+	if v, ok := e.lookup(name); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid boolean %q", name, v))
+			return
+		}
+		*dst = b
+	}
+}
+
+// list reads a comma-separated list.
+func (e *envReader) list(name string, dst *[]string) {
+	if v, ok := e.lookup(name); ok {
+		*dst = nil
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*dst = append(*dst, item)
+			}
+		}
+	}
+}
+
+func (e *envReader) duration(name string, dst *time.Duration) {
+	if v, ok := e.lookup(name); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid duration %q", name, v))
+			return
+		}
+		*dst = d
+	}
+}
+
+// Validate checks the configuration and reports every problem found.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, field, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(c.Port > 0 && c.Port < 65536, "port", "must be between 1 and 65535, got %d", c.Port)
+	check(c.WatchInterval >= 0, "watchInterval", "must not be negative")
+
+	check(c.Server.ReadHeaderTimeout > 0, "server.readHeaderTimeout", "must be positive")
+	check(c.Server.ReadTimeout >= 0, "server.readTimeout", "must not be negative")
+	check(c.Server.WriteTimeout >= 0, "server.writeTimeout", "must not be negative")
+	check(c.Server.IdleTimeout >= 0, "server.idleTimeout", "must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdownTimeout", "must be positive")
+
+	check(c.LogLevel == "info" || c.LogLevel == "warn", "logLevel", "must be info or warn, got %q", c.LogLevel)
+	if c.Admin.Addr != "" {
+		_, port, err := net.SplitHostPort(c.Admin.Addr)
+		check(err == nil && port != "", "admin.addr", "must be host:port or :port, got %q", c.Admin.Addr)
+		check(port != strconv.Itoa(c.Port), "admin.addr", "must use a different port from the proxy")
+	}
+	check((c.Admin.TLSCert == "") == (c.Admin.TLSKey == ""), "admin.tlsCert", "tlsCert and tlsKey must be set together")
+	check(c.Admin.TLSCert == "" || c.Admin.Addr != "", "admin.addr", "required when admin TLS is configured")
+
+	validateAuth(&c.Auth, check)
+	check(c.Auth.ClientCA == "" || c.Admin.TLSCert != "", "auth.clientCA", "requires admin TLS (admin.tlsCert and admin.tlsKey)")
+
+	check(c.Upstream.ConnectTimeout > 0, "upstream.connectTimeout", "must be positive")
+	check(c.Upstream.TLSTimeout > 0, "upstream.tlsTimeout", "must be positive")
+	check(c.Upstream.ResponseHeaderTimeout > 0, "upstream.responseTimeout", "must be positive")
+	check(c.Upstream.Retries >= 0, "upstream.retries", "must not be negative")
+	check(c.Upstream.RetryBackoff >= 0, "upstream.retryBackoff", "must not be negative")
+	check(c.Upstream.BreakerThreshold >= 0, "upstream.breakerThreshold", "must not be negative")
+	check(c.Upstream.BreakerCooldown > 0, "upstream.breakerCooldown", "must be positive")
+
+	check(c.Cache.MaxStale >= 0, "cache.maxStale", "must not be negative")
+	for i, t := range c.Cache.TTLs {
+		_, err := path.Match(t.Pattern, "/")
+		check(t.Pattern != "" && err == nil, fmt.Sprintf("cache.ttls[%d].pattern", i), "invalid pattern %q", t.Pattern)
+		check(t.TTL >= 0, fmt.Sprintf("cache.ttls[%d].ttl", i), "must not be negative")
+	}
+
+	check(c.Capture.BufferSize >= 0, "capture.buffer", "must not be negative")
+	check(c.Capture.FileEntries >= 0, "capture.fileEntries", "must not be negative")
+	check(c.Capture.MaxFiles >= 0, "capture.maxFiles", "must not be negative")
+
+	if c.MQTT.Broker != "" {
+		u, err := url.Parse(c.MQTT.Broker)
+		check(err == nil && u.Scheme != "" && u.Host != "", "mqtt.broker", "must be a URL such as tcp://localhost:1883, got %q", c.MQTT.Broker)
+		check(c.MQTT.Topic != "", "mqtt.topic", "must not be empty")
+		check(c.MQTT.DiagnosticsTopic != "", "mqtt.diagnosticsTopic", "must not be empty")
+		check(c.MQTT.FaultsTopic != "", "mqtt.faultsTopic", "must not be empty")
+		check(c.MQTT.AvailabilityTopic != "", "mqtt.availabilityTopic", "must not be empty")
+	}
+	check(c.MQTT.QoS <= 2, "mqtt.qos", "must be 0, 1 or 2, got %d", c.MQTT.QoS)
+
+	validateInflux(&c.Influx, check)
+	validateOTLP(&c.OTLP, check)
+	validateWebhooks(&c.Webhooks, check)
+	check(c.Archive.MaxDays >= 0, "archive.maxDays", "must not be negative")
+	validateWeather(&c.Weather, c.MQTT.Broker, check)
+	validateTime(&c.Time, check)
+	validateMessages(&c.Messages, c.MQTT.Broker, check)
+	validateBackup(&c.Backup, check)
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the configuration with secrets masked, for
+// printing.
+func (c Config) Redacted() Config {
+	if c.MQTT.Password != "" {
+		c.MQTT.Password = "REDACTED"
+	}
+	c.Auth.Tokens = slices.Clone(c.Auth.Tokens)
+	for i := range c.Auth.Tokens {
+		c.Auth.Tokens[i].Token = "REDACTED"
+	}
+	c.Auth.Users = slices.Clone(c.Auth.Users)
+	for i := range c.Auth.Users {
+		c.Auth.Users[i].PasswordHash = "REDACTED"
+	}
+	if c.Influx.Token != "" {
+		c.Influx.Token = "REDACTED"
+	}
+	if c.OTLP.Headers != nil {
+		headers := make(map[string]string, len(c.OTLP.Headers))
+		for k := range c.OTLP.Headers {
+			headers[k] = "REDACTED"
+		}
+		c.OTLP.Headers = headers
+	}
+	c.Webhooks.Endpoints = slices.Clone(c.Webhooks.Endpoints)
+	for i := range c.Webhooks.Endpoints {
+		c.Webhooks.Endpoints[i].URL = redactQuery(c.Webhooks.Endpoints[i].URL)
+		if c.Webhooks.Endpoints[i].Secret != "" {
+			c.Webhooks.Endpoints[i].Secret = "REDACTED"
+		}
+		if c.Webhooks.Endpoints[i].Headers != nil {
+			headers := make(map[string]string, len(c.Webhooks.Endpoints[i].Headers))
+			for k := range c.Webhooks.Endpoints[i].Headers {
+				headers[k] = "REDACTED"
+			}
+			c.Webhooks.Endpoints[i].Headers = headers
+		}
+	}
+	return c
+}
+
+// hvac returns the settings injected into the hvac package.
+func (c *Config) hvac() hvac.Config {
+	return hvac.Config{DataDir: c.DataDir, BlockUpdates: c.BlockUpdates, ConfigVersions: c.Backup.Versions}
+}
+
+// prepare fills in settings derived from others, creating a temporary data
+// directory when none is configured.
+func (c *Config) prepare() error {
+	if c.DataDir == "" {
+		tmp, err := os.MkdirTemp("", "hvac-data-*")
+		if err != nil {
+			return fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		c.DataDir = tmp
+	}
+	if c.Cache.Dir == "" {
+		c.Cache.Dir = filepath.Join(c.DataDir, "cache")
+	}
+	if c.Capture.Dir == "" {
+		c.Capture.Dir = filepath.Join(c.DataDir, "capture")
+	}
+	if c.Auth.AuditLog == "" {
+		c.Auth.AuditLog = filepath.Join(c.DataDir, "audit.log")
+	}
+	if c.Influx.BufferFile == "" {
+		c.Influx.BufferFile = filepath.Join(c.DataDir, "influx-buffer.lp")
+	}
+	if c.Archive.Dir == "" {
+		c.Archive.Dir = filepath.Join(c.DataDir, "archive")
+	}
+	c.Capture.Version = Version
+	return nil
+}
+
+// configFlags are the command line flags that override the configuration.
+type configFlags struct {
+	fs           *flag.FlagSet
+	file         string
+	port         int
+	dataDir      string
+	blockUpdates bool
+	mqttBroker   string
+	adminAddr    string
+}
+
+// addConfigFlags registers the configuration flags on fs.
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	f := &configFlags{fs: fs}
+	fs.StringVar(&f.file, "config", "", "YAML config file (default $CONFIG_FILE)")
+	fs.IntVar(&f.port, "port", 0, "listen port (overrides config and $PORT)")
+	fs.StringVar(&f.dataDir, "data-dir", "", "data directory (overrides config and $DATA_DIR)")
+	fs.BoolVar(&f.blockUpdates, "block-updates", false, "remove <update> blocks from saved content")
+	fs.StringVar(&f.mqttBroker, "mqtt-broker", "", "MQTT broker URL (overrides config and $MQTT_BROKER)")
+	fs.StringVar(&f.adminAddr, "admin-addr", "", "admin listener address (overrides config and $ADMIN_ADDR)")
+	return f
+}
+
+// path returns the config file in use, if any.
+func (f *configFlags) path() string {
+	if f.file != "" {
+		return f.file
+	}
+	return os.Getenv("CONFIG_FILE")
+}
+
+// load builds and validates the configuration after the flags are parsed.
+func (f *configFlags) load() (Config, error) {
+	cfg, err := loadConfig(f.path())
+	if err != nil {
+		return cfg, err
+	}
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "port":
+			cfg.Port = f.port
+		case "data-dir":
+			cfg.DataDir = f.dataDir
+		case "block-updates":
+			cfg.BlockUpdates = f.blockUpdates
+		case "mqtt-broker":
+			cfg.MQTT.Broker = f.mqttBroker
+		case "admin-addr":
+			cfg.Admin.Addr = f.adminAddr
+		}
+	})
+	return cfg, cfg.Validate()
+}
+
+// runConfig implements the "config" subcommand.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Println("Usage: hvac-proxy config check [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config check", flag.ContinueOnError)
+	flags := addConfigFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: hvac-proxy config check [flags]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg, err := flags.load()
+	if err != nil {
+		fmt.Printf("Configuration is invalid:\n%v\n", err)
+		return 1
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		fmt.Printf("Failed to render configuration: %v\n", err)
+		return 1
+	}
+	_ = enc.Close()
+	fmt.Println("Configuration is valid")
+	return 0
+}
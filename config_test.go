@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "hvac-proxy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestDefaultConfig_Valid(t *testing.T) {
+	cfg := defaultConfig()
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, 8080, cfg.Port)
+	assert.Equal(t, "hvac/value", cfg.MQTT.Topic)
+}
+
+func TestLoadConfig_FileThenEnv(t *testing.T) {
+	path := writeConfig(t, `
+port: 9090
+dataDir: /srv/hvac
+upstream:
+  retries: 4
+  responseTimeout: 45s
+cache:
+  enabled: true
+  ttls:
+    - pattern: /manifest
+      ttl: 1h
+mqtt:
+  broker: tcp://broker:1883
+  qos: 1
+`)
+	t.Setenv("PORT", "9191")
+	t.Setenv("MQTT_RETAINED", "true")
+
+	cfg, err := loadConfig(path)
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+
+	assert.Equal(t, 9191, cfg.Port, "environment overrides the file")
+	assert.Equal(t, "/srv/hvac", cfg.DataDir)
+	assert.Equal(t, 4, cfg.Upstream.Retries)
+	assert.Equal(t, 45*time.Second, cfg.Upstream.ResponseHeaderTimeout)
+	assert.Equal(t, defaultUpstreamConfig().ConnectTimeout, cfg.Upstream.ConnectTimeout, "unset keys keep defaults")
+	assert.True(t, cfg.Cache.Enabled)
+	assert.Equal(t, []CacheTTL{{Pattern: "/manifest", TTL: time.Hour}}, cfg.Cache.TTLs)
+	assert.Equal(t, byte(1), cfg.MQTT.QoS)
+	assert.True(t, cfg.MQTT.Retained)
+}
+
+func TestLoadConfig_UnknownKey(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, "mqtt:\n  brokr: tcp://broker:1883\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "brokr")
+}
+
+func TestLoadConfig_InvalidEnv(t *testing.T) {
+	t.Setenv("MQTT_QOS", "one")
+	t.Setenv("UPSTREAM_RETRY_BACKOFF", "soon")
+	t.Setenv("CACHE_ENABLED", "yes please")
+
+	_, err := loadConfig("")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "MQTT_QOS")
+	assert.Contains(t, err.Error(), "UPSTREAM_RETRY_BACKOFF")
+	assert.Contains(t, err.Error(), "CACHE_ENABLED")
+}
+
+func TestLoadConfig_LogLevel(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	cfg, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "warn", cfg.LogLevel)
+	require.NoError(t, cfg.Validate())
+
+	cfg.LogLevel = "debug"
+	assert.ErrorContains(t, cfg.Validate(), `logLevel: must be info or warn, got "debug"`)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Port = 0
+	cfg.Upstream.Retries = -1
+	cfg.MQTT.Broker = "localhost"
+	cfg.MQTT.QoS = 3
+	cfg.Cache.TTLs = []CacheTTL{{Pattern: "[", TTL: time.Hour}}
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	for _, field := range []string{"port", "upstream.retries", "mqtt.broker", "mqtt.qos", "cache.ttls[0].pattern"} {
+		assert.Contains(t, err.Error(), field+":")
+	}
+}
+
+func TestConfigFlags_Override(t *testing.T) {
+	t.Setenv("PORT", "9191")
+	t.Setenv("CONFIG_FILE", writeConfig(t, "blockUpdates: true\n"))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := addConfigFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-port", "7070", "-mqtt-broker", "tcp://broker:1883"}))
+
+	cfg, err := flags.load()
+	require.NoError(t, err)
+	assert.Equal(t, 7070, cfg.Port)
+	assert.Equal(t, "tcp://broker:1883", cfg.MQTT.Broker)
+	assert.True(t, cfg.BlockUpdates, "file is still read via CONFIG_FILE")
+}
+
+func TestConfig_Redacted(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MQTT.Password = "hunter2"
+	cfg.Webhooks.Endpoints = []WebhookEndpoint{{URL: "https://hooks.example.com/hvac?token=hunter2"}}
+
+	out, err := yaml.Marshal(cfg.Redacted())
+	require.NoError(t, err)
+	assert.NotContains(t, string(out), "hunter2")
+	assert.Contains(t, string(out), "password: REDACTED")
+	assert.Contains(t, string(out), "responseTimeout: 30s")
+	assert.Contains(t, string(out), "url: https://hooks.example.com/hvac?REDACTED")
+	assert.Equal(t, "hunter2", cfg.MQTT.Password, "original is unchanged")
+	assert.Equal(t, "https://hooks.example.com/hvac?token=hunter2", cfg.Webhooks.Endpoints[0].URL)
+}
+
+func TestRunConfig_Check(t *testing.T) {
+	assert.Equal(t, 0, runConfig([]string{"check", "-config", writeConfig(t, "port: 9000\n")}))
+	assert.Equal(t, 1, runConfig([]string{"check", "-config", writeConfig(t, "port: -1\n")}))
+	assert.Equal(t, 2, runConfig([]string{"validate"}))
+}
+
+func TestConfig_Prepare(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DataDir = "/srv/hvac"
+	require.NoError(t, cfg.prepare())
+	assert.Equal(t, "/srv/hvac/cache", cfg.Cache.Dir)
+	assert.Equal(t, "/srv/hvac/capture", cfg.Capture.Dir)
+	assert.Equal(t, "/srv/hvac", cfg.hvac().DataDir)
+}
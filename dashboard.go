@@ -0,0 +1,126 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"hvac-proxy/hvac"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+// This file serves the embedded dashboard and the JSON API it reads. The page
+// has no external assets so it works without internet access.
+
+//go:embed ui
+var uiFiles embed.FS
+
+// handleUI serves the dashboard under "/ui/".
+func handleUI() http.Handler {
+	sub, _ := fs.Sub(uiFiles, "ui")
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(sub)))
+}
+
+// handleStatus serves the most recent status document posted by the
+// thermostat.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	sample, ok := hvac.StatusHistory.Latest()
+	if !ok {
+		http.Error(w, "no status received yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, sample)
+}
+
+// handleHistory serves the status documents received within the "since"
+// duration (default 24h), at most one per "step" if given.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	since, err := queryDuration(r, "since", 24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	step, err := queryDuration(r, "step", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, hvac.StatusHistory.Since(time.Now().Add(-since), step))
+}
+
+// handleDiagnostics serves the latest raw diagnostics of each unit.
+func handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, hvac.LatestDiagnostics())
+}
+
+// handleInventory serves the equipment from the latest profile.
+func handleInventory(w http.ResponseWriter, r *http.Request) {
+	inv := hvac.LatestInventory()
+	if inv == nil {
+		http.Error(w, "no profile received yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, inv)
+}
+
+// handleFaults serves the active equipment faults and the recent history.
+func handleFaults(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Active  []hvac.Fault `json:"active"`
+		History []hvac.Fault `json:"history"`
+	}{hvac.Faults.Active(), hvac.Faults.History()})
+}
+
+// handleEnergy serves the latest energy report.
+func handleEnergy(w http.ResponseWriter, r *http.Request) {
+	u := hvac.EnergyHistory.Latest()
+	if u == nil {
+		http.Error(w, "no energy report received yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, u)
+}
+
+// handleEnergyHistory serves the last energy report of each day within the
+// "since" duration (default 31 days).
+func handleEnergyHistory(w http.ResponseWriter, r *http.Request) {
+	since, err := queryDuration(r, "since", 31*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, hvac.EnergyHistory.Since(time.Now().Add(-since)))
+}
+
+// handleActivity serves the recent thermostat requests and events.
+func handleActivity(w http.ResponseWriter, r *http.Request) {
+	traffic, events := activity.Snapshot()
+	writeJSON(w, struct {
+		Traffic []trafficEntry  `json:"traffic"`
+		Events  []activityEvent `json:"events"`
+	}{traffic, events})
+}
+
+// queryDuration parses a duration query parameter such as "24h".
+func queryDuration(r *http.Request, name string, def time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s duration %q", name, v)
+	}
+	return d, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"hvac-proxy/hvac"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDashboard_UI(t *testing.T) {
+	mux := newProxyMux(newAdminMux(), true)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/ui/", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rr.Body.String(), "api/v1/status")
+	assert.NotContains(t, rr.Body.String(), "https://", "no external assets")
+
+	rr = httptest.NewRecorder()
+	newAdminMux().ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "/ui/", rr.Header().Get("Location"))
+}
+
+func TestDashboard_RequiresAuth(t *testing.T) {
+	useAuth(t, AuthConfig{Tokens: []AuthToken{{Name: "family", Token: testToken, Scopes: []string{scopeRead}}}})
+	admin := newAdminMux()
+
+	for _, path := range []string{"/ui/", "/api/v1/status", "/api/v1/history", "/api/v1/diagnostics", "/api/v1/inventory", "/api/v1/faults", "/api/v1/energy", "/api/v1/energy/history", "/api/v1/activity", "/api/v1/messages", "/api/v1/schedules", "/api/v1/config/versions"} {
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, path)
+	}
+}
+
+func TestDashboard_StatusAndHistory(t *testing.T) {
+	useDataDir(t)
+	admin := newAdminMux()
+
+	status := `<status><oat>41</oat><filtrlvl>30</filtrlvl><idu><cfm>0</cfm><opstat>off</opstat></idu>` +
+		`<zones><zone id="1"><name>Main</name><rt>70.5</rt><rh>38</rh><htsp>70</htsp><clsp>76</clsp></zone></zones></status>`
+	require.NoError(t, hvac.SaveMetricsFromXML([]byte(status)))
+	hvac.FlushSinks(time.Second)
+
+	rr := httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/status", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var latest hvac.Sample
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &latest))
+	assert.Equal(t, 41.0, latest.Status.OAT)
+	assert.Equal(t, "Main", latest.Status.Zones.Zones[0].Name)
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/history?since=1h&step=10m", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var history []hvac.Sample
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &history))
+	assert.NotEmpty(t, history)
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/history?since=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid since duration")
+}
+
+func TestDashboard_Diagnostics(t *testing.T) {
+	useDataDir(t)
+	body := []byte(`<odu_raw><type>varcaphp</type><suctionPressure>118 psi</suctionPressure><compressorRPM>2400</compressorRPM></odu_raw>`)
+	hvac.SaveBody(httptest.NewRequest("POST", "/systems/123/odu_raw", nil), body, true)
+	require.True(t, hvac.FlushSinks(time.Second))
+
+	rr := httptest.NewRecorder()
+	newAdminMux().ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/diagnostics", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var got []hvac.Diagnostics
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	var outdoor *hvac.Diagnostics
+	for i := range got {
+		if got[i].Unit == "outdoor" {
+			outdoor = &got[i]
+		}
+	}
+	require.NotNil(t, outdoor)
+	assert.Equal(t, 118.0, outdoor.Values["suction_pressure"])
+	assert.Equal(t, "psi", outdoor.Units["suction_pressure"])
+	assert.Equal(t, 2400.0, outdoor.Values["compressor_rpm"])
+	assert.Equal(t, "varcaphp", outdoor.Info["type"])
+}
+
+func TestDashboard_Inventory(t *testing.T) {
+	useDataDir(t)
+	hvac.LoadInventory()
+	t.Cleanup(hvac.LoadInventory)
+	admin := newAdminMux()
+
+	rr := httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/inventory", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	body := []byte(`<profile><idu><type>fancoil</type><model>FE4ANF003</model><serial>4418X00001</serial><firmware>7</firmware></idu></profile>`)
+	hvac.SaveBody(httptest.NewRequest("POST", "/systems/123/profile", nil), body, true)
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/inventory", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var got hvac.Inventory
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	require.Len(t, got.Devices, 1)
+	assert.Equal(t, "FE4ANF003", got.Devices[0].Model)
+}
+
+func TestDashboard_Energy(t *testing.T) {
+	useDataDir(t)
+	require.NoError(t, hvac.LoadEnergy())
+	t.Cleanup(func() { _ = hvac.LoadEnergy() })
+	admin := newAdminMux()
+
+	rr := httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/energy", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	body := []byte(`<energy><usage><period id="month1"><cooling>42.5</cooling><fan>6</fan></period></usage></energy>`)
+	hvac.SaveBody(httptest.NewRequest("POST", "/systems/123/energy", nil), body, true)
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/energy", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var got hvac.EnergyUsage
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	require.Len(t, got.Periods, 1)
+	assert.Equal(t, 42.5, got.Periods[0].Usage["cooling"])
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/energy/history?since=24h", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var history []hvac.EnergyUsage
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &history))
+	assert.Len(t, history, 1)
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/energy/history?since=soon", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestDashboard_Faults(t *testing.T) {
+	useDataDir(t)
+	body := []byte(`<equipment_events><event><code>24</code><active>true</active></event></equipment_events>`)
+	req := httptest.NewRequest("POST", "/systems/123/equipment_events", nil)
+	hvac.SaveBody(req, body, true)
+	t.Cleanup(func() {
+		hvac.SaveBody(req, []byte(`<equipment_events><event><code>24</code><active>false</active></event></equipment_events>`), true)
+	})
+
+	rr := httptest.NewRecorder()
+	newAdminMux().ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/faults", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var got struct {
+		Active  []hvac.Fault `json:"active"`
+		History []hvac.Fault `json:"history"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	require.NotEmpty(t, got.Active)
+	assert.Equal(t, "Secondary voltage fuse is open", got.Active[0].Description)
+	assert.Equal(t, "furnace", got.Active[0].Device)
+	require.NotEmpty(t, got.History)
+	assert.Equal(t, "24", got.History[0].Code)
+}
+
+func TestActivitySink_RecordsEquipmentChanges(t *testing.T) {
+	log := newActivityLog(10)
+	bus := hvac.NewEventBus(16)
+	t.Cleanup(bus.AddSink("activity", activitySink{log}, hvac.SinkConfig{QueueSize: 10, BatchSize: 10}))
+
+	bus.Publish("status", hvac.Status{})
+	bus.Publish("inventory", hvac.InventoryChange{Role: "thermostat", Field: "firmware", Old: "4.17", New: "4.20"})
+	bus.Publish("fault", hvac.Fault{Code: "13", Device: "furnace", Description: "Limit circuit lockout", Active: true})
+	require.True(t, bus.FlushSinks(time.Second))
+
+	_, events := log.Snapshot()
+	require.Len(t, events, 2)
+	assert.Equal(t, "fault", events[0].Kind)
+	assert.Equal(t, "Limit circuit lockout (code 13) on furnace raised", events[0].Message)
+	assert.Equal(t, "inventory", events[1].Kind)
+	assert.Equal(t, "thermostat firmware changed from 4.17 to 4.20", events[1].Message)
+}
+
+func TestDashboard_Activity(t *testing.T) {
+	prev := activity
+	activity = newActivityLog(3)
+	defer func() { activity = prev }()
+
+	for i := range 5 {
+		req := httptest.NewRequest("GET", "/systems/123/status", nil)
+		activity.Request(req, 200+i, time.Millisecond, "")
+	}
+	activity.Event("config", "Applied new configuration")
+
+	rr := httptest.NewRecorder()
+	newAdminMux().ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/activity", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var got struct {
+		Traffic []trafficEntry  `json:"traffic"`
+		Events  []activityEvent `json:"events"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	require.Len(t, got.Traffic, 3, "only the most recent requests are kept")
+	assert.Equal(t, 204, got.Traffic[0].Status, "newest first")
+	assert.Equal(t, "/systems/123/status", got.Traffic[0].Path)
+	assert.Equal(t, 1.0, got.Traffic[0].Duration)
+	require.Len(t, got.Events, 1)
+	assert.Equal(t, "config", got.Events[0].Kind)
+}
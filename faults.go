@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"hvac-proxy/hvac"
+	"maps"
+	"os"
+)
+
+// FaultsConfig controls how equipment fault codes are decoded.
+type FaultsConfig struct {
+	Catalog string `yaml:"catalog"` // YAML file of fault codes added to, or replacing, the built-in ones
+}
+
+// initFaults merges the configured catalog into the built-in one.
+func initFaults(cfg FaultsConfig) error {
+	if cfg.Catalog == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.Catalog)
+	if err != nil {
+		return fmt.Errorf("failed to read fault catalog: %w", err)
+	}
+	overrides, err := hvac.ParseFaultCatalog(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cfg.Catalog, err)
+	}
+	catalog := hvac.DefaultFaultCatalog()
+	maps.Copy(catalog, overrides)
+	hvac.Faults.SetCatalog(catalog)
+	fmt.Printf("Loaded %d fault codes from %s\n", len(overrides), cfg.Catalog)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"hvac-proxy/hvac"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitFaults_Catalog(t *testing.T) {
+	t.Cleanup(func() { hvac.Faults.SetCatalog(hvac.DefaultFaultCatalog()) })
+	path := filepath.Join(t.TempDir(), "faults.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`"13":
+  description: High limit lockout
+  severity: critical
+  device: furnace
+"91":
+  description: Condensate pump overflow
+  severity: warning
+  device: accessory
+`), 0644))
+
+	require.NoError(t, initFaults(FaultsConfig{Catalog: path}))
+	changed := hvac.Faults.Report([]hvac.FaultReport{{Code: "13", Active: true}, {Code: "91", Active: true}, {Code: "14", Active: true}})
+	t.Cleanup(func() {
+		hvac.Faults.Report([]hvac.FaultReport{{Code: "13", Active: false}, {Code: "91", Active: false}, {Code: "14", Active: false}})
+	})
+	require.Len(t, changed, 3)
+	assert.Equal(t, "High limit lockout", changed[0].Description, "overridden")
+	assert.Equal(t, "accessory", changed[1].Device, "added")
+	assert.Equal(t, "Ignition lockout", changed[2].Description, "built-in codes are kept")
+
+	require.NoError(t, os.WriteFile(path, []byte("\"13\":\n  severity: dire\n"), 0644))
+	assert.ErrorContains(t, initFaults(FaultsConfig{Catalog: path}), "severity must be")
+	assert.ErrorContains(t, initFaults(FaultsConfig{Catalog: filepath.Join(t.TempDir(), "missing.yaml")}), "failed to read fault catalog")
+	assert.NoError(t, initFaults(FaultsConfig{}))
+}
@@ -0,0 +1,386 @@
+package hvac
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// This file implements the optional traffic capture mode. Every proxied
+// exchange is recorded into a rolling in-memory buffer and periodically
+// written to disk as HAR 1.2 files, so new firmware behaviour can be studied
+// without running tcpdump next to the proxy.
+
+// Exchange is a single request/response pair observed by the proxy.
+type Exchange struct {
+	Started        time.Time     // When the thermostat request was received
+	Method         string        // HTTP method
+	URL            string        // Full request URL including scheme and host
+	Proto          string        // HTTP protocol version of the request
+	RequestHeader  http.Header   // Headers sent by the thermostat
+	RequestBody    []byte        // Raw request body
+	StatusCode     int           // Upstream status code (0 if upstream failed)
+	ResponseHeader http.Header   // Headers returned by upstream
+	ResponseBody   []byte        // Raw response body
+	Wait           time.Duration // Time until upstream response headers arrived
+	Receive        time.Duration // Time spent reading the upstream response body
+	Error          string        // Upstream error, if any
+}
+
+// HAR STRUCTURES
+// These structs follow the HAR 1.2 specification. Fields prefixed with an
+// underscore are custom extensions allowed by the spec.
+
+// HAR is the root object of an HTTP Archive.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog holds the creator and the recorded entries.
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+// HARCreator identifies the application that produced the archive.
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry is one recorded exchange.
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+// HARRequest describes the thermostat request.
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARPostData holds the request body, both raw and decoded.
+type HARPostData struct {
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text"`
+	DecodedText string `json:"_decodedText,omitempty"`
+}
+
+// HARResponse describes the upstream response.
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARContent holds the response body, both raw and decoded.
+type HARContent struct {
+	Size        int    `json:"size"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text"`
+	DecodedText string `json:"_decodedText,omitempty"`
+}
+
+// HARNameValue is a header, cookie or query string pair.
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARTimings breaks down the time spent on an exchange in milliseconds.
+// Phases the proxy cannot observe are reported as -1.
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// CaptureConfig controls the capture buffer and its on-disk files.
+type CaptureConfig struct {
+	Enabled     bool   `yaml:"enabled"`     // Record proxied exchanges
+	BufferSize  int    `yaml:"buffer"`      // Number of exchanges kept in memory
+	Dir         string `yaml:"dir"`         // Directory for HAR files; empty disables disk output
+	FileEntries int    `yaml:"fileEntries"` // Number of exchanges written per HAR file
+	MaxFiles    int    `yaml:"maxFiles"`    // Number of HAR files kept on disk; 0 keeps all
+	Version     string `yaml:"-"`           // Creator version recorded in the archive
+}
+
+// Capture records proxied exchanges into a rolling buffer and HAR files.
+type Capture struct {
+	cfg     CaptureConfig
+	mu      sync.Mutex
+	ring    []HAREntry
+	next    int
+	full    bool
+	pending []HAREntry
+	files   int // HAR files written, numbering files written in the same millisecond
+}
+
+// NewCapture creates a capture buffer, applying defaults for unset sizes.
+func NewCapture(cfg CaptureConfig) *Capture {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 500
+	}
+	if cfg.FileEntries <= 0 {
+		cfg.FileEntries = 100
+	}
+	return &Capture{cfg: cfg, ring: make([]HAREntry, cfg.BufferSize)}
+}
+
+// Record adds an exchange to the buffer. When enough exchanges have been
+// collected since the last file was written, a new HAR file is flushed to disk.
+func (c *Capture) Record(ex Exchange) {
+	entry := ex.toHAREntry()
+
+	c.mu.Lock()
+	c.ring[c.next] = entry
+	c.next = (c.next + 1) % len(c.ring)
+	if c.next == 0 {
+		c.full = true
+	}
+	var batch []HAREntry
+	if c.cfg.Dir != "" {
+		c.pending = append(c.pending, entry)
+		if len(c.pending) >= c.cfg.FileEntries {
+			batch = c.pending
+			c.pending = nil
+		}
+	}
+	c.mu.Unlock()
+
+	if batch != nil {
+		if err := c.writeFile(batch); err != nil {
+			fmt.Printf("Failed to write capture file: %v\n", err)
+		}
+	}
+}
+
+// Entries returns the buffered entries, oldest first.
+func (c *Capture) Entries() []HAREntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var out []HAREntry
+	if c.full {
+		out = append(out, c.ring[c.next:]...)
+	}
+	out = append(out, c.ring[:c.next]...)
+	return out
+}
+
+// HAR returns the buffered entries as an HTTP Archive.
+func (c *Capture) HAR() *HAR {
+	return newHAR(c.cfg.Version, c.Entries())
+}
+
+// Flush writes any exchanges not yet saved to disk into a HAR file.
+func (c *Capture) Flush() error {
+	c.mu.Lock()
+	batch := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	if len(batch) == 0 || c.cfg.Dir == "" {
+		return nil
+	}
+	return c.writeFile(batch)
+}
+
+// ServeHTTP serves the buffered exchanges as a downloadable HAR file.
+func (c *Capture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := json.MarshalIndent(c.HAR(), "", "  ")
+	if err != nil {
+		http.Error(w, "Failed to encode capture", http.StatusInternalServerError)
+		return
+	}
+	name := fmt.Sprintf("hvac-capture-%s.har", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	_, _ = w.Write(data)
+}
+
+// writeFile saves a batch of entries as a HAR file and prunes old files.
+func (c *Capture) writeFile(entries []HAREntry) error {
+	if err := os.MkdirAll(c.cfg.Dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(newHAR(c.cfg.Version, entries), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.files++
+	seq := c.files
+	c.mu.Unlock()
+	name := fmt.Sprintf("capture-%s-%06d.har", time.Now().UTC().Format("20060102-150405.000"), seq)
+	path := filepath.Join(c.cfg.Dir, name)
+	if err := WriteFileAtomic(path, data); err != nil {
+		return err
+	}
+	return c.prune()
+}
+
+// prune removes the oldest HAR files beyond the configured maximum.
+func (c *Capture) prune() error {
+	if c.cfg.MaxFiles <= 0 {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(c.cfg.Dir, "capture-*.har"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for len(files) > c.cfg.MaxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// ReadHAR loads an HTTP Archive from disk.
+func ReadHAR(path string) (*HAR, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var har HAR
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("failed to parse HAR %s: %w", path, err)
+	}
+	return &har, nil
+}
+
+func newHAR(version string, entries []HAREntry) *HAR {
+	if version == "" {
+		version = "dev"
+	}
+	if entries == nil {
+		entries = []HAREntry{}
+	}
+	return &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "hvac-proxy", Version: version},
+		Entries: entries,
+	}}
+}
+
+// toHAREntry converts an exchange into its HAR representation.
+func (ex Exchange) toHAREntry() HAREntry {
+	wait := float64(ex.Wait) / float64(time.Millisecond)
+	receive := float64(ex.Receive) / float64(time.Millisecond)
+
+	entry := HAREntry{
+		StartedDateTime: ex.Started.Format(time.RFC3339Nano),
+		Time:            wait + receive,
+		Request: HARRequest{
+			Method:      ex.Method,
+			URL:         ex.URL,
+			HTTPVersion: ex.Proto,
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(ex.RequestHeader),
+			QueryString: harQuery(ex.URL),
+			HeadersSize: -1,
+			BodySize:    len(ex.RequestBody),
+		},
+		Response: HARResponse{
+			Status:      ex.StatusCode,
+			StatusText:  http.StatusText(ex.StatusCode),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(ex.ResponseHeader),
+			Content: HARContent{
+				Size:     len(ex.ResponseBody),
+				MimeType: ex.ResponseHeader.Get("Content-Type"),
+				Text:     string(ex.ResponseBody),
+			},
+			HeadersSize: -1,
+			BodySize:    len(ex.ResponseBody),
+		},
+		Timings: HARTimings{Blocked: -1, DNS: -1, Connect: -1, Send: 0, Wait: wait, Receive: receive},
+		Comment: ex.Error,
+	}
+	if entry.Request.HTTPVersion == "" {
+		entry.Request.HTTPVersion = "HTTP/1.1"
+	}
+
+	if len(ex.RequestBody) > 0 {
+		entry.Request.PostData = &HARPostData{
+			MimeType: ex.RequestHeader.Get("Content-Type"),
+			Text:     string(ex.RequestBody),
+		}
+		if decoded := DecodeBody(ex.RequestBody); string(decoded) != string(ex.RequestBody) {
+			entry.Request.PostData.DecodedText = string(decoded)
+		}
+	}
+	if decoded := DecodeBody(ex.ResponseBody); string(decoded) != string(ex.ResponseBody) {
+		entry.Response.Content.DecodedText = string(decoded)
+	}
+	return entry
+}
+
+func harHeaders(h http.Header) []HARNameValue {
+	out := []HARNameValue{}
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			out = append(out, HARNameValue{Name: k, Value: v})
+		}
+	}
+	return out
+}
+
+func harQuery(rawURL string) []HARNameValue {
+	out := []HARNameValue{}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return out
+	}
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range query[k] {
+			out = append(out, HARNameValue{Name: k, Value: v})
+		}
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+package hvac_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"hvac-proxy/hvac"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testExchange(path string) hvac.Exchange {
+	return hvac.Exchange{
+		Started:        time.Date(2025, 11, 21, 19, 49, 44, 0, time.UTC),
+		Method:         "POST",
+		URL:            "http://www.api.ing.carrier.com" + path + "?x=1",
+		RequestHeader:  http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		RequestBody:    []byte("data=%3Cstatus%3E%3C%2Fstatus%3E"),
+		StatusCode:     200,
+		ResponseHeader: http.Header{"Content-Type": {"application/xml"}},
+		ResponseBody:   []byte("<status><pingRate>12</pingRate></status>"),
+		Wait:           40 * time.Millisecond,
+		Receive:        2 * time.Millisecond,
+	}
+}
+
+// TestCapture_HAREntry verifies that exchanges are converted into HAR entries.
+func TestCapture_HAREntry(t *testing.T) {
+	c := hvac.NewCapture(hvac.CaptureConfig{BufferSize: 10})
+	c.Record(testExchange("/systems/123/status"))
+
+	har := c.HAR()
+	assert.Equal(t, "1.2", har.Log.Version)
+	require.Len(t, har.Log.Entries, 1)
+
+	e := har.Log.Entries[0]
+	assert.Equal(t, "POST", e.Request.Method)
+	assert.Equal(t, "2025-11-21T19:49:44Z", e.StartedDateTime)
+	assert.Equal(t, []hvac.HARNameValue{{Name: "x", Value: "1"}}, e.Request.QueryString)
+	require.NotNil(t, e.Request.PostData)
+	assert.Equal(t, "<status></status>", e.Request.PostData.DecodedText)
+	assert.Equal(t, 200, e.Response.Status)
+	assert.Equal(t, "application/xml", e.Response.Content.MimeType)
+	assert.InDelta(t, 42.0, e.Time, 0.001)
+	assert.InDelta(t, 40.0, e.Timings.Wait, 0.001)
+}
+
+// TestCapture_RingBuffer verifies that only the newest exchanges are kept, oldest first.
+func TestCapture_RingBuffer(t *testing.T) {
+	c := hvac.NewCapture(hvac.CaptureConfig{BufferSize: 2})
+	c.Record(testExchange("/a"))
+	c.Record(testExchange("/b"))
+	c.Record(testExchange("/c"))
+
+	entries := c.Entries()
+	require.Len(t, entries, 2)
+	assert.Contains(t, entries[0].Request.URL, "/b")
+	assert.Contains(t, entries[1].Request.URL, "/c")
+}
+
+// TestCapture_FilesSameMillisecond verifies that flushes close together
+// each get their own file.
+func TestCapture_FilesSameMillisecond(t *testing.T) {
+	dir := t.TempDir()
+	c := hvac.NewCapture(hvac.CaptureConfig{BufferSize: 10, Dir: dir})
+	for _, p := range []string{"/a", "/b", "/c"} {
+		c.Record(testExchange(p))
+		require.NoError(t, c.Flush())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	assert.Len(t, files, 3)
+}
+
+// TestCapture_Files verifies that HAR files are written, flushed and pruned.
+func TestCapture_Files(t *testing.T) {
+	dir := t.TempDir()
+	c := hvac.NewCapture(hvac.CaptureConfig{BufferSize: 10, Dir: dir, FileEntries: 2, MaxFiles: 1})
+
+	c.Record(testExchange("/a"))
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	assert.Empty(t, files)
+
+	c.Record(testExchange("/b"))
+	files, _ = filepath.Glob(filepath.Join(dir, "*.har"))
+	require.Len(t, files, 1)
+
+	har, err := hvac.ReadHAR(files[0])
+	require.NoError(t, err)
+	assert.Len(t, har.Log.Entries, 2)
+
+	time.Sleep(2 * time.Millisecond)
+	c.Record(testExchange("/c"))
+	require.NoError(t, c.Flush())
+	files, _ = filepath.Glob(filepath.Join(dir, "*.har"))
+	require.Len(t, files, 1)
+
+	har, err = hvac.ReadHAR(files[0])
+	require.NoError(t, err)
+	require.Len(t, har.Log.Entries, 1)
+	assert.Contains(t, har.Log.Entries[0].Request.URL, "/c")
+}
+
+// TestCapture_ServeHTTP verifies that the buffer is served as a HAR download.
+func TestCapture_ServeHTTP(t *testing.T) {
+	c := hvac.NewCapture(hvac.CaptureConfig{Version: "1.2.3"})
+	c.Record(testExchange("/a"))
+
+	rr := httptest.NewRecorder()
+	c.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/capture", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Header().Get("Content-Disposition"), ".har")
+
+	var har hvac.HAR
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &har))
+	assert.Equal(t, "1.2.3", har.Log.Creator.Version)
+	assert.Len(t, har.Log.Entries, 1)
+}
@@ -0,0 +1,56 @@
+package hvac
+
+import (
+	"sync/atomic"
+)
+
+// This file holds the settings injected into the hvac package by the
+// application. Nothing in this package reads the environment directly.
+
+// Config holds the settings used when saving bodies and metrics.
+type Config struct {
+	DataDir        string `yaml:"dataDir"`        // Directory for saved bodies and metrics
+	BlockUpdates   bool   `yaml:"blockUpdates"`   // Remove <update> blocks from saved content
+	ConfigVersions int    `yaml:"configVersions"` // Config document versions kept; 0 keeps the default
+}
+
+// MQTTConfig holds the MQTT connection and publish settings.
+type MQTTConfig struct {
+	Broker            string `yaml:"broker"`            // Broker URL; empty disables MQTT
+	ClientID          string `yaml:"clientID"`          // Client ID; defaults to hvac-proxy-<hostname>
+	User              string `yaml:"user"`              // Optional username
+	Password          string `yaml:"password"`          // Optional password
+	Topic             string `yaml:"topic"`             // Topic for status payloads
+	DiagnosticsTopic  string `yaml:"diagnosticsTopic"`  // Prefix of the per-unit topics for raw diagnostics
+	FaultsTopic       string `yaml:"faultsTopic"`       // Topic for raised and cleared faults
+	AvailabilityTopic string `yaml:"availabilityTopic"` // Topic for online/offline messages
+	QoS               byte   `yaml:"qos"`               // Quality of service for status payloads (0-2)
+	Retained          bool   `yaml:"retained"`          // Retain status payloads on the broker
+	Debug             bool   `yaml:"debug"`             // Log paho client internals
+}
+
+// DefaultMQTTConfig returns the MQTT settings used when nothing is configured.
+func DefaultMQTTConfig() MQTTConfig {
+	return MQTTConfig{
+		Topic:             "hvac/value",
+		DiagnosticsTopic:  "hvac/diagnostics",
+		FaultsTopic:       "hvac/faults",
+		AvailabilityTopic: "hvac/availability",
+	}
+}
+
+var settings atomic.Pointer[Config]
+
+// Configure sets the package settings. It is safe to call while requests
+// are being handled.
+func Configure(cfg Config) {
+	settings.Store(&cfg)
+}
+
+// Settings returns the current package settings.
+func Settings() Config {
+	if cfg := settings.Load(); cfg != nil {
+		return *cfg
+	}
+	return Config{}
+}
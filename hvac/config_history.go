@@ -0,0 +1,244 @@
+package hvac
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file keeps a versioned history of the config documents exchanged
+// with the cloud, so schedules and settings wiped by a dealer or a firmware
+// update can be found and restored. Each distinct document is stored as a
+// numbered XML file next to an index with the time, source and a summary of
+// what changed from the previous version.
+
+// ConfigSnapshot describes a stored version of the config document.
+type ConfigSnapshot struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`  // "thermostat" or "cloud"
+	Hash    string    `json:"hash"`    // SHA-256 of the document without formatting whitespace
+	Changes []string  `json:"changes"` // Differences from the previous version
+}
+
+const (
+	configSnapshotDir     = "config_snapshots"
+	defaultConfigVersions = 200
+	maxConfigChanges      = 20 // Changes listed per version; the rest are counted
+)
+
+// configSnapshotMu serializes updates of the snapshot index.
+var configSnapshotMu sync.Mutex
+
+// ConfigSnapshotDir returns the directory snapshots are kept in.
+func ConfigSnapshotDir(dataDir string) string {
+	return filepath.Join(dataDir, configSnapshotDir)
+}
+
+func configSnapshotFile(dataDir string, version int) string {
+	return filepath.Join(ConfigSnapshotDir(dataDir), strconv.Itoa(version)+".xml")
+}
+
+// ListConfigSnapshots returns the snapshots kept in the data directory,
+// oldest first.
+func ListConfigSnapshots(dataDir string) ([]ConfigSnapshot, error) {
+	data, err := os.ReadFile(filepath.Join(ConfigSnapshotDir(dataDir), "index.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []ConfigSnapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []ConfigSnapshot
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid config snapshot index: %w", err)
+	}
+	return list, nil
+}
+
+// LatestConfigSnapshot returns the newest snapshot in list from source, if
+// any.
+func LatestConfigSnapshot(list []ConfigSnapshot, source string) (ConfigSnapshot, bool) {
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].Source == source {
+			return list[i], true
+		}
+	}
+	return ConfigSnapshot{}, false
+}
+
+// ReadConfigSnapshot returns the document stored as a version.
+func ReadConfigSnapshot(dataDir string, version int) ([]byte, error) {
+	data, err := os.ReadFile(configSnapshotFile(dataDir, version))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no config version %d", version)
+	}
+	return data, err
+}
+
+// snapshotConfig stores a config document as a new version, unless it is
+// the same as the latest one or the latest from the same source. The
+// thermostat's posted config and the cloud's response rarely match, so
+// comparing with the latest alone would store both on every poll. Changes
+// are listed against the latest version from the same source. It returns
+// the new snapshot, or nil.
+func snapshotConfig(data []byte, source string) (*ConfigSnapshot, error) {
+	cfg := Settings()
+	configSnapshotMu.Lock()
+	defer configSnapshotMu.Unlock()
+
+	list, err := ListConfigSnapshots(cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(CanonicalXML(data)))
+	s := ConfigSnapshot{Version: 1, Time: time.Now(), Source: source, Hash: hex.EncodeToString(sum[:]), Changes: []string{"first version"}}
+	if n := len(list); n > 0 {
+		last, ok := LatestConfigSnapshot(list, source)
+		if !ok {
+			last = list[n-1]
+		}
+		if last.Hash == s.Hash || list[n-1].Hash == s.Hash {
+			return nil, nil
+		}
+		s.Version = list[n-1].Version + 1
+		if prev, err := ReadConfigSnapshot(cfg.DataDir, last.Version); err == nil {
+			s.Changes = DiffConfig(prev, data)
+		}
+	}
+
+	if err := os.MkdirAll(ConfigSnapshotDir(cfg.DataDir), 0755); err != nil {
+		return nil, err
+	}
+	if err := WriteFileAtomic(configSnapshotFile(cfg.DataDir, s.Version), data); err != nil {
+		return nil, err
+	}
+	list = append(list, s)
+	keep := cfg.ConfigVersions
+	if keep <= 0 {
+		keep = defaultConfigVersions
+	}
+	for len(list) > keep {
+		_ = os.Remove(configSnapshotFile(cfg.DataDir, list[0].Version))
+		list = list[1:]
+	}
+	index, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &s, WriteFileAtomic(filepath.Join(ConfigSnapshotDir(cfg.DataDir), "index.json"), index)
+}
+
+// recordConfigSnapshot stores a config document from either side, logging
+// new versions.
+func recordConfigSnapshot(data []byte, isRequest bool) {
+	source := "cloud"
+	if isRequest {
+		source = "thermostat"
+	}
+	s, err := snapshotConfig(data, source)
+	switch {
+	case err != nil:
+		log.Printf("[BACKUP] Failed to save config snapshot: %v", err)
+	case s != nil:
+		log.Printf("[BACKUP] Saved config version %d from the %s (%d changes)", s.Version, source, len(s.Changes))
+	}
+}
+
+// DiffConfig summarizes the differences between two config documents, one
+// line per changed value, e.g. "zone[1]/activity[home]/htsp: 68 → 70".
+func DiffConfig(prev, next []byte) []string {
+	before, prevOrder := flattenConfig(prev)
+	after, order := flattenConfig(next)
+	var changes []string
+	for _, path := range order {
+		old, ok := before[path]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("%s: added %s", path, quoteEmpty(after[path])))
+		case old != after[path]:
+			changes = append(changes, fmt.Sprintf("%s: %s → %s", path, quoteEmpty(old), quoteEmpty(after[path])))
+		}
+	}
+	for _, path := range prevOrder {
+		if _, ok := after[path]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: removed (was %s)", path, quoteEmpty(before[path])))
+		}
+	}
+	if len(changes) == 0 {
+		return []string{"no value changes"}
+	}
+	if n := len(changes); n > maxConfigChanges {
+		changes = append(changes[:maxConfigChanges], fmt.Sprintf("and %d more changes", n-maxConfigChanges))
+	}
+	return changes
+}
+
+func quoteEmpty(s string) string {
+	if s == "" {
+		return `""`
+	}
+	return s
+}
+
+// flattenConfig returns the values of a config document by path, and the
+// paths in document order. Elements with an id are named like "zone[1]",
+// and containers of them without one are left out, so a zone's heating set
+// point for home is "zone[1]/activity[home]/htsp".
+func flattenConfig(data []byte) (map[string]string, []string) {
+	values := map[string]string{}
+	var order []string
+	var root xmlNode
+	if xml.Unmarshal(data, &root) != nil {
+		return values, order
+	}
+	join := func(prefix, name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + "/" + name
+	}
+	var walk func(n xmlNode, prefix string)
+	walk = func(n xmlNode, prefix string) {
+		for _, c := range n.Nodes {
+			name := c.XMLName.Local
+			if c.ID != "" {
+				name += "[" + c.ID + "]"
+			}
+			if len(c.Nodes) > 0 {
+				list := c.ID == ""
+				for _, gc := range c.Nodes {
+					list = list && gc.ID != ""
+				}
+				if list {
+					walk(c, prefix)
+				} else {
+					walk(c, join(prefix, name))
+				}
+				continue
+			}
+			path := join(prefix, name)
+			for i := 2; ; i++ {
+				if _, dup := values[path]; !dup {
+					break
+				}
+				path = join(prefix, fmt.Sprintf("%s#%d", name, i))
+			}
+			values[path] = strings.TrimSpace(c.Text)
+			order = append(order, path)
+		}
+	}
+	walk(root, "")
+	return values, order
+}
@@ -0,0 +1,75 @@
+package hvac_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"hvac-proxy/hvac"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDiffConfig verifies the change summary between config documents.
+func TestDiffConfig(t *testing.T) {
+	next := strings.NewReplacer("<htsp>64</htsp>", "<htsp>62</htsp>", "<time>22:00</time>", "<time>21:30</time>", "<mode>heat</mode>", "").Replace(testConfigXML)
+	next = strings.Replace(next, "</zones>", `<zone id="2"><name>Upstairs</name></zone></zones>`, 1)
+
+	assert.Equal(t, []string{
+		"zone[1]/activity[sleep]/htsp: 64 → 62",
+		"zone[1]/day[Monday]/period[2]/time: 22:00 → 21:30",
+		"zone[2]/name: added Upstairs",
+		"mode: removed (was heat)",
+	}, hvac.DiffConfig([]byte(testConfigXML), []byte(next)))
+	assert.Equal(t, []string{"no value changes"}, hvac.DiffConfig([]byte(testConfigXML), []byte(testConfigXML)))
+}
+
+// TestSaveBody_ConfigSnapshots verifies that each distinct config document
+// is stored as a version, and that old versions are pruned.
+func TestSaveBody_ConfigSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	hvac.Configure(hvac.Config{DataDir: dir, ConfigVersions: 2})
+	defer hvac.Configure(hvac.Config{})
+	defer hvac.LoadSystemConfig()
+
+	save := func(body string, isRequest bool) {
+		req := httptest.NewRequest("GET", "/systems/123/config", nil)
+		hvac.SaveBody(req, []byte(body), isRequest)
+	}
+	save(testConfigXML, false)
+	save(strings.ReplaceAll(testConfigXML, "><", ">\n<"), true)
+	list, err := hvac.ListConfigSnapshots(dir)
+	require.NoError(t, err)
+	require.Len(t, list, 1, "formatting is not a change")
+	assert.Equal(t, "cloud", list[0].Source)
+	assert.Equal(t, []string{"first version"}, list[0].Changes)
+
+	// The thermostat and the cloud disagree; each poll cycle stores nothing new
+	living := strings.Replace(testConfigXML, "<name>Main</name>", "<name>Living</name>", 1)
+	for range 3 {
+		save(living, true)
+		save(testConfigXML, false)
+	}
+	list, err = hvac.ListConfigSnapshots(dir)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, 2, list[1].Version)
+	assert.Equal(t, "thermostat", list[1].Source)
+	assert.Equal(t, []string{"zone[1]/name: Main → Living"}, list[1].Changes)
+
+	// Changes are listed against the same source, and old versions pruned
+	save(testConfigXML, true)
+	list, err = hvac.ListConfigSnapshots(dir)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, 2, list[0].Version)
+	assert.Equal(t, 3, list[1].Version)
+	assert.Equal(t, []string{"zone[1]/name: Living → Main"}, list[1].Changes)
+
+	doc, err := hvac.ReadConfigSnapshot(dir, 3)
+	require.NoError(t, err)
+	assert.Equal(t, testConfigXML, string(doc))
+	_, err = hvac.ReadConfigSnapshot(dir, 1)
+	assert.EqualError(t, err, "no config version 1")
+}
@@ -0,0 +1,202 @@
+package hvac
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// This file contains the parser for the raw equipment diagnostics that the
+// thermostat posts for the indoor unit ("idu_raw") and the outdoor unit
+// ("odu_raw"), such as coil temperatures, pressures and motor speeds.
+
+// Diagnostics holds one raw diagnostic document from a unit.
+type Diagnostics struct {
+	Unit   string             `json:"unit"`            // indoor or outdoor
+	Time   time.Time          `json:"time"`            // When the document was received
+	Values map[string]float64 `json:"values"`          // Numeric readings by name, e.g. "suction_pressure"
+	Units  map[string]string  `json:"units,omitempty"` // Unit of measure of readings that state one, e.g. "psi"
+	Info   map[string]string  `json:"info,omitempty"`  // Readings that are not numbers, e.g. "type"
+}
+
+// diagnosticsRoots maps the root element of each document to its unit.
+var diagnosticsRoots = map[string]string{
+	"idu_raw": "indoor",
+	"odu_raw": "outdoor",
+}
+
+// diagnosticValue matches a number with an optional unit, e.g. "118", "-3.5",
+// "72.5F" or "0.5 inH2O".
+var diagnosticValue = regexp.MustCompile(`^([-+]?(?:\d+\.?\d*|\.\d+))\s*([A-Za-z%°][\w%/°]*)?$`)
+
+// ParseDiagnostics parses an idu_raw or odu_raw document. Every leaf element
+// becomes a reading named after its path below the root in snake_case, so
+// <compressor><rpm> becomes "compressor_rpm" and <coilTemp> "coil_temp".
+// Elements with an id attribute have it appended, e.g. "stage_1".
+func ParseDiagnostics(data []byte) (*Diagnostics, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	d := &Diagnostics{Values: map[string]float64{}, Units: map[string]string{}, Info: map[string]string{}}
+
+	var path []string // Names of the open elements below the root
+	var text strings.Builder
+	leaf := false // Whether the innermost open element has no children yet
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse XML: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if d.Unit == "" {
+				unit, ok := diagnosticsRoots[t.Name.Local]
+				if !ok {
+					return nil, fmt.Errorf("not HVAC diagnostics XML")
+				}
+				d.Unit = unit
+				continue
+			}
+			name := snakeCase(t.Name.Local)
+			for _, a := range t.Attr {
+				if a.Name.Local == "id" && a.Value != "" {
+					name += "_" + snakeCase(a.Value)
+				}
+			}
+			path = append(path, name)
+			text.Reset()
+			leaf = true
+		case xml.CharData:
+			if leaf {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if len(path) == 0 {
+				continue
+			}
+			if leaf {
+				d.add(strings.Join(path, "_"), strings.TrimSpace(text.String()))
+			}
+			path = path[:len(path)-1]
+			leaf = false
+		}
+	}
+	if d.Unit == "" {
+		return nil, fmt.Errorf("not HVAC diagnostics XML")
+	}
+	return d, nil
+}
+
+// add records a leaf reading as a number where it is one.
+func (d *Diagnostics) add(name, value string) {
+	if value == "" {
+		return
+	}
+	if m := diagnosticValue.FindStringSubmatch(value); m != nil {
+		if v, err := strconv.ParseFloat(m[1], 64); err == nil {
+			d.Values[name] = v
+			if m[2] != "" {
+				d.Units[name] = m[2]
+			}
+			return
+		}
+	}
+	d.Info[name] = value
+}
+
+// snakeCase converts an element name such as "coilTemp" or "Suction-Press"
+// to "coil_temp" or "suction_press".
+func snakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		switch {
+		case unicode.IsUpper(r):
+			// Start a word at a lower-to-upper change, or at the last capital
+			// of an acronym, e.g. "EEVPosition" is "eev_position"
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return strings.Trim(b.String(), "_")
+}
+
+// diagnostics holds the latest document per unit.
+var (
+	diagnosticsMu sync.RWMutex
+	diagnostics   = map[string]Diagnostics{}
+)
+
+// saveDiagnostics parses a diagnostics document, keeps it as the latest for
+// its unit and publishes it for sinks and subscribers.
+func saveDiagnostics(ctx context.Context, data []byte) (err error) {
+	ctx, span := StartSpan(ctx, "parse diagnostics", SpanInternal)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
+	d, err := ParseDiagnostics(data)
+	if err != nil {
+		return err
+	}
+	d.Time = time.Now()
+	span.SetAttr("hvac.unit", d.Unit)
+
+	diagnosticsMu.Lock()
+	diagnostics[d.Unit] = *d
+	diagnosticsMu.Unlock()
+	Events.PublishContext(ctx, "diagnostics", *d)
+	return nil
+}
+
+// LatestDiagnostics returns the latest document of each unit, indoor first.
+func LatestDiagnostics() []Diagnostics {
+	diagnosticsMu.RLock()
+	defer diagnosticsMu.RUnlock()
+	out := []Diagnostics{}
+	for _, unit := range []string{"indoor", "outdoor"} {
+		if d, ok := diagnostics[unit]; ok {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// DiagnosticsMetrics renders the latest numeric readings of each unit.
+func DiagnosticsMetrics() string {
+	var b strings.Builder
+	latest := LatestDiagnostics()
+	b.WriteString("# HELP hvac_equipment_diagnostic latest raw diagnostic reading by unit and name\n")
+	b.WriteString("# TYPE hvac_equipment_diagnostic gauge\n")
+	for _, d := range latest {
+		for _, name := range slices.Sorted(maps.Keys(d.Values)) {
+			b.WriteString(fmt.Sprintf("hvac_equipment_diagnostic{unit=%q,name=%q,units=%q} %s\n",
+				d.Unit, name, d.Units[name], strconv.FormatFloat(d.Values[name], 'f', -1, 64)))
+		}
+	}
+	b.WriteString("# HELP hvac_equipment_diagnostic_timestamp_seconds time the latest diagnostics of each unit were received\n")
+	b.WriteString("# TYPE hvac_equipment_diagnostic_timestamp_seconds gauge\n")
+	for _, d := range latest {
+		b.WriteString(fmt.Sprintf("hvac_equipment_diagnostic_timestamp_seconds{unit=%q} %d\n", d.Unit, d.Time.Unix()))
+	}
+	return b.String()
+}
@@ -0,0 +1,81 @@
+package hvac_test
+
+import (
+	"bytes"
+	"hvac-proxy/hvac"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testODURawXML = `<odu_raw version="1.2"><type>varcaphp</type><opmode>heat</opmode><stage>3</stage>
+<oat>28</oat><coilTemp>24.5F</coilTemp><dischargeTemp>151</dischargeTemp><suctionPressure>82 psi</suctionPressure>
+<compressor><rpm>3900</rpm><current>11.2A</current></compressor><EEVPosition>212</EEVPosition>
+<fan id="1"><rpm>640</rpm></fan><fault></fault></odu_raw>`
+
+// TestParseDiagnostics verifies that every leaf becomes a named reading.
+func TestParseDiagnostics(t *testing.T) {
+	d, err := hvac.ParseDiagnostics([]byte(testODURawXML))
+	require.NoError(t, err)
+
+	assert.Equal(t, "outdoor", d.Unit)
+	assert.Equal(t, map[string]float64{
+		"stage":              3,
+		"oat":                28,
+		"coil_temp":          24.5,
+		"discharge_temp":     151,
+		"suction_pressure":   82,
+		"compressor_rpm":     3900,
+		"compressor_current": 11.2,
+		"eev_position":       212,
+		"fan_1_rpm":          640,
+	}, d.Values)
+	assert.Equal(t, map[string]string{"coil_temp": "F", "suction_pressure": "psi", "compressor_current": "A"}, d.Units)
+	assert.Equal(t, map[string]string{"type": "varcaphp", "opmode": "heat"}, d.Info)
+}
+
+// TestParseDiagnostics_NotDiagnostics verifies that other documents are rejected.
+func TestParseDiagnostics_NotDiagnostics(t *testing.T) {
+	_, err := hvac.ParseDiagnostics([]byte(`<status><oat>40</oat></status>`))
+	assert.ErrorContains(t, err, "not HVAC diagnostics XML")
+	_, err = hvac.ParseDiagnostics([]byte(`<idu_raw><blower>`))
+	assert.Error(t, err)
+}
+
+// TestSaveBody_Diagnostics verifies that posted diagnostics are kept,
+// published and exposed as metrics.
+func TestSaveBody_Diagnostics(t *testing.T) {
+	hvac.Configure(hvac.Config{DataDir: t.TempDir()})
+	defer hvac.Configure(hvac.Config{})
+	_, events, cancel := hvac.Events.Subscribe(0)
+	defer cancel()
+
+	body := []byte(`<idu_raw version="1.2"><type>furnace</type><blowerRPM>1050</blowerRPM><staticPressure>0.52 inH2O</staticPressure><cfm>875</cfm></idu_raw>`)
+	req, _ := http.NewRequest("POST", "/systems/1234/idu_raw", bytes.NewBuffer(body))
+	hvac.SaveBody(req, body, true)
+	req, _ = http.NewRequest("POST", "/systems/1234/odu_raw", bytes.NewBufferString(testODURawXML))
+	hvac.SaveBody(req, []byte(testODURawXML), false)
+	require.True(t, hvac.FlushSinks(time.Second))
+
+	e := <-events
+	assert.Equal(t, "diagnostics", e.Type)
+	indoor := e.Data.(hvac.Diagnostics)
+	assert.Equal(t, "indoor", indoor.Unit)
+	assert.Equal(t, 1050.0, indoor.Values["blower_rpm"])
+
+	latest := hvac.LatestDiagnostics()
+	require.NotEmpty(t, latest)
+	assert.Equal(t, "indoor", latest[0].Unit)
+	assert.WithinDuration(t, time.Now(), latest[0].Time, time.Minute)
+	for _, d := range latest {
+		assert.NotEqual(t, "outdoor", d.Unit, "response bodies are not parsed")
+	}
+
+	metrics := hvac.DiagnosticsMetrics()
+	assert.Contains(t, metrics, `hvac_equipment_diagnostic{unit="indoor",name="static_pressure",units="inH2O"} 0.52`)
+	assert.Contains(t, metrics, `hvac_equipment_diagnostic{unit="indoor",name="cfm",units=""} 875`)
+	assert.Contains(t, metrics, `hvac_equipment_diagnostic_timestamp_seconds{unit="indoor"}`)
+}
@@ -0,0 +1,265 @@
+package hvac
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains the model of the energy document, in which the
+// thermostat reports energy use per period (such as today, this month or
+// this year) and per component (such as cooling, fan or electric heat).
+// The last report of each day is kept on disk for comparing months.
+
+// EnergyUsage is an energy document.
+type EnergyUsage struct {
+	Time    time.Time      `json:"time"` // When the document was received
+	Periods []EnergyPeriod `json:"periods"`
+}
+
+// EnergyPeriod is the energy used within a reporting period.
+type EnergyPeriod struct {
+	ID    string             `json:"id"`    // As reported, e.g. "day1", "month1" or "year1"
+	Usage map[string]float64 `json:"usage"` // By component, e.g. "cooling"; electric use is in kWh
+}
+
+// Period returns the period with the given ID, or nil.
+func (u *EnergyUsage) Period(id string) *EnergyPeriod {
+	for i := range u.Periods {
+		if u.Periods[i].ID == id {
+			return &u.Periods[i]
+		}
+	}
+	return nil
+}
+
+// energyComponents maps the element names of the energy document to
+// component names.
+var energyComponents = map[string]string{
+	"hpheat":   "heating",
+	"heat":     "heating",
+	"eheat":    "electric_heat",
+	"cooling":  "cooling",
+	"fan":      "fan",
+	"fangas":   "fan_gas",
+	"gas":      "gas",
+	"reheat":   "reheat",
+	"looppump": "loop_pump",
+	"hotwater": "hot_water",
+}
+
+// ParseEnergy parses an energy document. Each period element with an id
+// lists a component per child element; names the catalog does not know are
+// kept in snake_case.
+func ParseEnergy(data []byte) (*EnergyUsage, error) {
+	s := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(s, "<energy") {
+		return nil, fmt.Errorf("not HVAC energy XML")
+	}
+	var root xmlNode
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal XML: %w", err)
+	}
+	u := &EnergyUsage{Periods: []EnergyPeriod{}}
+	var walk func(n xmlNode)
+	walk = func(n xmlNode) {
+		if n.XMLName.Local == "period" && n.ID != "" {
+			p := EnergyPeriod{ID: n.ID, Usage: map[string]float64{}}
+			for _, c := range n.Nodes {
+				v, err := strconv.ParseFloat(strings.TrimSpace(c.Text), 64)
+				if err != nil || len(c.Nodes) > 0 {
+					continue
+				}
+				name, ok := energyComponents[strings.ToLower(c.XMLName.Local)]
+				if !ok {
+					name = snakeCase(c.XMLName.Local)
+				}
+				p.Usage[name] += v
+			}
+			u.Periods = append(u.Periods, p)
+			return
+		}
+		for _, c := range n.Nodes {
+			walk(c)
+		}
+	}
+	walk(root)
+	return u, nil
+}
+
+// EnergyLog keeps the latest energy report, the last report of each day and
+// running totals per component.
+type EnergyLog struct {
+	days int
+
+	mu      sync.Mutex
+	latest  *EnergyUsage
+	daily   []EnergyUsage      // Last report of each day, oldest first
+	today   map[string]float64 // Latest "day1" usage, to find what was added
+	totals  map[string]float64 // Usage counted since startup
+	changed bool               // Whether daily has changes not yet saved
+}
+
+// NewEnergyLog creates a log that keeps the given number of days.
+func NewEnergyLog(days int) *EnergyLog {
+	return &EnergyLog{days: days, totals: map[string]float64{}}
+}
+
+// EnergyHistory holds the energy reports of the last 400 days, so months can
+// be compared with the utility bill.
+var EnergyHistory = NewEnergyLog(400)
+
+// energyFile is where the daily reports are kept in the data directory.
+const energyFile = "energy_history.json"
+
+// Add records a report. Totals grow by the increase of the "day1" period,
+// or by its whole value when it went down because a new day started.
+func (l *EnergyLog) Add(u EnergyUsage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.latest = &u
+
+	if day := u.Period("day1"); day != nil {
+		for c, v := range day.Usage {
+			switch prev, ok := l.today[c]; {
+			case l.today == nil:
+				l.totals[c] += 0 // Counted from the next report on
+			case ok && v < prev:
+				l.totals[c] += v
+			default:
+				l.totals[c] += v - prev
+			}
+		}
+		l.today = day.Usage
+	}
+
+	y, m, d := u.Time.Date()
+	if n := len(l.daily); n > 0 {
+		ly, lm, ld := l.daily[n-1].Time.Date()
+		if ly == y && lm == m && ld == d {
+			l.daily[n-1] = u
+			l.changed = true
+			return
+		}
+	}
+	l.daily = appendRing(l.daily, u, l.days)
+	l.changed = true
+}
+
+// Latest returns the latest report, or nil before one has been received.
+func (l *EnergyLog) Latest() *EnergyUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.latest
+}
+
+// Since returns the last report of each day from t on, oldest first.
+func (l *EnergyLog) Since(t time.Time) []EnergyUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []EnergyUsage{}
+	for _, u := range l.daily {
+		if !u.Time.Before(t) {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// Save writes the daily reports to path if they changed.
+func (l *EnergyLog) Save(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.changed {
+		return nil
+	}
+	data, err := json.Marshal(l.daily)
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(path, data); err != nil {
+		return err
+	}
+	l.changed = false
+	return nil
+}
+
+// Load replaces the daily reports with those saved at path, and makes the
+// newest the latest report. A missing file leaves the log empty.
+func (l *EnergyLog) Load(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.latest, l.daily, l.today, l.changed = nil, nil, nil, false
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &l.daily); err != nil {
+		l.daily = nil
+		return fmt.Errorf("invalid energy history %s: %w", path, err)
+	}
+	if n := len(l.daily); n > 0 {
+		latest := l.daily[n-1]
+		l.latest = &latest
+	}
+	return nil
+}
+
+// Metrics renders the latest usage per period and component, and the usage
+// counted since startup per component.
+func (l *EnergyLog) Metrics() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("# HELP hvac_energy_usage energy used per reporting period and component in the latest report\n")
+	b.WriteString("# TYPE hvac_energy_usage gauge\n")
+	if l.latest != nil {
+		for _, p := range l.latest.Periods {
+			for _, c := range slices.Sorted(maps.Keys(p.Usage)) {
+				b.WriteString(fmt.Sprintf("hvac_energy_usage{period=%q,component=%q} %s\n", p.ID, c, strconv.FormatFloat(p.Usage[c], 'f', -1, 64)))
+			}
+		}
+	}
+	b.WriteString("# HELP hvac_energy_used_total energy used per component, counted from today's usage since startup\n")
+	b.WriteString("# TYPE hvac_energy_used_total counter\n")
+	for _, c := range slices.Sorted(maps.Keys(l.totals)) {
+		b.WriteString(fmt.Sprintf("hvac_energy_used_total{component=%q} %s\n", c, strconv.FormatFloat(l.totals[c], 'f', -1, 64)))
+	}
+	return b.String()
+}
+
+// LoadEnergy reads the daily energy reports saved in the data directory.
+func LoadEnergy() error {
+	return EnergyHistory.Load(filepath.Join(Settings().DataDir, energyFile))
+}
+
+// saveEnergy parses an energy document, records it and publishes it for
+// sinks and subscribers.
+func saveEnergy(ctx context.Context, data []byte) (err error) {
+	ctx, span := StartSpan(ctx, "parse energy", SpanInternal)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
+	u, err := ParseEnergy(data)
+	if err != nil {
+		return err
+	}
+	u.Time = time.Now()
+	EnergyHistory.Add(*u)
+	Events.PublishContext(ctx, "energy", *u)
+	return EnergyHistory.Save(filepath.Join(Settings().DataDir, energyFile))
+}
@@ -0,0 +1,91 @@
+package hvac_test
+
+import (
+	"bytes"
+	"hvac-proxy/hvac"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testEnergyXML = `<energy version="1.9">
+<usage>
+<period id="day1"><hpheat>4.5</hpheat><eheat>1.25</eheat><cooling>0</cooling><fan>0.75</fan><hotWater>0.5</hotWater><units>kWh</units></period>
+<period id="month1"><hpheat>120</hpheat><eheat>18</eheat><cooling>2</cooling><fan>21.5</fan><hotWater>9</hotWater></period>
+</usage>
+</energy>`
+
+// TestParseEnergy verifies that components are named and non-numeric
+// elements are skipped.
+func TestParseEnergy(t *testing.T) {
+	u, err := hvac.ParseEnergy([]byte(testEnergyXML))
+	require.NoError(t, err)
+	require.Len(t, u.Periods, 2)
+	assert.Equal(t, hvac.EnergyPeriod{ID: "day1", Usage: map[string]float64{
+		"heating": 4.5, "electric_heat": 1.25, "cooling": 0, "fan": 0.75, "hot_water": 0.5,
+	}}, u.Periods[0])
+	assert.Equal(t, 21.5, u.Period("month1").Usage["fan"])
+	assert.Nil(t, u.Period("year1"))
+
+	_, err = hvac.ParseEnergy([]byte(`<status></status>`))
+	assert.Error(t, err)
+}
+
+// TestEnergyLog_Totals verifies that totals count what was added to today's
+// usage, starting over when the day rolls over.
+func TestEnergyLog_Totals(t *testing.T) {
+	l := hvac.NewEnergyLog(10)
+	day := func(at time.Time, fan float64) hvac.EnergyUsage {
+		return hvac.EnergyUsage{Time: at, Periods: []hvac.EnergyPeriod{{ID: "day1", Usage: map[string]float64{"fan": fan}}}}
+	}
+	start := time.Date(2026, 3, 1, 22, 0, 0, 0, time.Local)
+	l.Add(day(start, 2))
+	assert.Contains(t, l.Metrics(), `hvac_energy_used_total{component="fan"} 0`+"\n")
+	l.Add(day(start.Add(time.Hour), 3))
+	l.Add(day(start.Add(3*time.Hour), 0.5))
+	assert.Contains(t, l.Metrics(), `hvac_energy_used_total{component="fan"} 1.5`+"\n")
+	assert.Contains(t, l.Metrics(), `hvac_energy_usage{period="day1",component="fan"} 0.5`+"\n")
+
+	// One report is kept per day
+	daily := l.Since(time.Time{})
+	require.Len(t, daily, 2)
+	assert.Equal(t, 3.0, daily[0].Period("day1").Usage["fan"])
+	assert.Len(t, l.Since(start.Add(2*time.Hour)), 1)
+}
+
+// TestSaveBody_Energy verifies that energy reports are recorded, published
+// and survive a restart.
+func TestSaveBody_Energy(t *testing.T) {
+	dir := t.TempDir()
+	hvac.Configure(hvac.Config{DataDir: dir})
+	defer hvac.Configure(hvac.Config{})
+	require.NoError(t, hvac.LoadEnergy())
+	defer hvac.LoadEnergy()
+	_, events, cancel := hvac.Events.Subscribe(0)
+	defer cancel()
+
+	req, _ := http.NewRequest("POST", "/systems/2714W012345/energy", bytes.NewBufferString(testEnergyXML))
+	hvac.SaveBody(req, []byte(testEnergyXML), true)
+	u := hvac.EnergyHistory.Latest()
+	require.NotNil(t, u)
+	assert.WithinDuration(t, time.Now(), u.Time, time.Minute)
+	assert.Contains(t, hvac.EnergyHistory.Metrics(), `hvac_energy_usage{period="month1",component="electric_heat"} 18`)
+
+	e := <-events
+	assert.Equal(t, "energy", e.Type)
+	assert.IsType(t, hvac.EnergyUsage{}, e.Data)
+
+	require.FileExists(t, filepath.Join(dir, "energy_history.json"))
+	require.NoError(t, hvac.LoadEnergy())
+	require.NotNil(t, hvac.EnergyHistory.Latest())
+	assert.Equal(t, 120.0, hvac.EnergyHistory.Latest().Period("month1").Usage["heating"])
+
+	// Responses and other documents are not energy reports
+	hvac.SaveBody(req, []byte(strings.Replace(testEnergyXML, "4.5", "9", 1)), false)
+	assert.Equal(t, 4.5, hvac.EnergyHistory.Latest().Period("day1").Usage["heating"])
+}
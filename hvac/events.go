@@ -0,0 +1,155 @@
+package hvac
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains the event bus that pushes parsed status documents and
+// other updates to live subscribers such as the "/api/v1/stream" endpoint,
+// and to the registered sinks. Recent events are kept in a ring buffer so
+// reconnecting clients can replay what they missed.
+
+// Event is a typed update delivered to subscribers.
+type Event struct {
+	ID   uint64    `json:"id"`   // Increases by one per event, starting at 1
+	Type string    `json:"type"` // status, systemconfig, diagnostics, inventory, fault, energy, config, event, alert or control
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+
+	ctx context.Context // Context of the request that produced the event, if any
+}
+
+// Context returns the context the event was published with, which carries
+// the trace of the request that produced it. It is never cancelled.
+func (e Event) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// Alert is the data of an "alert" event: a condition that needs attention,
+// or the end of one.
+type Alert struct {
+	Source   string `json:"source"`   // What raised the alert, e.g. "breaker/host" or "sink/mqtt"
+	Severity string `json:"severity"` // info, warning or critical
+	Active   bool   `json:"active"`   // False when the condition has cleared
+	Message  string `json:"message"`
+}
+
+// EventBus fans events out to subscribers and remembers the most recent ones.
+type EventBus struct {
+	size int
+
+	mu     sync.Mutex
+	nextID uint64
+	ring   []Event
+	subs   map[chan Event]struct{}
+	sinks  map[string]*sinkRunner
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind before it
+// is dropped. Dropped subscribers reconnect and replay from the ring.
+const subscriberBuffer = 64
+
+// NewEventBus creates a bus that keeps the last size events for replay.
+func NewEventBus(size int) *EventBus {
+	return &EventBus{size: size, nextID: 1, subs: map[chan Event]struct{}{}}
+}
+
+// Events carries status documents, config changes, events, alerts and
+// control results to live subscribers and sinks.
+var Events = NewEventBus(256)
+
+// Publish assigns the next ID to an event and delivers it to subscribers and
+// sinks. Data must not be modified afterwards.
+func (b *EventBus) Publish(typ string, data any) Event {
+	return b.PublishContext(context.Background(), typ, data)
+}
+
+// PublishContext is like Publish, and keeps ctx, without its cancellation,
+// so sinks can trace their work as part of the request that produced the
+// event.
+func (b *EventBus) PublishContext(ctx context.Context, typ string, data any) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := Event{ID: b.nextID, Type: typ, Time: time.Now(), Data: data, ctx: context.WithoutCancel(ctx)}
+	b.nextID++
+	if len(b.ring) >= b.size {
+		b.ring = append(b.ring[:0], b.ring[len(b.ring)-b.size+1:]...)
+	}
+	b.ring = append(b.ring, e)
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// Too slow; close so the client reconnects and replays.
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	for _, r := range b.sinks {
+		r.offer(e)
+	}
+	return e
+}
+
+// Subscribe returns the buffered events after lastID followed by a channel of
+// new events. With lastID zero nothing is replayed. A lastID ahead of the bus,
+// left over from before a restart, replays the whole buffer. The channel is
+// closed when cancel is called or the subscriber falls too far behind.
+func (b *EventBus) Subscribe(lastID uint64) (replay []Event, ch <-chan Event, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastID >= b.nextID {
+		lastID = 0
+		replay = append(replay, b.ring...)
+	} else if lastID > 0 {
+		for _, e := range b.ring {
+			if e.ID > lastID {
+				replay = append(replay, e)
+			}
+		}
+	}
+
+	c := make(chan Event, subscriberBuffer)
+	b.subs[c] = struct{}{}
+	cancel = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[c]; ok {
+			delete(b.subs, c)
+			close(c)
+		}
+	}
+	return replay, c, cancel
+}
+
+// Subscribers returns the number of live subscribers.
+func (b *EventBus) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// Metrics renders the subscriber gauge and event counter for "/metrics".
+func (b *EventBus) Metrics() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString("# HELP hvac_proxy_stream_subscribers live event stream subscribers\n")
+	sb.WriteString("# TYPE hvac_proxy_stream_subscribers gauge\n")
+	sb.WriteString(fmt.Sprintf("hvac_proxy_stream_subscribers %d\n", len(b.subs)))
+	sb.WriteString("# HELP hvac_proxy_stream_events_total events published to the stream\n")
+	sb.WriteString("# TYPE hvac_proxy_stream_events_total counter\n")
+	sb.WriteString(fmt.Sprintf("hvac_proxy_stream_events_total %d\n", b.nextID-1))
+	return sb.String()
+}
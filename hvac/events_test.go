@@ -0,0 +1,76 @@
+package hvac_test
+
+import (
+	"hvac-proxy/hvac"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func eventIDs(events []hvac.Event) []uint64 {
+	var ids []uint64
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestEventBus_Replay(t *testing.T) {
+	bus := hvac.NewEventBus(3)
+	for i := range 5 {
+		bus.Publish("event", i)
+	}
+
+	replay, _, cancel := bus.Subscribe(0)
+	cancel()
+	assert.Empty(t, replay, "new subscribers start with live events")
+
+	replay, _, cancel = bus.Subscribe(3)
+	cancel()
+	assert.Equal(t, []uint64{4, 5}, eventIDs(replay))
+
+	replay, _, cancel = bus.Subscribe(1)
+	cancel()
+	assert.Equal(t, []uint64{3, 4, 5}, eventIDs(replay), "only the ring is replayed")
+
+	replay, _, cancel = bus.Subscribe(99)
+	cancel()
+	assert.Equal(t, []uint64{3, 4, 5}, eventIDs(replay), "IDs from before a restart replay everything")
+}
+
+func TestEventBus_Live(t *testing.T) {
+	bus := hvac.NewEventBus(10)
+	_, events, cancel := bus.Subscribe(0)
+	assert.Equal(t, 1, bus.Subscribers())
+
+	bus.Publish("status", hvac.Status{OAT: 50})
+	e := <-events
+	assert.Equal(t, uint64(1), e.ID)
+	assert.Equal(t, "status", e.Type)
+	assert.Equal(t, 50.0, e.Data.(hvac.Status).OAT)
+
+	cancel()
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+	assert.Equal(t, 0, bus.Subscribers())
+	assert.Contains(t, bus.Metrics(), "hvac_proxy_stream_events_total 1\n")
+}
+
+func TestEventBus_DropsSlowSubscribers(t *testing.T) {
+	bus := hvac.NewEventBus(10)
+	_, events, cancel := bus.Subscribe(0)
+	defer cancel()
+
+	for i := range 100 {
+		bus.Publish("event", i)
+	}
+	n := 0
+	for range events {
+		n++
+	}
+	require.Positive(t, n)
+	assert.Less(t, n, 100, "channel closed once the subscriber fell behind")
+	assert.Equal(t, 0, bus.Subscribers())
+}
@@ -0,0 +1,317 @@
+package hvac
+
+import (
+	"context"
+	_ "embed"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// This file decodes the equipment events the thermostat posts, which carry
+// numeric fault codes, using a catalog of what each code means. Faults are
+// tracked as raised or cleared, and each change is published as a "fault"
+// event.
+
+// FaultInfo describes a fault code.
+type FaultInfo struct {
+	Description string `yaml:"description" json:"description"`
+	Severity    string `yaml:"severity" json:"severity"` // info, warning or critical
+	Device      string `yaml:"device" json:"device"`     // Device reporting the code when the event names none
+	Action      string `yaml:"action" json:"action"`     // Suggested next step
+}
+
+// FaultCatalog maps fault codes to their descriptions.
+type FaultCatalog map[string]FaultInfo
+
+//go:embed faults.yaml
+var defaultFaultCatalog []byte
+
+// ParseFaultCatalog parses a YAML catalog of fault codes.
+func ParseFaultCatalog(data []byte) (FaultCatalog, error) {
+	var c FaultCatalog
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid fault catalog: %w", err)
+	}
+	for code, info := range c {
+		switch info.Severity {
+		case "info", "warning", "critical":
+		case "":
+			info.Severity = "warning"
+			c[code] = info
+		default:
+			return nil, fmt.Errorf("invalid fault catalog: code %s: severity must be info, warning or critical, got %q", code, info.Severity)
+		}
+	}
+	return c, nil
+}
+
+// DefaultFaultCatalog returns the built-in catalog.
+func DefaultFaultCatalog() FaultCatalog {
+	c, err := ParseFaultCatalog(defaultFaultCatalog)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// Lookup describes a code, falling back to a generic warning for codes the
+// catalog does not know.
+func (c FaultCatalog) Lookup(code string) FaultInfo {
+	if info, ok := c[code]; ok {
+		return info
+	}
+	return FaultInfo{Description: "Unknown fault code " + code, Severity: "warning"}
+}
+
+// Fault is a decoded fault and its state.
+type Fault struct {
+	Code        string    `json:"code"`
+	Device      string    `json:"device"`
+	Description string    `json:"description"`
+	Severity    string    `json:"severity"`
+	Action      string    `json:"action,omitempty"`
+	Active      bool      `json:"active"`
+	Raised      time.Time `json:"raised"`
+	Cleared     time.Time `json:"cleared,omitzero"`
+}
+
+// String describes the fault for logs and the dashboard, e.g. "Limit
+// circuit lockout (code 13) on furnace raised".
+func (f Fault) String() string {
+	state := "cleared"
+	if f.Active {
+		state = "raised"
+	}
+	return fmt.Sprintf("%s (code %s) on %s %s", f.Description, f.Code, f.Device, state)
+}
+
+// equipmentEvent is an entry of the equipment events document. Devices name
+// the fields in different ways, so a few spellings are accepted.
+type equipmentEvent struct {
+	Code      string `xml:"code"`
+	FaultCode string `xml:"faultCode"`
+	Device    string `xml:"device"`
+	Source    string `xml:"source"`
+	Active    string `xml:"active"`
+	State     string `xml:"state"`
+	Timestamp string `xml:"timestamp"`
+	Time      string `xml:"time"`
+}
+
+// equipmentEvents is the equipment events document.
+type equipmentEvents struct {
+	Events []equipmentEvent `xml:"event"`
+}
+
+// eventTimeLayouts are the timestamp formats seen in equipment events.
+var eventTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05"}
+
+// FaultReport is a fault reported by an equipment events document.
+type FaultReport struct {
+	Code   string
+	Device string // Empty when the event does not name one
+	Active bool
+	Time   time.Time // Zero when the event has no usable timestamp
+}
+
+// ParseEquipmentEvents parses an equipment events document.
+func ParseEquipmentEvents(data []byte) ([]FaultReport, error) {
+	s := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(s, "<equipment_events") && !strings.HasPrefix(s, "<equipmentEvents") {
+		return nil, fmt.Errorf("not HVAC equipment events XML")
+	}
+	var doc equipmentEvents
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal XML: %w", err)
+	}
+	var reports []FaultReport
+	for _, e := range doc.Events {
+		r := FaultReport{
+			Code:   strings.TrimSpace(firstOf(e.Code, e.FaultCode)),
+			Device: strings.TrimSpace(firstOf(e.Device, e.Source)),
+			Active: true,
+		}
+		if r.Code == "" {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(firstOf(e.Active, e.State))) {
+		case "false", "off", "0", "cleared", "inactive", "clear":
+			r.Active = false
+		}
+		ts := strings.TrimSpace(firstOf(e.Timestamp, e.Time))
+		for _, layout := range eventTimeLayouts {
+			if t, err := time.ParseInLocation(layout, ts, time.Local); err == nil {
+				r.Time = t
+				break
+			}
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+// firstOf returns the first non-empty string.
+func firstOf(a, b string) string {
+	if a != "" {
+		return a
+	}
+	return b
+}
+
+// FaultTracker keeps the active faults and the recent history of raised and
+// cleared faults.
+type FaultTracker struct {
+	historySize int
+
+	mu      sync.Mutex
+	catalog FaultCatalog
+	active  map[string]Fault // By device and code
+	history []Fault          // Oldest first
+	raised  map[string]int   // Faults raised by severity
+}
+
+// NewFaultTracker creates a tracker that keeps historySize faults.
+func NewFaultTracker(catalog FaultCatalog, historySize int) *FaultTracker {
+	return &FaultTracker{historySize: historySize, catalog: catalog, active: map[string]Fault{}, raised: map[string]int{}}
+}
+
+// Faults tracks the faults reported by the thermostat.
+var Faults = NewFaultTracker(DefaultFaultCatalog(), 200)
+
+// SetCatalog replaces the catalog used for faults reported from now on.
+func (t *FaultTracker) SetCatalog(c FaultCatalog) {
+	t.mu.Lock()
+	t.catalog = c
+	t.mu.Unlock()
+}
+
+// Report applies reported faults, returning those whose state changed:
+// newly raised faults and cleared active ones. Repeats are ignored.
+func (t *FaultTracker) Report(reports []FaultReport) []Fault {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var changed []Fault
+	for _, r := range reports {
+		info := t.catalog.Lookup(r.Code)
+		device := firstOf(r.Device, info.Device)
+		if device == "" {
+			device = "system"
+		}
+		at := r.Time
+		if at.IsZero() {
+			at = time.Now()
+		}
+		key := device + "/" + r.Code
+		f, isActive := t.active[key]
+		switch {
+		case r.Active && !isActive:
+			f = Fault{Code: r.Code, Device: device, Description: info.Description, Severity: info.Severity, Action: info.Action, Active: true, Raised: at}
+			t.active[key] = f
+			t.raised[f.Severity]++
+		case !r.Active && isActive:
+			delete(t.active, key)
+			f.Active, f.Cleared = false, at
+		default:
+			continue
+		}
+		t.history = appendRing(t.history, f, t.historySize)
+		changed = append(changed, f)
+	}
+	return changed
+}
+
+// Active returns the active faults, most severe and then oldest first.
+func (t *FaultTracker) Active() []Fault {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := slices.Collect(maps.Values(t.active))
+	slices.SortFunc(out, func(a, b Fault) int {
+		if d := severityRank(b.Severity) - severityRank(a.Severity); d != 0 {
+			return d
+		}
+		return a.Raised.Compare(b.Raised)
+	})
+	if out == nil {
+		out = []Fault{}
+	}
+	return out
+}
+
+// History returns the recently raised and cleared faults, newest first.
+func (t *FaultTracker) History() []Fault {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]Fault, len(t.history))
+	for i, f := range t.history {
+		out[len(out)-1-i] = f
+	}
+	return out
+}
+
+// Metrics renders the active and raised fault counts by severity.
+func (t *FaultTracker) Metrics() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	active := map[string]int{}
+	for _, f := range t.active {
+		active[f.Severity]++
+	}
+	var b strings.Builder
+	b.WriteString("# HELP hvac_active_faults equipment faults currently active by severity\n")
+	b.WriteString("# TYPE hvac_active_faults gauge\n")
+	for _, s := range []string{"info", "warning", "critical"} {
+		b.WriteString(fmt.Sprintf("hvac_active_faults{severity=%q} %d\n", s, active[s]))
+	}
+	b.WriteString("# HELP hvac_faults_raised_total equipment faults raised by severity\n")
+	b.WriteString("# TYPE hvac_faults_raised_total counter\n")
+	for _, s := range []string{"info", "warning", "critical"} {
+		b.WriteString(fmt.Sprintf("hvac_faults_raised_total{severity=%q} %d\n", s, t.raised[s]))
+	}
+	return b.String()
+}
+
+func severityRank(s string) int {
+	switch s {
+	case "critical":
+		return 2
+	case "warning":
+		return 1
+	}
+	return 0
+}
+
+// appendRing appends v, dropping the oldest entry once s holds size entries.
+func appendRing[T any](s []T, v T, size int) []T {
+	if len(s) >= size {
+		s = append(s[:0], s[len(s)-size+1:]...)
+	}
+	return append(s, v)
+}
+
+// saveFaults decodes an equipment events document and publishes a "fault"
+// event for each fault raised or cleared.
+func saveFaults(ctx context.Context, data []byte) (err error) {
+	ctx, span := StartSpan(ctx, "parse equipment events", SpanInternal)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
+	reports, err := ParseEquipmentEvents(data)
+	if err != nil {
+		return err
+	}
+	for _, f := range Faults.Report(reports) {
+		log.Printf("[FAULT] %s", f)
+		Events.PublishContext(ctx, "fault", f)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package hvac_test
+
+import (
+	"bytes"
+	"hvac-proxy/hvac"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDefaultFaultCatalog verifies that the built-in catalog loads.
+func TestDefaultFaultCatalog(t *testing.T) {
+	c := hvac.DefaultFaultCatalog()
+	info := c.Lookup("13")
+	assert.Equal(t, "Limit circuit lockout", info.Description)
+	assert.Equal(t, "critical", info.Severity)
+	assert.Equal(t, "furnace", info.Device)
+	assert.NotEmpty(t, info.Action)
+
+	assert.Equal(t, hvac.FaultInfo{Description: "Unknown fault code 999", Severity: "warning"}, c.Lookup("999"))
+}
+
+// TestParseFaultCatalog verifies defaults and validation of catalog files.
+func TestParseFaultCatalog(t *testing.T) {
+	c, err := hvac.ParseFaultCatalog([]byte("\"77\":\n  description: Condensate overflow\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "warning", c.Lookup("77").Severity, "severity defaults to warning")
+
+	_, err = hvac.ParseFaultCatalog([]byte("\"77\":\n  severity: dire\n"))
+	assert.ErrorContains(t, err, "code 77: severity must be info, warning or critical")
+}
+
+// TestParseEquipmentEvents verifies the accepted field spellings.
+func TestParseEquipmentEvents(t *testing.T) {
+	reports, err := hvac.ParseEquipmentEvents([]byte(`<equipment_events version="1.0">
+<event><code>13</code><device>furnace</device><active>true</active><timestamp>2024-04-05T06:10:00</timestamp></event>
+<event><faultCode>45</faultCode><state>cleared</state></event>
+<event><description>no code</description></event>
+</equipment_events>`))
+	require.NoError(t, err)
+	assert.Equal(t, []hvac.FaultReport{
+		{Code: "13", Device: "furnace", Active: true, Time: time.Date(2024, 4, 5, 6, 10, 0, 0, time.Local)},
+		{Code: "45", Active: false},
+	}, reports)
+
+	_, err = hvac.ParseEquipmentEvents([]byte(`<status></status>`))
+	assert.Error(t, err)
+}
+
+// TestFaultTracker verifies the raised and cleared state machine.
+func TestFaultTracker(t *testing.T) {
+	tracker := hvac.NewFaultTracker(hvac.DefaultFaultCatalog(), 3)
+	raised := time.Date(2024, 4, 5, 6, 10, 0, 0, time.UTC)
+
+	changed := tracker.Report([]hvac.FaultReport{{Code: "13", Active: true, Time: raised}, {Code: "33", Active: true}})
+	require.Len(t, changed, 2)
+	assert.Equal(t, hvac.Fault{
+		Code: "13", Device: "furnace", Description: "Limit circuit lockout", Severity: "critical",
+		Action: changed[0].Action, Active: true, Raised: raised,
+	}, changed[0])
+	assert.Equal(t, "Limit circuit lockout (code 13) on furnace raised", changed[0].String())
+
+	assert.Empty(t, tracker.Report([]hvac.FaultReport{{Code: "13", Active: true}}), "repeats are ignored")
+	assert.Empty(t, tracker.Report([]hvac.FaultReport{{Code: "14", Active: false}}), "clearing an inactive fault is ignored")
+
+	active := tracker.Active()
+	require.Len(t, active, 2)
+	assert.Equal(t, "13", active[0].Code, "most severe first")
+	metrics := tracker.Metrics()
+	assert.Contains(t, metrics, `hvac_active_faults{severity="critical"} 1`)
+	assert.Contains(t, metrics, `hvac_active_faults{severity="warning"} 1`)
+
+	cleared := raised.Add(time.Hour)
+	changed = tracker.Report([]hvac.FaultReport{{Code: "13", Device: "furnace", Active: false, Time: cleared}})
+	require.Len(t, changed, 1)
+	assert.False(t, changed[0].Active)
+	assert.Equal(t, raised, changed[0].Raised)
+	assert.Equal(t, cleared, changed[0].Cleared)
+
+	history := tracker.History()
+	require.Len(t, history, 3)
+	assert.Equal(t, "13", history[0].Code, "newest first")
+	assert.False(t, history[0].Active)
+	assert.Len(t, tracker.Active(), 1)
+	metrics = tracker.Metrics()
+	assert.Contains(t, metrics, `hvac_active_faults{severity="critical"} 0`)
+	assert.Contains(t, metrics, `hvac_faults_raised_total{severity="critical"} 1`)
+
+	tracker.Report([]hvac.FaultReport{{Code: "14", Active: true}})
+	assert.Len(t, tracker.History(), 3, "history is bounded")
+}
+
+// TestSaveBody_EquipmentEvents verifies that faults are published.
+func TestSaveBody_EquipmentEvents(t *testing.T) {
+	hvac.Configure(hvac.Config{DataDir: t.TempDir()})
+	defer hvac.Configure(hvac.Config{})
+	_, events, cancel := hvac.Events.Subscribe(0)
+	defer cancel()
+
+	body := []byte(`<equipment_events><event><code>14</code><device>furnace</device><active>true</active></event></equipment_events>`)
+	req, _ := http.NewRequest("POST", "/systems/1234/equipment_events", bytes.NewBuffer(body))
+	hvac.SaveBody(req, body, true)
+
+	e := <-events
+	assert.Equal(t, "fault", e.Type)
+	f := e.Data.(hvac.Fault)
+	assert.Equal(t, "Ignition lockout", f.Description)
+	assert.True(t, f.Active)
+	assert.NotEmpty(t, hvac.Faults.Active())
+
+	clear := []byte(`<equipment_events><event><code>14</code><device>furnace</device><active>false</active></event></equipment_events>`)
+	hvac.SaveBody(req, clear, true)
+	e = <-events
+	assert.False(t, e.Data.(hvac.Fault).Active)
+}
@@ -0,0 +1,77 @@
+package hvac
+
+import (
+	"sync"
+	"time"
+)
+
+// This file keeps a rolling in-memory history of the status documents posted
+// by the thermostat, for the dashboard and API.
+
+// Sample is a parsed status document and the time it was received.
+type Sample struct {
+	Time   time.Time `json:"time"`
+	Status Status    `json:"status"`
+}
+
+// History holds the samples received within a time window.
+type History struct {
+	window time.Duration
+
+	mu      sync.RWMutex
+	samples []Sample
+}
+
+// NewHistory creates a history that keeps samples for the given window.
+func NewHistory(window time.Duration) *History {
+	return &History{window: window}
+}
+
+// StatusHistory holds the last 24 hours of status documents.
+var StatusHistory = NewHistory(24 * time.Hour)
+
+// Add appends a sample and drops samples older than the window.
+func (h *History) Add(s Sample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples = append(h.samples, s)
+
+	cutoff := s.Time.Add(-h.window)
+	drop := 0
+	for drop < len(h.samples) && h.samples[drop].Time.Before(cutoff) {
+		drop++
+	}
+	if drop > 0 {
+		h.samples = append(h.samples[:0], h.samples[drop:]...)
+	}
+}
+
+// Latest returns the most recent sample.
+func (h *History) Latest() (Sample, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.samples) == 0 {
+		return Sample{}, false
+	}
+	return h.samples[len(h.samples)-1], true
+}
+
+// Since returns the samples received at or after t. With step greater than
+// zero, at most one sample is returned per step interval.
+func (h *History) Since(t time.Time, step time.Duration) []Sample {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	out := []Sample{}
+	var next time.Time
+	for _, s := range h.samples {
+		if s.Time.Before(t) || (step > 0 && s.Time.Before(next)) {
+			continue
+		}
+		out = append(out, s)
+		if step > 0 {
+			next = s.Time.Truncate(step).Add(step)
+		}
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+package hvac_test
+
+import (
+	"hvac-proxy/hvac"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory_Window(t *testing.T) {
+	h := hvac.NewHistory(time.Hour)
+	_, ok := h.Latest()
+	assert.False(t, ok)
+
+	start := time.Date(2024, 4, 5, 12, 0, 0, 0, time.UTC)
+	for i := 0; i <= 90; i += 5 {
+		h.Add(hvac.Sample{Time: start.Add(time.Duration(i) * time.Minute), Status: hvac.Status{OAT: float64(i)}})
+	}
+
+	latest, ok := h.Latest()
+	require.True(t, ok)
+	assert.Equal(t, 90.0, latest.Status.OAT)
+
+	all := h.Since(time.Time{}, 0)
+	assert.Len(t, all, 13, "samples older than the window are dropped")
+	assert.Equal(t, 30.0, all[0].Status.OAT)
+
+	recent := h.Since(start.Add(80*time.Minute), 0)
+	assert.Len(t, recent, 3)
+
+	stepped := h.Since(time.Time{}, 15*time.Minute)
+	var oats []float64
+	for _, s := range stepped {
+		oats = append(oats, s.Status.OAT)
+	}
+	assert.Equal(t, []float64{30, 45, 60, 75, 90}, oats)
+}
+
+func TestSaveMetricsFromXML_RecordsHistory(t *testing.T) {
+	hvac.Configure(hvac.Config{DataDir: t.TempDir()})
+	defer hvac.Configure(hvac.Config{})
+
+	xml := `<status><localTime>2024-04-05T14:30:00</localTime><oat>55</oat><mode>heat</mode><filtrlvl>20</filtrlvl>` +
+		`<idu><cfm>600</cfm><opstat>low</opstat></idu><odu><type>proteusac</type><opstat>off</opstat><opmode>off</opmode></odu>` +
+		`<zones><zone id="1"><name>Main</name><currentActivity>home</currentActivity><hold>off</hold>` +
+		`<zoneconditioning>active_heat</zoneconditioning><rt>68.5</rt><rh>40</rh><htsp>70.0</htsp><clsp>76.0</clsp></zone></zones></status>`
+	require.NoError(t, hvac.SaveMetricsFromXML([]byte(xml)))
+	hvac.FlushSinks(time.Second)
+
+	latest, ok := hvac.StatusHistory.Latest()
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now(), latest.Time, time.Minute)
+	assert.Equal(t, "heat", latest.Status.Mode)
+	assert.Equal(t, "proteusac", latest.Status.ODU.Type)
+	require.Len(t, latest.Status.Zones.Zones, 1)
+	zone := latest.Status.Zones.Zones[0]
+	assert.Equal(t, "Main", zone.Name)
+	assert.Equal(t, "home", zone.CurrentActivity)
+	assert.Equal(t, "active_heat", zone.Conditioning)
+	assert.Equal(t, 68.5, zone.CurrentTemp)
+}
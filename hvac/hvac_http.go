@@ -16,7 +16,7 @@ import (
 This file contains functions to:
 1. Save HTTP request/response bodies to disk
 2. Decode URL-encoded HVAC form data
-3. Update metrics from HVAC status XML
+3. Update metrics from HVAC status and diagnostics XML
 4. Generate safe, standardized file paths for saved content
 **/
 
@@ -30,17 +30,40 @@ func SaveBody(r *http.Request, content []byte, isRequest bool) {
 		return
 	}
 
-	// Decode URL-encoded HVAC form data (e.g., "data=encoded%20value")
-	if bytes.HasPrefix(content, []byte("data=")) {
-		encoded := bytes.TrimPrefix(content, []byte("data="))
-		if decoded, err := url.QueryUnescape(string(encoded)); err == nil {
-			content = []byte(decoded)
-		}
-	}
+	ctx, span := StartSpan(r.Context(), "save body", SpanInternal)
+	defer span.Finish()
+	span.SetAttr("hvac.request_body", isRequest)
+
+	content = DecodeBody(content)
 
 	// If this is a request to the "/status" endpoint, update metrics from the XML content
 	if strings.HasSuffix(r.URL.Path, "/status") && isRequest {
-		_ = SaveMetricsFromXML(content)
+		_ = saveMetrics(ctx, content)
+	}
+
+	// Raw equipment diagnostics from the thermostat
+	if (strings.HasSuffix(r.URL.Path, "/idu_raw") || strings.HasSuffix(r.URL.Path, "/odu_raw")) && isRequest {
+		_ = saveDiagnostics(ctx, content)
+	}
+
+	// Equipment events carry fault codes
+	if strings.HasSuffix(r.URL.Path, "/equipment_events") && isRequest {
+		_ = saveFaults(ctx, content)
+	}
+
+	// Energy reports list usage per period and component
+	if strings.HasSuffix(r.URL.Path, "/energy") && isRequest {
+		_ = saveEnergy(ctx, content)
+	}
+
+	// Profile documents from either side list the installed equipment
+	if strings.HasSuffix(r.URL.Path, "/profile") {
+		_ = saveInventory(ctx, content)
+	}
+
+	// Config documents from either side are kept, versioned and published for sinks and subscribers
+	if strings.HasSuffix(r.URL.Path, "/config") {
+		_ = saveSystemConfig(ctx, content, isRequest)
 	}
 
 	// Determine file extension based on content type
@@ -51,9 +74,8 @@ func SaveBody(r *http.Request, content []byte, isRequest bool) {
 		ext = ""
 	}
 
-	// If BLOCK_UPDATES is enabled, remove any <update> blocks from the content
-	blockUpdates := os.Getenv("BLOCK_UPDATES") == "true"
-	if blockUpdates {
+	// If BlockUpdates is enabled, remove any <update> blocks from the content
+	if Settings().BlockUpdates {
 		re := regexp.MustCompile(`(?s)<update[^>]*>.*?</update>`)
 		content = re.ReplaceAll(content, []byte{})
 	}
@@ -71,11 +93,63 @@ func SaveBody(r *http.Request, content []byte, isRequest bool) {
 	filepath := CreateFilePath(r, suffix, ext)
 
 	// Write the content to disk
-	if err := os.WriteFile(filepath, content, 0644); err != nil {
+	if err := WriteFileAtomic(filepath, content); err != nil {
+		span.SetError(err)
 		fmt.Printf("Failed to write file: %v\n", err)
 	}
 }
 
+// WriteFileAtomic writes data to a temporary file and renames it into place,
+// so readers and restarts never see a truncated file. Each write has its own
+// temporary file, so concurrent writers of the same path can't rename each
+// other's partial data into place.
+func WriteFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// LoadSavedResponse returns the last response body saved by SaveBody for the
+// same method and path, for use as a fallback when upstream is unavailable.
+func LoadSavedResponse(r *http.Request) ([]byte, error) {
+	data, err := os.ReadFile(CreateFilePath(r, "response", ".xml"))
+	if os.IsNotExist(err) {
+		data, err = os.ReadFile(CreateFilePath(r, "response", ""))
+	}
+	return data, err
+}
+
+// DecodeBody decodes URL-encoded HVAC form data (e.g., "data=encoded%20value").
+// Content that is not form encoded is returned unchanged.
+func DecodeBody(content []byte) []byte {
+	if bytes.HasPrefix(content, []byte("data=")) {
+		encoded := bytes.TrimPrefix(content, []byte("data="))
+		if decoded, err := url.QueryUnescape(string(encoded)); err == nil {
+			return []byte(decoded)
+		}
+	}
+	return content
+}
+
 // CreateFilePath generates a safe, standardized file path for HTTP content.
 // Parameters:
 // - r: the HTTP request
@@ -111,6 +185,6 @@ func CreateFilePath(r *http.Request, suffix string, extension string) string {
 	}
 
 	// Write the file to the data directory
-	filePath := filepath.Join(os.Getenv("DATA_DIR"), sanitized)
+	filePath := filepath.Join(Settings().DataDir, sanitized)
 	return filePath
 }
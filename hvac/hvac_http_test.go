@@ -5,7 +5,9 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"hvac-proxy/hvac"
 
@@ -16,8 +18,8 @@ import (
 // TestSaveBody_FilenameConstruction verifies that the filename is constructed correctly.
 func TestSaveBody_FilenameConstruction(t *testing.T) {
 	tmpDir := t.TempDir()
-	_ = os.Setenv("DATA_DIR", tmpDir)
-	defer func() { _ = os.Unsetenv("DATA_DIR") }()
+	hvac.Configure(hvac.Config{DataDir: tmpDir})
+	defer hvac.Configure(hvac.Config{})
 
 	body := []byte("<response>OK</response>")
 	req, _ := http.NewRequest("POST", "/status", bytes.NewBuffer(body))
@@ -36,8 +38,8 @@ func TestSaveBody_FilenameConstruction(t *testing.T) {
 // TestSaveBody_URLDecoding verifies that URL-encoded data is decoded properly.
 func TestSaveBody_URLDecoding(t *testing.T) {
 	tmpDir := t.TempDir()
-	_ = os.Setenv("DATA_DIR", tmpDir)
-	defer func() { _ = os.Unsetenv("DATA_DIR") }()
+	hvac.Configure(hvac.Config{DataDir: tmpDir})
+	defer hvac.Configure(hvac.Config{})
 
 	encodedBody := []byte("data=%3Cresponse%3EOK%3C%2Fresponse%3E")
 	req, _ := http.NewRequest("GET", "/test", bytes.NewBuffer(encodedBody))
@@ -56,8 +58,8 @@ func TestSaveBody_URLDecoding(t *testing.T) {
 // TestSaveBody_EmptyBody verifies that no file is written for empty body.
 func TestSaveBody_EmptyBody(t *testing.T) {
 	tmpDir := t.TempDir()
-	_ = os.Setenv("DATA_DIR", tmpDir)
-	defer func() { _ = os.Unsetenv("DATA_DIR") }()
+	hvac.Configure(hvac.Config{DataDir: tmpDir})
+	defer hvac.Configure(hvac.Config{})
 
 	body := []byte{}
 	req, _ := http.NewRequest("POST", "/empty", bytes.NewBuffer(body))
@@ -71,8 +73,8 @@ func TestSaveBody_EmptyBody(t *testing.T) {
 // TestSaveBody_MetricsUpdate verifies metrics are saved only for request bodies.
 func TestSaveBody_MetricsUpdate(t *testing.T) {
 	tmpDir := t.TempDir()
-	_ = os.Setenv("DATA_DIR", tmpDir)
-	defer func() { _ = os.Unsetenv("DATA_DIR") }()
+	hvac.Configure(hvac.Config{DataDir: tmpDir})
+	defer hvac.Configure(hvac.Config{})
 
 	// Valid HVAC status XML
 	body := []byte(`<status><localTime>2025-11-21T19:49:44-05:00</localTime><oat>72</oat><filtrlvl>90</filtrlvl><idu><cfm>100</cfm></idu><zones><zone id="1"><rt>70</rt><rh>40</rh><htsp>68</htsp><clsp>75</clsp></zone></zones></status>`)
@@ -80,25 +82,23 @@ func TestSaveBody_MetricsUpdate(t *testing.T) {
 
 	// Request case should trigger metrics save
 	hvac.SaveBody(req, body, true)
+	require.True(t, hvac.FlushSinks(time.Second))
 	metricsFile := filepath.Join(tmpDir, "metrics_last.txt")
 	assert.FileExists(t, metricsFile)
 
 	// Response case should NOT trigger metrics save
 	_ = os.Remove(metricsFile)
 	hvac.SaveBody(req, body, false)
+	require.True(t, hvac.FlushSinks(time.Second))
 	assert.NoFileExists(t, metricsFile)
 }
 
-// TestSaveBody_BlockUpdates verifies that <update> blocks are stripped when BLOCK_UPDATES=true.
+// TestSaveBody_BlockUpdates verifies that <update> blocks are stripped when BlockUpdates is set.
 func TestSaveBody_BlockUpdates(t *testing.T) {
 
 	tmpDir := t.TempDir()
-	_ = os.Setenv("DATA_DIR", tmpDir)
-	_ = os.Setenv("BLOCK_UPDATES", "true")
-	defer func() {
-		_ = os.Unsetenv("DATA_DIR")
-		_ = os.Unsetenv("BLOCK_UPDATES")
-	}()
+	hvac.Configure(hvac.Config{DataDir: tmpDir, BlockUpdates: true})
+	defer hvac.Configure(hvac.Config{})
 
 	body := []byte(`<updates xmlns="http://schema.ota.carrier.com" xmlns="http://schema.ota.carrier.com"><update xmlns="http://schema.ota.carrier.com"><type xmlns="http://schema.ota.carrier.com">thermostat</type><model xmlns="http://schema.ota.carrier.com">SYSTXCCITC01-A</model><locales xmlns="http://schema.ota.carrier.com"><locale xmlns="http://schema.ota.carrier.com">en-us</locale></locales><version xmlns="http://schema.ota.carrier.com">14.02</version><url xmlns="http://schema.ota.carrier.com">http://www.ota.ing.carrier.com/updates/systxccit-14.02.hex</url><releaseNotes xmlns="http://schema.ota.carrier.com"><url xmlns="http://schema.ota.carrier.com" type="text/plain" locale="en-us">http://www.ota.ing.carrier.com/releaseNotes/systxccit-14.02.txt</url><url xmlns="http://schema.ota.carrier.com" type="text/html" locale="en-us">http://www.ota.ing.carrier.com/releaseNotes/systxccit-14.02.html</url></releaseNotes></update></updates>`)
 
@@ -118,8 +118,8 @@ func TestSaveBody_BlockUpdates(t *testing.T) {
 // TestSaveBody_NonXML verifies that non-XML bodies are saved without .xml extension.
 func TestSaveBody_NonXML(t *testing.T) {
 	tmpDir := t.TempDir()
-	_ = os.Setenv("DATA_DIR", tmpDir)
-	defer func() { _ = os.Unsetenv("DATA_DIR") }()
+	hvac.Configure(hvac.Config{DataDir: tmpDir})
+	defer hvac.Configure(hvac.Config{})
 
 	body := []byte("plain text")
 	req, _ := http.NewRequest("GET", "/plain", bytes.NewBuffer(body))
@@ -133,8 +133,8 @@ func TestSaveBody_NonXML(t *testing.T) {
 // TestCreateFileName_QueryString verifies query string inclusion when RequestURI is empty.
 func TestCreateFileName_QueryString(t *testing.T) {
 	tmpDir := t.TempDir()
-	_ = os.Setenv("DATA_DIR", tmpDir)
-	defer func() { _ = os.Unsetenv("DATA_DIR") }()
+	hvac.Configure(hvac.Config{DataDir: tmpDir})
+	defer hvac.Configure(hvac.Config{})
 
 	req, _ := http.NewRequest("GET", "/path?foo=bar", nil)
 	req.RequestURI = "" // force fallback path building
@@ -142,3 +142,42 @@ func TestCreateFileName_QueryString(t *testing.T) {
 	filename := hvac.CreateFilePath(req, "", ".xml")
 	assert.Contains(t, filename, "GET-path_foo=bar.xml")
 }
+
+// TestWriteFileAtomic verifies that the file is replaced without leaving a temp file behind.
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "GET-systems_123_config-response.xml")
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0644))
+
+	require.NoError(t, hvac.WriteFileAtomic(path, []byte("new")))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	tmps, err := filepath.Glob(path + ".*.tmp")
+	require.NoError(t, err)
+	assert.Empty(t, tmps)
+}
+
+// TestWriteFileAtomic_Concurrent verifies that concurrent writers of one path
+// each leave a complete file.
+func TestWriteFileAtomic_Concurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "energy.json")
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			data := bytes.Repeat([]byte{byte('a' + i)}, 64<<10)
+			for range 20 {
+				assert.NoError(t, hvac.WriteFileAtomic(path, data))
+			}
+		})
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, data, 64<<10)
+	assert.Equal(t, bytes.Repeat(data[:1], 64<<10), data, "one writer's data only")
+}
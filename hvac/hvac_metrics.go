@@ -1,6 +1,7 @@
 package hvac
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -17,22 +20,25 @@ import (
 
 var mqttClient mqtt.Client
 
-// InitMQTT initializes the MQTT client if MQTT_BROKER is set.
-func InitMQTT() {
-	broker := os.Getenv("MQTT_BROKER")
-	if broker == "" {
+// mqttSettings holds the settings passed to InitMQTT, updated by UpdateMQTT.
+var mqttSettings atomic.Pointer[MQTTConfig]
+
+// InitMQTT initializes the MQTT client if a broker is configured.
+func InitMQTT(cfg MQTTConfig) {
+	if cfg.Broker == "" {
 		return
 	}
+	mqttSettings.Store(&cfg)
 
-	if os.Getenv("MQTT_DEBUG") != "" {
+	if cfg.Debug {
 		mqtt.DEBUG = log.New(os.Stdout, "[MQTT-DEBUG] ", 0)
 		mqtt.ERROR = log.New(os.Stderr, "[MQTT-ERROR] ", 0)
 	}
 
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
+	opts.AddBroker(cfg.Broker)
 
-	clientID := os.Getenv("MQTT_CLIENT_ID")
+	clientID := cfg.ClientID
 	if clientID == "" {
 		hostname, _ := os.Hostname()
 		if hostname != "" {
@@ -47,14 +53,24 @@ func InitMQTT() {
 	opts.SetConnectRetry(true)
 	opts.SetConnectRetryInterval(10 * time.Second)
 
-	username := os.Getenv("MQTT_USER")
-	if username != "" {
-		opts.SetUsername(username)
-		opts.SetPassword(os.Getenv("MQTT_PASSWORD"))
+	if cfg.User != "" {
+		opts.SetUsername(cfg.User)
+		opts.SetPassword(cfg.Password)
 	}
 
+	// Announce availability, with a retained will so subscribers see the
+	// proxy go offline even if it dies without disconnecting
+	opts.SetWill(cfg.AvailabilityTopic, "offline", 1, true)
+
 	opts.OnConnect = func(c mqtt.Client) {
 		fmt.Printf("Connected to MQTT broker as %s\n", clientID)
+		c.Publish(cfg.AvailabilityTopic, 1, true, "online")
+		// Subscriptions do not survive a new session, so renew them
+		mqttSubscriptionsMu.Lock()
+		for topic, handler := range mqttSubscriptions {
+			subscribeMQTT(c, topic, handler)
+		}
+		mqttSubscriptionsMu.Unlock()
 	}
 	opts.OnConnectionLost = func(c mqtt.Client, err error) {
 		fmt.Printf("Connection lost: %v\n", err)
@@ -65,10 +81,17 @@ func InitMQTT() {
 
 	client := mqtt.NewClient(opts)
 	mqttClient = client
+	Events.AddSink("mqtt", mqttSink{}, SinkConfig{
+		QueueSize:    100,
+		BatchSize:    1,
+		Timeout:      10 * time.Second,
+		Retries:      2,
+		RetryBackoff: 2 * time.Second,
+	})
 
 	// Start connection in background to avoid blocking server startup
 	go func() {
-		fmt.Printf("Connecting to MQTT broker: %s\n", broker)
+		fmt.Printf("Connecting to MQTT broker: %s\n", cfg.Broker)
 		token := client.Connect()
 		// Wait short time for initial connection to provide immediate feedback
 		if token.WaitTimeout(5 * time.Second) {
@@ -81,6 +104,69 @@ func InitMQTT() {
 	}()
 }
 
+// UpdateMQTT applies new publish settings (topics, QoS and retain) to the
+// running client. Connection settings only take effect on the next InitMQTT.
+func UpdateMQTT(cfg MQTTConfig) {
+	cur := mqttSettings.Load()
+	if cur == nil {
+		return
+	}
+	next := *cur
+	next.Topic, next.DiagnosticsTopic, next.FaultsTopic = cfg.Topic, cfg.DiagnosticsTopic, cfg.FaultsTopic
+	next.QoS, next.Retained = cfg.QoS, cfg.Retained
+	mqttSettings.Store(&next)
+}
+
+// mqttSubscriptions holds the handlers of the topics subscribed to with
+// SubscribeMQTT, renewed on every connect.
+var (
+	mqttSubscriptionsMu sync.Mutex
+	mqttSubscriptions   = map[string]func(payload []byte){}
+)
+
+// SubscribeMQTT calls handler with the payload of each message on topic,
+// including a retained one, for as long as the proxy runs. It reports false
+// if MQTT is not configured.
+func SubscribeMQTT(topic string, handler func(payload []byte)) bool {
+	if mqttClient == nil {
+		return false
+	}
+	mqttSubscriptionsMu.Lock()
+	defer mqttSubscriptionsMu.Unlock()
+	mqttSubscriptions[topic] = handler
+	if mqttClient.IsConnected() {
+		subscribeMQTT(mqttClient, topic, handler)
+	}
+	return true
+}
+
+func subscribeMQTT(c mqtt.Client, topic string, handler func(payload []byte)) {
+	c.Subscribe(topic, 1, func(_ mqtt.Client, m mqtt.Message) {
+		handler(m.Payload())
+	})
+}
+
+// MQTTConnected reports whether the MQTT client is currently connected.
+func MQTTConnected() bool {
+	return mqttClient != nil && mqttClient.IsConnected()
+}
+
+// CloseMQTT publishes the offline availability message and disconnects
+// cleanly, waiting up to timeout for the message to be delivered.
+func CloseMQTT(timeout time.Duration) {
+	if mqttClient == nil {
+		return
+	}
+	if mqttClient.IsConnected() {
+		token := mqttClient.Publish(mqttSettings.Load().AvailabilityTopic, 1, true, "offline")
+		if !token.WaitTimeout(timeout) || token.Error() != nil {
+			fmt.Println("Failed to publish offline availability message")
+		}
+	}
+	mqttClient.Disconnect(250)
+	fmt.Println("Disconnected from MQTT broker")
+}
+
 // This file contains functions to parse HVAC status XML data and generate
 // Prometheus-formatted metrics, which are saved to disk.
 // It also includes the HTTP handler for the "/metrics" endpoint.
@@ -94,6 +180,13 @@ type IDU struct {
 	OPSTAT string `xml:"opstat" json:"opstat"` // Operation status of the unit
 }
 
+// ODU represents the Outdoor Unit data in the XML.
+type ODU struct {
+	Type   string `xml:"type" json:"type,omitempty"`     // Unit type, e.g. "proteusac"
+	OPSTAT string `xml:"opstat" json:"opstat,omitempty"` // Operation status of the unit
+	OPMODE string `xml:"opmode" json:"opmode,omitempty"` // Operating mode, e.g. "cool stage 1"
+}
+
 // Zones represents the collection of zones in the HVAC system.
 type Zones struct {
 	Zones []Zone `xml:"zone" json:"zones"` // List of individual zone data
@@ -101,11 +194,15 @@ type Zones struct {
 
 // Zone represents a specific zone in the HVAC system.
 type Zone struct {
-	ID               int     `xml:"id,attr" json:"id"`          // Zone ID
-	CurrentTemp      float64 `xml:"rt" json:"currentTemp"`      // Current temperature in the zone
-	RelativeHumidity int     `xml:"rh" json:"relativeHumidity"` // Relative humidity in the zone
-	HeatSetPoint     float64 `xml:"htsp" json:"heatSetPoint"`   // Heating set point temperature
-	CoolSetPoint     float64 `xml:"clsp" json:"coolSetPoint"`   // Cooling set point temperature
+	ID               int     `xml:"id,attr" json:"id"`                                // Zone ID
+	Name             string  `xml:"name" json:"name,omitempty"`                       // Zone name shown on the wall control
+	CurrentActivity  string  `xml:"currentActivity" json:"currentActivity,omitempty"` // Activity in effect, e.g. "home"
+	Hold             string  `xml:"hold" json:"hold,omitempty"`                       // "on" if the program is overridden
+	Conditioning     string  `xml:"zoneconditioning" json:"conditioning,omitempty"`   // idle, active_heat or active_cool
+	CurrentTemp      float64 `xml:"rt" json:"currentTemp"`                            // Current temperature in the zone
+	RelativeHumidity int     `xml:"rh" json:"relativeHumidity"`                       // Relative humidity in the zone
+	HeatSetPoint     float64 `xml:"htsp" json:"heatSetPoint"`                         // Heating set point temperature
+	CoolSetPoint     float64 `xml:"clsp" json:"coolSetPoint"`                         // Cooling set point temperature
 }
 
 // Status represents the overall status of the HVAC system.
@@ -113,13 +210,29 @@ type Status struct {
 	XMLName   xml.Name `xml:"status" json:"-"`             // Root XML element
 	LocalTime string   `xml:"localTime" json:"localTime"`  // Local time from the system
 	OAT       float64  `xml:"oat" json:"outdoorAirTemp"`   // Outdoor air temperature in Fahrenheit
+	Mode      string   `xml:"mode" json:"mode,omitempty"`  // heat, cool, auto, fanonly or off
 	FiltrLvl  int      `xml:"filtrlvl" json:"filterLevel"` // Filter life percentage
 	IDU       IDU      `xml:"idu" json:"idu"`              // Indoor Unit data
+	ODU       ODU      `xml:"odu" json:"odu,omitzero"`     // Outdoor Unit data
 	Zones     Zones    `xml:"zones" json:"zones"`          // Zones data
 }
 
-// SaveMetricsFromXML parses the given XML data and saves Prometheus-formatted metrics to a file.
+// SaveMetricsFromXML parses the given status XML, records it in the status
+// history and publishes it to the event bus. The metrics file, MQTT and the
+// other sinks write it out asynchronously; FlushSinks waits for them.
 func SaveMetricsFromXML(xmlData []byte) error {
+	return saveMetrics(context.Background(), xmlData)
+}
+
+// saveMetrics implements SaveMetricsFromXML, tracing the parse and the MQTT
+// publish as children of the span in ctx.
+func saveMetrics(ctx context.Context, xmlData []byte) (err error) {
+	ctx, span := StartSpan(ctx, "parse status", SpanInternal)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
 	s := strings.TrimSpace(string(xmlData))
 	if !strings.HasPrefix(s, "<status") {
 		return fmt.Errorf("not HVAC status XML")
@@ -130,54 +243,103 @@ func SaveMetricsFromXML(xmlData []byte) error {
 		return fmt.Errorf("failed to unmarshal XML: %w", err)
 	}
 
-	// Publish to MQTT if enabled
-	go PublishMQTT(&status)
+	StatusHistory.Add(Sample{Time: time.Now(), Status: status})
+	// The metrics file, MQTT and other sinks pick the status up from the bus
+	Events.PublishContext(ctx, "status", status)
+	return nil
+}
+
+// prometheusSink keeps metrics_last.txt, served by "/metrics", up to date
+// with the latest status.
+type prometheusSink struct{}
 
-	prometheusStr := status.ToPrometheus()
+func (prometheusSink) Accepts(e Event) bool {
+	_, ok := e.Data.(Status)
+	return ok && e.Type == "status"
+}
 
-	filePath := filepath.Join(os.Getenv("DATA_DIR"), "metrics_last.txt")
-	if err := os.WriteFile(filePath, []byte(prometheusStr), 0644); err != nil {
+// Write saves only the newest status of the batch.
+func (prometheusSink) Write(ctx context.Context, events []Event) error {
+	status := events[len(events)-1].Data.(Status)
+	filePath := filepath.Join(Settings().DataDir, "metrics_last.txt")
+	if err := WriteFileAtomic(filePath, []byte(status.ToPrometheus())); err != nil {
 		return fmt.Errorf("failed to save metrics to file: %w", err)
 	}
-
 	return nil
 }
 
-// PublishMQTT publishes the status to the MQTT topic.
-func PublishMQTT(s *Status) {
-	if mqttClient == nil || !mqttClient.IsConnected() {
-		fmt.Println("MQTT client not connected, skipping publish")
-		return
-	}
+func init() {
+	Events.AddSink("prometheus", prometheusSink{}, SinkConfig{
+		QueueSize:    16,
+		BatchSize:    16,
+		Timeout:      10 * time.Second,
+		Retries:      2,
+		RetryBackoff: time.Second,
+	})
+}
 
-	topic := os.Getenv("MQTT_TOPIC")
-	if topic == "" {
-		topic = "hvac/value"
+// mqttSink publishes each status to the MQTT topic, raw diagnostics to a
+// topic per unit below the diagnostics topic, and faults to the faults topic.
+type mqttSink struct{}
+
+func (mqttSink) Accepts(e Event) bool {
+	switch e.Data.(type) {
+	case Status:
+		return e.Type == "status"
+	case Diagnostics:
+		return e.Type == "diagnostics"
+	case Fault:
+		return e.Type == "fault"
 	}
-	qosStr := os.Getenv("MQTT_QOS")
-	var qos byte
-	if qosStr != "" {
-		q, _ := strconv.Atoi(qosStr)
-		qos = byte(q)
+	return false
+}
+
+func (mqttSink) Write(ctx context.Context, events []Event) error {
+	for _, e := range events {
+		_, span := StartSpan(e.Context(), "mqtt publish", SpanClient)
+		cfg := mqttSettings.Load()
+		var err error
+		switch data := e.Data.(type) {
+		case Status:
+			err = publishMQTT(ctx, cfg.Topic, &data)
+		case Diagnostics:
+			err = publishMQTT(ctx, cfg.DiagnosticsTopic+"/"+data.Unit, &data)
+		case Fault:
+			err = publishMQTT(ctx, cfg.FaultsTopic, &data)
+		}
+		span.SetError(err)
+		span.Finish()
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	retainedStr := os.Getenv("MQTT_RETAINED")
-	var retained bool
-	if retainedStr != "" {
-		retained, _ = strconv.ParseBool(retainedStr)
+// publishMQTT publishes v as JSON to topic, waiting until ctx ends for the
+// broker to acknowledge it.
+func publishMQTT(ctx context.Context, topic string, v any) error {
+	if mqttClient == nil || !mqttClient.IsConnected() {
+		return fmt.Errorf("MQTT client not connected")
 	}
-	payload, err := json.Marshal(s)
+
+	payload, err := json.Marshal(v)
 	if err != nil {
-		fmt.Printf("Failed to marshal status to JSON: %v\n", err)
-		return
+		return fmt.Errorf("%w: failed to marshal %s payload to JSON: %v", ErrPermanent, topic, err)
 	}
 
+	cfg := mqttSettings.Load()
 	fmt.Printf("Publishing to topic %s: %s\n", topic, string(payload))
-	token := mqttClient.Publish(topic, qos, retained, payload)
-	token.Wait()
+	token := mqttClient.Publish(topic, cfg.QoS, cfg.Retained, payload)
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		return fmt.Errorf("MQTT publish: %w", ctx.Err())
+	}
 	if token.Error() != nil {
-		fmt.Printf("Failed to publish to MQTT: %v\n", token.Error())
+		return fmt.Errorf("failed to publish to MQTT: %w", token.Error())
 	}
+	return nil
 }
 
 // ToPrometheus generates a Prometheus-formatted string directly from the Status data.
@@ -208,42 +370,37 @@ func (s *Status) ToPrometheus() string {
 	b.WriteString("# TYPE filter gauge\n")
 	b.WriteString(fmt.Sprintf("filter %d\n", s.FiltrLvl))
 
+	// Zone readings come from the first zone
+	var zone Zone
+	if len(s.Zones.Zones) > 0 {
+		zone = s.Zones.Zones[0]
+	}
+
 	// Zone Temperature
 	b.WriteString("# HELP temperature indoor temp\n")
 	b.WriteString("# TYPE temperature gauge\n")
-	b.WriteString(fmt.Sprintf("temperature %.1f\n", s.Zones.Zones[0].CurrentTemp))
+	b.WriteString(fmt.Sprintf("temperature %.1f\n", zone.CurrentTemp))
 
 	// Zone Relative Humidity
 	b.WriteString("# HELP relativeHumidity indoor relative humidity\n")
 	b.WriteString("# TYPE relativeHumidity gauge\n")
-	b.WriteString(fmt.Sprintf("relativeHumidity %d\n", s.Zones.Zones[0].RelativeHumidity))
+	b.WriteString(fmt.Sprintf("relativeHumidity %d\n", zone.RelativeHumidity))
 
 	// Zone Heat Set Point
 	b.WriteString("# HELP heatSetPoint heat set point\n")
 	b.WriteString("# TYPE heatSetPoint gauge\n")
-	b.WriteString(fmt.Sprintf("heatSetPoint %.1f\n", s.Zones.Zones[0].HeatSetPoint))
+	b.WriteString(fmt.Sprintf("heatSetPoint %.1f\n", zone.HeatSetPoint))
 
 	// Zone Cooling Set Point
 	b.WriteString("# HELP coolingSetPoint cooling set point\n")
 	b.WriteString("# TYPE coolingSetPoint gauge\n")
-	b.WriteString(fmt.Sprintf("coolingSetPoint %.1f\n", s.Zones.Zones[0].CoolSetPoint))
+	b.WriteString(fmt.Sprintf("coolingSetPoint %.1f\n", zone.CoolSetPoint))
 
 	// Local Time
 	b.WriteString("# HELP localtime last refreshed time\n")
 	b.WriteString("# TYPE localtime gauge\n")
 
-	// Attempt to parse local time using RFC3339 format
-	t, err := time.Parse(time.RFC3339, s.LocalTime)
-	if err != nil {
-		// Fallback for non-standard time formats (e.g., with offset like -05:58)
-		fixed := s.LocalTime
-		if i := strings.LastIndex(fixed, ":"); i > len("2006-01-02T15:04:05") {
-			fixed = fixed[:i] + fixed[i+1:]
-		}
-		layout := "2006-01-02T15:04:05-0700"
-		t, err = time.Parse(layout, fixed)
-	}
-
+	t, err := ParseLocalTime(s.LocalTime)
 	if err == nil {
 		// Convert time to a numeric format suitable for Prometheus (YYYYMMDDhhmmss)
 		formatted := t.Format("20060102150405")
@@ -259,14 +416,76 @@ func (s *Status) ToPrometheus() string {
 	return b.String()
 }
 
+// ParseLocalTime parses the thermostat's localTime. Besides RFC 3339 it
+// accepts the malformed offsets some thermostats send, such as "-05:58", and
+// times without an offset, which are returned in UTC.
+func ParseLocalTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	fixed := s
+	if i := strings.LastIndex(fixed, ":"); i > len("2006-01-02T15:04:05") {
+		fixed = fixed[:i] + fixed[i+1:]
+	}
+	if t, err := time.Parse("2006-01-02T15:04:05-0700", fixed); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02T15:04:05", s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, err
+}
+
+// metricsProviders holds additional metric sources appended to "/metrics".
+var (
+	metricsMu        sync.RWMutex
+	metricsProviders []metricsProvider
+)
+
+type metricsProvider struct {
+	name string
+	fn   func() string
+}
+
+// RegisterMetrics adds a source of Prometheus-formatted metrics that is
+// appended to the "/metrics" output. Registering a name again replaces the
+// previous source.
+func RegisterMetrics(name string, fn func() string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for i := range metricsProviders {
+		if metricsProviders[i].name == name {
+			metricsProviders[i].fn = fn
+			return
+		}
+	}
+	metricsProviders = append(metricsProviders, metricsProvider{name: name, fn: fn})
+}
+
+// ProviderMetrics returns the combined output of the registered metrics
+// sources.
+func ProviderMetrics() string {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	var b strings.Builder
+	for _, p := range metricsProviders {
+		b.WriteString(p.fn())
+	}
+	return b.String()
+}
+
 // HandleMetrics is the HTTP handler for the "/metrics" endpoint.
-// It reads the last saved metrics from disk and serves them as plain text.
+// It reads the last saved metrics from disk and serves them as plain text,
+// followed by any registered metric sources.
 func HandleMetrics(w http.ResponseWriter, r *http.Request) {
-	filePath := filepath.Join(os.Getenv("DATA_DIR"), "metrics_last.txt")
+	filePath := filepath.Join(Settings().DataDir, "metrics_last.txt")
+
+	extra := ProviderMetrics()
 
 	// Read the metrics file
 	data, err := os.ReadFile(filePath)
-	if err != nil {
+	if err != nil && extra == "" {
 		http.Error(w, "Failed to read metrics file", http.StatusInternalServerError)
 		return
 	}
@@ -274,4 +493,5 @@ func HandleMetrics(w http.ResponseWriter, r *http.Request) {
 	// Set the content type to plain text and write the response
 	w.Header().Set("Content-Type", "text/plain")
 	_, _ = w.Write(data)
+	_, _ = w.Write([]byte(extra))
 }
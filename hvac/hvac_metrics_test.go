@@ -3,9 +3,14 @@ package hvac_test
 import (
 	"encoding/json"
 	"hvac-proxy/hvac"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestToPrometheus(t *testing.T) {
@@ -74,3 +79,20 @@ func TestStatusJSON(t *testing.T) {
 	expectedJSON := `{"localTime":"2024-04-05T14:30:00Z","outdoorAirTemp":63.5,"filterLevel":40,"idu":{"cfm":437,"opstat":"off"},"zones":{"zones":[{"id":1,"currentTemp":72.3,"relativeHumidity":45,"heatSetPoint":68,"coolSetPoint":75}]}}`
 	assert.JSONEq(t, expectedJSON, string(importJSON))
 }
+
+func TestHandleMetrics_RegisteredSources(t *testing.T) {
+	tmpDir := t.TempDir()
+	hvac.Configure(hvac.Config{DataDir: tmpDir})
+	defer hvac.Configure(hvac.Config{})
+
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "metrics_last.txt"), []byte("filter 40\n"), 0644))
+	hvac.RegisterMetrics("test", func() string { return "extra_metric 1\n" })
+	hvac.RegisterMetrics("test", func() string { return "extra_metric 2\n" })
+	defer hvac.RegisterMetrics("test", func() string { return "" })
+
+	rr := httptest.NewRecorder()
+	hvac.HandleMetrics(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "filter 40\nextra_metric 2\n", rr.Body.String())
+}
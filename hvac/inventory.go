@@ -0,0 +1,259 @@
+package hvac
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains the equipment inventory built from the profile document,
+// which lists the model, serial number and firmware of the thermostat, the
+// indoor and outdoor units and any accessories. The latest inventory is kept
+// on disk so changes are noticed across restarts.
+
+// Device is a piece of equipment listed in the profile.
+type Device struct {
+	Role     string `json:"role"`               // Element the device is listed under, e.g. "thermostat", "idu" or "odu"
+	Type     string `json:"type,omitempty"`     // e.g. "furnace" or "varcaphp"
+	Model    string `json:"model,omitempty"`    // Model number
+	Serial   string `json:"serial,omitempty"`   // Serial number
+	Firmware string `json:"firmware,omitempty"` // Firmware or software version
+	Hardware string `json:"hardware,omitempty"` // Hardware revision
+	Capacity string `json:"capacity,omitempty"` // Capacity as reported, e.g. "36" (kBTU) or "80000"
+}
+
+// Inventory is the equipment listed in a profile document.
+type Inventory struct {
+	Time    time.Time `json:"time"` // When the profile was received
+	Devices []Device  `json:"devices"`
+}
+
+// InventoryChange is the data of an "inventory" event: a device whose
+// identity or versions differ from the previous profile.
+type InventoryChange struct {
+	Role  string `json:"role"`
+	Field string `json:"field"` // model, serial, firmware or hardware; "device" when added or removed
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// String describes the change for logs and the dashboard.
+func (c InventoryChange) String() string {
+	switch {
+	case c.Field == "device" && c.Old == "":
+		return fmt.Sprintf("%s added: %s", c.Role, c.New)
+	case c.Field == "device":
+		return fmt.Sprintf("%s removed: %s", c.Role, c.Old)
+	default:
+		return fmt.Sprintf("%s %s changed from %s to %s", c.Role, c.Field, c.Old, c.New)
+	}
+}
+
+// deviceFields maps the element names used for device details to fields.
+var deviceFields = map[string]string{
+	"type":            "type",
+	"model":           "model",
+	"modelnumber":     "model",
+	"serial":          "serial",
+	"serialnumber":    "serial",
+	"firmware":        "firmware",
+	"firmwareversion": "firmware",
+	"software":        "firmware",
+	"swversion":       "firmware",
+	"hardware":        "hardware",
+	"hardwareversion": "hardware",
+	"hwversion":       "hardware",
+	"capacity":        "capacity",
+}
+
+// ParseProfile parses a profile document into an inventory. Any element
+// with a model or serial child is a device, named by its element and, if it
+// has one, its id attribute, e.g. "accessory_2".
+func ParseProfile(data []byte) (*Inventory, error) {
+	s := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(s, "<profile") && !strings.HasPrefix(s, "<system_profile") {
+		return nil, fmt.Errorf("not HVAC profile XML")
+	}
+	var root xmlNode
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal XML: %w", err)
+	}
+	inv := &Inventory{Devices: []Device{}}
+	var walk func(n xmlNode)
+	walk = func(n xmlNode) {
+		if d, ok := n.device(); ok {
+			inv.Devices = append(inv.Devices, d)
+		}
+		for _, c := range n.Nodes {
+			walk(c)
+		}
+	}
+	walk(root)
+	return inv, nil
+}
+
+// device reads the node as a device if it has a model or serial.
+func (n xmlNode) device() (Device, bool) {
+	d := Device{Role: n.XMLName.Local}
+	if n.ID != "" {
+		d.Role += "_" + n.ID
+	}
+	for _, c := range n.Nodes {
+		if len(c.Nodes) > 0 {
+			continue
+		}
+		v := strings.TrimSpace(c.Text)
+		switch deviceFields[strings.ToLower(c.XMLName.Local)] {
+		case "type":
+			d.Type = v
+		case "model":
+			d.Model = v
+		case "serial":
+			d.Serial = v
+		case "firmware":
+			d.Firmware = v
+		case "hardware":
+			d.Hardware = v
+		case "capacity":
+			d.Capacity = v
+		}
+	}
+	return d, d.Model != "" || d.Serial != ""
+}
+
+// Device returns the device with the given role, or nil.
+func (inv *Inventory) Device(role string) *Device {
+	for i := range inv.Devices {
+		if inv.Devices[i].Role == role {
+			return &inv.Devices[i]
+		}
+	}
+	return nil
+}
+
+// Changes lists the differences from prev, in device order.
+func (inv *Inventory) Changes(prev *Inventory) []InventoryChange {
+	var changes []InventoryChange
+	for _, d := range inv.Devices {
+		old := prev.Device(d.Role)
+		if old == nil {
+			changes = append(changes, InventoryChange{Role: d.Role, Field: "device", New: d.describe()})
+			continue
+		}
+		for _, f := range []struct{ name, old, new string }{
+			{"model", old.Model, d.Model},
+			{"serial", old.Serial, d.Serial},
+			{"firmware", old.Firmware, d.Firmware},
+			{"hardware", old.Hardware, d.Hardware},
+		} {
+			if f.old != f.new {
+				changes = append(changes, InventoryChange{Role: d.Role, Field: f.name, Old: f.old, New: f.new})
+			}
+		}
+	}
+	for _, d := range prev.Devices {
+		if inv.Device(d.Role) == nil {
+			changes = append(changes, InventoryChange{Role: d.Role, Field: "device", Old: d.describe()})
+		}
+	}
+	return changes
+}
+
+// describe names the device by model and serial.
+func (d Device) describe() string {
+	switch {
+	case d.Serial == "":
+		return d.Model
+	case d.Model == "":
+		return "serial " + d.Serial
+	default:
+		return d.Model + " serial " + d.Serial
+	}
+}
+
+// inventory holds the latest inventory.
+var (
+	inventoryMu sync.Mutex
+	inventory   *Inventory
+)
+
+// inventoryFile is where the latest inventory is kept in the data directory.
+const inventoryFile = "inventory.json"
+
+// saveInventory parses a profile document, publishes an "inventory" event
+// per change from the previous profile and keeps it as the latest.
+func saveInventory(ctx context.Context, data []byte) (err error) {
+	ctx, span := StartSpan(ctx, "parse profile", SpanInternal)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
+	inv, err := ParseProfile(data)
+	if err != nil {
+		return err
+	}
+	inv.Time = time.Now()
+
+	inventoryMu.Lock()
+	defer inventoryMu.Unlock()
+	if inventory != nil {
+		for _, c := range inv.Changes(inventory) {
+			log.Printf("[INVENTORY] %s", c)
+			Events.PublishContext(ctx, "inventory", c)
+		}
+	}
+	inventory = inv
+
+	out, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(Settings().DataDir, inventoryFile), out)
+}
+
+// LoadInventory reads the inventory saved in the data directory, so changes
+// made while the proxy was down are noticed. A missing or unreadable file
+// leaves no inventory.
+func LoadInventory() {
+	inventoryMu.Lock()
+	defer inventoryMu.Unlock()
+	inventory = nil
+	data, err := os.ReadFile(filepath.Join(Settings().DataDir, inventoryFile))
+	if err != nil {
+		return
+	}
+	var inv Inventory
+	if err := json.Unmarshal(data, &inv); err == nil {
+		inventory = &inv
+	}
+}
+
+// LatestInventory returns the equipment from the latest profile, or nil
+// before one has been received.
+func LatestInventory() *Inventory {
+	inventoryMu.Lock()
+	defer inventoryMu.Unlock()
+	return inventory
+}
+
+// InventoryMetrics renders an info metric per device.
+func InventoryMetrics() string {
+	var b strings.Builder
+	b.WriteString("# HELP hvac_device_info equipment listed in the latest profile\n")
+	b.WriteString("# TYPE hvac_device_info gauge\n")
+	if inv := LatestInventory(); inv != nil {
+		for _, d := range inv.Devices {
+			b.WriteString(fmt.Sprintf("hvac_device_info{role=%q,type=%q,model=%q,serial=%q,firmware=%q,hardware=%q,capacity=%q} 1\n",
+				d.Role, d.Type, d.Model, d.Serial, d.Firmware, d.Hardware, d.Capacity))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,96 @@
+package hvac_test
+
+import (
+	"bytes"
+	"hvac-proxy/hvac"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testProfileXML = `<profile version="1.4">
+<thermostat><type>touch</type><model>SYSTXCCITC01-B</model><serial>2714W012345</serial><firmware>4.17</firmware><hardware>B</hardware></thermostat>
+<idu><type>furnace</type><model>59MN7B080C21</model><serial>3316A54321</serial><firmware>12</firmware><capacity>80000</capacity></idu>
+<odu><type>varcaphp</type><modelNumber>25VNA036A003</modelNumber><serialNumber>1017E98765</serialNumber><swVersion>3.4</swVersion><capacity>36</capacity></odu>
+<accessories><accessory id="1"><type>humidifier</type><model>HUMXXSTM</model></accessory><accessory id="2"><type>none</type></accessory></accessories>
+</profile>`
+
+// TestParseProfile verifies that devices are found wherever they are listed.
+func TestParseProfile(t *testing.T) {
+	inv, err := hvac.ParseProfile([]byte(testProfileXML))
+	require.NoError(t, err)
+
+	assert.Equal(t, []hvac.Device{
+		{Role: "thermostat", Type: "touch", Model: "SYSTXCCITC01-B", Serial: "2714W012345", Firmware: "4.17", Hardware: "B"},
+		{Role: "idu", Type: "furnace", Model: "59MN7B080C21", Serial: "3316A54321", Firmware: "12", Capacity: "80000"},
+		{Role: "odu", Type: "varcaphp", Model: "25VNA036A003", Serial: "1017E98765", Firmware: "3.4", Capacity: "36"},
+		{Role: "accessory_1", Type: "humidifier", Model: "HUMXXSTM"},
+	}, inv.Devices)
+
+	_, err = hvac.ParseProfile([]byte(`<status></status>`))
+	assert.Error(t, err)
+}
+
+// TestInventory_Changes verifies that version and identity changes are found.
+func TestInventory_Changes(t *testing.T) {
+	prev, err := hvac.ParseProfile([]byte(testProfileXML))
+	require.NoError(t, err)
+	next, err := hvac.ParseProfile([]byte(strings.NewReplacer(
+		"<firmware>4.17</firmware>", "<firmware>4.20</firmware>",
+		"<serialNumber>1017E98765</serialNumber>", "<serialNumber>2219E11111</serialNumber>",
+		`<accessory id="1"><type>humidifier</type><model>HUMXXSTM</model></accessory>`, "",
+	).Replace(testProfileXML)))
+	require.NoError(t, err)
+
+	changes := next.Changes(prev)
+	assert.Equal(t, []hvac.InventoryChange{
+		{Role: "thermostat", Field: "firmware", Old: "4.17", New: "4.20"},
+		{Role: "odu", Field: "serial", Old: "1017E98765", New: "2219E11111"},
+		{Role: "accessory_1", Field: "device", Old: "HUMXXSTM"},
+	}, changes)
+	assert.Equal(t, "thermostat firmware changed from 4.17 to 4.20", changes[0].String())
+	assert.Equal(t, "accessory_1 removed: HUMXXSTM", changes[2].String())
+	assert.Empty(t, prev.Changes(prev))
+}
+
+// TestSaveBody_Profile verifies that profiles update the inventory, flag
+// changes and survive a restart.
+func TestSaveBody_Profile(t *testing.T) {
+	hvac.Configure(hvac.Config{DataDir: t.TempDir()})
+	defer hvac.Configure(hvac.Config{})
+	hvac.LoadInventory()
+	defer hvac.LoadInventory()
+	_, events, cancel := hvac.Events.Subscribe(0)
+	defer cancel()
+
+	save := func(body string) {
+		req, _ := http.NewRequest("POST", "/systems/2714W012345/profile", bytes.NewBufferString(body))
+		hvac.SaveBody(req, []byte(body), true)
+	}
+	save(testProfileXML)
+	inv := hvac.LatestInventory()
+	require.NotNil(t, inv)
+	assert.Len(t, inv.Devices, 4)
+	assert.WithinDuration(t, time.Now(), inv.Time, time.Minute)
+	assert.Contains(t, hvac.InventoryMetrics(),
+		`hvac_device_info{role="odu",type="varcaphp",model="25VNA036A003",serial="1017E98765",firmware="3.4",hardware="",capacity="36"} 1`)
+
+	// The first profile and unchanged ones are not flagged
+	save(testProfileXML)
+	hvac.LoadInventory()
+	require.NotNil(t, hvac.LatestInventory(), "read back from the data directory")
+	save(strings.Replace(testProfileXML, "<firmware>12</firmware>", "<firmware>14</firmware>", 1))
+
+	e := <-events
+	assert.Equal(t, "inventory", e.Type)
+	assert.Equal(t, hvac.InventoryChange{Role: "idu", Field: "firmware", Old: "12", New: "14"}, e.Data)
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+}
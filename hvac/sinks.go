@@ -0,0 +1,405 @@
+package hvac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains the outbound sinks that events on the bus fan out to,
+// such as the metrics file, MQTT and InfluxDB. Each sink has its own bounded
+// queue and goroutine, so a slow or failing output never blocks the request
+// that published the event, and failed writes are retried with backoff.
+
+// Sink is an output for events.
+type Sink interface {
+	// Accepts reports whether the sink wants the event. It is called while
+	// publishing and must be fast.
+	Accepts(e Event) bool
+	// Write delivers a batch of accepted events, oldest first. Errors
+	// wrapping ErrPermanent are not retried.
+	Write(ctx context.Context, events []Event) error
+}
+
+// SinkSpiller is implemented by sinks that keep events they could not write,
+// for example on disk, instead of dropping them after the last retry.
+type SinkSpiller interface {
+	Spill(events []Event)
+}
+
+// ErrPermanent marks write failures that retrying cannot fix, such as a
+// payload the destination rejected.
+var ErrPermanent = errors.New("permanent failure")
+
+// SinkConfig controls how events are queued, batched and retried for a sink.
+type SinkConfig struct {
+	QueueSize     int           // Events waiting to be written; more are dropped
+	BatchSize     int           // Most events per write
+	FlushInterval time.Duration // Longest time an event waits for a batch to fill; 0 writes what is queued right away
+	Timeout       time.Duration // Time allowed per write attempt
+	Retries       int           // Extra attempts per write
+	RetryBackoff  time.Duration // Wait before the first retry, doubled each time
+}
+
+// sinkRunner owns a sink's queue and delivers batches from its goroutine.
+type sinkRunner struct {
+	bus     *EventBus
+	name    string
+	sink    Sink
+	cfg     SinkConfig
+	queue   chan Event
+	flushes chan sinkFlush
+	stop    chan struct{}
+	stopped sync.Once
+
+	flushing []sinkFlush // Flush requests taken while a batch was being retried
+
+	mu          sync.Mutex
+	counts      map[string]int // Events by outcome: delivered, failed or dropped
+	retries     int
+	healthy     bool
+	lastSuccess time.Time
+}
+
+// sinkFlush asks a runner to write everything queued, giving up on retries
+// when ctx ends, and to close done when finished.
+type sinkFlush struct {
+	ctx  context.Context
+	done chan struct{}
+}
+
+// AddSink registers a sink under name and starts delivering accepted events
+// to it. A sink already registered under name is replaced; it writes out
+// what it has queued and stops. The returned function unregisters the sink,
+// unless it has been replaced by then.
+func (b *EventBus) AddSink(name string, s Sink, cfg SinkConfig) (remove func()) {
+	r := &sinkRunner{
+		bus:     b,
+		name:    name,
+		sink:    s,
+		cfg:     cfg,
+		queue:   make(chan Event, max(cfg.QueueSize, 1)),
+		flushes: make(chan sinkFlush),
+		stop:    make(chan struct{}),
+		counts:  map[string]int{},
+		healthy: true,
+	}
+	b.mu.Lock()
+	if b.sinks == nil {
+		b.sinks = map[string]*sinkRunner{}
+	}
+	if old := b.sinks[name]; old != nil {
+		old.close()
+	}
+	b.sinks[name] = r
+	b.mu.Unlock()
+	go r.run()
+
+	return func() {
+		b.mu.Lock()
+		current := b.sinks[name] == r
+		if current {
+			delete(b.sinks, name)
+		}
+		b.mu.Unlock()
+		if current {
+			r.close()
+		}
+	}
+}
+
+// close tells the runner to write out its queue and stop. It is safe to call
+// more than once.
+func (r *sinkRunner) close() {
+	r.stopped.Do(func() { close(r.stop) })
+}
+
+// offer queues an event for the sink without blocking, dropping it if the
+// queue is full. The bus lock is held.
+func (r *sinkRunner) offer(e Event) {
+	if !r.sink.Accepts(e) {
+		return
+	}
+	select {
+	case r.queue <- e:
+	default:
+		r.count("dropped", 1)
+	}
+}
+
+func (r *sinkRunner) run() {
+	var batch []Event
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	deliver := func(ctx context.Context) {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+		for len(batch) > 0 {
+			n := min(len(batch), max(r.cfg.BatchSize, 1))
+			r.deliver(ctx, batch[:n])
+			batch = batch[n:]
+		}
+		batch = nil
+	}
+	// fill adds whatever is already queued, up to a full batch
+	fill := func() {
+		for len(batch) < r.cfg.BatchSize {
+			select {
+			case e := <-r.queue:
+				batch = append(batch, e)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case e := <-r.queue:
+			batch = append(batch, e)
+			if r.cfg.FlushInterval <= 0 {
+				fill()
+			}
+			switch {
+			case len(batch) >= r.cfg.BatchSize || r.cfg.FlushInterval <= 0:
+				deliver(context.Background())
+			case timer == nil:
+				timer = time.NewTimer(r.cfg.FlushInterval)
+				timeout = timer.C
+			}
+		case <-timeout:
+			timer, timeout = nil, nil
+			deliver(context.Background())
+		case f := <-r.flushes:
+			r.flushing = append(r.flushing, f)
+		case <-r.stop:
+			// No more events arrive once the runner is unregistered, so
+			// what is queued now is all that is left
+		rest:
+			for {
+				select {
+				case e := <-r.queue:
+					batch = append(batch, e)
+				default:
+					break rest
+				}
+			}
+			deliver(context.Background())
+			for _, f := range r.flushing {
+				close(f.done)
+			}
+			return
+		}
+
+		// Flush requests, including any taken during a retry, write out
+		// the whole queue under the latest deadline
+		if len(r.flushing) > 0 {
+		drain:
+			for {
+				select {
+				case e := <-r.queue:
+					batch = append(batch, e)
+				default:
+					break drain
+				}
+			}
+			deliver(r.flushing[len(r.flushing)-1].ctx)
+			for _, f := range r.flushing {
+				close(f.done)
+			}
+			r.flushing = nil
+		}
+	}
+}
+
+// deliver writes a batch, retrying transient failures with backoff. Batches
+// that still fail are spilled if the sink supports it, otherwise dropped.
+func (r *sinkRunner) deliver(ctx context.Context, batch []Event) {
+	var err error
+	backoff := r.cfg.RetryBackoff
+	for attempt := 0; attempt <= r.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			r.mu.Lock()
+			r.retries++
+			r.mu.Unlock()
+			ctx = r.backoff(ctx, backoff)
+			if ctx.Err() != nil {
+				break
+			}
+			backoff *= 2
+		}
+		err = r.write(ctx, batch)
+		if err == nil || errors.Is(err, ErrPermanent) {
+			break
+		}
+	}
+
+	r.mu.Lock()
+	wasHealthy := r.healthy
+	r.healthy = err == nil
+	if err == nil {
+		r.counts["delivered"] += len(batch)
+		r.lastSuccess = time.Now()
+	} else {
+		r.counts["failed"] += len(batch)
+	}
+	r.mu.Unlock()
+
+	if err == nil {
+		if !wasHealthy {
+			log.Printf("[SINK] %s recovered", r.name)
+			r.bus.Publish("alert", Alert{Source: "sink/" + r.name, Severity: "warning", Message: fmt.Sprintf("Sink %s recovered", r.name)})
+		}
+		return
+	}
+	log.Printf("[SINK] %s failed to write %d events: %v", r.name, len(batch), err)
+	if spiller, ok := r.sink.(SinkSpiller); ok && !errors.Is(err, ErrPermanent) {
+		spiller.Spill(batch)
+	}
+	if wasHealthy {
+		r.bus.Publish("alert", Alert{Source: "sink/" + r.name, Severity: "warning", Active: true, Message: fmt.Sprintf("Sink %s is failing: %v", r.name, err)})
+	}
+}
+
+// backoff waits before a retry. A flush request arriving meanwhile is kept
+// for the run loop, and its deadline applies to the rest of the batch's
+// retries, which is returned as the new context.
+func (r *sinkRunner) backoff(ctx context.Context, d time.Duration) context.Context {
+	wait := time.NewTimer(d)
+	defer wait.Stop()
+	for {
+		select {
+		case <-wait.C:
+			return ctx
+		case <-ctx.Done():
+			return ctx
+		case f := <-r.flushes:
+			r.flushing = append(r.flushing, f)
+			ctx = f.ctx
+		}
+	}
+}
+
+// write makes one attempt, turning a panicking sink into an error so it
+// cannot take the process down.
+func (r *sinkRunner) write(ctx context.Context, batch []Event) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%w: sink panicked: %v", ErrPermanent, p)
+		}
+	}()
+	if r.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.Timeout)
+		defer cancel()
+	}
+	return r.sink.Write(ctx, batch)
+}
+
+func (r *sinkRunner) count(outcome string, n int) {
+	r.mu.Lock()
+	r.counts[outcome] += n
+	r.mu.Unlock()
+}
+
+// FlushSinks asks every sink to write out its queue and waits up to timeout
+// for them to finish. Sinks give up retrying at the deadline and spill or
+// drop what is left. It reports whether all sinks finished in time.
+func (b *EventBus) FlushSinks(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	b.mu.Lock()
+	runners := slices.Collect(maps.Values(b.sinks))
+	b.mu.Unlock()
+
+	var dones []chan struct{}
+	for _, r := range runners {
+		f := sinkFlush{ctx: ctx, done: make(chan struct{})}
+		select {
+		case r.flushes <- f:
+			dones = append(dones, f.done)
+		case <-r.stop:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	// Sinks that give up at the deadline get a moment to spill what is left
+	grace := time.After(timeout + time.Second)
+	for _, done := range dones {
+		select {
+		case <-done:
+		case <-grace:
+			return false
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// FlushSinks flushes the sinks of the default bus.
+func FlushSinks(timeout time.Duration) bool {
+	return Events.FlushSinks(timeout)
+}
+
+// SinkMetrics renders delivery counters and health for each sink.
+func (b *EventBus) SinkMetrics() string {
+	b.mu.Lock()
+	names := slices.Sorted(maps.Keys(b.sinks))
+	runners := make([]*sinkRunner, len(names))
+	for i, name := range names {
+		runners[i] = b.sinks[name]
+	}
+	b.mu.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString("# HELP hvac_proxy_sink_events_total events handled by each sink by outcome\n")
+	sb.WriteString("# TYPE hvac_proxy_sink_events_total counter\n")
+	for _, r := range runners {
+		r.mu.Lock()
+		for _, outcome := range []string{"delivered", "failed", "dropped"} {
+			sb.WriteString(fmt.Sprintf("hvac_proxy_sink_events_total{sink=%q,outcome=%q} %d\n", r.name, outcome, r.counts[outcome]))
+		}
+		r.mu.Unlock()
+	}
+	sb.WriteString("# HELP hvac_proxy_sink_retries_total write retries by sink\n")
+	sb.WriteString("# TYPE hvac_proxy_sink_retries_total counter\n")
+	for _, r := range runners {
+		r.mu.Lock()
+		sb.WriteString(fmt.Sprintf("hvac_proxy_sink_retries_total{sink=%q} %d\n", r.name, r.retries))
+		r.mu.Unlock()
+	}
+	sb.WriteString("# HELP hvac_proxy_sink_queue_length events waiting in each sink's queue\n")
+	sb.WriteString("# TYPE hvac_proxy_sink_queue_length gauge\n")
+	for _, r := range runners {
+		sb.WriteString(fmt.Sprintf("hvac_proxy_sink_queue_length{sink=%q} %d\n", r.name, len(r.queue)))
+	}
+	sb.WriteString("# HELP hvac_proxy_sink_up whether the sink's last write succeeded (1) or failed (0)\n")
+	sb.WriteString("# TYPE hvac_proxy_sink_up gauge\n")
+	for _, r := range runners {
+		r.mu.Lock()
+		up := 0
+		if r.healthy {
+			up = 1
+		}
+		sb.WriteString(fmt.Sprintf("hvac_proxy_sink_up{sink=%q} %d\n", r.name, up))
+		r.mu.Unlock()
+	}
+	sb.WriteString("# HELP hvac_proxy_sink_last_success_timestamp_seconds time of each sink's last successful write\n")
+	sb.WriteString("# TYPE hvac_proxy_sink_last_success_timestamp_seconds gauge\n")
+	for _, r := range runners {
+		r.mu.Lock()
+		if !r.lastSuccess.IsZero() {
+			sb.WriteString(fmt.Sprintf("hvac_proxy_sink_last_success_timestamp_seconds{sink=%q} %d\n", r.name, r.lastSuccess.Unix()))
+		}
+		r.mu.Unlock()
+	}
+	return sb.String()
+}
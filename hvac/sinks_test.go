@@ -0,0 +1,241 @@
+package hvac_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hvac-proxy/hvac"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSink records the batches it is given and fails while err is set.
+type testSink struct {
+	mu      sync.Mutex
+	batches [][]string
+	spilled []string
+	err     error
+	block   chan struct{}
+	panics  bool
+}
+
+func (s *testSink) Accepts(e hvac.Event) bool {
+	return e.Type != "alert"
+}
+
+func (s *testSink) Write(ctx context.Context, events []hvac.Event) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.panics {
+		panic("boom")
+	}
+	var batch []string
+	for _, e := range events {
+		batch = append(batch, fmt.Sprint(e.Data))
+	}
+	s.batches = append(s.batches, batch)
+	return s.err
+}
+
+func (s *testSink) Spill(events []hvac.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range events {
+		s.spilled = append(s.spilled, fmt.Sprint(e.Data))
+	}
+}
+
+func (s *testSink) setErr(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func (s *testSink) written() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+func testSinkConfig() hvac.SinkConfig {
+	return hvac.SinkConfig{QueueSize: 10, BatchSize: 3, Retries: 2, RetryBackoff: time.Millisecond}
+}
+
+func TestSinks_BatchesOnFlush(t *testing.T) {
+	bus := hvac.NewEventBus(16)
+	sink := &testSink{}
+	cfg := testSinkConfig()
+	cfg.FlushInterval = time.Hour
+	defer bus.AddSink("test", sink, cfg)()
+
+	for i := range 4 {
+		bus.Publish("status", i)
+	}
+	require.Eventually(t, func() bool { return len(sink.written()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, [][]string{{"0", "1", "2"}}, sink.written(), "a full batch is written right away")
+
+	require.True(t, bus.FlushSinks(time.Second))
+	assert.Equal(t, [][]string{{"0", "1", "2"}, {"3"}}, sink.written())
+	assert.Contains(t, bus.SinkMetrics(), `hvac_proxy_sink_events_total{sink="test",outcome="delivered"} 4`)
+}
+
+func TestSinks_FlushInterval(t *testing.T) {
+	bus := hvac.NewEventBus(16)
+	sink := &testSink{}
+	cfg := testSinkConfig()
+	cfg.FlushInterval = 20 * time.Millisecond
+	defer bus.AddSink("test", sink, cfg)()
+
+	bus.Publish("status", "a")
+	require.Eventually(t, func() bool { return len(sink.written()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, [][]string{{"a"}}, sink.written())
+}
+
+func TestSinks_RetriesThenSpills(t *testing.T) {
+	bus := hvac.NewEventBus(16)
+	sink := &testSink{err: errors.New("down")}
+	defer bus.AddSink("test", sink, testSinkConfig())()
+	_, alerts, cancel := bus.Subscribe(0)
+	defer cancel()
+
+	bus.Publish("status", "a")
+	require.True(t, bus.FlushSinks(time.Second))
+	assert.Len(t, sink.written(), 3, "first attempt plus two retries")
+	assert.Equal(t, []string{"a"}, sink.spilled)
+
+	metrics := bus.SinkMetrics()
+	assert.Contains(t, metrics, `hvac_proxy_sink_events_total{sink="test",outcome="failed"} 1`)
+	assert.Contains(t, metrics, `hvac_proxy_sink_retries_total{sink="test"} 2`)
+	assert.Contains(t, metrics, `hvac_proxy_sink_up{sink="test"} 0`)
+
+	<-alerts // The status itself
+	alert := <-alerts
+	assert.Equal(t, "alert", alert.Type)
+	assert.Equal(t, hvac.Alert{Source: "sink/test", Severity: "warning", Active: true, Message: "Sink test is failing: down"}, alert.Data)
+
+	sink.setErr(nil)
+	bus.Publish("status", "b")
+	require.True(t, bus.FlushSinks(time.Second))
+	assert.Contains(t, bus.SinkMetrics(), `hvac_proxy_sink_up{sink="test"} 1`)
+	<-alerts
+	alert = <-alerts
+	assert.False(t, alert.Data.(hvac.Alert).Active, "recovery clears the alert")
+}
+
+func TestSinks_PermanentErrorsAreNotRetried(t *testing.T) {
+	bus := hvac.NewEventBus(16)
+	sink := &testSink{err: fmt.Errorf("%w: rejected", hvac.ErrPermanent)}
+	defer bus.AddSink("test", sink, testSinkConfig())()
+
+	bus.Publish("status", "a")
+	require.True(t, bus.FlushSinks(time.Second))
+	assert.Len(t, sink.written(), 1)
+	assert.Empty(t, sink.spilled, "rejected events are dropped")
+}
+
+func TestSinks_PanicIsContained(t *testing.T) {
+	bus := hvac.NewEventBus(16)
+	sink := &testSink{panics: true}
+	defer bus.AddSink("test", sink, testSinkConfig())()
+
+	bus.Publish("status", "a")
+	require.True(t, bus.FlushSinks(time.Second))
+	assert.Contains(t, bus.SinkMetrics(), `hvac_proxy_sink_events_total{sink="test",outcome="failed"} 1`)
+}
+
+func TestSinks_SlowSinkDropsInsteadOfBlocking(t *testing.T) {
+	bus := hvac.NewEventBus(64)
+	sink := &testSink{block: make(chan struct{})}
+	cfg := testSinkConfig()
+	cfg.QueueSize, cfg.BatchSize = 2, 1
+	defer bus.AddSink("test", sink, cfg)()
+
+	// Wait until the first event is being written, then overflow the queue
+	bus.Publish("status", 0)
+	require.Eventually(t, func() bool {
+		return strings.Contains(bus.SinkMetrics(), `hvac_proxy_sink_queue_length{sink="test"} 0`)
+	}, time.Second, time.Millisecond)
+	published := make(chan struct{})
+	go func() {
+		for i := range 9 {
+			bus.Publish("status", i)
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publishing blocked on a slow sink")
+	}
+	close(sink.block)
+	require.True(t, bus.FlushSinks(time.Second))
+
+	metrics := bus.SinkMetrics()
+	assert.Contains(t, metrics, `hvac_proxy_sink_events_total{sink="test",outcome="dropped"} 7`)
+	assert.Contains(t, metrics, `hvac_proxy_sink_events_total{sink="test",outcome="delivered"} 3`)
+}
+
+func TestSinks_FlushGivesUpAtDeadline(t *testing.T) {
+	bus := hvac.NewEventBus(16)
+	sink := &testSink{err: errors.New("down")}
+	cfg := testSinkConfig()
+	cfg.Retries, cfg.RetryBackoff = 10, time.Hour
+	defer bus.AddSink("test", sink, cfg)()
+
+	bus.Publish("status", "a")
+	start := time.Now()
+	assert.False(t, bus.FlushSinks(50*time.Millisecond))
+	assert.Less(t, time.Since(start), time.Second)
+	require.Eventually(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return len(sink.spilled) == 1
+	}, time.Second, time.Millisecond, "spilled when retries are cut short")
+}
+
+func TestSinks_Remove(t *testing.T) {
+	bus := hvac.NewEventBus(16)
+	sink := &testSink{}
+	remove := bus.AddSink("test", sink, testSinkConfig())
+	remove()
+	remove()
+
+	bus.Publish("status", "a")
+	require.True(t, bus.FlushSinks(time.Second))
+	assert.Empty(t, sink.written())
+	assert.NotContains(t, bus.SinkMetrics(), `sink="test"`)
+}
+
+func TestSinks_Replace(t *testing.T) {
+	bus := hvac.NewEventBus(16)
+	old := &testSink{block: make(chan struct{})}
+	removeOld := bus.AddSink("test", old, hvac.SinkConfig{QueueSize: 10, BatchSize: 1})
+	bus.Publish("status", "a")
+	bus.Publish("status", "b")
+
+	sink := &testSink{}
+	remove := bus.AddSink("test", sink, testSinkConfig())
+	removeOld()
+	removeOld()
+	bus.Publish("status", "c")
+	close(old.block)
+
+	assert.Eventually(t, func() bool {
+		return len(old.written()) == 2
+	}, time.Second, time.Millisecond, "the replaced sink writes out its queue")
+	assert.Equal(t, [][]string{{"a"}, {"b"}}, old.written())
+	require.True(t, bus.FlushSinks(time.Second))
+	assert.Equal(t, [][]string{{"c"}}, sink.written())
+	assert.Contains(t, bus.SinkMetrics(), `sink="test"`, "removing the replaced sink leaves its replacement")
+
+	remove()
+	assert.NotContains(t, bus.SinkMetrics(), `sink="test"`)
+}
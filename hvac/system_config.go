@@ -0,0 +1,193 @@
+package hvac
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains the model of the system config document that the
+// thermostat polls from the cloud. It holds the operating mode and, per zone,
+// the hold state, the comfort activities and the weekly program.
+
+// SystemConfig represents the config document exchanged with the cloud.
+type SystemConfig struct {
+	XMLName xml.Name     `xml:"config" json:"-"`             // Root XML element
+	Version string       `xml:"version,attr" json:"version"` // Document version
+	Mode    string       `xml:"mode" json:"mode"`            // heat, cool, auto, fanonly or off
+	Zones   []ConfigZone `xml:"zones>zone" json:"zones"`     // Per-zone configuration
+}
+
+// ConfigZone holds the configuration of a single zone.
+type ConfigZone struct {
+	ID           int          `xml:"id,attr" json:"id"`                     // Zone ID
+	Name         string       `xml:"name" json:"name"`                      // Zone name shown on the wall control
+	Enabled      string       `xml:"enabled" json:"enabled"`                // "on" if the zone is installed
+	Hold         string       `xml:"hold" json:"hold"`                      // "on" if the program is overridden
+	HoldActivity string       `xml:"holdActivity" json:"holdActivity"`      // Activity held while Hold is on
+	OTMR         string       `xml:"otmr" json:"otmr"`                      // Hold end time (HH:MM), empty for indefinite
+	Activities   []Activity   `xml:"activities>activity" json:"activities"` // Comfort settings per activity
+	Program      []ProgramDay `xml:"program>day" json:"program"`            // Weekly program
+}
+
+// Activity holds the comfort settings of an activity such as home or sleep.
+type Activity struct {
+	ID   string  `xml:"id,attr" json:"id"`        // home, away, sleep, wake or manual
+	HTSP float64 `xml:"htsp" json:"heatSetPoint"` // Heating set point
+	CLSP float64 `xml:"clsp" json:"coolSetPoint"` // Cooling set point
+	Fan  string  `xml:"fan" json:"fan"`           // off, low, med or high
+}
+
+// ProgramDay holds the program periods of a single weekday.
+type ProgramDay struct {
+	ID      string   `xml:"id,attr" json:"day"`    // Weekday name, e.g. "Monday"
+	Periods []Period `xml:"period" json:"periods"` // Periods in order
+}
+
+// Period is a single program period.
+type Period struct {
+	ID       int    `xml:"id,attr" json:"id"`        // Period number within the day
+	Activity string `xml:"activity" json:"activity"` // Activity that starts at Time
+	Time     string `xml:"time" json:"time"`         // Start time (HH:MM)
+	Enabled  string `xml:"enabled" json:"enabled"`   // "on" if the period is used
+}
+
+// ParseSystemConfig parses a config document.
+func ParseSystemConfig(data []byte) (*SystemConfig, error) {
+	s := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(s, "<config") {
+		return nil, fmt.Errorf("not HVAC config XML")
+	}
+	var cfg SystemConfig
+	if err := xml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal XML: %w", err)
+	}
+	return &cfg, nil
+}
+
+// systemConfig holds the latest config document from either side.
+var (
+	systemConfigMu sync.Mutex
+	systemConfig   *SystemConfig
+)
+
+// systemConfigFile is where the latest config document is kept in the data
+// directory.
+const systemConfigFile = "system_config.xml"
+
+// saveSystemConfig parses a config document, keeps it as the latest,
+// stores it as a version if it changed and publishes it for sinks and
+// subscribers.
+func saveSystemConfig(ctx context.Context, data []byte, isRequest bool) (err error) {
+	ctx, span := StartSpan(ctx, "parse config", SpanInternal)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
+	cfg, err := ParseSystemConfig(data)
+	if err != nil {
+		return err
+	}
+	systemConfigMu.Lock()
+	systemConfig = cfg
+	systemConfigMu.Unlock()
+	recordConfigSnapshot(data, isRequest)
+	Events.PublishContext(ctx, "systemconfig", *cfg)
+	return WriteFileAtomic(filepath.Join(Settings().DataDir, systemConfigFile), data)
+}
+
+// LoadSystemConfig reads the config document saved in the data directory,
+// so the schedules are known before the thermostat next polls. A missing or
+// unreadable file leaves no config.
+func LoadSystemConfig() {
+	systemConfigMu.Lock()
+	defer systemConfigMu.Unlock()
+	systemConfig = nil
+	data, err := os.ReadFile(filepath.Join(Settings().DataDir, systemConfigFile))
+	if err != nil {
+		return
+	}
+	if cfg, err := ParseSystemConfig(data); err == nil {
+		systemConfig = cfg
+	}
+}
+
+// LatestSystemConfig returns the latest config document, or nil before one
+// has been received. Callers must not modify it.
+func LatestSystemConfig() *SystemConfig {
+	systemConfigMu.Lock()
+	defer systemConfigMu.Unlock()
+	return systemConfig
+}
+
+// Zone returns the configuration of the zone with the given ID, or nil.
+func (c *SystemConfig) Zone(id int) *ConfigZone {
+	for i := range c.Zones {
+		if c.Zones[i].ID == id {
+			return &c.Zones[i]
+		}
+	}
+	return nil
+}
+
+// Activity returns the activity with the given ID, or nil.
+func (z *ConfigZone) Activity(id string) *Activity {
+	for i := range z.Activities {
+		if z.Activities[i].ID == id {
+			return &z.Activities[i]
+		}
+	}
+	return nil
+}
+
+// CurrentActivity returns the activity in effect at the given time: the hold
+// activity when the zone is on hold, otherwise the program period that
+// started most recently (looking back into previous days if needed).
+func (z *ConfigZone) CurrentActivity(now time.Time) string {
+	if z.Hold == "on" && z.HoldActivity != "" {
+		return z.HoldActivity
+	}
+	minutes := now.Hour()*60 + now.Minute()
+	for back := 0; back < 7; back++ {
+		day := z.day(now.AddDate(0, 0, -back).Weekday())
+		if day == nil {
+			continue
+		}
+		current, latest := "", -1
+		for _, p := range day.Periods {
+			start, ok := parseClock(p.Time)
+			if p.Enabled != "on" || !ok || (back == 0 && start > minutes) || start < latest {
+				continue
+			}
+			current, latest = p.Activity, start
+		}
+		if current != "" {
+			return current
+		}
+	}
+	return "home"
+}
+
+func (z *ConfigZone) day(wd time.Weekday) *ProgramDay {
+	for i := range z.Program {
+		if strings.EqualFold(z.Program[i].ID, wd.String()) {
+			return &z.Program[i]
+		}
+	}
+	return nil
+}
+
+// parseClock converts "HH:MM" into minutes after midnight.
+func parseClock(s string) (int, bool) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
@@ -0,0 +1,74 @@
+package hvac_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"hvac-proxy/hvac"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfigXML = `<config version="1.7"><mode>heat</mode><zones>
+<zone id="1"><name>Main</name><enabled>on</enabled><hold>off</hold><holdActivity></holdActivity><otmr></otmr>
+<activities><activity id="home"><htsp>68</htsp><clsp>75</clsp><fan>off</fan></activity><activity id="sleep"><htsp>64</htsp><clsp>78</clsp><fan>low</fan></activity></activities>
+<program><day id="Monday"><period id="1"><activity>home</activity><time>06:00</time><enabled>on</enabled></period><period id="2"><activity>sleep</activity><time>22:00</time><enabled>on</enabled></period><period id="3"><activity>away</activity><time>12:00</time><enabled>off</enabled></period></day></program>
+</zone></zones></config>`
+
+// TestParseSystemConfig verifies that the config document is parsed.
+func TestParseSystemConfig(t *testing.T) {
+	cfg, err := hvac.ParseSystemConfig([]byte(testConfigXML))
+	require.NoError(t, err)
+
+	assert.Equal(t, "heat", cfg.Mode)
+	z := cfg.Zone(1)
+	require.NotNil(t, z)
+	assert.Equal(t, "Main", z.Name)
+	require.NotNil(t, z.Activity("sleep"))
+	assert.Equal(t, 64.0, z.Activity("sleep").HTSP)
+	assert.Nil(t, cfg.Zone(2))
+}
+
+// TestParseSystemConfig_NotConfig verifies that other documents are rejected.
+func TestParseSystemConfig_NotConfig(t *testing.T) {
+	_, err := hvac.ParseSystemConfig([]byte(`<status></status>`))
+	assert.Error(t, err)
+}
+
+// TestConfigZone_CurrentActivity verifies program and hold resolution.
+func TestConfigZone_CurrentActivity(t *testing.T) {
+	cfg, err := hvac.ParseSystemConfig([]byte(testConfigXML))
+	require.NoError(t, err)
+	z := cfg.Zone(1)
+
+	monday := time.Date(2025, 11, 17, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, "home", z.CurrentActivity(monday.Add(13*time.Hour)), "disabled period is skipped")
+	assert.Equal(t, "sleep", z.CurrentActivity(monday.Add(23*time.Hour)))
+	// Early Tuesday has no program, so Monday's last period carries over
+	assert.Equal(t, "sleep", z.CurrentActivity(monday.Add(26*time.Hour)))
+
+	z.Hold, z.HoldActivity = "on", "manual"
+	assert.Equal(t, "manual", z.CurrentActivity(monday.Add(13*time.Hour)))
+}
+
+// TestSaveBody_SystemConfig verifies that the latest config document is kept
+// and survives a restart.
+func TestSaveBody_SystemConfig(t *testing.T) {
+	hvac.Configure(hvac.Config{DataDir: t.TempDir()})
+	defer hvac.Configure(hvac.Config{})
+	hvac.LoadSystemConfig()
+	defer hvac.LoadSystemConfig()
+	assert.Nil(t, hvac.LatestSystemConfig())
+
+	req := httptest.NewRequest("POST", "/systems/123/config", strings.NewReader(testConfigXML))
+	hvac.SaveBody(req, []byte(testConfigXML), true)
+	require.NotNil(t, hvac.LatestSystemConfig())
+	assert.Equal(t, "heat", hvac.LatestSystemConfig().Mode)
+
+	hvac.LoadSystemConfig()
+	require.NotNil(t, hvac.LatestSystemConfig(), "read back from the data directory")
+	assert.Equal(t, "Main", hvac.LatestSystemConfig().Zone(1).Name)
+}
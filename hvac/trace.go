@@ -0,0 +1,103 @@
+package hvac
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// This file contains a minimal tracing API used to time the steps of a
+// proxied exchange. Spans are handed to the recorder installed with
+// SetSpanRecorder; with none installed, StartSpan returns nil and every Span
+// method is a no-op.
+
+// SpanKind is the OTLP span kind.
+type SpanKind int
+
+// Span kinds, numbered as in OTLP.
+const (
+	SpanInternal SpanKind = 1
+	SpanServer   SpanKind = 2
+	SpanClient   SpanKind = 3
+)
+
+// Attr is a span attribute. Value is a string, bool, int, int64 or float64.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// Span is a timed operation within a trace.
+type Span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte // Zero for the root span
+	Name     string
+	Kind     SpanKind
+	Start    time.Time
+	End      time.Time
+	Attrs    []Attr
+	Err      string // Set when the operation failed
+
+	record func(*Span)
+}
+
+type spanKey struct{}
+
+var spanRecorder atomic.Pointer[func(*Span)]
+
+// SetSpanRecorder installs fn to receive each span when it ends. A nil fn
+// disables tracing.
+func SetSpanRecorder(fn func(*Span)) {
+	if fn == nil {
+		spanRecorder.Store(nil)
+		return
+	}
+	spanRecorder.Store(&fn)
+}
+
+// StartSpan starts a span as a child of the span in ctx, or as the root of a
+// new trace, and returns a context carrying it.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	record := spanRecorder.Load()
+	if record == nil {
+		return ctx, nil
+	}
+	s := &Span{Name: name, Kind: kind, Start: time.Now(), record: *record}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		putRandom(s.TraceID[:])
+	}
+	putRandom(s.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func putRandom(b []byte) {
+	for i := range b {
+		b[i] = byte(rand.Uint32())
+	}
+}
+
+// SetAttr adds an attribute to the span.
+func (s *Span) SetAttr(key string, value any) {
+	if s != nil {
+		s.Attrs = append(s.Attrs, Attr{key, value})
+	}
+}
+
+// SetError marks the span as failed if err is not nil.
+func (s *Span) SetError(err error) {
+	if s != nil && err != nil {
+		s.Err = err.Error()
+	}
+}
+
+// Finish ends the span and hands it to the recorder.
+func (s *Span) Finish() {
+	if s != nil {
+		s.End = time.Now()
+		s.record(s)
+	}
+}
@@ -0,0 +1,47 @@
+package hvac_test
+
+import (
+	"context"
+	"errors"
+	"hvac-proxy/hvac"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpan_DisabledIsNoOp(t *testing.T) {
+	hvac.SetSpanRecorder(nil)
+	ctx, span := hvac.StartSpan(context.Background(), "op", hvac.SpanInternal)
+	assert.Nil(t, span)
+	assert.Equal(t, context.Background(), ctx)
+
+	span.SetAttr("k", "v")
+	span.SetError(errors.New("boom"))
+	span.Finish()
+}
+
+func TestSpan_ParentAndRecord(t *testing.T) {
+	var recorded []*hvac.Span
+	hvac.SetSpanRecorder(func(s *hvac.Span) { recorded = append(recorded, s) })
+	t.Cleanup(func() { hvac.SetSpanRecorder(nil) })
+
+	ctx, root := hvac.StartSpan(context.Background(), "root", hvac.SpanServer)
+	_, child := hvac.StartSpan(ctx, "child", hvac.SpanClient)
+	child.SetAttr("http.response.status_code", 502)
+	child.SetError(errors.New("bad gateway"))
+	child.SetError(nil)
+	child.Finish()
+	root.Finish()
+
+	require.Len(t, recorded, 2)
+	assert.Equal(t, "child", recorded[0].Name)
+	assert.Equal(t, root.TraceID, child.TraceID)
+	assert.Equal(t, root.SpanID, child.ParentID)
+	assert.NotEqual(t, root.SpanID, child.SpanID)
+	assert.Equal(t, [8]byte{}, root.ParentID)
+	assert.NotEqual(t, [16]byte{}, root.TraceID)
+	assert.Equal(t, []hvac.Attr{{Key: "http.response.status_code", Value: 502}}, child.Attrs)
+	assert.Equal(t, "bad gateway", child.Err)
+	assert.False(t, child.End.Before(child.Start))
+}
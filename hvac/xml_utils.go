@@ -3,7 +3,10 @@ package hvac
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
 )
 
 // PrettifyXML formats raw XML with indentation.
@@ -60,3 +63,40 @@ func IsXML(data []byte) bool {
 		}
 	}
 }
+
+// xmlNode is an element of a document whose structure varies between
+// devices, unmarshalled as a tree.
+type xmlNode struct {
+	XMLName xml.Name
+	ID      string    `xml:"id,attr"`
+	Text    string    `xml:",chardata"`
+	Nodes   []xmlNode `xml:",any"`
+}
+
+// CanonicalXML renders XML without formatting whitespace, so documents that
+// differ only in layout compare equal.
+func CanonicalXML(data []byte) string {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var b strings.Builder
+	for {
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return b.String()
+		}
+		if err != nil {
+			return string(data)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			b.WriteString("<" + t.Name.Local)
+			for _, a := range t.Attr {
+				fmt.Fprintf(&b, " %s=%q", a.Name.Local, a.Value)
+			}
+			b.WriteString(">")
+		case xml.EndElement:
+			b.WriteString("</" + t.Name.Local + ">")
+		case xml.CharData:
+			_ = xml.EscapeText(&b, bytes.TrimSpace(t))
+		}
+	}
+}
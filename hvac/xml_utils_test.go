@@ -61,3 +61,11 @@ func TestIsXML_WITHNAMESPACESXML(t *testing.T) {
 	input := []byte(`<updates xmlns="http://schema.ota.carrier.com" xmlns="http://schema.ota.carrier.com"><update xmlns="http://schema.ota.carrier.com"><type xmlns="http://schema.ota.carrier.com">thermostat</type><model xmlns="http://schema.ota.carrier.com">SYSTXCCITC01-A</model><locales xmlns="http://schema.ota.carrier.com"><locale xmlns="http://schema.ota.carrier.com">en-us</locale></locales><version xmlns="http://schema.ota.carrier.com">14.02</version><url xmlns="http://schema.ota.carrier.com">http://www.ota.ing.carrier.com/updates/systxccit-14.02.hex</url><releaseNotes xmlns="http://schema.ota.carrier.com"><url xmlns="http://schema.ota.carrier.com" type="text/plain" locale="en-us">http://www.ota.ing.carrier.com/releaseNotes/systxccit-14.02.txt</url><url xmlns="http://schema.ota.carrier.com" type="text/html" locale="en-us">http://www.ota.ing.carrier.com/releaseNotes/systxccit-14.02.html</url></releaseNotes></update></updates>`)
 	assert.True(t, hvac.IsXML(input))
 }
+
+// TestCanonicalXML verifies that documents differing only in layout compare
+// equal.
+func TestCanonicalXML(t *testing.T) {
+	assert.Equal(t, hvac.CanonicalXML([]byte(`<day id="Monday"><period id="1"><time>06:00</time></period></day>`)),
+		hvac.CanonicalXML([]byte("<day id=\"Monday\">\n  <period id=\"1\">\n    <time> 06:00 </time>\n  </period>\n</day>")))
+	assert.NotEqual(t, hvac.CanonicalXML([]byte(`<time>06:00</time>`)), hvac.CanonicalXML([]byte(`<time>06:15</time>`)))
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hvac-proxy/hvac"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfluxConfig controls the optional InfluxDB line protocol sink. Each status
+// document the thermostat posts becomes a set of points written to the
+// InfluxDB v2 write API, a file or a UDP socket.
+type InfluxConfig struct {
+	URL            string        `yaml:"url"`            // http(s)://host:8086, file:///path or udp://host:port; empty disables
+	Org            string        `yaml:"org"`            // InfluxDB organization (HTTP only)
+	Bucket         string        `yaml:"bucket"`         // InfluxDB bucket (HTTP only)
+	Token          string        `yaml:"token"`          // InfluxDB API token (HTTP only)
+	BatchSize      int           `yaml:"batchSize"`      // Points per write
+	FlushInterval  time.Duration `yaml:"flushInterval"`  // Longest time a point waits before being written
+	Timeout        time.Duration `yaml:"timeout"`        // Time allowed per write attempt
+	Retries        int           `yaml:"retries"`        // Extra attempts per write before buffering
+	RetryBackoff   time.Duration `yaml:"retryBackoff"`   // Wait before the first retry, doubled each time
+	BufferFile     string        `yaml:"bufferFile"`     // Points kept while the destination is down; defaults to DATA_DIR/influx-buffer.lp
+	BufferMaxBytes int           `yaml:"bufferMaxBytes"` // Oldest buffered points are dropped beyond this size
+}
+
+// defaultInfluxConfig returns the settings used when nothing is configured.
+func defaultInfluxConfig() InfluxConfig {
+	return InfluxConfig{
+		BatchSize:      100,
+		FlushInterval:  10 * time.Second,
+		Timeout:        10 * time.Second,
+		Retries:        2,
+		RetryBackoff:   time.Second,
+		BufferMaxBytes: 10 << 20,
+	}
+}
+
+// validateInflux checks the sink settings when it is enabled.
+func validateInflux(c *InfluxConfig, check func(ok bool, field, format string, args ...any)) {
+	if c.URL == "" {
+		return
+	}
+	u, err := url.Parse(c.URL)
+	switch {
+	case err != nil:
+		check(false, "influx.url", "invalid URL %q", c.URL)
+	case u.Scheme == "http" || u.Scheme == "https":
+		check(u.Host != "", "influx.url", "must include a host, got %q", c.URL)
+		check(c.Bucket != "", "influx.bucket", "required for the HTTP write API")
+	case u.Scheme == "file":
+		check(u.Path != "", "influx.url", "must be file:///path, got %q", c.URL)
+	case u.Scheme == "udp":
+		_, _, err := net.SplitHostPort(u.Host)
+		check(err == nil, "influx.url", "must be udp://host:port, got %q", c.URL)
+	default:
+		check(false, "influx.url", "scheme must be http, https, file or udp, got %q", u.Scheme)
+	}
+	check(c.BatchSize > 0, "influx.batchSize", "must be positive")
+	check(c.FlushInterval > 0, "influx.flushInterval", "must be positive")
+	check(c.Timeout > 0, "influx.timeout", "must be positive")
+	check(c.Retries >= 0, "influx.retries", "must not be negative")
+	check(c.RetryBackoff >= 0, "influx.retryBackoff", "must not be negative")
+	check(c.BufferMaxBytes >= 0, "influx.bufferMaxBytes", "must not be negative")
+}
+
+// errInfluxRejected marks writes the destination refused as invalid. They
+// are dropped rather than retried.
+var errInfluxRejected = fmt.Errorf("%w: points rejected", hvac.ErrPermanent)
+
+// influxSink writes status events from the bus as line protocol. Points
+// that cannot be written are appended to a buffer file and sent first on the
+// next successful write.
+type influxSink struct {
+	cfg  InfluxConfig
+	send func(ctx context.Context, body []byte) error
+
+	mu     sync.Mutex
+	points map[string]int // Points by outcome: written, buffered or dropped
+}
+
+// newInfluxSink creates a sink for the configured destination.
+func newInfluxSink(cfg InfluxConfig) (*influxSink, error) {
+	s := &influxSink{cfg: cfg, points: map[string]int{}}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		s.send = influxHTTPWriter(cfg)
+	case "file":
+		s.send = influxFileWriter(u.Path)
+	case "udp":
+		s.send = influxUDPWriter(u.Host)
+	default:
+		return nil, fmt.Errorf("unsupported influx URL %q", cfg.URL)
+	}
+	return s, nil
+}
+
+// sinkConfig returns the queueing and retry policy for the sink. The queue
+// holds ten batches.
+func (s *influxSink) sinkConfig() hvac.SinkConfig {
+	return hvac.SinkConfig{
+		QueueSize:     10 * s.cfg.BatchSize,
+		BatchSize:     s.cfg.BatchSize,
+		FlushInterval: s.cfg.FlushInterval,
+		Timeout:       s.cfg.Timeout,
+		Retries:       s.cfg.Retries,
+		RetryBackoff:  s.cfg.RetryBackoff,
+	}
+}
+
+func (s *influxSink) Accepts(e hvac.Event) bool {
+	return e.Type == "status"
+}
+
+// Write sends buffered points and then the batch's points.
+func (s *influxSink) Write(ctx context.Context, events []hvac.Event) error {
+	if err := s.drainBuffer(ctx); err != nil {
+		return err
+	}
+	lines := statusLines(events)
+	if len(lines) == 0 {
+		return nil
+	}
+	if err := s.write(ctx, lines); err != nil {
+		if errors.Is(err, errInfluxRejected) {
+			s.count("dropped", len(lines))
+		}
+		return err
+	}
+	s.count("written", len(lines))
+	return nil
+}
+
+// Spill keeps the points of a batch that could not be written in the buffer
+// file.
+func (s *influxSink) Spill(events []hvac.Event) {
+	s.spill(statusLines(events))
+}
+
+func statusLines(events []hvac.Event) []string {
+	var lines []string
+	for _, e := range events {
+		if status, ok := e.Data.(hvac.Status); ok {
+			lines = append(lines, influxLines(e.Time, &status)...)
+		}
+	}
+	return lines
+}
+
+// write sends lines in batches of BatchSize points. After a failure the
+// sink retries all lines, so earlier batches may be sent again; InfluxDB
+// overwrites identical points.
+func (s *influxSink) write(ctx context.Context, lines []string) error {
+	for len(lines) > 0 {
+		n := min(len(lines), s.cfg.BatchSize)
+		body := []byte(strings.Join(lines[:n], "\n") + "\n")
+		if err := s.send(ctx, body); err != nil {
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+// drainBuffer sends the points kept in the buffer file, oldest first.
+func (s *influxSink) drainBuffer(ctx context.Context) error {
+	lines, err := readLines(s.cfg.BufferFile)
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+	switch err := s.write(ctx, lines); {
+	case errors.Is(err, errInfluxRejected):
+		log.Printf("[INFLUX] Dropped %d buffered points: %v", len(lines), err)
+		s.count("dropped", len(lines))
+	case err != nil:
+		return err
+	default:
+		log.Printf("[INFLUX] Sent %d buffered points", len(lines))
+		s.count("written", len(lines))
+	}
+	return os.Remove(s.cfg.BufferFile)
+}
+
+// spill appends lines to the buffer file, dropping the oldest points once it
+// exceeds BufferMaxBytes.
+func (s *influxSink) spill(lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	kept, err := readLines(s.cfg.BufferFile)
+	if err != nil {
+		log.Printf("[INFLUX] Failed to read buffer: %v", err)
+	}
+	kept = append(kept, lines...)
+
+	size := 0
+	for _, l := range kept {
+		size += len(l) + 1
+	}
+	dropped := 0
+	for size > s.cfg.BufferMaxBytes && dropped < len(kept) {
+		size -= len(kept[dropped]) + 1
+		dropped++
+	}
+	kept = kept[dropped:]
+	if dropped > 0 {
+		log.Printf("[INFLUX] Buffer full, dropped %d oldest points", dropped)
+		s.count("dropped", dropped)
+	}
+
+	data := []byte(strings.Join(kept, "\n"))
+	if len(kept) > 0 {
+		data = append(data, '\n')
+	}
+	if err := hvac.WriteFileAtomic(s.cfg.BufferFile, data); err != nil {
+		log.Printf("[INFLUX] Failed to write buffer, dropped %d points: %v", len(lines), err)
+		s.count("dropped", len(lines))
+		return
+	}
+	s.count("buffered", len(lines))
+}
+
+func (s *influxSink) count(outcome string, n int) {
+	s.mu.Lock()
+	s.points[outcome] += n
+	s.mu.Unlock()
+}
+
+// metrics renders the sink counters for "/metrics".
+func (s *influxSink) metrics() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP hvac_proxy_influx_points_total points handled by the InfluxDB sink by outcome\n")
+	b.WriteString("# TYPE hvac_proxy_influx_points_total counter\n")
+	for _, outcome := range []string{"written", "buffered", "dropped"} {
+		b.WriteString(fmt.Sprintf("hvac_proxy_influx_points_total{outcome=%q} %d\n", outcome, s.points[outcome]))
+	}
+	var size int64
+	if info, err := os.Stat(s.cfg.BufferFile); err == nil {
+		size = info.Size()
+	}
+	b.WriteString("# HELP hvac_proxy_influx_buffer_bytes size of the InfluxDB sink buffer file\n")
+	b.WriteString("# TYPE hvac_proxy_influx_buffer_bytes gauge\n")
+	b.WriteString(fmt.Sprintf("hvac_proxy_influx_buffer_bytes %d\n", size))
+	return b.String()
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var lines []string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if line := sc.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, sc.Err()
+}
+
+// influxHTTPWriter posts to the InfluxDB v2 write API.
+func influxHTTPWriter(cfg InfluxConfig) func(context.Context, []byte) error {
+	q := url.Values{"bucket": {cfg.Bucket}, "precision": {"ns"}}
+	if cfg.Org != "" {
+		q.Set("org", cfg.Org)
+	}
+	endpoint := strings.TrimSuffix(cfg.URL, "/") + "/api/v2/write?" + q.Encode()
+	client := &http.Client{}
+
+	return func(ctx context.Context, body []byte) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if cfg.Token != "" {
+			req.Header.Set("Authorization", "Token "+cfg.Token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+		switch {
+		case resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			return fmt.Errorf("influx returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+		default:
+			return fmt.Errorf("%w: influx returned %s: %s", errInfluxRejected, resp.Status, bytes.TrimSpace(msg))
+		}
+	}
+}
+
+// influxFileWriter appends points to a local file, e.g. for Telegraf's tail
+// input.
+func influxFileWriter(path string) func(context.Context, []byte) error {
+	return func(ctx context.Context, body []byte) error {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(body); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return f.Close()
+	}
+}
+
+// influxUDPMaxPacket keeps datagrams within a typical Ethernet MTU.
+const influxUDPMaxPacket = 1400
+
+// influxUDPWriter sends points to a UDP listener such as Telegraf's
+// socket_listener, splitting them into datagrams at line boundaries.
+func influxUDPWriter(addr string) func(context.Context, []byte) error {
+	return func(ctx context.Context, body []byte) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "udp", addr)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = conn.Close() }()
+
+		var packet []byte
+		for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+			if len(packet) > 0 && len(packet)+len(line) > influxUDPMaxPacket {
+				if _, err := conn.Write(packet); err != nil {
+					return err
+				}
+				packet = packet[:0]
+			}
+			packet = append(packet, line...)
+		}
+		if len(packet) > 0 {
+			_, err = conn.Write(packet)
+		}
+		return err
+	}
+}
+
+// influxLines converts a status document to line protocol: one hvac_zone
+// point per zone, plus hvac_system, hvac_equipment and hvac_proxy points.
+func influxLines(t time.Time, s *hvac.Status) []string {
+	ts := strconv.FormatInt(t.UnixNano(), 10)
+	var lines []string
+
+	for _, z := range s.Zones.Zones {
+		tags := [][2]string{{"zone", strconv.Itoa(z.ID)}, {"name", z.Name}}
+		fields := []influxField{
+			{"temperature", z.CurrentTemp},
+			{"humidity", z.RelativeHumidity},
+			{"heat_setpoint", z.HeatSetPoint},
+			{"cool_setpoint", z.CoolSetPoint},
+			{"activity", z.CurrentActivity},
+			{"conditioning", z.Conditioning},
+		}
+		if z.Hold != "" {
+			fields = append(fields, influxField{"hold", z.Hold == "on"})
+		}
+		lines = append(lines, influxLine("hvac_zone", tags, fields, ts))
+	}
+
+	lines = append(lines, influxLine("hvac_system", nil, []influxField{
+		{"outdoor_temp", s.OAT},
+		{"filter_level", s.FiltrLvl},
+		{"mode", s.Mode},
+	}, ts))
+
+	lines = append(lines, influxLine("hvac_equipment", [][2]string{{"unit", "indoor"}}, []influxField{
+		{"state", s.IDU.OPSTAT},
+		{"cfm", s.IDU.CFM},
+	}, ts))
+	if s.ODU.OPSTAT != "" {
+		lines = append(lines, influxLine("hvac_equipment", [][2]string{{"unit", "outdoor"}, {"type", s.ODU.Type}}, []influxField{
+			{"state", s.ODU.OPSTAT},
+			{"mode", s.ODU.OPMODE},
+		}, ts))
+	}
+
+	requests, retries, fallbacks := upstream.counters()
+	proxy := []influxField{{"upstream_retries", retries}, {"upstream_fallbacks", fallbacks}}
+	for _, result := range sortedKeys(requests) {
+		proxy = append(proxy, influxField{"upstream_" + result, requests[result]})
+	}
+	proxy = append(proxy, influxField{"stream_subscribers", hvac.Events.Subscribers()})
+	lines = append(lines, influxLine("hvac_proxy", nil, proxy, ts))
+	return lines
+}
+
+// influxField is a field key and a float64, int, bool or string value.
+type influxField struct {
+	key   string
+	value any
+}
+
+// influxLine renders one point. Empty tag values and empty string fields are
+// left out, since line protocol does not allow empty tags. Callers pass at
+// least one numeric field.
+func influxLine(measurement string, tags [][2]string, fields []influxField, ts string) string {
+	var b strings.Builder
+	b.WriteString(influxEscape(measurement, ", "))
+
+	sort.Slice(tags, func(i, j int) bool { return tags[i][0] < tags[j][0] })
+	for _, t := range tags {
+		if t[1] == "" {
+			continue
+		}
+		b.WriteString("," + influxEscape(t[0], ",= ") + "=" + influxEscape(t[1], ",= "))
+	}
+
+	sep := " "
+	for _, f := range fields {
+		var v string
+		switch x := f.value.(type) {
+		case float64:
+			v = strconv.FormatFloat(x, 'f', -1, 64)
+		case int:
+			v = strconv.Itoa(x) + "i"
+		case bool:
+			v = strconv.FormatBool(x)
+		case string:
+			if x == "" {
+				continue
+			}
+			v = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(x) + `"`
+		}
+		b.WriteString(sep + influxEscape(f.key, ",= ") + "=" + v)
+		sep = ","
+	}
+	b.WriteString(" " + ts)
+	return b.String()
+}
+
+// influxEscape backslash-escapes the given special characters.
+func influxEscape(s, special string) string {
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// initInflux enables the InfluxDB sink when configured.
+func initInflux(cfg InfluxConfig) error {
+	if cfg.URL == "" {
+		return nil
+	}
+	s, err := newInfluxSink(cfg)
+	if err != nil {
+		return err
+	}
+	hvac.RegisterMetrics("influx", s.metrics)
+	hvac.Events.AddSink("influx", s, s.sinkConfig())
+	fmt.Printf("Writing InfluxDB points to %s\n", cfg.URL)
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"hvac-proxy/hvac"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testInfluxStatus() hvac.Status {
+	return hvac.Status{
+		OAT:      41,
+		Mode:     "heat",
+		FiltrLvl: 30,
+		IDU:      hvac.IDU{CFM: 600, OPSTAT: "low"},
+		ODU:      hvac.ODU{Type: "proteusac", OPSTAT: "off", OPMODE: "off"},
+		Zones: hvac.Zones{Zones: []hvac.Zone{
+			{ID: 1, Name: "Living Room", CurrentActivity: "home", Hold: "on", Conditioning: "active_heat",
+				CurrentTemp: 68.5, RelativeHumidity: 38, HeatSetPoint: 70, CoolSetPoint: 76},
+		}},
+	}
+}
+
+func TestInfluxLines(t *testing.T) {
+	useUpstream(t, testUpstreamConfig())
+	status := testInfluxStatus()
+	lines := influxLines(time.Unix(1712327400, 0), &status)
+
+	assert.Equal(t, []string{
+		`hvac_zone,name=Living\ Room,zone=1 temperature=68.5,humidity=38i,heat_setpoint=70,cool_setpoint=76,activity="home",conditioning="active_heat",hold=true 1712327400000000000`,
+		`hvac_system outdoor_temp=41,filter_level=30i,mode="heat" 1712327400000000000`,
+		`hvac_equipment,unit=indoor state="low",cfm=600i 1712327400000000000`,
+		`hvac_equipment,type=proteusac,unit=outdoor state="off",mode="off" 1712327400000000000`,
+	}, lines[:4])
+	assert.Regexp(t, `^hvac_proxy upstream_retries=0i,upstream_fallbacks=0i,stream_subscribers=\d+i 1712327400000000000$`, lines[4])
+}
+
+func TestInfluxLine_Escaping(t *testing.T) {
+	line := influxLine("m", [][2]string{{"name", `a,b=c`}, {"empty", ""}}, []influxField{
+		{"msg", `say "hi" \o/`},
+		{"skip", ""},
+		{"v", 1.5},
+	}, "1")
+	assert.Equal(t, `m,name=a\,b\=c msg="say \"hi\" \\o/",v=1.5 1`, line)
+}
+
+// influxStandIn is a local stand-in for the InfluxDB v2 write API.
+type influxStandIn struct {
+	mu     sync.Mutex
+	status int
+	bodies []string
+	reqs   []*http.Request
+}
+
+func (s *influxStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reqs = append(s.reqs, r)
+	if s.status != 0 {
+		http.Error(w, `{"code":"unavailable"}`, s.status)
+		return
+	}
+	s.bodies = append(s.bodies, string(body))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *influxStandIn) setStatus(code int) {
+	s.mu.Lock()
+	s.status = code
+	s.mu.Unlock()
+}
+
+func (s *influxStandIn) points() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines []string
+	for _, b := range s.bodies {
+		lines = append(lines, strings.Split(strings.TrimSpace(b), "\n")...)
+	}
+	return lines
+}
+
+func testInfluxSink(t *testing.T, url string) *influxSink {
+	cfg := defaultInfluxConfig()
+	cfg.URL, cfg.Org, cfg.Bucket, cfg.Token = url, "home", "hvac", "secret-token"
+	cfg.BatchSize, cfg.Retries, cfg.RetryBackoff = 2, 1, time.Millisecond
+	cfg.BufferFile = filepath.Join(t.TempDir(), "buffer.lp")
+	s, err := newInfluxSink(cfg)
+	require.NoError(t, err)
+	return s
+}
+
+// useInfluxSink registers s on a private bus and returns a function that
+// publishes a status and waits for the sink to handle it.
+func useInfluxSink(t *testing.T, s *influxSink) func() {
+	useUpstream(t, testUpstreamConfig())
+	bus := hvac.NewEventBus(16)
+	t.Cleanup(bus.AddSink("influx", s, s.sinkConfig()))
+	return func() {
+		bus.Publish("event", activityEvent{Message: "ignored"})
+		bus.Publish("status", testInfluxStatus())
+		require.True(t, bus.FlushSinks(5*time.Second))
+	}
+}
+
+func TestInfluxSink_HTTP(t *testing.T) {
+	standIn := &influxStandIn{}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+	s := testInfluxSink(t, srv.URL)
+
+	require.NoError(t, s.write(context.Background(), []string{"a v=1i 1", "b v=2i 2", "c v=3i 3"}))
+
+	assert.Equal(t, []string{"a v=1i 1", "b v=2i 2", "c v=3i 3"}, standIn.points())
+	require.Len(t, standIn.reqs, 2, "written in batches")
+	req := standIn.reqs[0]
+	assert.Equal(t, "/api/v2/write", req.URL.Path)
+	assert.Equal(t, "hvac", req.URL.Query().Get("bucket"))
+	assert.Equal(t, "home", req.URL.Query().Get("org"))
+	assert.Equal(t, "ns", req.URL.Query().Get("precision"))
+	assert.Equal(t, "Token secret-token", req.Header.Get("Authorization"))
+}
+
+func TestInfluxSink_WritesStatusEvents(t *testing.T) {
+	standIn := &influxStandIn{}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+	s := testInfluxSink(t, srv.URL)
+	s.cfg.BatchSize = 100
+	publish := useInfluxSink(t, s)
+
+	publish()
+	points := standIn.points()
+	require.Len(t, points, 5, "only the status is written")
+	assert.True(t, strings.HasPrefix(points[0], "hvac_zone,"))
+	assert.Contains(t, s.metrics(), `hvac_proxy_influx_points_total{outcome="written"} 5`)
+}
+
+func TestInfluxSink_BuffersWhileDown(t *testing.T) {
+	standIn := &influxStandIn{status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+	s := testInfluxSink(t, srv.URL)
+	publish := useInfluxSink(t, s)
+
+	publish()
+	publish()
+	assert.Len(t, standIn.reqs, 4, "each write is retried once")
+
+	buffered, err := readLines(s.cfg.BufferFile)
+	require.NoError(t, err)
+	assert.Len(t, buffered, 10)
+	assert.Contains(t, s.metrics(), `hvac_proxy_influx_points_total{outcome="buffered"} 10`)
+
+	standIn.setStatus(0)
+	publish()
+	points := standIn.points()
+	assert.Len(t, points, 15)
+	assert.Equal(t, buffered, points[:10], "buffered points are sent first")
+	assert.NoFileExists(t, s.cfg.BufferFile)
+	assert.Contains(t, s.metrics(), `hvac_proxy_influx_points_total{outcome="written"} 15`)
+}
+
+func TestInfluxSink_DropsRejected(t *testing.T) {
+	standIn := &influxStandIn{status: http.StatusBadRequest}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+	s := testInfluxSink(t, srv.URL)
+	publish := useInfluxSink(t, s)
+
+	publish()
+	assert.Len(t, standIn.reqs, 1, "not retried")
+	assert.NoFileExists(t, s.cfg.BufferFile)
+	assert.Contains(t, s.metrics(), `hvac_proxy_influx_points_total{outcome="dropped"} 5`)
+}
+
+func TestInfluxSink_BufferBounded(t *testing.T) {
+	s := testInfluxSink(t, "http://127.0.0.1:1")
+	s.cfg.BufferMaxBytes = 20
+
+	s.spill([]string{"a v=1i 1", "b v=2i 2"})
+	s.spill([]string{"c v=3i 3"})
+	buffered, err := os.ReadFile(s.cfg.BufferFile)
+	require.NoError(t, err)
+	assert.Equal(t, "b v=2i 2\nc v=3i 3\n", string(buffered), "oldest points dropped")
+	assert.Contains(t, s.metrics(), `hvac_proxy_influx_points_total{outcome="dropped"} 1`)
+}
+
+func TestInfluxSink_FileAndUDP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "points.lp")
+	s := testInfluxSink(t, "file://"+path)
+	require.NoError(t, s.write(context.Background(), []string{"a v=1i 1"}))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "a v=1i 1\n", string(data))
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = pc.Close() }()
+	s = testInfluxSink(t, "udp://"+pc.LocalAddr().String())
+	require.NoError(t, s.write(context.Background(), []string{"b v=2i 2"}))
+
+	buf := make([]byte, 2048)
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "b v=2i 2\n", string(buf[:n]))
+}
+
+func TestInfluxConfig_Validate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Influx.URL = "http://influx:8086"
+	cfg.Influx.BatchSize = 0
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "influx.bucket")
+	assert.Contains(t, err.Error(), "influx.batchSize")
+
+	cfg.Influx = defaultInfluxConfig()
+	cfg.Influx.URL = "tcp://influx:8089"
+	assert.ErrorContains(t, cfg.Validate(), "scheme must be")
+
+	cfg.Influx.URL = "udp://127.0.0.1:8089"
+	assert.NoError(t, cfg.Validate())
+
+	t.Setenv("INFLUX_URL", "http://influx:8086")
+	t.Setenv("INFLUX_BUCKET", "hvac")
+	t.Setenv("INFLUX_TOKEN", "secret")
+	loaded, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "hvac", loaded.Influx.Bucket)
+	assert.Equal(t, "REDACTED", loaded.Redacted().Influx.Token)
+}
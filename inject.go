@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hvac-proxy/hvac"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configPatch replaces one element of the config document the thermostat
+// polls from the cloud, such as a zone's weekly program.
+type configPatch struct {
+	Zone      int       `json:"zone,omitempty"`     // Zone the element belongs to; 0 for the system level
+	Element   string    `json:"element"`            // Element name, e.g. "program"
+	XML       string    `json:"xml"`                // Replacement element
+	Source    string    `json:"source"`             // What queued the patch, e.g. "schedule"
+	Queued    time.Time `json:"queued"`             // When it was queued
+	Delivered time.Time `json:"delivered,omitzero"` // When it was last sent to the thermostat
+}
+
+// String describes the patched element, e.g. "zone 2 program".
+func (p configPatch) String() string {
+	if p.Zone == 0 {
+		return p.Element
+	}
+	return fmt.Sprintf("zone %d %s", p.Zone, p.Element)
+}
+
+// configInjector delivers changes to the thermostat through the cloud's
+// config document. Queued patches flag configHasChanges in status responses
+// so the thermostat polls its config, and replace their elements in the
+// config responses it receives until it posts a config with the change.
+type configInjector struct {
+	file string // Where pending patches are kept across restarts; empty keeps them in memory
+	now  func() time.Time
+
+	mu        sync.Mutex
+	patches   []configPatch
+	delivered int // Config responses patches were added to
+	confirmed int // Patches the thermostat has applied
+}
+
+// injector holds the changes waiting to be delivered to the thermostat.
+var injector *configInjector
+
+func newConfigInjector(file string) *configInjector {
+	c := &configInjector{file: file, now: time.Now}
+	if data, err := os.ReadFile(file); err == nil {
+		if err := json.Unmarshal(data, &c.patches); err != nil {
+			log.Printf("[INJECT] Ignoring %s: %v", file, err)
+			c.patches = nil
+		}
+	}
+	return c
+}
+
+// initInjector sets up config injection, restoring pending patches.
+func initInjector(dataDir string) {
+	injector = newConfigInjector(filepath.Join(dataDir, "config_patches.json"))
+	hvac.RegisterMetrics("inject", injector.metrics)
+	if n := len(injector.Pending("")); n > 0 {
+		fmt.Printf("Delivering %d pending config changes to the thermostat\n", n)
+	}
+}
+
+// Queue adds patches, replacing pending ones for the same elements, and
+// returns them as queued.
+func (c *configInjector) Queue(patches ...configPatch) []configPatch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	queued := make([]configPatch, 0, len(patches))
+	for _, p := range patches {
+		p.Queued, p.Delivered = c.now(), time.Time{}
+		c.patches = slices.DeleteFunc(c.patches, func(o configPatch) bool { return o.Zone == p.Zone && o.Element == p.Element })
+		c.patches = append(c.patches, p)
+		queued = append(queued, p)
+		log.Printf("[INJECT] Queued %s change from %s", p, p.Source)
+	}
+	c.save()
+	return queued
+}
+
+// Pending returns the patches waiting to be applied, those queued by source
+// if it is not empty.
+func (c *configInjector) Pending(source string) []configPatch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := []configPatch{}
+	for _, p := range c.patches {
+		if source == "" || p.Source == source {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Discard drops the pending patches match returns true for, returning how
+// many were dropped.
+func (c *configInjector) Discard(match func(configPatch) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.patches)
+	c.patches = slices.DeleteFunc(c.patches, match)
+	if len(c.patches) != n {
+		c.save()
+	}
+	return n - len(c.patches)
+}
+
+// save writes the pending patches to the file. Callers hold c.mu.
+func (c *configInjector) save() {
+	if c.file == "" {
+		return
+	}
+	data, err := json.Marshal(c.patches)
+	if err == nil {
+		err = hvac.WriteFileAtomic(c.file, data)
+	}
+	if err != nil {
+		log.Printf("[INJECT] Failed to save pending config changes: %v", err)
+	}
+}
+
+// isConfigPath reports whether r is for the config document.
+func isConfigPath(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/config")
+}
+
+// apply flags and patches a response to the thermostat, whether it came
+// from upstream, the cache or a saved response, so changes are delivered
+// while the cloud is down too. It returns the response to send.
+func (c *configInjector) apply(w http.ResponseWriter, r *http.Request, body []byte) []byte {
+	return c.inject(w, r, c.flag(r, body))
+}
+
+// flag sets configHasChanges in a status response while patches have not
+// been delivered, so the thermostat polls its config. It returns the
+// response to send.
+func (c *configInjector) flag(r *http.Request, body []byte) []byte {
+	if !strings.HasSuffix(r.URL.Path, "/status") {
+		return body
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !slices.ContainsFunc(c.patches, func(p configPatch) bool { return p.Delivered.IsZero() }) {
+		return body
+	}
+	return setElement(body, "configHasChanges", "true")
+}
+
+// inject replaces the patched elements in a config response to the
+// thermostat. Patches the cloud's document already matches are dropped
+// first. It returns the response to send.
+func (c *configInjector) inject(w http.ResponseWriter, r *http.Request, body []byte) []byte {
+	if r.Method != http.MethodGet || !isConfigPath(r) {
+		return body
+	}
+	c.confirm(body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.patches) == 0 {
+		return body
+	}
+	injected := false
+	for i, p := range c.patches {
+		start, end, ok := elementSpan(body, p.Zone, p.Element)
+		if !ok {
+			log.Printf("[INJECT] No %s in the config document, skipping", p)
+			continue
+		}
+		body = slices.Concat(body[:start], []byte(p.XML), body[end:])
+		c.patches[i].Delivered = c.now()
+		injected = true
+	}
+	if !injected {
+		return body
+	}
+	c.delivered++
+	c.save()
+	log.Printf("[INJECT] %s %s → added %d pending config changes", r.Method, r.RequestURI, len(c.patches))
+	w.Header().Set("X-Hvac-Proxy-Config", "injected")
+	return body
+}
+
+// confirm drops the patches a config document already matches, such as the
+// config the thermostat posts after applying a change.
+func (c *configInjector) confirm(doc []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.patches)
+	c.patches = slices.DeleteFunc(c.patches, func(p configPatch) bool {
+		start, end, ok := elementSpan(doc, p.Zone, p.Element)
+		if !ok || hvac.CanonicalXML(doc[start:end]) != hvac.CanonicalXML([]byte(p.XML)) {
+			return false
+		}
+		log.Printf("[INJECT] Thermostat applied %s change from %s", p, p.Source)
+		activity.Event(p.Source, "Thermostat applied the %s change", p)
+		return true
+	})
+	if len(c.patches) != n {
+		c.confirmed += n - len(c.patches)
+		c.save()
+	}
+}
+
+// metrics renders the pending, delivered and applied changes for
+// "/metrics".
+func (c *configInjector) metrics() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("# HELP hvac_config_changes_pending config changes waiting to be applied by the thermostat\n")
+	b.WriteString("# TYPE hvac_config_changes_pending gauge\n")
+	b.WriteString(fmt.Sprintf("hvac_config_changes_pending %d\n", len(c.patches)))
+	b.WriteString("# HELP hvac_config_injections_total config responses pending changes were added to\n")
+	b.WriteString("# TYPE hvac_config_injections_total counter\n")
+	b.WriteString(fmt.Sprintf("hvac_config_injections_total %d\n", c.delivered))
+	b.WriteString("# HELP hvac_config_changes_applied_total config changes the thermostat has applied\n")
+	b.WriteString("# TYPE hvac_config_changes_applied_total counter\n")
+	b.WriteString(fmt.Sprintf("hvac_config_changes_applied_total %d\n", c.confirmed))
+	return b.String()
+}
+
+// elementSpan returns the byte range of the element called name in a
+// config document: a child of the root when zone is 0, or else a child of
+// the zone with that ID.
+func elementSpan(doc []byte, zone int, name string) (start, end int, ok bool) {
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	depth, inZone := 0, false
+	for {
+		off := d.InputOffset()
+		tok, err := d.Token()
+		if err != nil {
+			return 0, 0, false
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case zone > 0 && depth == 3 && t.Name.Local == "zone":
+				inZone = slices.Contains(t.Attr, xml.Attr{Name: xml.Name{Local: "id"}, Value: strconv.Itoa(zone)})
+			case t.Name.Local == name && ((zone == 0 && depth == 2) || (inZone && depth == 4)):
+				if d.Skip() != nil {
+					return 0, 0, false
+				}
+				return int(off), int(d.InputOffset()), true
+			}
+		case xml.EndElement:
+			if depth == 3 {
+				// The zone, or whatever else is at its depth, has ended
+				inZone = false
+			}
+			depth--
+		}
+	}
+}
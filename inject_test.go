@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testInjectConfig = `<config version="1.7"><mode>heat</mode><humidityHome><rhtg>4</rhtg></humidityHome><zones>
+<zone id="1"><name>Main</name><program><day id="Monday"><period id="1"><activity>home</activity><time>06:00</time><enabled>on</enabled></period></day></program></zone>
+<zone id="2"><name>Upstairs</name><program><day id="Monday"><period id="1"><activity>sleep</activity><time>22:00</time><enabled>on</enabled></period></day></program></zone>
+</zones></config>`
+
+// useInjector enables config injection for the duration of a test.
+func useInjector(t *testing.T) *configInjector {
+	c := newConfigInjector(filepath.Join(t.TempDir(), "config_patches.json"))
+	prev := injector
+	injector = c
+	t.Cleanup(func() { injector = prev })
+	return c
+}
+
+func TestElementSpan(t *testing.T) {
+	doc := []byte(testInjectConfig)
+	span := func(zone int, name string) string {
+		start, end, ok := elementSpan(doc, zone, name)
+		if !ok {
+			return ""
+		}
+		return string(doc[start:end])
+	}
+
+	assert.Equal(t, `<program><day id="Monday"><period id="1"><activity>sleep</activity><time>22:00</time><enabled>on</enabled></period></day></program>`, span(2, "program"))
+	assert.Equal(t, "<name>Main</name>", span(1, "name"))
+	assert.Equal(t, "<humidityHome><rhtg>4</rhtg></humidityHome>", span(0, "humidityHome"))
+	assert.Empty(t, span(0, "program"), "system level elements only")
+	assert.Empty(t, span(3, "program"))
+	assert.Empty(t, span(1, "activities"))
+
+	// Elements after the zone has closed aren't part of it
+	doc = []byte(`<config><zones><zone id="1"><name>Main</name></zone><vacation><program>x</program></vacation></zones></config>`)
+	assert.Empty(t, span(1, "program"))
+}
+
+func TestProxyHandler_InjectsConfig(t *testing.T) {
+	useDataDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/config") {
+			_, _ = w.Write([]byte(testInjectConfig))
+			return
+		}
+		_, _ = w.Write([]byte(`<status version="1.37"><serverHasChanges>false</serverHasChanges><configHasChanges>false</configHasChanges></status>`))
+	}))
+	defer srv.Close()
+	useUpstream(t, testUpstreamConfig())
+	c := useInjector(t)
+
+	do := func(method, p, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, p, strings.NewReader(body))
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		return rr
+	}
+
+	assert.Contains(t, do("POST", "/systems/123/status", "<status/>").Body.String(), "<configHasChanges>false</configHasChanges>", "nothing pending")
+
+	humidity := `<humidityHome><rhtg>6</rhtg></humidityHome>`
+	program := `<program><day id="Monday"><period id="1"><activity>away</activity><time>08:00</time><enabled>on</enabled></period></day></program>`
+	c.Queue(configPatch{Element: "humidityHome", XML: humidity, Source: "test"}, configPatch{Zone: 2, Element: "program", XML: program, Source: "test"})
+	require.Len(t, c.Pending("test"), 2)
+	assert.Contains(t, do("POST", "/systems/123/status", "<status/>").Body.String(), "<configHasChanges>true</configHasChanges>")
+
+	rr := do("GET", "/systems/123/config", "")
+	assert.Equal(t, "injected", rr.Header().Get("X-Hvac-Proxy-Config"))
+	doc := rr.Body.String()
+	assert.Contains(t, doc, `<mode>heat</mode>`+humidity)
+	assert.Contains(t, doc, `<zone id="1"><name>Main</name><program><day id="Monday"><period id="1"><activity>home</activity>`, "other zones are kept")
+	assert.Contains(t, doc, `<zone id="2"><name>Upstairs</name>`+program+`</zone>`)
+	assert.Contains(t, do("POST", "/systems/123/status", "<status/>").Body.String(), "<configHasChanges>false</configHasChanges>", "flagged until delivered")
+
+	// The thermostat posts its config once it has applied the changes
+	do("POST", "/systems/123/config", strings.Replace(doc, "<program>", "\n  <program>", -1))
+	assert.Empty(t, c.Pending(""))
+	rr = do("GET", "/systems/123/config", "")
+	assert.Empty(t, rr.Header().Get("X-Hvac-Proxy-Config"))
+
+	m := c.metrics()
+	assert.Contains(t, m, "hvac_config_changes_pending 0\n")
+	assert.Contains(t, m, "hvac_config_injections_total 1\n")
+	assert.Contains(t, m, "hvac_config_changes_applied_total 2\n")
+}
+
+func TestProxyHandler_InjectsConfigWhileUpstreamDown(t *testing.T) {
+	useDataDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/config") {
+			_, _ = w.Write([]byte(testInjectConfig))
+			return
+		}
+		_, _ = w.Write([]byte(`<status version="1.37"><configHasChanges>false</configHasChanges></status>`))
+	}))
+	cfg := testUpstreamConfig()
+	cfg.Fallback = true
+	useUpstream(t, cfg)
+	c := useInjector(t)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	do := func(method, p string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, p, strings.NewReader("<status/>"))
+		req.Host = host
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		return rr
+	}
+	do("POST", "/systems/123/status")
+	do("GET", "/systems/123/config")
+
+	// Upstream becomes unreachable; the saved responses carry the change
+	srv.Close()
+	humidity := `<humidityHome><rhtg>6</rhtg></humidityHome>`
+	c.Queue(configPatch{Element: "humidityHome", XML: humidity, Source: "test"})
+
+	rr := do("POST", "/systems/123/status")
+	assert.Equal(t, "saved", rr.Header().Get("X-Hvac-Proxy-Fallback"))
+	assert.Contains(t, rr.Body.String(), "<configHasChanges>true</configHasChanges>")
+	rr = do("GET", "/systems/123/config")
+	assert.Equal(t, "saved", rr.Header().Get("X-Hvac-Proxy-Fallback"))
+	assert.Equal(t, "injected", rr.Header().Get("X-Hvac-Proxy-Config"))
+	assert.Contains(t, rr.Body.String(), humidity)
+}
+
+func TestConfigInjector_Persists(t *testing.T) {
+	c := useInjector(t)
+	c.now = func() time.Time { return time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC) }
+	queued := c.Queue(configPatch{Zone: 1, Element: "program", XML: "<program/>", Source: "schedule"})
+	require.Len(t, queued, 1)
+	assert.Equal(t, c.now(), queued[0].Queued)
+	c.Queue(configPatch{Zone: 1, Element: "program", XML: "<program></program>", Source: "schedule"})
+
+	pending := newConfigInjector(c.file).Pending("schedule")
+	require.Len(t, pending, 1, "a new patch replaces the pending one")
+	assert.Equal(t, "<program></program>", pending[0].XML)
+	assert.Equal(t, 1, c.Discard(func(p configPatch) bool { return p.Zone == 1 }))
+	assert.Empty(t, newConfigInjector(c.file).Pending(""))
+}
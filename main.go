@@ -2,16 +2,51 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"hvac-proxy/hvac"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// capture records proxied exchanges when CAPTURE_ENABLED is set.
+var capture *hvac.Capture
+
+// cache stores upstream GET responses when CACHE_ENABLED is set.
+var cache *responseCache
+
+// auth checks admin and API requests when credentials are configured.
+var auth *authenticator
+
+// audit records control actions on the admin and API endpoints.
+var audit *auditLog
+
+// upstream forwards thermostat requests to the Carrier servers.
+var upstream = newUpstreamClient(defaultUpstreamConfig())
+
+// logLevel holds the configured log level. A reload can change it.
+var logLevel atomic.Value
+
+// logTraffic reports whether each request and response is logged.
+func logTraffic() bool {
+	return logLevel.Load() != "warn"
+}
+
 func logRequest(r *http.Request, body []byte) {
+	if !logTraffic() {
+		return
+	}
 	// Infer scheme from the connection
 	var scheme string
 	if r.TLS != nil {
@@ -26,6 +61,9 @@ func logRequest(r *http.Request, body []byte) {
 }
 
 func logResponse(resp *http.Response, elapsed time.Duration) {
+	if !logTraffic() {
+		return
+	}
 	// Use the Request field from the response to get URL details
 	fullURL := fmt.Sprintf("%s://%s%s",
 		resp.Request.URL.Scheme,
@@ -41,26 +79,99 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	started := time.Now()
+
+	// Trace the exchange when OTLP export is enabled
+	ctx, span := hvac.StartSpan(r.Context(), r.Method+" "+r.URL.Path, hvac.SpanServer)
+	r = r.WithContext(ctx)
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
+	span.SetAttr("http.request.method", r.Method)
+	span.SetAttr("url.path", r.URL.Path)
+	span.SetAttr("server.address", r.Host)
+	defer func() {
+		span.SetAttr("http.response.status_code", rec.status)
+		span.Finish()
+	}()
+
 	// Read request body
+	_, read := hvac.StartSpan(ctx, "read request", hvac.SpanInternal)
 	var reqBuf bytes.Buffer
 	if r.Body != nil {
 		_, _ = io.Copy(&reqBuf, r.Body)
 	}
 	body := reqBuf.Bytes()
 	r.Body = io.NopCloser(bytes.NewBuffer(body))
+	read.SetAttr("http.request.body.size", len(body))
+	read.Finish()
 
 	logRequest(r, body)
 	hvac.SaveBody(r, body, true)
 
+	// Config posted by the thermostat shows which pending changes it applied
+	if injector != nil && isConfigPath(r) && r.Method == http.MethodPost {
+		injector.confirm(hvac.DecodeBody(body))
+	}
+
+	// Check the thermostat's clock and answer time requests from the host clock
+	if clock != nil {
+		if strings.HasSuffix(r.URL.Path, "/status") && r.Method == http.MethodPost {
+			clock.observe(hvac.DecodeBody(body))
+		}
+		if doc := clock.answer(w, r); doc != nil {
+			span.SetAttr("hvac.time", "local")
+			recordExchange(r, body, started, http.StatusOK, w.Header(), doc, 0, 0, "served local time")
+			return
+		}
+	}
+
+	// Answer weather forecasts from local data when configured
+	if weather != nil {
+		if doc := weather.answer(w, r, false); doc != nil {
+			span.SetAttr("hvac.weather", "local")
+			recordExchange(r, body, started, http.StatusOK, w.Header(), doc, 0, 0, "served local weather")
+			return
+		}
+	}
+
+	// Serve fresh cached documents without going upstream
+	if cache != nil {
+		if e := cache.Fresh(r); e != nil {
+			span.SetAttr("hvac.cache", "hit")
+			e.Body = localChanges(w, r, e.Body, "cache")
+			recordExchange(r, body, started, e.Status, e.Header, e.Body, 0, 0, "served from cache")
+			e.serve(w, "HIT")
+			return
+		}
+	}
+
 	// Forward to upstream
 	targetURL := fmt.Sprintf("http://%s%s", r.Host, r.RequestURI)
 
-	upReq, _ := http.NewRequest(r.Method, targetURL, bytes.NewReader(body))
-	upReq.Header = r.Header.Clone()
 	startTime := time.Now()
-	resp, err := http.DefaultClient.Do(upReq)
+	_, up := hvac.StartSpan(ctx, "upstream "+r.Method, hvac.SpanClient)
+	up.SetAttr("server.address", r.Host)
+	resp, err := upstream.Do(ctx, r.Method, targetURL, r.Header.Clone(), body)
 	if err != nil {
-		http.Error(w, "Upstream error", http.StatusBadGateway)
+		up.SetError(err)
+		up.Finish()
+		span.SetError(err)
+		recordExchange(r, body, started, 0, nil, nil, time.Since(startTime), 0, err.Error())
+		log.Printf("[ERR]  %s %s → %v", r.Method, targetURL, err)
+		if weather != nil && weather.answer(w, r, true) != nil {
+			return
+		}
+		if serveFallback(w, r) {
+			return
+		}
+		if messages != nil && messages.answer(w, r) != nil {
+			return
+		}
+		if errors.Is(err, errBreakerOpen) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(upstream.config().BreakerCooldown.Seconds())))
+		}
+		status := upstreamErrorStatus(err)
+		http.Error(w, "Upstream error: "+http.StatusText(status), status)
 		return
 	}
 	defer func() { _ = resp.Body.Close() }()
@@ -69,45 +180,265 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	var respBuf bytes.Buffer
 	_, _ = io.Copy(&respBuf, resp.Body)
 	respBody := respBuf.Bytes()
+	up.SetAttr("http.response.status_code", resp.StatusCode)
+	up.SetAttr("http.response.body.size", len(respBody))
+	up.Finish()
 
 	logResponse(resp, elapsed)
-	hvac.SaveBody(r, respBody, false)
+	receive := time.Since(startTime) - elapsed
+	if resp.StatusCode >= 500 {
+		recordExchange(r, body, started, resp.StatusCode, resp.Header, respBody, elapsed, receive, "")
+		// Keep the last good response on disk for fallback
+		if weather != nil && weather.answer(w, r, true) != nil {
+			return
+		}
+		if serveFallback(w, r) {
+			return
+		}
+		if messages != nil && messages.answer(w, r) != nil {
+			return
+		}
+	} else {
+		hvac.SaveBody(r, respBody, false)
+		if cache != nil {
+			cache.Store(r, resp, respBody)
+		}
+		if resp.StatusCode == http.StatusOK {
+			respBody = localChanges(w, r, respBody, "upstream")
+		}
+		if messages != nil && resp.StatusCode == http.StatusNotFound && messages.answer(w, r) != nil {
+			// Upstream has no notifications endpoint; answer with the queued messages
+			recordExchange(r, body, started, resp.StatusCode, resp.Header, respBody, elapsed, receive, "answered with queued messages")
+			return
+		}
+		// Record what the thermostat receives, after local changes
+		recordExchange(r, body, started, resp.StatusCode, resp.Header, respBody, elapsed, receive, "")
+	}
 
 	// Write response
 	w.WriteHeader(resp.StatusCode)
 	_, _ = w.Write(respBody)
 }
 
-func init() {
-	// Determine DATA_DIR or fallback to temp dir
-	dataDir := os.Getenv("DATA_DIR")
-	if dataDir == "" {
-		tmp, err := os.MkdirTemp("", "hvac-data-*")
-		if err != nil {
-			fmt.Printf("Failed to create temp directory: %v\n", err)
-			return
+// serveFallback answers a request upstream could not, using a stale cache
+// entry if one exists, or else the last saved response when fallback is
+// enabled. It reports whether a response was written.
+func serveFallback(w http.ResponseWriter, r *http.Request) bool {
+	if cache != nil {
+		if e := cache.Stale(r); e != nil {
+			log.Printf("[CACHE] %s %s → serving stale response from %s", r.Method, r.RequestURI, e.Stored.Format(time.RFC3339))
+			activity.Event("cache", "Served stale response for %s from %s", r.URL.Path, e.Stored.Format(time.RFC3339))
+			e.Body = localChanges(w, r, e.Body, "cache")
+			e.serve(w, "STALE")
+			return true
 		}
-		_ = os.Setenv("DATA_DIR", tmp)
 	}
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if !upstream.config().Fallback {
+		return false
+	}
+	data, err := hvac.LoadSavedResponse(r)
+	if err != nil {
+		return false
 	}
-	_ = os.Setenv("PORT", port)
+	upstream.fellBack()
+	log.Printf("[FALLBACK] %s %s → serving saved response (%d bytes)", r.Method, r.RequestURI, len(data))
+	activity.Event("fallback", "Served saved response for %s", r.URL.Path)
+	w.Header().Set("X-Hvac-Proxy-Fallback", "saved")
+	data = localChanges(w, r, data, "cache")
+	_, _ = w.Write(data)
+	return true
+}
+
+// localChanges applies the proxy's own changes to a successful response,
+// whether from upstream or, with source "cache", the cache or a saved file:
+// local weather merged into forecasts, clock corrections, pending config
+// changes and queued messages.
+func localChanges(w http.ResponseWriter, r *http.Request, body []byte, source string) []byte {
+	if weather != nil {
+		body = weather.merge(w, r, body, source)
+	}
+	if clock != nil {
+		body = clock.correct(r, body)
+	}
+	if injector != nil {
+		body = injector.apply(w, r, body)
+	}
+	if messages != nil {
+		body = messages.inject(w, r, body)
+	}
+	return body
+}
+
+// recordExchange adds the exchange to the recent activity and, if capture is
+// enabled, the capture buffer. A zero status means no response was received;
+// note records why.
+func recordExchange(r *http.Request, body []byte, started time.Time, status int, header http.Header, respBody []byte, wait, receive time.Duration, note string) {
+	activity.Request(r, status, time.Since(started), note)
+	if capture == nil {
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	capture.Record(hvac.Exchange{
+		Started:        started,
+		Method:         r.Method,
+		URL:            fmt.Sprintf("%s://%s%s", scheme, r.Host, r.RequestURI),
+		Proto:          r.Proto,
+		RequestHeader:  r.Header.Clone(),
+		RequestBody:    body,
+		StatusCode:     status,
+		ResponseHeader: header.Clone(),
+		ResponseBody:   respBody,
+		Wait:           wait,
+		Receive:        receive,
+		Error:          note,
+	})
+}
+
+// initCache enables the upstream response cache when configured.
+func initCache(cfg CacheConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	cache = newResponseCache(cfg)
+	hvac.RegisterMetrics("cache", cache.metrics)
+	fmt.Printf("Caching upstream responses in %s\n", cfg.Dir)
+}
+
+// initCapture enables traffic capture when configured.
+func initCapture(cfg hvac.CaptureConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	capture = hvac.NewCapture(cfg)
+	fmt.Printf("Capturing traffic to %s\n", cfg.Dir)
 }
 
 var Version = "dev"
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "simulate":
+			os.Exit(runSimulate(os.Args[2:]))
+		case "mock-upstream":
+			os.Exit(runMockUpstream(os.Args[2:]))
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		case "backups":
+			os.Exit(runBackups(os.Args[2:]))
+		}
+	}
+
+	os.Exit(runServer(os.Args[1:]))
+}
+
+// runServer starts the proxy and blocks until SIGINT or SIGTERM, then drains
+// in-flight requests and flushes queued work before returning the exit code.
+func runServer(args []string) int {
+	fs := flag.NewFlagSet("hvac-proxy", flag.ContinueOnError)
+	flags := addConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cfg, err := flags.load()
+	if err == nil {
+		err = cfg.prepare()
+	}
+	if err != nil {
+		fmt.Printf("Invalid configuration:\n%v\n", err)
+		return 1
+	}
+
 	fmt.Printf("HVAC Proxy version: %s\n", Version)
-	hvac.InitMQTT()
+	hvac.Configure(cfg.hvac())
+	logLevel.Store(cfg.LogLevel)
+	hvac.InitMQTT(cfg.MQTT)
+	initCapture(cfg.Capture)
+	upstream = newUpstreamClient(cfg.Upstream)
+	hvac.RegisterMetrics("upstream", upstream.metrics)
+	hvac.RegisterMetrics("stream", hvac.Events.Metrics)
+	hvac.RegisterMetrics("diagnostics", hvac.DiagnosticsMetrics)
+	hvac.LoadInventory()
+	hvac.LoadSystemConfig()
+	hvac.RegisterMetrics("inventory", hvac.InventoryMetrics)
+	if err := initFaults(cfg.Faults); err != nil {
+		fmt.Printf("Fault catalog error: %v\n", err)
+		return 1
+	}
+	hvac.RegisterMetrics("faults", hvac.Faults.Metrics)
+	if err := hvac.LoadEnergy(); err != nil {
+		log.Printf("[ENERGY] %v", err)
+	}
+	hvac.RegisterMetrics("energy", hvac.EnergyHistory.Metrics)
+	hvac.Events.AddSink("activity", activitySink{activity}, hvac.SinkConfig{QueueSize: 50, BatchSize: 50})
+	initCache(cfg.Cache)
+	initWeather(cfg.Weather)
+	if err := initClock(cfg.Time); err != nil {
+		fmt.Printf("Clock error: %v\n", err)
+		return 1
+	}
+	if err := initInflux(cfg.Influx); err != nil {
+		fmt.Printf("InfluxDB sink error: %v\n", err)
+		return 1
+	}
+	initOTLP(cfg.OTLP)
+	initWebhooks(cfg.Webhooks)
+	initArchive(cfg.Archive)
+	hvac.RegisterMetrics("sinks", hvac.Events.SinkMetrics)
+
+	audit = newAuditLog(cfg.Auth.AuditLog)
+	initMessages(cfg.Messages, cfg.DataDir)
+	initInjector(cfg.DataDir)
+	initBackups(cfg.Backup, cfg.DataDir)
+	if cfg.Auth.Enabled() {
+		auth = newAuthenticator(cfg.Auth)
+		fmt.Println("Admin authentication enabled")
+	}
+	admin := newAdminMux()
+	proxy := newProxyMux(admin, cfg.Admin.Addr == "")
+
+	// Stop accepting on SIGINT/SIGTERM, drain requests, then flush
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Reload on SIGHUP or when the config file changes
+	reload := newReloader(cfg, flags.path(), flags.load)
+	hvac.RegisterMetrics("config", reload.metrics)
+	go reload.run(ctx, cfg.WatchInterval)
+
+	srv := newServer(":"+strconv.Itoa(cfg.Port), proxy, cfg.Server)
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		fmt.Printf("Server error: %v\n", err)
+		return 1
+	}
+	servers := []listener{{srv, ln}}
+	fmt.Printf("Server running on port %d\n saving to %s\n", cfg.Port, cfg.DataDir)
 
-	http.HandleFunc("/", proxyHandler)
-	http.HandleFunc("/metrics", hvac.HandleMetrics)
+	if cfg.Admin.Addr != "" {
+		adminLn, err := listenAdmin(cfg.Admin, cfg.Auth.ClientCA)
+		if err != nil {
+			_ = ln.Close()
+			fmt.Printf("Admin server error: %v\n", err)
+			return 1
+		}
+		servers = append(servers, listener{newServer(cfg.Admin.Addr, admin, cfg.Server), adminLn})
+		fmt.Printf("Admin server running on %s\n", adminLn.Addr())
+	}
 
-	fmt.Printf("Server running on port %s\n saving to %s\n",
-		os.Getenv("PORT"), os.Getenv("DATA_DIR"))
-	if err := http.ListenAndServe(":"+os.Getenv("PORT"), nil); err != nil {
+	code := 0
+	ready.Store(true)
+	if err := serveAll(ctx, servers, cfg.Server.ShutdownTimeout); err != nil {
 		fmt.Printf("Server error: %v\n", err)
+		code = 1
 	}
+	ready.Store(false)
+	flush(cfg.Server.ShutdownTimeout)
+	fmt.Println("Shutdown complete")
+	return code
 }
@@ -5,12 +5,38 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"hvac-proxy/hvac"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "hvac-test-*")
+	if err != nil {
+		panic(err)
+	}
+	hvac.Configure(hvac.Config{DataDir: dir})
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// useDataDir points the hvac package at a fresh data directory for the
+// duration of a test.
+func useDataDir(t *testing.T) string {
+	dir := t.TempDir()
+	prev := hvac.Settings()
+	hvac.Configure(hvac.Config{DataDir: dir})
+	t.Cleanup(func() { hvac.Configure(prev) })
+	return dir
+}
+
 func TestProxyHandler_IgnoresFavicon(t *testing.T) {
 	req := httptest.NewRequest("GET", "/favicon.ico", nil)
 	rr := httptest.NewRecorder()
@@ -41,3 +67,55 @@ func TestProxyHandler_ForwardsRequest(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rr.Code)
 	assert.Contains(t, rr.Body.String(), "<status>")
 }
+
+func TestProxyHandler_RecordsCapture(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(`<status><pingRate>12</pingRate></status>`))
+	}))
+	defer upstream.Close()
+
+	capture = hvac.NewCapture(hvac.CaptureConfig{BufferSize: 5})
+	defer func() { capture = nil }()
+
+	req := httptest.NewRequest("POST", "/systems/123/profile", strings.NewReader("data=%3Cprofile%3E%3C%2Fprofile%3E"))
+	req.Host = strings.TrimPrefix(upstream.URL, "http://")
+	proxyHandler(httptest.NewRecorder(), req)
+
+	entries := capture.Entries()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "POST", entries[0].Request.Method)
+	assert.Equal(t, "<profile></profile>", entries[0].Request.PostData.DecodedText)
+	assert.Equal(t, "application/xml", entries[0].Response.Content.MimeType)
+}
+
+func TestProxyHandler_RecordsServedBody(t *testing.T) {
+	useDataDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testInjectConfig))
+	}))
+	defer srv.Close()
+	useUpstream(t, testUpstreamConfig())
+	useCache(t, CacheConfig{TTLs: []CacheTTL{{"/systems/*/config", time.Hour}}})
+	c := useInjector(t)
+	capture = hvac.NewCapture(hvac.CaptureConfig{BufferSize: 5})
+	defer func() { capture = nil }()
+
+	get := func() string {
+		req := httptest.NewRequest("GET", "/systems/123/config", nil)
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		return rr.Body.String()
+	}
+	humidity := `<humidityHome><rhtg>6</rhtg></humidityHome>`
+	c.Queue(configPatch{Element: "humidityHome", XML: humidity, Source: "test"})
+	live := get()
+	cached := get()
+	assert.Contains(t, cached, humidity)
+
+	entries := capture.Entries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, live, entries[0].Response.Content.Text)
+	assert.Equal(t, cached, entries[1].Response.Content.Text, "cache hits are recorded as served")
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hvac-proxy/hvac"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessagesConfig controls the custom messages shown on the thermostat.
+type MessagesConfig struct {
+	Path  string `yaml:"path"`  // path.Match pattern of the cloud responses messages are added to
+	Topic string `yaml:"topic"` // MQTT topic accepting messages as JSON; empty disables
+	Max   int    `yaml:"max"`   // Messages kept at most; the oldest of the lowest priority is dropped
+}
+
+// defaultMessagesConfig returns the settings used when nothing is configured.
+func defaultMessagesConfig() MessagesConfig {
+	return MessagesConfig{Path: "/systems/*/notifications", Max: 20}
+}
+
+// validateMessages checks the message settings.
+func validateMessages(c *MessagesConfig, mqttBroker string, check func(bool, string, string, ...any)) {
+	_, err := path.Match(c.Path, "/")
+	check(c.Path != "" && err == nil, "messages.path", "invalid pattern %q", c.Path)
+	check(c.Topic == "" || mqttBroker != "", "messages.topic", "requires mqtt.broker")
+	check(c.Max > 0, "messages.max", "must be positive")
+}
+
+// messagePriorities lists the priorities, lowest first.
+var messagePriorities = []string{"low", "normal", "high"}
+
+// Limits on message text, so it fits the thermostat screen.
+const (
+	maxMessageTitle = 64
+	maxMessageBody  = 512
+)
+
+// message is a custom message for the thermostat screen.
+type message struct {
+	ID       string    `json:"id"`
+	Title    string    `json:"title"`
+	Body     string    `json:"body"`
+	Priority string    `json:"priority"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires,omitzero"` // Zero keeps the message until it is deleted
+}
+
+// messageRequest is the JSON accepted by the API and the MQTT topic.
+type messageRequest struct {
+	ID       string    `json:"id"`       // Replaces the message with this ID; generated if empty
+	Title    string    `json:"title"`    // Required
+	Body     string    `json:"body"`     // Optional text below the title
+	Priority string    `json:"priority"` // low, normal or high (default normal)
+	Expires  time.Time `json:"expires"`  // When the message is removed
+	TTL      string    `json:"ttl"`      // Or how long it is kept, e.g. "48h"
+	Delete   bool      `json:"delete"`   // Over MQTT, deletes the message with ID instead
+}
+
+// messageID matches the IDs a request may set. They end up in the XML sent
+// to the thermostat, so only plain names are accepted.
+var messageID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// message validates the request and builds the message.
+func (req messageRequest) message(now time.Time) (message, error) {
+	m := message{ID: req.ID, Title: strings.TrimSpace(req.Title), Body: strings.TrimSpace(req.Body), Priority: req.Priority, Created: now, Expires: req.Expires}
+	var errs []error
+	if m.ID != "" && !messageID.MatchString(m.ID) {
+		errs = append(errs, fmt.Errorf("id must be 1 to 32 letters, digits, _ or -, got %q", m.ID))
+	}
+	if m.Title == "" {
+		errs = append(errs, errors.New("title is required"))
+	}
+	if utf8.RuneCountInString(m.Title) > maxMessageTitle {
+		errs = append(errs, fmt.Errorf("title must be at most %d characters", maxMessageTitle))
+	}
+	if utf8.RuneCountInString(m.Body) > maxMessageBody {
+		errs = append(errs, fmt.Errorf("body must be at most %d characters", maxMessageBody))
+	}
+	if m.Priority == "" {
+		m.Priority = "normal"
+	}
+	if !slices.Contains(messagePriorities, m.Priority) {
+		errs = append(errs, fmt.Errorf("priority must be low, normal or high, got %q", m.Priority))
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		switch {
+		case err != nil || ttl <= 0:
+			errs = append(errs, fmt.Errorf("invalid ttl %q", req.TTL))
+		case !req.Expires.IsZero():
+			errs = append(errs, errors.New("set expires or ttl, not both"))
+		default:
+			m.Expires = now.Add(ttl)
+		}
+	}
+	if !m.Expires.IsZero() && !m.Expires.After(now) {
+		errs = append(errs, errors.New("expires must be in the future"))
+	}
+	if m.ID == "" {
+		b := make([]byte, 4)
+		_, _ = rand.Read(b)
+		m.ID = hex.EncodeToString(b)
+	}
+	return m, errors.Join(errs...)
+}
+
+// messageQueue holds the messages shown on the thermostat and adds them to
+// its cloud responses.
+type messageQueue struct {
+	cfg  MessagesConfig
+	file string // Where the messages are kept across restarts; empty keeps them in memory
+	now  func() time.Time
+
+	mu        sync.Mutex
+	messages  []message // Highest priority, then newest, first
+	delivered int       // Responses messages were added to
+}
+
+// messages holds the custom messages for the thermostat.
+var messages *messageQueue
+
+func newMessageQueue(cfg MessagesConfig, file string) *messageQueue {
+	q := &messageQueue{cfg: cfg, file: file, now: time.Now}
+	if data, err := os.ReadFile(file); err == nil {
+		if err := json.Unmarshal(data, &q.messages); err != nil {
+			log.Printf("[MESSAGE] Ignoring %s: %v", file, err)
+			q.messages = nil
+		}
+	}
+	return q
+}
+
+// initMessages sets up the message queue, subscribing to the MQTT command
+// topic if one is set.
+func initMessages(cfg MessagesConfig, dataDir string) {
+	messages = newMessageQueue(cfg, filepath.Join(dataDir, "messages.json"))
+	hvac.RegisterMetrics("messages", messages.metrics)
+	if cfg.Topic != "" && hvac.SubscribeMQTT(cfg.Topic, messages.receive) {
+		fmt.Printf("Accepting thermostat messages on MQTT topic %s\n", cfg.Topic)
+	}
+}
+
+// Add queues a message, replacing one with the same ID.
+func (q *messageQueue) Add(m message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire()
+	q.messages = slices.DeleteFunc(q.messages, func(o message) bool { return o.ID == m.ID })
+	q.messages = append(q.messages, m)
+	slices.SortStableFunc(q.messages, func(a, b message) int {
+		if d := slices.Index(messagePriorities, b.Priority) - slices.Index(messagePriorities, a.Priority); d != 0 {
+			return d
+		}
+		return b.Created.Compare(a.Created)
+	})
+	if len(q.messages) > q.cfg.Max {
+		q.messages = q.messages[:q.cfg.Max]
+	}
+	q.save()
+	log.Printf("[MESSAGE] Queued %s message %s: %s", m.Priority, m.ID, m.Title)
+	activity.Event("message", "Queued message for the thermostat: %s", m.Title)
+}
+
+// Delete removes a message, reporting whether it existed.
+func (q *messageQueue) Delete(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.messages)
+	q.messages = slices.DeleteFunc(q.messages, func(m message) bool { return m.ID == id })
+	if len(q.messages) == n {
+		return false
+	}
+	q.save()
+	return true
+}
+
+// List returns the messages that have not expired, highest priority first.
+func (q *messageQueue) List() []message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire()
+	return append([]message{}, q.messages...)
+}
+
+// expire drops expired messages. Callers hold q.mu.
+func (q *messageQueue) expire() {
+	now := q.now()
+	n := len(q.messages)
+	q.messages = slices.DeleteFunc(q.messages, func(m message) bool { return !m.Expires.IsZero() && !m.Expires.After(now) })
+	if len(q.messages) != n {
+		q.save()
+	}
+}
+
+// save writes the messages to the file. Callers hold q.mu.
+func (q *messageQueue) save() {
+	if q.file == "" {
+		return
+	}
+	data, err := json.Marshal(q.messages)
+	if err == nil {
+		err = hvac.WriteFileAtomic(q.file, data)
+	}
+	if err != nil {
+		log.Printf("[MESSAGE] Failed to save messages: %v", err)
+	}
+}
+
+// receive handles a message published to the MQTT command topic. Each
+// command is recorded in the audit log, like control requests to the API.
+func (q *messageQueue) receive(payload []byte) {
+	entry := auditEntry{Principal: "mqtt", Auth: "mqtt", Method: "PUBLISH", Path: q.cfg.Topic, Status: http.StatusOK}
+	var req messageRequest
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	switch {
+	case err != nil:
+		entry.Status, entry.Detail = http.StatusBadRequest, fmt.Sprintf("invalid message JSON: %v", err)
+	case req.Delete:
+		if req.ID == "" || !q.Delete(req.ID) {
+			entry.Status = http.StatusNotFound
+		}
+		entry.Detail = "delete message " + req.ID
+	default:
+		m, err := req.message(q.now())
+		if err != nil {
+			entry.Status, entry.Detail = http.StatusBadRequest, err.Error()
+			break
+		}
+		q.Add(m)
+		entry.Detail = "queue message " + m.ID
+	}
+	if entry.Status != http.StatusOK {
+		log.Printf("[MESSAGE] Rejected command on %s: %s", q.cfg.Topic, entry.Detail)
+	}
+	audit.write(entry)
+}
+
+// applies reports whether messages are added to the response to r.
+func (q *messageQueue) applies(r *http.Request) bool {
+	ok, _ := path.Match(q.cfg.Path, r.URL.Path)
+	return ok && r.Method == http.MethodGet
+}
+
+// render returns the messages as <message> elements, or nil if there are
+// none. Callers hold q.mu.
+func (q *messageQueue) render() []byte {
+	q.expire()
+	if len(q.messages) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	text := func(name, v string) {
+		fmt.Fprintf(&b, "<%s>", name)
+		_ = xml.EscapeText(&b, []byte(v))
+		fmt.Fprintf(&b, "</%s>", name)
+	}
+	for _, m := range q.messages {
+		b.WriteString(`<message id="`)
+		_ = xml.EscapeText(&b, []byte(m.ID))
+		b.WriteString(`">`)
+		text("title", m.Title)
+		text("text", m.Body)
+		text("priority", m.Priority)
+		text("created", m.Created.Format(time.RFC3339))
+		if !m.Expires.IsZero() {
+			text("expires", m.Expires.Format(time.RFC3339))
+		}
+		b.WriteString("</message>")
+	}
+	return b.Bytes()
+}
+
+// emptyMessages matches a self-closed <messages/> element.
+var emptyMessages = regexp.MustCompile(`<messages\s*/>`)
+
+// inject adds the queued messages to a cloud response: inside its
+// <messages> element if it has one, or else in a new one at the end of the
+// document.
+func (q *messageQueue) inject(w http.ResponseWriter, r *http.Request, body []byte) []byte {
+	if !q.applies(r) {
+		return body
+	}
+	q.mu.Lock()
+	elems := q.render()
+	q.mu.Unlock()
+	if elems == nil {
+		return body
+	}
+	var at int
+	empty := emptyMessages.FindIndex(body)
+	switch {
+	case bytes.Contains(body, []byte("</messages>")):
+		at = bytes.LastIndex(body, []byte("</messages>"))
+	case empty != nil:
+		// Expand <messages/> in place
+		at = empty[0]
+		body = slices.Concat(body[:empty[0]], body[empty[1]:])
+		elems = slices.Concat([]byte("<messages>"), elems, []byte("</messages>"))
+	case bytes.HasSuffix(bytes.TrimSpace(body), []byte("/>")) || bytes.LastIndex(body, []byte("</")) < 0:
+		// Nothing to add to, such as an empty document
+		return body
+	default:
+		at = bytes.LastIndex(body, []byte("</"))
+		elems = slices.Concat([]byte("<messages>"), elems, []byte("</messages>"))
+	}
+	q.mu.Lock()
+	q.delivered++
+	q.mu.Unlock()
+	w.Header().Set("X-Hvac-Proxy-Messages", "added")
+	return slices.Concat(body[:at], elems, body[at:])
+}
+
+// answer writes a document with the queued messages when upstream could
+// not answer, returning it, or returns nil if there are none.
+func (q *messageQueue) answer(w http.ResponseWriter, r *http.Request) []byte {
+	if !q.applies(r) {
+		return nil
+	}
+	q.mu.Lock()
+	elems := q.render()
+	if elems != nil {
+		q.delivered++
+	}
+	q.mu.Unlock()
+	if elems == nil {
+		return nil
+	}
+	doc := slices.Concat([]byte(`<notifications version="1.0"><messages>`), elems, []byte("</messages></notifications>"))
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Hvac-Proxy-Messages", "local")
+	_, _ = w.Write(doc)
+	return doc
+}
+
+// metrics renders the queued messages and deliveries for "/metrics".
+func (q *messageQueue) metrics() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire()
+	count := map[string]int{}
+	for _, m := range q.messages {
+		count[m.Priority]++
+	}
+	var b strings.Builder
+	b.WriteString("# HELP hvac_messages_queued custom messages waiting on the thermostat by priority\n")
+	b.WriteString("# TYPE hvac_messages_queued gauge\n")
+	for _, p := range messagePriorities {
+		b.WriteString(fmt.Sprintf("hvac_messages_queued{priority=%q} %d\n", p, count[p]))
+	}
+	b.WriteString("# HELP hvac_messages_delivered_total thermostat responses custom messages were added to\n")
+	b.WriteString("# TYPE hvac_messages_delivered_total counter\n")
+	b.WriteString(fmt.Sprintf("hvac_messages_delivered_total %d\n", q.delivered))
+	return b.String()
+}
+
+// handleMessages serves the queued messages.
+func handleMessages(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, messages.List())
+}
+
+// handleAddMessage queues the message in the JSON body.
+func handleAddMessage(w http.ResponseWriter, r *http.Request) {
+	var req messageRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, "invalid message JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := req.message(messages.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages.Add(m)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, m)
+}
+
+// handleDeleteMessage removes a queued message.
+func handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	if !messages.Delete(r.PathValue("id")) {
+		http.Error(w, "no such message", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useMessages enables the message queue for the duration of a test, with
+// the time fixed at now.
+func useMessages(t *testing.T, cfg MessagesConfig, now time.Time) *messageQueue {
+	if cfg.Path == "" {
+		cfg.Path = defaultMessagesConfig().Path
+	}
+	if cfg.Max == 0 {
+		cfg.Max = 20
+	}
+	q := newMessageQueue(cfg, filepath.Join(t.TempDir(), "messages.json"))
+	q.now = func() time.Time { return now }
+	prev := messages
+	messages = q
+	t.Cleanup(func() { messages = prev })
+	return q
+}
+
+func TestMessageRequest_Validate(t *testing.T) {
+	now := time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC)
+
+	m, err := messageRequest{Title: " Filter due ", TTL: "48h"}.message(now)
+	require.NoError(t, err)
+	assert.Equal(t, "Filter due", m.Title)
+	assert.Equal(t, "normal", m.Priority)
+	assert.Equal(t, now.Add(48*time.Hour), m.Expires)
+	assert.Len(t, m.ID, 8)
+
+	_, err = messageRequest{Priority: "urgent", TTL: "soon"}.message(now)
+	assert.ErrorContains(t, err, "title is required")
+	assert.ErrorContains(t, err, `priority must be low, normal or high, got "urgent"`)
+	assert.ErrorContains(t, err, `invalid ttl "soon"`)
+
+	_, err = messageRequest{Title: strings.Repeat("x", 65)}.message(now)
+	assert.ErrorContains(t, err, "title must be at most 64 characters")
+	_, err = messageRequest{Title: "Late", Expires: now.Add(-time.Minute)}.message(now)
+	assert.ErrorContains(t, err, "expires must be in the future")
+	_, err = messageRequest{ID: `x"/><configHasChanges>true</configHasChanges><x a="`, Title: "Hi"}.message(now)
+	assert.ErrorContains(t, err, "id must be 1 to 32 letters, digits, _ or -")
+}
+
+func TestMessages_API(t *testing.T) {
+	auditPath := useAuth(t, AuthConfig{Tokens: []AuthToken{
+		{Name: "grafana", Token: testToken, Scopes: []string{scopeRead}},
+		{Name: "automation", Token: testControlToken, Scopes: []string{scopeControl}},
+	}})
+	now := time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC)
+	q := useMessages(t, MessagesConfig{}, now)
+	admin := newAdminMux()
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusForbidden, do("POST", "/api/v1/messages", testToken, `{"title": "Hi"}`).Code, "queueing needs control scope")
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/v1/messages", testControlToken, `{"title": ""}`).Code)
+
+	rr := do("POST", "/api/v1/messages", testControlToken, `{"id": "filter", "title": "Replace the filter", "body": "MERV 11, 16x25", "ttl": "72h"}`)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var m message
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &m))
+	assert.Equal(t, "filter", m.ID)
+	assert.Equal(t, now.Add(72*time.Hour), m.Expires)
+
+	rr = do("GET", "/api/v1/messages", testToken, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var list []message
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, "Replace the filter", list[0].Title)
+
+	// Messages survive a restart
+	restarted := newMessageQueue(q.cfg, q.file)
+	restarted.now = q.now
+	assert.Len(t, restarted.List(), 1)
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/v1/messages/filter", testControlToken, "").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/api/v1/messages/filter", testControlToken, "").Code)
+	assert.Empty(t, q.List())
+
+	entries := readAudit(t, auditPath)
+	require.Len(t, entries, 5)
+	assert.Equal(t, "POST", entries[2].Method)
+	assert.Equal(t, http.StatusCreated, entries[2].Status)
+	assert.Equal(t, "/api/v1/messages/filter", entries[3].Path)
+}
+
+func TestMessages_MQTT(t *testing.T) {
+	auditPath := useAuth(t, AuthConfig{})
+	now := time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC)
+	q := useMessages(t, MessagesConfig{Topic: "hvac/message"}, now)
+
+	q.receive([]byte(`{"id": "door", "title": "Back door open", "priority": "high"}`))
+	q.receive([]byte(`{"title": "Hello"}`))
+	q.receive([]byte(`{"title": "Hello", "colour": "red"}`))
+	q.receive([]byte(`{"id": "door", "delete": true}`))
+
+	list := q.List()
+	require.Len(t, list, 1)
+	assert.Equal(t, "Hello", list[0].Title)
+
+	entries := readAudit(t, auditPath)
+	require.Len(t, entries, 4, "every command is audited")
+	assert.Equal(t, "mqtt", entries[0].Principal)
+	assert.Equal(t, "PUBLISH", entries[0].Method)
+	assert.Equal(t, "hvac/message", entries[0].Path)
+	assert.Equal(t, "queue message door", entries[0].Detail)
+	assert.Equal(t, http.StatusBadRequest, entries[2].Status)
+	assert.Equal(t, "delete message door", entries[3].Detail)
+}
+
+func TestProxyHandler_Messages(t *testing.T) {
+	useDataDir(t)
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		switch {
+		case status != http.StatusOK:
+		case strings.HasSuffix(r.URL.Path, "/notifications"):
+			_, _ = w.Write([]byte(`<notifications version="1.0"><messages><message id="1"><title>Cloud</title></message></messages></notifications>`))
+		default:
+			_, _ = w.Write([]byte(`<status version="1.37"><pingRate>12</pingRate></status>`))
+		}
+	}))
+	defer srv.Close()
+	cfg := testUpstreamConfig()
+	cfg.Retries = 0
+	useUpstream(t, cfg)
+	now := time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC)
+	q := useMessages(t, MessagesConfig{}, now)
+
+	get := func(p string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", p, nil)
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		return rr
+	}
+
+	rr := get("/systems/123/notifications")
+	assert.Empty(t, rr.Header().Get("X-Hvac-Proxy-Messages"), "nothing queued")
+
+	q.Add(message{ID: "a", Title: "Low", Priority: "low", Created: now})
+	q.Add(message{ID: "b", Title: "Tea & biscuits", Body: "<now>", Priority: "high", Created: now, Expires: now.Add(time.Hour)})
+	rr = get("/systems/123/notifications")
+	assert.Equal(t, "added", rr.Header().Get("X-Hvac-Proxy-Messages"))
+	assert.Equal(t, `<notifications version="1.0"><messages><message id="1"><title>Cloud</title></message>`+
+		`<message id="b"><title>Tea &amp; biscuits</title><text>&lt;now&gt;</text><priority>high</priority><created>2024-12-01T09:00:00Z</created><expires>2024-12-01T10:00:00Z</expires></message>`+
+		`<message id="a"><title>Low</title><text></text><priority>low</priority><created>2024-12-01T09:00:00Z</created></message>`+
+		`</messages></notifications>`, rr.Body.String(), "high priority first")
+
+	rr = get("/systems/123/status")
+	assert.NotContains(t, rr.Body.String(), "<message", "only the configured path")
+
+	// Without a notifications endpoint upstream, the messages are answered locally
+	status = http.StatusNotFound
+	q.now = func() time.Time { return now.Add(2 * time.Hour) }
+	rr = get("/systems/123/notifications")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "local", rr.Header().Get("X-Hvac-Proxy-Messages"))
+	assert.NotContains(t, rr.Body.String(), "Tea", "expired messages are dropped")
+	assert.Contains(t, rr.Body.String(), `<message id="a">`)
+
+	status = http.StatusBadGateway
+	assert.Equal(t, "local", get("/systems/123/notifications").Header().Get("X-Hvac-Proxy-Messages"))
+
+	m := q.metrics()
+	assert.Contains(t, m, `hvac_messages_queued{priority="low"} 1`)
+	assert.Contains(t, m, `hvac_messages_queued{priority="high"} 0`)
+	assert.Contains(t, m, "hvac_messages_delivered_total 3")
+}
+
+func TestMessages_InjectWithoutMessagesElement(t *testing.T) {
+	now := time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC)
+	q := useMessages(t, MessagesConfig{Path: "/systems/*/status"}, now)
+	q.Add(message{ID: "a", Title: "Hi", Priority: "normal", Created: now})
+
+	rr := httptest.NewRecorder()
+	body := q.inject(rr, httptest.NewRequest("GET", "/systems/1/status", nil), []byte(`<status><pingRate>12</pingRate></status>`))
+	assert.Equal(t, `<status><pingRate>12</pingRate><messages><message id="a"><title>Hi</title><text></text><priority>normal</priority><created>2024-12-01T09:00:00Z</created></message></messages></status>`, string(body))
+
+	body = q.inject(rr, httptest.NewRequest("GET", "/systems/1/status", nil), []byte(`<status/>`))
+	assert.Equal(t, `<status/>`, string(body), "empty documents are left alone")
+	assert.Contains(t, q.metrics(), "hvac_messages_delivered_total 1", "only counted when added")
+
+	body = q.inject(rr, httptest.NewRequest("GET", "/systems/1/status", nil), []byte(`<status><messages /><pingRate>12</pingRate></status>`))
+	assert.Equal(t, `<status><messages><message id="a"><title>Hi</title><text></text><priority>normal</priority><created>2024-12-01T09:00:00Z</created></message></messages><pingRate>12</pingRate></status>`, string(body),
+		"an empty messages element is filled in")
+
+	// IDs from an older queue file are escaped all the same
+	q.Delete("a")
+	q.Add(message{ID: `x"/><y`, Title: "Hi", Priority: "normal", Created: now})
+	body = q.inject(rr, httptest.NewRequest("GET", "/systems/1/status", nil), []byte(`<status></status>`))
+	assert.Contains(t, string(body), `<message id="x&#34;/&gt;&lt;y">`)
+}
+
+func TestMessagesConfig_Env(t *testing.T) {
+	t.Setenv("MESSAGES_PATH", "/systems/*/notifications/*")
+	t.Setenv("MESSAGES_TOPIC", "hvac/message")
+	t.Setenv("MESSAGES_MAX", "5")
+	cfg, err := loadConfig("")
+	require.NoError(t, err)
+
+	assert.Equal(t, MessagesConfig{Path: "/systems/*/notifications/*", Topic: "hvac/message", Max: 5}, cfg.Messages)
+	assert.ErrorContains(t, cfg.Validate(), "messages.topic: requires mqtt.broker")
+	cfg.MQTT.Broker = "tcp://localhost:1883"
+	require.NoError(t, cfg.Validate())
+	cfg.Messages.Path = "/systems/[/notifications"
+	assert.ErrorContains(t, cfg.Validate(), `messages.path: invalid pattern "/systems/[/notifications"`)
+}
+
+func TestProxyHandler_MessagesFromCache(t *testing.T) {
+	useDataDir(t)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, _ = w.Write([]byte(`<notifications version="1.0"><messages></messages></notifications>`))
+	}))
+	defer srv.Close()
+	useUpstream(t, testUpstreamConfig())
+	useCache(t, CacheConfig{TTLs: []CacheTTL{{"/systems/*/notifications", time.Hour}}})
+	now := time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC)
+	q := useMessages(t, MessagesConfig{}, now)
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/systems/123/notifications", nil)
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		return rr
+	}
+	get()
+	q.Add(message{ID: "a", Title: "Hi", Priority: "normal", Created: now})
+	rr := get()
+	assert.Equal(t, "HIT", rr.Header().Get("X-Hvac-Proxy-Cache"))
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, "added", rr.Header().Get("X-Hvac-Proxy-Messages"))
+	assert.Contains(t, rr.Body.String(), `<messages><message id="a">`)
+
+	// Upstream being down is when the queued messages matter most
+	c := cache
+	later := time.Now().Add(2 * time.Hour)
+	c.now = func() time.Time { return later }
+	srv.Close()
+	rr = get()
+	assert.Equal(t, "STALE", rr.Header().Get("X-Hvac-Proxy-Cache"))
+	assert.Equal(t, "added", rr.Header().Get("X-Hvac-Proxy-Messages"))
+	assert.Equal(t, `<notifications version="1.0"><messages><message id="a"><title>Hi</title><text></text><priority>normal</priority><created>2024-12-01T09:00:00Z</created></message></messages></notifications>`, rr.Body.String())
+}
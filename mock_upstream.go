@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hvac-proxy/hvac"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mockRule is a scripted fault applied to matching requests.
+type mockRule struct {
+	Method      string  `json:"method"`      // HTTP method to match, empty matches any
+	Path        string  `json:"path"`        // path.Match pattern, e.g. "/systems/*/status"
+	Skip        int     `json:"skip"`        // Number of matching requests to let through first
+	Count       int     `json:"count"`       // Number of times to apply, 0 for unlimited
+	Probability float64 `json:"probability"` // Chance to apply (0 or 1 always applies)
+	Delay       string  `json:"delay"`       // Delay before responding, e.g. "2s"
+	Status      int     `json:"status"`      // Status code to return instead of the document
+	Drop        bool    `json:"drop"`        // Close the connection without a response
+	Malformed   bool    `json:"malformed"`   // Return a truncated XML document
+
+	seen    int
+	applied int
+}
+
+// mockScript is the fault script loaded from a file or posted at runtime.
+type mockScript struct {
+	ServerHasChanges bool       `json:"serverHasChanges"` // Initial serverHasChanges flag
+	ConfigHasChanges bool       `json:"configHasChanges"` // Initial configHasChanges flag
+	Rules            []mockRule `json:"rules"`
+}
+
+// mockUpstream implements the Carrier endpoints used by the thermostat,
+// serving documents from a directory laid out like the proxy's DATA_DIR.
+type mockUpstream struct {
+	dir string
+
+	mu               sync.Mutex
+	rules            []*mockRule
+	serverHasChanges bool
+	configHasChanges bool
+}
+
+// runMockUpstream implements the "mock-upstream" subcommand.
+func runMockUpstream(args []string) int {
+	fs := flag.NewFlagSet("mock-upstream", flag.ContinueOnError)
+	listen := fs.String("listen", ":8081", "address to listen on")
+	dir := fs.String("dir", ".", "directory of response documents named like the proxy's saved files")
+	script := fs.String("faults", "", "JSON fault script to load at startup")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: hvac-proxy mock-upstream [flags]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	m := newMockUpstream(*dir)
+	if *script != "" {
+		data, err := os.ReadFile(*script)
+		if err != nil {
+			fmt.Printf("Failed to read fault script: %v\n", err)
+			return 1
+		}
+		if err := m.load(data); err != nil {
+			fmt.Printf("Invalid fault script: %v\n", err)
+			return 1
+		}
+	}
+
+	fmt.Printf("Mock upstream listening on %s serving %s\n", *listen, *dir)
+	if err := http.ListenAndServe(*listen, m); err != nil {
+		fmt.Printf("Server error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func newMockUpstream(dir string) *mockUpstream {
+	return &mockUpstream{dir: dir}
+}
+
+// load replaces the fault script.
+func (m *mockUpstream) load(data []byte) error {
+	var script mockScript
+	if err := json.Unmarshal(data, &script); err != nil {
+		return err
+	}
+	rules := make([]*mockRule, len(script.Rules))
+	for i := range script.Rules {
+		r := script.Rules[i]
+		if r.Delay != "" {
+			if _, err := time.ParseDuration(r.Delay); err != nil {
+				return fmt.Errorf("rule %d: invalid delay %q", i, r.Delay)
+			}
+		}
+		if r.Path != "" {
+			if _, err := path.Match(r.Path, "/"); err != nil {
+				return fmt.Errorf("rule %d: invalid path pattern %q", i, r.Path)
+			}
+		}
+		rules[i] = &r
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = rules
+	m.serverHasChanges = script.ServerHasChanges
+	m.configHasChanges = script.ConfigHasChanges
+	return nil
+}
+
+// ServeHTTP answers thermostat requests. The /_mock/ prefix is reserved for
+// controlling the mock from test scripts:
+//   - POST /_mock/faults replaces the fault script with the JSON body
+//   - POST /_mock/changes?server=true&config=false sets the change flags
+func (m *mockUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	switch r.URL.Path {
+	case "/_mock/faults":
+		if err := m.load(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "/_mock/changes":
+		m.mu.Lock()
+		m.serverHasChanges = r.URL.Query().Get("server") == "true"
+		m.configHasChanges = r.URL.Query().Get("config") == "true"
+		m.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if rule := m.match(r); rule != nil {
+		if rule.Delay != "" {
+			d, _ := time.ParseDuration(rule.Delay)
+			time.Sleep(d)
+		}
+		switch {
+		case rule.Drop:
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					_ = conn.Close()
+					return
+				}
+			}
+			panic(http.ErrAbortHandler)
+		case rule.Status != 0:
+			http.Error(w, http.StatusText(rule.Status), rule.Status)
+			return
+		case rule.Malformed:
+			doc := m.document(r, body)
+			w.Header().Set("Content-Type", "application/xml")
+			_, _ = w.Write(doc[:len(doc)/2])
+			return
+		}
+	}
+
+	doc := m.document(r, body)
+	if doc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(doc)
+}
+
+// match returns the first rule that applies to the request, or nil. Every
+// rule matching the request counts it, so Skip is independent per rule.
+func (m *mockUpstream) match(r *http.Request) *mockRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var chosen *mockRule
+	for _, rule := range m.rules {
+		if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+			continue
+		}
+		if ok, _ := path.Match(rule.Path, r.URL.Path); rule.Path != "" && !ok {
+			continue
+		}
+		rule.seen++
+		if rule.seen <= rule.Skip || (rule.Count > 0 && rule.applied >= rule.Count) {
+			continue
+		}
+		if chosen != nil || (rule.Probability > 0 && rule.Probability < 1 && rand.Float64() >= rule.Probability) {
+			continue
+		}
+		rule.applied++
+		chosen = rule
+	}
+	return chosen
+}
+
+// document returns the response document for a request. Files in the
+// directory take precedence; status and time have built-in defaults.
+// Config posted by the thermostat is stored and served on the next GET.
+func (m *mockUpstream) document(r *http.Request, body []byte) []byte {
+	isConfig := strings.HasSuffix(r.URL.Path, "/config")
+
+	if isConfig && r.Method == http.MethodPost && len(body) > 0 {
+		get := r.Clone(r.Context())
+		get.Method = http.MethodGet
+		_ = os.WriteFile(m.filePath(get), hvac.DecodeBody(body), 0644)
+	}
+
+	if data, err := os.ReadFile(m.filePath(r)); err == nil {
+		if isConfig && r.Method == http.MethodGet {
+			m.mu.Lock()
+			m.serverHasChanges, m.configHasChanges = false, false
+			m.mu.Unlock()
+		}
+		return m.withChanges(r, data)
+	}
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/status"):
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return fmt.Appendf(nil, `<status version="1.37"><timestamp>%s</timestamp><pingRate>12</pingRate>`+
+			`<dealerHasChanges>false</dealerHasChanges><serverHasChanges>%t</serverHasChanges>`+
+			`<configHasChanges>%t</configHasChanges></status>`,
+			time.Now().UTC().Format(time.RFC3339), m.serverHasChanges, m.configHasChanges)
+	case r.URL.Path == "/time" || r.URL.Path == "/time/":
+		return fmt.Appendf(nil, `<time version="1.9"><utc>%s</utc></time>`, time.Now().UTC().Format("2006-01-02T15:04:05"))
+	}
+	return nil
+}
+
+// withChanges overrides the change flags of a status document from disk.
+func (m *mockUpstream) withChanges(r *http.Request, data []byte) []byte {
+	if !strings.HasSuffix(r.URL.Path, "/status") {
+		return data
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data = replaceElement(data, "serverHasChanges", fmt.Sprint(m.serverHasChanges))
+	return replaceElement(data, "configHasChanges", fmt.Sprint(m.configHasChanges))
+}
+
+// filePath maps a request onto a response file in the mock directory, using
+// the same naming as the proxy's saved response files.
+func (m *mockUpstream) filePath(r *http.Request) string {
+	name := filepath.Base(hvac.CreateFilePath(r, "response", ".xml"))
+	return filepath.Join(m.dir, name)
+}
+
+// replaceElement replaces the text of the first <name> element.
+func replaceElement(doc []byte, name, value string) []byte {
+	open, closing := []byte("<"+name+">"), []byte("</"+name+">")
+	start := bytes.Index(doc, open)
+	if start < 0 {
+		return doc
+	}
+	end := bytes.Index(doc[start:], closing)
+	if end < 0 {
+		return doc
+	}
+	var out bytes.Buffer
+	out.Write(doc[:start+len(open)])
+	out.WriteString(value)
+	out.Write(doc[start+end:])
+	return out.Bytes()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMock(t *testing.T) (*mockUpstream, *httptest.Server) {
+	m := newMockUpstream(t.TempDir())
+	srv := httptest.NewServer(m)
+	t.Cleanup(srv.Close)
+	return m, srv
+}
+
+func mockGet(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestMockUpstream_ServesFiles(t *testing.T) {
+	m, srv := newTestMock(t)
+	require.NoError(t, os.WriteFile(filepath.Join(m.dir, "GET-systems_123_profile-response.xml"), []byte("<profile/>"), 0644))
+
+	code, body := mockGet(t, srv.URL+"/systems/123/profile")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "<profile/>", body)
+
+	code, _ = mockGet(t, srv.URL+"/systems/123/unknown")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestMockUpstream_ConfigRoundTrip(t *testing.T) {
+	m, srv := newTestMock(t)
+	require.NoError(t, m.load([]byte(`{"serverHasChanges": true}`)))
+
+	resp, err := http.Post(srv.URL+"/systems/123/status", "application/x-www-form-urlencoded", nil)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Contains(t, string(body), "<serverHasChanges>true</serverHasChanges>")
+
+	resp, err = http.Post(srv.URL+"/systems/123/config", "application/x-www-form-urlencoded",
+		strings.NewReader("data=%3Cconfig%3E%3Cmode%3Eheat%3C%2Fmode%3E%3C%2Fconfig%3E"))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	_, body2 := mockGet(t, srv.URL+"/systems/123/config")
+	assert.Equal(t, "<config><mode>heat</mode></config>", body2)
+
+	resp, err = http.Post(srv.URL+"/systems/123/status", "application/x-www-form-urlencoded", nil)
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Contains(t, string(body), "<serverHasChanges>false</serverHasChanges>", "config fetch clears the flag")
+}
+
+func TestMockUpstream_Faults(t *testing.T) {
+	m, srv := newTestMock(t)
+	require.NoError(t, os.WriteFile(filepath.Join(m.dir, "GET-manifest-response.xml"), []byte("<manifest><a>1</a></manifest>"), 0644))
+
+	script := `{"rules": [
+		{"path": "/manifest", "skip": 1, "count": 1, "status": 503},
+		{"path": "/manifest", "skip": 2, "count": 1, "malformed": true},
+		{"path": "/dropped", "drop": true},
+		{"path": "/slow", "delay": "50ms", "status": 500}
+	]}`
+	resp, err := http.Post(srv.URL+"/_mock/faults", "application/json", bytes.NewBufferString(script))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	code, _ := mockGet(t, srv.URL+"/manifest")
+	assert.Equal(t, http.StatusOK, code, "first request skipped")
+	code, _ = mockGet(t, srv.URL+"/manifest")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	_, body := mockGet(t, srv.URL+"/manifest")
+	assert.Equal(t, "<manifest><a>1", body)
+	_, body = mockGet(t, srv.URL+"/manifest")
+	assert.Equal(t, "<manifest><a>1</a></manifest>", body, "rules exhausted")
+
+	_, err = http.Get(srv.URL + "/dropped")
+	assert.Error(t, err)
+
+	start := time.Now()
+	code, _ = mockGet(t, srv.URL+"/slow")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestMockUpstream_InvalidScript(t *testing.T) {
+	m := newMockUpstream(t.TempDir())
+	assert.Error(t, m.load([]byte(`{"rules": [{"delay": "soon"}]}`)))
+	assert.Error(t, m.load([]byte(`not json`)))
+}
+
+func TestProxyHandler_UpstreamDropped(t *testing.T) {
+	m, srv := newTestMock(t)
+	require.NoError(t, m.load([]byte(`{"rules": [{"drop": true}]}`)))
+	useUpstream(t, testUpstreamConfig())
+
+	req := httptest.NewRequest("GET", "/systems/123/config", nil)
+	req.Host = strings.TrimPrefix(srv.URL, "http://")
+	rr := httptest.NewRecorder()
+	proxyHandler(rr, req)
+
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hvac-proxy/hvac"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLPConfig controls the optional OpenTelemetry exporter. The HVAC readings
+// and the proxy's own metrics are exported as OTLP metrics, and each proxied
+// exchange as a trace, to a collector over HTTP or gRPC.
+type OTLPConfig struct {
+	Endpoint        string            `yaml:"endpoint"`        // Collector base URL, e.g. http://collector:4318 (HTTP) or http://collector:4317 (gRPC); empty disables
+	Protocol        string            `yaml:"protocol"`        // "http/protobuf" or "grpc"
+	Headers         map[string]string `yaml:"headers"`         // Extra headers sent with each export, e.g. for authentication
+	ServiceName     string            `yaml:"serviceName"`     // service.name resource attribute
+	Metrics         bool              `yaml:"metrics"`         // Export metrics
+	Traces          bool              `yaml:"traces"`          // Export a trace per proxied exchange
+	MetricsInterval time.Duration     `yaml:"metricsInterval"` // Time between metric exports
+	Timeout         time.Duration     `yaml:"timeout"`         // Time allowed per export
+}
+
+// defaultOTLPConfig returns the settings used when nothing is configured.
+func defaultOTLPConfig() OTLPConfig {
+	return OTLPConfig{
+		Protocol:        "http/protobuf",
+		ServiceName:     "hvac-proxy",
+		Metrics:         true,
+		Traces:          true,
+		MetricsInterval: time.Minute,
+		Timeout:         10 * time.Second,
+	}
+}
+
+// validateOTLP checks the exporter settings when it is enabled.
+func validateOTLP(c *OTLPConfig, check func(ok bool, field, format string, args ...any)) {
+	if c.Endpoint == "" {
+		return
+	}
+	u, err := url.Parse(c.Endpoint)
+	switch {
+	case err != nil:
+		check(false, "otlp.endpoint", "invalid URL %q", c.Endpoint)
+	case u.Scheme != "http" && u.Scheme != "https":
+		check(false, "otlp.endpoint", "scheme must be http or https, got %q", u.Scheme)
+	default:
+		check(u.Host != "", "otlp.endpoint", "must include a host, got %q", c.Endpoint)
+	}
+	check(c.Protocol == "http/protobuf" || c.Protocol == "grpc", "otlp.protocol", "must be http/protobuf or grpc, got %q", c.Protocol)
+	check(c.MetricsInterval > 0, "otlp.metricsInterval", "must be positive")
+	check(c.Timeout > 0, "otlp.timeout", "must be positive")
+}
+
+// parseOTLPHeaders parses OTEL_EXPORTER_OTLP_HEADERS, a comma-separated list
+// of key=value pairs with URL-encoded values.
+func parseOTLPHeaders(s string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid header %q, want key=value", pair)
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for header %q", k)
+		}
+		headers[k] = v
+	}
+	return headers, nil
+}
+
+// otlp exports telemetry when the exporter is enabled.
+var otlp *otlpExporter
+
+const (
+	otlpSpanQueue    = 2048            // Finished spans waiting to be exported; more are dropped
+	otlpSpanBatch    = 512             // Most spans per export
+	otlpSpanInterval = 5 * time.Second // Longest time a span waits before being exported
+)
+
+// otlpExporter batches finished spans and periodically collects metrics,
+// sending both to the collector. Failed exports are logged and dropped.
+type otlpExporter struct {
+	cfg   OTLPConfig
+	send  func(ctx context.Context, signal string, body []byte) error
+	res   otlpResource
+	since time.Time // Start of the cumulative sums
+
+	spans chan *hvac.Span
+	batch []*hvac.Span
+	stop  chan struct{}
+	done  chan struct{}
+
+	mu      sync.Mutex
+	exports map[otlpExportKey]int
+	dropped int
+}
+
+// otlpExportKey counts exports by signal (traces or metrics) and result.
+type otlpExportKey struct {
+	signal, result string
+}
+
+// newOTLPExporter creates an exporter for the configured collector.
+func newOTLPExporter(cfg OTLPConfig) *otlpExporter {
+	return &otlpExporter{
+		cfg:  cfg,
+		send: otlpSender(cfg),
+		res: otlpResource{attrs: []hvac.Attr{
+			{Key: "service.name", Value: cfg.ServiceName},
+			{Key: "service.version", Value: Version},
+		}},
+		since:   time.Now(),
+		spans:   make(chan *hvac.Span, otlpSpanQueue),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		exports: map[otlpExportKey]int{},
+	}
+}
+
+// start installs the span recorder and exports until Close.
+func (e *otlpExporter) start() {
+	if e.cfg.Traces {
+		hvac.SetSpanRecorder(e.record)
+	}
+	go e.run()
+}
+
+// record queues a finished span, dropping it if the queue is full.
+func (e *otlpExporter) record(s *hvac.Span) {
+	select {
+	case e.spans <- s:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	spanTicker := time.NewTicker(otlpSpanInterval)
+	defer spanTicker.Stop()
+	var metricTick <-chan time.Time
+	if e.cfg.Metrics {
+		t := time.NewTicker(e.cfg.MetricsInterval)
+		defer t.Stop()
+		metricTick = t.C
+	}
+	for {
+		select {
+		case s := <-e.spans:
+			e.batch = append(e.batch, s)
+			if len(e.batch) >= otlpSpanBatch {
+				e.exportSpans(context.Background())
+			}
+		case <-spanTicker.C:
+			e.exportSpans(context.Background())
+		case <-metricTick:
+			e.exportMetrics(context.Background())
+		case <-e.stop:
+			// Keep spans already finished for the final export
+			for {
+				select {
+				case s := <-e.spans:
+					e.batch = append(e.batch, s)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close stops tracing and makes a final export of pending spans and current
+// metrics within timeout.
+func (e *otlpExporter) Close(timeout time.Duration) {
+	hvac.SetSpanRecorder(nil)
+	close(e.stop)
+	<-e.done
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for len(e.batch) > 0 && ctx.Err() == nil {
+		e.exportSpans(ctx)
+	}
+	if e.cfg.Metrics {
+		e.exportMetrics(ctx)
+	}
+}
+
+// exportSpans sends up to otlpSpanBatch queued spans.
+func (e *otlpExporter) exportSpans(ctx context.Context) {
+	if len(e.batch) == 0 {
+		return
+	}
+	n := min(len(e.batch), otlpSpanBatch)
+	spans := e.batch[:n]
+	e.batch = e.batch[n:]
+	if err := e.export(ctx, "traces", encodeTraces(&e.res, spans)); err != nil {
+		log.Printf("[OTLP] Export of %d spans failed: %v", len(spans), err)
+	}
+}
+
+// exportMetrics sends the latest HVAC readings and the proxy's metrics.
+func (e *otlpExporter) exportMetrics(ctx context.Context) {
+	now := time.Now()
+	var metrics []otlpMetric
+	if latest, ok := hvac.StatusHistory.Latest(); ok {
+		metrics = append(metrics, statusMetrics(latest.Time, &latest.Status)...)
+	}
+	metrics = append(metrics, parsePrometheus(hvac.ProviderMetrics(), now)...)
+	if len(metrics) == 0 {
+		return
+	}
+	if err := e.export(ctx, "metrics", encodeMetrics(&e.res, e.since, metrics)); err != nil {
+		log.Printf("[OTLP] Export of %d metrics failed: %v", len(metrics), err)
+	}
+}
+
+func (e *otlpExporter) export(ctx context.Context, signal string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+	defer cancel()
+	err := e.send(ctx, signal, body)
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	e.mu.Lock()
+	e.exports[otlpExportKey{signal, result}]++
+	e.mu.Unlock()
+	return err
+}
+
+// metrics returns the exporter counters in Prometheus text format.
+func (e *otlpExporter) metrics() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP hvac_proxy_otlp_exports_total OTLP exports by signal and result\n")
+	b.WriteString("# TYPE hvac_proxy_otlp_exports_total counter\n")
+	keys := make([]otlpExportKey, 0, len(e.exports))
+	for k := range e.exports {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b otlpExportKey) int {
+		return strings.Compare(a.signal+" "+a.result, b.signal+" "+b.result)
+	})
+	for _, k := range keys {
+		b.WriteString(fmt.Sprintf("hvac_proxy_otlp_exports_total{signal=%q,result=%q} %d\n", k.signal, k.result, e.exports[k]))
+	}
+
+	b.WriteString("# HELP hvac_proxy_otlp_spans_dropped_total spans dropped because the export queue was full\n")
+	b.WriteString("# TYPE hvac_proxy_otlp_spans_dropped_total counter\n")
+	b.WriteString(fmt.Sprintf("hvac_proxy_otlp_spans_dropped_total %d\n", e.dropped))
+	return b.String()
+}
+
+// otlpGRPCMethods are the collector services' Export methods by signal.
+var otlpGRPCMethods = map[string]string{
+	"traces":  "/opentelemetry.proto.collector.trace.v1.TraceService/Export",
+	"metrics": "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export",
+}
+
+// otlpSender returns a function that posts an export request for a signal
+// using the configured protocol. gRPC is spoken directly over HTTP/2, in
+// cleartext for http:// endpoints.
+func otlpSender(cfg OTLPConfig) func(context.Context, string, []byte) error {
+	base := strings.TrimSuffix(cfg.Endpoint, "/")
+	grpc := cfg.Protocol == "grpc"
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if grpc {
+		protocols := new(http.Protocols)
+		if strings.HasPrefix(base, "http://") {
+			protocols.SetUnencryptedHTTP2(true)
+		} else {
+			protocols.SetHTTP2(true)
+		}
+		transport.Protocols = protocols
+	}
+	client := &http.Client{Transport: transport}
+
+	return func(ctx context.Context, signal string, body []byte) error {
+		target, contentType := base+"/v1/"+signal, "application/x-protobuf"
+		if grpc {
+			// Length-prefixed message: uncompressed flag, then big-endian size
+			frame := make([]byte, 5, 5+len(body))
+			binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+			body = append(frame, body...)
+			target, contentType = base+otlpGRPCMethods[signal], "application/grpc"
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		if grpc {
+			req.Header.Set("TE", "trailers")
+		}
+		for k, v := range cfg.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		// Read the body so the gRPC trailers arrive; its content is not needed
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+
+		if resp.StatusCode != http.StatusOK && (grpc || resp.StatusCode >= 300) {
+			return fmt.Errorf("collector returned %s", resp.Status)
+		}
+		if grpc {
+			// Trailers-only responses carry the status in the headers
+			status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+			if status == "" {
+				status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+			}
+			if status != "0" {
+				message, _ = url.PathUnescape(message)
+				return fmt.Errorf("collector returned gRPC status %s: %s", status, message)
+			}
+		}
+		return nil
+	}
+}
+
+// statusMetrics converts a status document to OTLP gauges.
+func statusMetrics(t time.Time, s *hvac.Status) []otlpMetric {
+	zoneMetric := func(name, description, unit string, value func(hvac.Zone) float64) otlpMetric {
+		m := otlpMetric{Name: name, Description: description, Unit: unit}
+		for _, z := range s.Zones.Zones {
+			attrs := []hvac.Attr{{Key: "zone.id", Value: z.ID}}
+			if z.Name != "" {
+				attrs = append(attrs, hvac.Attr{Key: "zone.name", Value: z.Name})
+			}
+			m.Points = append(m.Points, otlpPoint{Attrs: attrs, Time: t, Value: value(z)})
+		}
+		return m
+	}
+	single := func(name, description, unit string, value float64) otlpMetric {
+		return otlpMetric{Name: name, Description: description, Unit: unit, Points: []otlpPoint{{Time: t, Value: value}}}
+	}
+	return []otlpMetric{
+		zoneMetric("hvac.zone.temperature", "zone temperature", "[degF]", func(z hvac.Zone) float64 { return z.CurrentTemp }),
+		zoneMetric("hvac.zone.humidity", "zone relative humidity", "%", func(z hvac.Zone) float64 { return float64(z.RelativeHumidity) }),
+		zoneMetric("hvac.zone.heat_setpoint", "zone heating set point", "[degF]", func(z hvac.Zone) float64 { return z.HeatSetPoint }),
+		zoneMetric("hvac.zone.cool_setpoint", "zone cooling set point", "[degF]", func(z hvac.Zone) float64 { return z.CoolSetPoint }),
+		single("hvac.outdoor.temperature", "outdoor air temperature", "[degF]", s.OAT),
+		single("hvac.filter.level", "filter life remaining", "%", float64(s.FiltrLvl)),
+		single("hvac.fan.airflow", "indoor fan airflow", "[cft_i]/min", float64(s.IDU.CFM)),
+	}
+}
+
+// parsePrometheus converts metrics in Prometheus text format to OTLP
+// metrics: counters become cumulative sums, everything else gauges.
+func parsePrometheus(text string, t time.Time) []otlpMetric {
+	var metrics []otlpMetric
+	index := map[string]int{}
+	help := map[string]string{}
+	types := map[string]string{}
+
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if rest, ok := strings.CutPrefix(line, "# HELP "); ok {
+			name, text, _ := strings.Cut(rest, " ")
+			help[name] = text
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, typ, _ := strings.Cut(rest, " ")
+			types[name] = typ
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, attrs, value, ok := parsePrometheusSample(line)
+		if !ok {
+			continue
+		}
+		i, seen := index[name]
+		if !seen {
+			i = len(metrics)
+			index[name] = i
+			metrics = append(metrics, otlpMetric{Name: name, Description: help[name], Sum: types[name] == "counter"})
+		}
+		metrics[i].Points = append(metrics[i].Points, otlpPoint{Attrs: attrs, Time: t, Value: value})
+	}
+	return metrics
+}
+
+// parsePrometheusSample parses a line such as `name{a="x",b="y"} 1`.
+func parsePrometheusSample(line string) (name string, attrs []hvac.Attr, value float64, ok bool) {
+	end := strings.IndexAny(line, "{ ")
+	if end <= 0 {
+		return "", nil, 0, false
+	}
+	name, rest := line[:end], line[end:]
+	if labels, ok := strings.CutPrefix(rest, "{"); ok {
+		for {
+			labels = strings.TrimLeft(labels, ", ")
+			if after, ok := strings.CutPrefix(labels, "}"); ok {
+				rest = after
+				break
+			}
+			key, after, ok := strings.Cut(labels, "=")
+			if !ok {
+				return "", nil, 0, false
+			}
+			quoted, err := strconv.QuotedPrefix(after)
+			if err != nil {
+				return "", nil, 0, false
+			}
+			v, _ := strconv.Unquote(quoted)
+			attrs = append(attrs, hvac.Attr{Key: key, Value: v})
+			labels = after[len(quoted):]
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", nil, 0, false
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	return name, attrs, value, err == nil
+}
+
+// initOTLP enables the OpenTelemetry exporter when configured.
+func initOTLP(cfg OTLPConfig) {
+	if cfg.Endpoint == "" || (!cfg.Metrics && !cfg.Traces) {
+		return
+	}
+	otlp = newOTLPExporter(cfg)
+	hvac.RegisterMetrics("otlp", otlp.metrics)
+	otlp.start()
+	fmt.Printf("Exporting OpenTelemetry data to %s over %s\n", cfg.Endpoint, cfg.Protocol)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/binary"
+	"hvac-proxy/hvac"
+	"math"
+	"time"
+)
+
+// This file encodes OTLP export requests in the protobuf wire format by hand,
+// which keeps the gRPC and protobuf libraries out of the binary. Field
+// numbers follow the opentelemetry-proto definitions.
+
+// pbuf is a protobuf message being encoded.
+type pbuf struct {
+	b []byte
+}
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func (p *pbuf) tag(field, wire int) {
+	p.b = binary.AppendUvarint(p.b, uint64(field)<<3|uint64(wire))
+}
+
+func (p *pbuf) uvarint(field int, v uint64) {
+	if v != 0 {
+		p.tag(field, wireVarint)
+		p.b = binary.AppendUvarint(p.b, v)
+	}
+}
+
+func (p *pbuf) boolean(field int, v bool) {
+	if v {
+		p.uvarint(field, 1)
+	}
+}
+
+func (p *pbuf) fixed64(field int, v uint64) {
+	p.tag(field, wireFixed64)
+	p.b = binary.LittleEndian.AppendUint64(p.b, v)
+}
+
+func (p *pbuf) double(field int, v float64) {
+	p.fixed64(field, math.Float64bits(v))
+}
+
+func (p *pbuf) bytes(field int, v []byte) {
+	p.tag(field, wireBytes)
+	p.b = binary.AppendUvarint(p.b, uint64(len(v)))
+	p.b = append(p.b, v...)
+}
+
+func (p *pbuf) string(field int, v string) {
+	if v != "" {
+		p.bytes(field, []byte(v))
+	}
+}
+
+// message encodes a nested message built by fn.
+func (p *pbuf) message(field int, fn func(*pbuf)) {
+	var m pbuf
+	fn(&m)
+	p.bytes(field, m.b)
+}
+
+// keyValue encodes a common.v1.KeyValue.
+func (p *pbuf) keyValue(field int, a hvac.Attr) {
+	p.message(field, func(kv *pbuf) {
+		kv.string(1, a.Key)
+		kv.message(2, func(v *pbuf) {
+			switch x := a.Value.(type) {
+			case string:
+				v.bytes(1, []byte(x))
+			case bool:
+				// Oneof fields are written even when zero
+				n := uint64(0)
+				if x {
+					n = 1
+				}
+				v.tag(2, wireVarint)
+				v.b = binary.AppendUvarint(v.b, n)
+			case int:
+				v.tag(3, wireVarint)
+				v.b = binary.AppendUvarint(v.b, uint64(x))
+			case int64:
+				v.tag(3, wireVarint)
+				v.b = binary.AppendUvarint(v.b, uint64(x))
+			case float64:
+				v.double(4, x)
+			}
+		})
+	})
+}
+
+func unixNano(t time.Time) uint64 {
+	return uint64(t.UnixNano())
+}
+
+// otlpResource describes the process exporting telemetry.
+type otlpResource struct {
+	attrs []hvac.Attr
+}
+
+// encode writes the resource.v1.Resource and a scope for this proxy.
+func (r *otlpResource) encode(p *pbuf) {
+	p.message(1, func(res *pbuf) {
+		for _, a := range r.attrs {
+			res.keyValue(1, a)
+		}
+	})
+}
+
+func encodeScope(p *pbuf) {
+	p.message(1, func(s *pbuf) {
+		s.string(1, "hvac-proxy")
+		s.string(2, Version)
+	})
+}
+
+// encodeTraces builds a collector.trace.v1.ExportTraceServiceRequest.
+func encodeTraces(res *otlpResource, spans []*hvac.Span) []byte {
+	var req pbuf
+	req.message(1, func(rs *pbuf) { // ResourceSpans
+		res.encode(rs)
+		rs.message(2, func(ss *pbuf) { // ScopeSpans
+			encodeScope(ss)
+			for _, s := range spans {
+				ss.message(2, func(sp *pbuf) { encodeSpan(sp, s) })
+			}
+		})
+	})
+	return req.b
+}
+
+// encodeSpan writes a trace.v1.Span.
+func encodeSpan(p *pbuf, s *hvac.Span) {
+	p.bytes(1, s.TraceID[:])
+	p.bytes(2, s.SpanID[:])
+	if s.ParentID != [8]byte{} {
+		p.bytes(4, s.ParentID[:])
+	}
+	p.string(5, s.Name)
+	p.uvarint(6, uint64(s.Kind))
+	p.fixed64(7, unixNano(s.Start))
+	p.fixed64(8, unixNano(s.End))
+	for _, a := range s.Attrs {
+		p.keyValue(9, a)
+	}
+	if s.Err != "" {
+		p.message(15, func(st *pbuf) { // Status
+			st.string(2, s.Err)
+			st.uvarint(3, 2) // STATUS_CODE_ERROR
+		})
+	}
+}
+
+// otlpMetric is a gauge or a cumulative monotonic sum.
+type otlpMetric struct {
+	Name        string
+	Description string
+	Unit        string
+	Sum         bool
+	Points      []otlpPoint
+}
+
+// otlpPoint is a single value of a metric.
+type otlpPoint struct {
+	Attrs []hvac.Attr
+	Time  time.Time
+	Value float64
+}
+
+// encodeMetrics builds a collector.metrics.v1.ExportMetricsServiceRequest.
+// Sums are cumulative from start.
+func encodeMetrics(res *otlpResource, start time.Time, metrics []otlpMetric) []byte {
+	var req pbuf
+	req.message(1, func(rm *pbuf) { // ResourceMetrics
+		res.encode(rm)
+		rm.message(2, func(sm *pbuf) { // ScopeMetrics
+			encodeScope(sm)
+			for _, m := range metrics {
+				sm.message(2, func(mp *pbuf) { encodeMetric(mp, m, start) })
+			}
+		})
+	})
+	return req.b
+}
+
+// encodeMetric writes a metrics.v1.Metric.
+func encodeMetric(p *pbuf, m otlpMetric, start time.Time) {
+	p.string(1, m.Name)
+	p.string(2, m.Description)
+	p.string(3, m.Unit)
+
+	points := func(d *pbuf) {
+		for _, pt := range m.Points {
+			d.message(1, func(dp *pbuf) { // NumberDataPoint
+				if m.Sum {
+					dp.fixed64(2, unixNano(start))
+				}
+				dp.fixed64(3, unixNano(pt.Time))
+				dp.double(4, pt.Value)
+				for _, a := range pt.Attrs {
+					dp.keyValue(7, a)
+				}
+			})
+		}
+	}
+	if m.Sum {
+		p.message(7, func(sum *pbuf) {
+			points(sum)
+			sum.uvarint(2, 2) // AGGREGATION_TEMPORALITY_CUMULATIVE
+			sum.boolean(3, true)
+		})
+		return
+	}
+	p.message(5, points) // Gauge
+}
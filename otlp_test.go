@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"hvac-proxy/hvac"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pbMessage is a decoded protobuf message: the values of each field number
+// in order. Varint and fixed64 values are uint64, length-delimited ones
+// []byte.
+type pbMessage map[int][]any
+
+func decodePB(t *testing.T, b []byte) pbMessage {
+	t.Helper()
+	m := pbMessage{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		require.Positive(t, n, "bad tag")
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			require.Positive(t, n, "bad varint")
+			m[field] = append(m[field], v)
+			b = b[n:]
+		case wireFixed64:
+			require.GreaterOrEqual(t, len(b), 8)
+			m[field] = append(m[field], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			require.Positive(t, n, "bad length")
+			b = b[n:]
+			require.GreaterOrEqual(t, uint64(len(b)), l)
+			m[field] = append(m[field], b[:l])
+			b = b[l:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return m
+}
+
+func (m pbMessage) message(t *testing.T, field, i int) pbMessage {
+	t.Helper()
+	require.Greater(t, len(m[field]), i, "missing field %d", field)
+	return decodePB(t, m[field][i].([]byte))
+}
+
+func (m pbMessage) string(field int) string {
+	if len(m[field]) == 0 {
+		return ""
+	}
+	return string(m[field][0].([]byte))
+}
+
+// pbAttrs decodes the KeyValue attributes in field.
+func (m pbMessage) attrs(t *testing.T, field int) map[string]any {
+	t.Helper()
+	attrs := map[string]any{}
+	for i := range m[field] {
+		kv := m.message(t, field, i)
+		v := kv.message(t, 2, 0)
+		switch {
+		case v[1] != nil:
+			attrs[kv.string(1)] = v.string(1)
+		case v[2] != nil:
+			attrs[kv.string(1)] = v[2][0].(uint64) == 1
+		case v[3] != nil:
+			attrs[kv.string(1)] = int64(v[3][0].(uint64))
+		case v[4] != nil:
+			attrs[kv.string(1)] = math.Float64frombits(v[4][0].(uint64))
+		}
+	}
+	return attrs
+}
+
+func testSpan() *hvac.Span {
+	return &hvac.Span{
+		TraceID:  [16]byte{1, 2, 3},
+		SpanID:   [8]byte{4, 5},
+		ParentID: [8]byte{6},
+		Name:     "upstream POST",
+		Kind:     hvac.SpanClient,
+		Start:    time.Unix(100, 0),
+		End:      time.Unix(101, 0),
+		Attrs: []hvac.Attr{
+			{Key: "server.address", Value: "www.api.ing.carrier.com"},
+			{Key: "http.response.status_code", Value: 200},
+			{Key: "retry", Value: false},
+		},
+		Err: "connection refused",
+	}
+}
+
+func TestEncodeTraces(t *testing.T) {
+	res := otlpResource{attrs: []hvac.Attr{{Key: "service.name", Value: "hvac-proxy"}}}
+	req := decodePB(t, encodeTraces(&res, []*hvac.Span{testSpan()}))
+
+	rs := req.message(t, 1, 0)
+	assert.Equal(t, map[string]any{"service.name": "hvac-proxy"}, rs.message(t, 1, 0).attrs(t, 1))
+	ss := rs.message(t, 2, 0)
+	assert.Equal(t, "hvac-proxy", ss.message(t, 1, 0).string(1))
+
+	span := ss.message(t, 2, 0)
+	assert.Equal(t, []byte{1, 2, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, span[1][0])
+	assert.Equal(t, []byte{4, 5, 0, 0, 0, 0, 0, 0}, span[2][0])
+	assert.Equal(t, []byte{6, 0, 0, 0, 0, 0, 0, 0}, span[4][0])
+	assert.Equal(t, "upstream POST", span.string(5))
+	assert.Equal(t, uint64(hvac.SpanClient), span[6][0])
+	assert.Equal(t, uint64(100e9), span[7][0])
+	assert.Equal(t, uint64(101e9), span[8][0])
+	assert.Equal(t, map[string]any{
+		"server.address":            "www.api.ing.carrier.com",
+		"http.response.status_code": int64(200),
+		"retry":                     false,
+	}, span.attrs(t, 9))
+
+	status := span.message(t, 15, 0)
+	assert.Equal(t, "connection refused", status.string(2))
+	assert.Equal(t, uint64(2), status[3][0])
+}
+
+func TestEncodeMetrics(t *testing.T) {
+	res := otlpResource{}
+	start, now := time.Unix(50, 0), time.Unix(100, 0)
+	req := decodePB(t, encodeMetrics(&res, start, []otlpMetric{
+		{Name: "g", Description: "a gauge", Unit: "%", Points: []otlpPoint{{Time: now, Value: 1.5}}},
+		{Name: "c", Sum: true, Points: []otlpPoint{{Attrs: []hvac.Attr{{Key: "result", Value: "ok"}}, Time: now, Value: 3}}},
+	}))
+	sm := req.message(t, 1, 0).message(t, 2, 0)
+
+	gauge := sm.message(t, 2, 0)
+	assert.Equal(t, "g", gauge.string(1))
+	assert.Equal(t, "a gauge", gauge.string(2))
+	assert.Equal(t, "%", gauge.string(3))
+	point := gauge.message(t, 5, 0).message(t, 1, 0)
+	assert.Nil(t, point[2], "gauges have no start time")
+	assert.Equal(t, uint64(100e9), point[3][0])
+	assert.Equal(t, 1.5, math.Float64frombits(point[4][0].(uint64)))
+
+	sum := sm.message(t, 2, 1).message(t, 7, 0)
+	assert.Equal(t, uint64(2), sum[2][0], "cumulative")
+	assert.Equal(t, uint64(1), sum[3][0], "monotonic")
+	point = sum.message(t, 1, 0)
+	assert.Equal(t, uint64(50e9), point[2][0])
+	assert.Equal(t, 3.0, math.Float64frombits(point[4][0].(uint64)))
+	assert.Equal(t, map[string]any{"result": "ok"}, point.attrs(t, 7))
+}
+
+func TestParsePrometheus(t *testing.T) {
+	now := time.Unix(100, 0)
+	metrics := parsePrometheus(`# HELP hvac_proxy_upstream_requests_total upstream attempts by result
+# TYPE hvac_proxy_upstream_requests_total counter
+hvac_proxy_upstream_requests_total{result="success"} 5
+hvac_proxy_upstream_requests_total{result="error",host="a \"b\""} 2
+# HELP hvac_proxy_stream_subscribers connected clients
+# TYPE hvac_proxy_stream_subscribers gauge
+hvac_proxy_stream_subscribers 1
+not a sample
+`, now)
+
+	assert.Equal(t, []otlpMetric{
+		{Name: "hvac_proxy_upstream_requests_total", Description: "upstream attempts by result", Sum: true, Points: []otlpPoint{
+			{Attrs: []hvac.Attr{{Key: "result", Value: "success"}}, Time: now, Value: 5},
+			{Attrs: []hvac.Attr{{Key: "result", Value: "error"}, {Key: "host", Value: `a "b"`}}, Time: now, Value: 2},
+		}},
+		{Name: "hvac_proxy_stream_subscribers", Description: "connected clients", Points: []otlpPoint{
+			{Time: now, Value: 1},
+		}},
+	}, metrics)
+}
+
+func TestStatusMetrics(t *testing.T) {
+	status := testInfluxStatus()
+	now := time.Unix(100, 0)
+	metrics := statusMetrics(now, &status)
+
+	byName := map[string]otlpMetric{}
+	for _, m := range metrics {
+		byName[m.Name] = m
+	}
+	assert.Equal(t, []otlpPoint{{
+		Attrs: []hvac.Attr{{Key: "zone.id", Value: 1}, {Key: "zone.name", Value: "Living Room"}},
+		Time:  now, Value: 68.5,
+	}}, byName["hvac.zone.temperature"].Points)
+	assert.Equal(t, 41.0, byName["hvac.outdoor.temperature"].Points[0].Value)
+	assert.Equal(t, 30.0, byName["hvac.filter.level"].Points[0].Value)
+	assert.Equal(t, 600.0, byName["hvac.fan.airflow"].Points[0].Value)
+}
+
+// otlpStandIn is a local stand-in for an OTLP collector. It accepts both
+// OTLP/HTTP and OTLP/gRPC requests.
+type otlpStandIn struct {
+	mu         sync.Mutex
+	requests   map[string][][]byte // Decoded request bodies by path
+	headers    http.Header
+	protoMajor int
+	grpcStatus string
+}
+
+func (s *otlpStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.headers, s.protoMajor = r.Header.Clone(), r.ProtoMajor
+
+	if r.Header.Get("Content-Type") == "application/grpc" {
+		if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			w.Header().Set("Grpc-Status", "13")
+			return
+		}
+		s.requests[r.URL.Path] = append(s.requests[r.URL.Path], body[5:])
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		_, _ = w.Write([]byte{0, 0, 0, 0, 0}) // Empty response message
+		w.Header().Set("Grpc-Status", s.grpcStatus)
+		if s.grpcStatus != "0" {
+			w.Header().Set("Grpc-Message", "try%20later")
+		}
+		return
+	}
+	s.requests[r.URL.Path] = append(s.requests[r.URL.Path], body)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+}
+
+func (s *otlpStandIn) received(path string) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func startOTLPStandIn(t *testing.T, h2c bool) (*otlpStandIn, string) {
+	standIn := &otlpStandIn{requests: map[string][][]byte{}, grpcStatus: "0"}
+	srv := httptest.NewUnstartedServer(standIn)
+	if h2c {
+		srv.Config.Protocols = new(http.Protocols)
+		srv.Config.Protocols.SetHTTP1(true)
+		srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return standIn, srv.URL
+}
+
+func testOTLPConfig(endpoint, protocol string) OTLPConfig {
+	cfg := defaultOTLPConfig()
+	cfg.Endpoint, cfg.Protocol = endpoint, protocol
+	cfg.Headers = map[string]string{"Authorization": "Bearer secret"}
+	return cfg
+}
+
+func TestOTLPExporter_HTTP(t *testing.T) {
+	standIn, endpoint := startOTLPStandIn(t, false)
+	e := newOTLPExporter(testOTLPConfig(endpoint+"/", "http/protobuf"))
+
+	e.batch = []*hvac.Span{testSpan()}
+	e.exportSpans(context.Background())
+	e.exportMetrics(context.Background())
+
+	traces := standIn.received("/v1/traces")
+	require.Len(t, traces, 1)
+	span := decodePB(t, traces[0]).message(t, 1, 0).message(t, 2, 0).message(t, 2, 0)
+	assert.Equal(t, "upstream POST", span.string(5))
+	assert.Len(t, standIn.received("/v1/metrics"), 1)
+	assert.Equal(t, "Bearer secret", standIn.headers.Get("Authorization"))
+	assert.Equal(t, "application/x-protobuf", standIn.headers.Get("Content-Type"))
+	assert.Contains(t, e.metrics(), `hvac_proxy_otlp_exports_total{signal="traces",result="success"} 1`)
+	assert.Contains(t, e.metrics(), `hvac_proxy_otlp_exports_total{signal="metrics",result="success"} 1`)
+}
+
+func TestOTLPExporter_GRPC(t *testing.T) {
+	standIn, endpoint := startOTLPStandIn(t, true)
+	e := newOTLPExporter(testOTLPConfig(endpoint, "grpc"))
+
+	e.batch = []*hvac.Span{testSpan()}
+	e.exportSpans(context.Background())
+
+	traces := standIn.received("/opentelemetry.proto.collector.trace.v1.TraceService/Export")
+	require.Len(t, traces, 1)
+	span := decodePB(t, traces[0]).message(t, 1, 0).message(t, 2, 0).message(t, 2, 0)
+	assert.Equal(t, "upstream POST", span.string(5))
+	assert.Equal(t, 2, standIn.protoMajor, "gRPC needs HTTP/2")
+	assert.Equal(t, "trailers", standIn.headers.Get("TE"))
+
+	standIn.mu.Lock()
+	standIn.grpcStatus = "14"
+	standIn.mu.Unlock()
+	err := e.send(context.Background(), "metrics", nil)
+	assert.EqualError(t, err, "collector returned gRPC status 14: try later")
+}
+
+func TestOTLPExporter_Failure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	e := newOTLPExporter(testOTLPConfig(srv.URL, "http/protobuf"))
+
+	e.batch = []*hvac.Span{testSpan()}
+	e.exportSpans(context.Background())
+	assert.Empty(t, e.batch, "failed spans are dropped")
+	assert.Contains(t, e.metrics(), `hvac_proxy_otlp_exports_total{signal="traces",result="failure"} 1`)
+}
+
+func TestOTLPExporter_TracesProxiedExchange(t *testing.T) {
+	useDataDir(t)
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<ok/>"))
+	}))
+	defer upstreamSrv.Close()
+	useUpstream(t, testUpstreamConfig())
+
+	standIn, endpoint := startOTLPStandIn(t, false)
+	otlpCfg := testOTLPConfig(endpoint, "http/protobuf")
+	otlpCfg.Metrics = false
+	e := newOTLPExporter(otlpCfg)
+	e.start()
+
+	req := httptest.NewRequest(http.MethodPost, "/systems/1234/status", strings.NewReader("data="+url.QueryEscape(`<status><oat>40</oat><zones><zone id="1"><rt>70</rt></zone></zones></status>`)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Host = strings.TrimPrefix(upstreamSrv.URL, "http://")
+	proxyHandler(httptest.NewRecorder(), req)
+	hvac.FlushSinks(time.Second)
+	e.Close(5 * time.Second)
+
+	var names []string
+	traceIDs := map[string]bool{}
+	for _, body := range standIn.received("/v1/traces") {
+		ss := decodePB(t, body).message(t, 1, 0).message(t, 2, 0)
+		for i := range ss[2] {
+			span := ss.message(t, 2, i)
+			names = append(names, span.string(5))
+			traceIDs[string(span[1][0].([]byte))] = true
+		}
+	}
+	assert.ElementsMatch(t, []string{
+		"POST /systems/1234/status", "read request", "save body", "parse status", "upstream POST", "save body",
+	}, names)
+	assert.Len(t, traceIDs, 1, "all spans belong to one trace")
+}
+
+func TestOTLPExporter_DropsWhenQueueFull(t *testing.T) {
+	e := newOTLPExporter(testOTLPConfig("http://127.0.0.1:1", "http/protobuf"))
+	for range otlpSpanQueue + 3 {
+		e.record(testSpan())
+	}
+	assert.Contains(t, e.metrics(), "hvac_proxy_otlp_spans_dropped_total 3")
+}
+
+func TestOTLPConfig_Validate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.OTLP.Endpoint = "ftp://collector"
+	cfg.OTLP.Protocol = "thrift"
+	cfg.OTLP.Timeout = 0
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "otlp.endpoint: scheme must be http or https")
+	assert.Contains(t, err.Error(), "otlp.protocol: must be http/protobuf or grpc")
+	assert.Contains(t, err.Error(), "otlp.timeout: must be positive")
+
+	cfg = defaultConfig()
+	cfg.OTLP.Endpoint = "http://collector:4317"
+	cfg.OTLP.Protocol = "grpc"
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestOTLPConfig_Env(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "https://collector:4318")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer%20abc, X-Scope=home")
+	t.Setenv("OTEL_SERVICE_NAME", "attic-proxy")
+	t.Setenv("OTLP_TRACES", "false")
+	t.Setenv("OTLP_METRICS_INTERVAL", "15s")
+	cfg, err := loadConfig("")
+	require.NoError(t, err)
+
+	assert.Equal(t, "https://collector:4318", cfg.OTLP.Endpoint)
+	assert.Equal(t, map[string]string{"Authorization": "Bearer abc", "X-Scope": "home"}, cfg.OTLP.Headers)
+	assert.Equal(t, "attic-proxy", cfg.OTLP.ServiceName)
+	assert.False(t, cfg.OTLP.Traces)
+	assert.True(t, cfg.OTLP.Metrics)
+	assert.Equal(t, 15*time.Second, cfg.OTLP.MetricsInterval)
+	assert.Equal(t, map[string]string{"Authorization": "REDACTED", "X-Scope": "REDACTED"}, cfg.Redacted().OTLP.Headers)
+
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "novalue")
+	_, err = loadConfig("")
+	assert.ErrorContains(t, err, "OTEL_EXPORTER_OTLP_HEADERS")
+}
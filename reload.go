@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hvac-proxy/hvac"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reloader re-reads the configuration on SIGHUP or when the config file
+// changes. A new configuration is validated first and rejected as a whole if
+// invalid; otherwise the settings that can change at runtime are applied to
+// the running subsystems. The listener is never touched, so the thermostat's
+// in-flight requests are unaffected.
+type reloader struct {
+	file string                 // Config file to watch; empty disables watching
+	load func() (Config, error) // Builds and validates a new configuration
+
+	current atomic.Pointer[Config]
+
+	mu       sync.Mutex // Serializes reloads
+	modTime  time.Time
+	size     int64
+	results  map[string]int // Reloads by result: applied, rejected
+	lastLoad time.Time
+}
+
+func newReloader(cfg Config, file string, load func() (Config, error)) *reloader {
+	r := &reloader{file: file, load: load, results: map[string]int{}, lastLoad: time.Now()}
+	r.current.Store(&cfg)
+	r.changed()
+	return r
+}
+
+// Config returns the configuration currently in effect.
+func (r *reloader) Config() Config {
+	return *r.current.Load()
+}
+
+// Reload loads, validates and applies the configuration. On error the
+// current configuration stays in effect.
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := r.load()
+	if err != nil {
+		r.results["rejected"]++
+		log.Printf("[CONFIG] Rejected new configuration, keeping current:\n%v", err)
+		activity.Event("config", "Rejected new configuration")
+		hvac.Events.Publish("config", configChange{Result: "rejected", Error: err.Error()})
+		return err
+	}
+
+	prev := r.Config()
+	next.inherit(&prev)
+	restart := applyConfig(&prev, &next)
+	r.current.Store(&next)
+	r.results["applied"]++
+	r.lastLoad = time.Now()
+
+	log.Printf("[CONFIG] Applied new configuration")
+	activity.Event("config", "Applied new configuration")
+	if len(restart) > 0 {
+		log.Printf("[CONFIG] Changes to %s take effect after a restart", strings.Join(restart, ", "))
+	}
+	hvac.Events.Publish("config", configChange{Result: "applied", Restart: restart})
+	return nil
+}
+
+// configChange is the event published for each reload attempt.
+type configChange struct {
+	Result  string   `json:"result"`            // applied or rejected
+	Error   string   `json:"error,omitempty"`   // Validation errors when rejected
+	Restart []string `json:"restart,omitempty"` // Changed settings that need a restart
+}
+
+// run reloads on SIGHUP and, if interval is positive, whenever the config
+// file's modification time or size changes. It returns when ctx is done.
+func (r *reloader) run(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if r.file != "" && interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("[CONFIG] SIGHUP received, reloading")
+			r.mu.Lock()
+			r.changed()
+			r.mu.Unlock()
+			_ = r.Reload()
+		case <-tick:
+			r.mu.Lock()
+			changed := r.changed()
+			r.mu.Unlock()
+			if changed {
+				log.Printf("[CONFIG] %s changed, reloading", r.file)
+				_ = r.Reload()
+			}
+		}
+	}
+}
+
+// changed records the config file's modification time and size and reports
+// whether they differ from the last check. Callers hold r.mu.
+func (r *reloader) changed() bool {
+	if r.file == "" {
+		return false
+	}
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return false
+	}
+	if info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return false
+	}
+	r.modTime, r.size = info.ModTime(), info.Size()
+	return true
+}
+
+// metrics renders the reload counters for "/metrics".
+func (r *reloader) metrics() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP hvac_proxy_config_reloads_total configuration reloads by result\n")
+	b.WriteString("# TYPE hvac_proxy_config_reloads_total counter\n")
+	for _, result := range []string{"applied", "rejected"} {
+		b.WriteString(fmt.Sprintf("hvac_proxy_config_reloads_total{result=%q} %d\n", result, r.results[result]))
+	}
+	b.WriteString("# HELP hvac_proxy_config_last_reload_timestamp_seconds time the current configuration was applied\n")
+	b.WriteString("# TYPE hvac_proxy_config_last_reload_timestamp_seconds gauge\n")
+	b.WriteString(fmt.Sprintf("hvac_proxy_config_last_reload_timestamp_seconds %d\n", r.lastLoad.Unix()))
+	return b.String()
+}
+
+// inherit keeps settings that were derived at startup, so a reload does not
+// create a new temporary data directory or move the cache and capture.
+func (c *Config) inherit(prev *Config) {
+	if c.DataDir == "" {
+		c.DataDir = prev.DataDir
+	}
+	if c.Cache.Dir == "" {
+		c.Cache.Dir = prev.Cache.Dir
+	}
+	if c.Capture.Dir == "" {
+		c.Capture.Dir = prev.Capture.Dir
+	}
+	if c.Auth.AuditLog == "" {
+		c.Auth.AuditLog = prev.Auth.AuditLog
+	}
+	if c.Influx.BufferFile == "" {
+		c.Influx.BufferFile = prev.Influx.BufferFile
+	}
+	if c.Archive.Dir == "" {
+		c.Archive.Dir = prev.Archive.Dir
+	}
+	c.Capture.Version = prev.Capture.Version
+}
+
+// applyConfig applies the runtime-changeable settings of next to the running
+// subsystems and returns the names of changed settings that need a restart.
+func applyConfig(prev, next *Config) []string {
+	var restart []string
+	changed := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			restart = append(restart, name)
+		}
+	}
+	changed("port", prev.Port, next.Port)
+	changed("dataDir", prev.DataDir, next.DataDir)
+	changed("server", prev.Server, next.Server)
+	changed("admin", prev.Admin, next.Admin)
+	changed("auth.clientCA", prev.Auth.ClientCA, next.Auth.ClientCA)
+	changed("auth.auditLog", prev.Auth.AuditLog, next.Auth.AuditLog)
+	changed("auth enabled", prev.Auth.Enabled(), next.Auth.Enabled())
+	changed("watchInterval", prev.WatchInterval, next.WatchInterval)
+	changed("cache.enabled", prev.Cache.Enabled, next.Cache.Enabled)
+	changed("cache.dir", prev.Cache.Dir, next.Cache.Dir)
+	changed("capture", prev.Capture, next.Capture)
+	changed("mqtt.broker", prev.MQTT.Broker, next.MQTT.Broker)
+	changed("mqtt.clientID", prev.MQTT.ClientID, next.MQTT.ClientID)
+	changed("mqtt.user", prev.MQTT.User, next.MQTT.User)
+	changed("mqtt.password", prev.MQTT.Password, next.MQTT.Password)
+	changed("mqtt.availabilityTopic", prev.MQTT.AvailabilityTopic, next.MQTT.AvailabilityTopic)
+	changed("mqtt.debug", prev.MQTT.Debug, next.MQTT.Debug)
+	changed("influx", prev.Influx, next.Influx)
+	changed("otlp", prev.OTLP, next.OTLP)
+	changed("archive", prev.Archive, next.Archive)
+	changed("faults", prev.Faults, next.Faults)
+	changed("weather", prev.Weather, next.Weather)
+	restartTime := next.Time
+	restartTime.MaxSkew = prev.Time.MaxSkew
+	changed("time", prev.Time, restartTime)
+	changed("messages", prev.Messages, next.Messages)
+	changed("backup", prev.Backup, next.Backup)
+
+	// Settings that can't change at runtime keep their startup values, so
+	// the configuration in effect matches what is actually running
+	next.Port, next.DataDir, next.Server, next.WatchInterval = prev.Port, prev.DataDir, prev.Server, prev.WatchInterval
+	next.Admin = prev.Admin
+	next.Auth.ClientCA, next.Auth.AuditLog = prev.Auth.ClientCA, prev.Auth.AuditLog
+	if prev.Auth.Enabled() != next.Auth.Enabled() {
+		next.Auth = prev.Auth
+	}
+	next.Cache.Enabled, next.Cache.Dir = prev.Cache.Enabled, prev.Cache.Dir
+	next.Capture = prev.Capture
+	next.Influx, next.OTLP = prev.Influx, prev.OTLP
+	next.Archive, next.Faults, next.Weather = prev.Archive, prev.Faults, prev.Weather
+	maxSkew := next.Time.MaxSkew
+	next.Time, next.Messages, next.Backup = prev.Time, prev.Messages, prev.Backup
+	next.Time.MaxSkew = maxSkew
+	publish := next.MQTT
+	next.MQTT = prev.MQTT
+	next.MQTT.Topic, next.MQTT.DiagnosticsTopic, next.MQTT.FaultsTopic = publish.Topic, publish.DiagnosticsTopic, publish.FaultsTopic
+	next.MQTT.QoS, next.MQTT.Retained = publish.QoS, publish.Retained
+
+	hvac.Configure(next.hvac())
+	hvac.UpdateMQTT(next.MQTT)
+	upstream.reconfigure(next.Upstream)
+	if cache != nil {
+		cache.reconfigure(next.Cache)
+	}
+	if auth != nil {
+		auth.reconfigure(next.Auth)
+	}
+	if clock != nil {
+		clock.reconfigure(next.Time)
+	}
+	if !reflect.DeepEqual(prev.Webhooks, next.Webhooks) {
+		initWebhooks(next.Webhooks)
+	}
+	logLevel.Store(next.LogLevel)
+	return restart
+}
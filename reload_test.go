@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"hvac-proxy/hvac"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startReloader loads the config file like runServer does and returns the
+// reloader and the file path.
+func startReloader(t *testing.T, content string) (*reloader, string) {
+	dataDir := useDataDir(t)
+	useUpstream(t, testUpstreamConfig())
+
+	path := writeConfig(t, content)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := addConfigFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-config", path, "-data-dir", dataDir}))
+
+	cfg, err := flags.load()
+	require.NoError(t, err)
+	require.NoError(t, cfg.prepare())
+	upstream.reconfigure(cfg.Upstream)
+	return newReloader(cfg, flags.path(), flags.load), path
+}
+
+func TestReloader_Applies(t *testing.T) {
+	r, path := startReloader(t, "upstream:\n  retries: 1\n  responseTimeout: 200ms\n")
+
+	require.NoError(t, os.WriteFile(path, []byte("port: 9999\nblockUpdates: true\nupstream:\n  retries: 3\n  fallback: true\n"), 0644))
+	require.NoError(t, r.Reload())
+
+	assert.Equal(t, 3, upstream.config().Retries)
+	assert.True(t, upstream.config().Fallback)
+	assert.True(t, hvac.Settings().BlockUpdates)
+	assert.Equal(t, 8080, r.Config().Port, "port needs a restart")
+	assert.Equal(t, 3, r.Config().Upstream.Retries)
+	assert.Contains(t, r.metrics(), `hvac_proxy_config_reloads_total{result="applied"} 1`)
+}
+
+func TestReloader_RejectsInvalid(t *testing.T) {
+	r, path := startReloader(t, "upstream:\n  retries: 1\n")
+	dataDir := hvac.Settings().DataDir
+
+	require.NoError(t, os.WriteFile(path, []byte("blockUpdates: true\nupstream:\n  retries: -5\n"), 0644))
+	err := r.Reload()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "upstream.retries")
+
+	assert.Equal(t, 1, upstream.config().Retries)
+	assert.False(t, hvac.Settings().BlockUpdates, "nothing from a rejected config is applied")
+	assert.Equal(t, dataDir, hvac.Settings().DataDir)
+	assert.Contains(t, r.metrics(), `hvac_proxy_config_reloads_total{result="rejected"} 1`)
+}
+
+func TestReloader_WatchesFile(t *testing.T) {
+	r, path := startReloader(t, "upstream:\n  retries: 1\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.run(ctx, 10*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(path, []byte("upstream:\n  retries: 4\n"), 0644))
+	assert.Eventually(t, func() bool { return upstream.config().Retries == 4 }, time.Second, 10*time.Millisecond)
+}
+
+func TestReloader_KeepsInFlightRequests(t *testing.T) {
+	r, path := startReloader(t, "upstream:\n  responseTimeout: 2s\n")
+
+	started := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("<manifest/>"))
+	}))
+	defer srv.Close()
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest("GET", "/manifest", nil)
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		done <- rr
+	}()
+
+	<-started
+	require.NoError(t, os.WriteFile(path, []byte("upstream:\n  responseTimeout: 10ms\n  connectTimeout: 1s\n"), 0644))
+	require.NoError(t, r.Reload())
+
+	rr := <-done
+	assert.Equal(t, http.StatusOK, rr.Code, "in-flight request keeps the transport it started with")
+	assert.Equal(t, 10*time.Millisecond, upstream.config().ResponseHeaderTimeout)
+}
+
+func TestApplyConfig_RestartRequired(t *testing.T) {
+	useDataDir(t)
+	useUpstream(t, testUpstreamConfig())
+	prev := defaultConfig()
+	prev.MQTT.Broker = "tcp://a:1883"
+	next := prev
+	next.Port = 9000
+	next.MQTT.Broker = "tcp://b:1883"
+	next.MQTT.Topic = "house/hvac"
+
+	restart := applyConfig(&prev, &next)
+	assert.ElementsMatch(t, []string{"port", "mqtt.broker"}, restart)
+	assert.Equal(t, 8080, next.Port)
+	assert.Equal(t, "tcp://a:1883", next.MQTT.Broker)
+	assert.Equal(t, "house/hvac", next.MQTT.Topic)
+}
+
+func TestApplyConfig_LogLevelAndSkew(t *testing.T) {
+	useDataDir(t)
+	useUpstream(t, testUpstreamConfig())
+	c := useClock(t, TimeConfig{Timezone: "UTC"}, time.Now())
+	t.Cleanup(func() { logLevel.Store("info") })
+	prev := defaultConfig()
+	prev.Time.Timezone = "UTC"
+	next := prev
+	next.LogLevel = "warn"
+	next.Time.MaxSkew = 10 * time.Minute
+
+	assert.Empty(t, applyConfig(&prev, &next))
+	assert.False(t, logTraffic(), "requests and responses are no longer logged")
+	assert.Equal(t, 10*time.Minute, next.Time.MaxSkew)
+	assert.Equal(t, 10*time.Minute, c.cfg.MaxSkew)
+
+	next2 := next
+	next2.Time.Serve = true
+	assert.Equal(t, []string{"time"}, applyConfig(&next, &next2))
+}
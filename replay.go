@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"hvac-proxy/hvac"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// replayItem is a single recorded exchange to be fed back through SaveBody.
+type replayItem struct {
+	at       time.Time
+	method   string
+	url      string
+	header   http.Header
+	body     []byte
+	response []byte
+}
+
+// runReplay implements the "replay" subcommand. It loads exchanges from a HAR
+// file or an archive directory and pushes them through the same SaveBody
+// pipeline the proxy uses, writing outputs to a scratch data dir and,
+// optionally, a live MQTT broker.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	dataDir := fs.String("data", "", "scratch data directory for outputs (default: new temp dir)")
+	speed := fs.Float64("speed", 0, "replay speed: 1 is real-time, 10 is ten times faster, 0 is as fast as possible")
+	broker := fs.String("mqtt", "", "MQTT broker URL to publish parsed status to (e.g. tcp://localhost:1883)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: hvac-proxy replay [flags] <file.har|archive-dir>...\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var items []replayItem
+	for _, path := range fs.Args() {
+		loaded, err := loadReplayItems(path)
+		if err != nil {
+			fmt.Printf("Failed to load %s: %v\n", path, err)
+			return 1
+		}
+		items = append(items, loaded...)
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].at.Before(items[j].at) })
+
+	if *dataDir == "" {
+		tmp, err := os.MkdirTemp("", "hvac-replay-*")
+		if err != nil {
+			fmt.Printf("Failed to create temp directory: %v\n", err)
+			return 1
+		}
+		*dataDir = tmp
+	}
+	if err := os.MkdirAll(*dataDir, 0755); err != nil {
+		fmt.Printf("Failed to create data directory: %v\n", err)
+		return 1
+	}
+
+	// Other settings, such as the MQTT topic, come from the usual config
+	// file and environment
+	cfg, err := loadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		fmt.Printf("Invalid configuration:\n%v\n", err)
+		return 1
+	}
+	cfg.DataDir = *dataDir
+	hvac.Configure(cfg.hvac())
+
+	if *broker != "" {
+		cfg.MQTT.Broker = *broker
+		hvac.InitMQTT(cfg.MQTT)
+		deadline := time.Now().Add(10 * time.Second)
+		for !hvac.MQTTConnected() && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if !hvac.MQTTConnected() {
+			fmt.Printf("Could not connect to MQTT broker %s\n", *broker)
+			return 1
+		}
+	}
+
+	fmt.Printf("Replaying %d exchanges into %s\n", len(items), *dataDir)
+	replayItems(items, *speed)
+
+	if !hvac.FlushSinks(10 * time.Second) {
+		fmt.Println("Timed out writing metrics and MQTT publishes")
+	}
+	return 0
+}
+
+// replayItems feeds each item through SaveBody, sleeping between items to
+// reproduce the recorded cadence scaled by speed.
+func replayItems(items []replayItem, speed float64) {
+	for i, item := range items {
+		if speed > 0 && i > 0 && !item.at.IsZero() && !items[i-1].at.IsZero() {
+			if gap := item.at.Sub(items[i-1].at); gap > 0 {
+				time.Sleep(time.Duration(float64(gap) / speed))
+			}
+		}
+
+		r, err := item.request()
+		if err != nil {
+			fmt.Printf("Skipping %s %s: %v\n", item.method, item.url, err)
+			continue
+		}
+		logRequest(r, item.body)
+		hvac.SaveBody(r, item.body, true)
+		hvac.SaveBody(r, item.response, false)
+	}
+}
+
+// request builds a server-side style request for the item, so that SaveBody
+// sees the same RequestURI and Host as it would behind the proxy.
+func (item replayItem) request() (*http.Request, error) {
+	r, err := http.NewRequest(item.method, item.url, bytes.NewReader(item.body))
+	if err != nil {
+		return nil, err
+	}
+	r.RequestURI = r.URL.RequestURI()
+	if item.header != nil {
+		r.Header = item.header
+	}
+	return r, nil
+}
+
+// loadReplayItems loads items from a HAR file or an archive directory.
+func loadReplayItems(path string) ([]replayItem, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return loadHARItems(path)
+	}
+	return loadArchiveItems(path)
+}
+
+// loadHARItems converts the entries of a HAR file into replay items.
+func loadHARItems(path string) ([]replayItem, error) {
+	har, err := hvac.ReadHAR(path)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]replayItem, 0, len(har.Log.Entries))
+	for _, e := range har.Log.Entries {
+		item := replayItem{
+			method:   e.Request.Method,
+			url:      e.Request.URL,
+			header:   http.Header{},
+			response: []byte(e.Response.Content.Text),
+		}
+		item.at, _ = time.Parse(time.RFC3339Nano, e.StartedDateTime)
+		for _, h := range e.Request.Headers {
+			item.header.Add(h.Name, h.Value)
+		}
+		if e.Request.PostData != nil {
+			item.body = []byte(e.Request.PostData.Text)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// loadArchiveItems walks an archive directory. HAR files are loaded as-is;
+// other files are treated as SaveBody output named "METHOD-path[-response]",
+// with the file modification time used as the exchange time. Requests
+// without a body (such as config GETs) only leave a response file behind, so
+// those are replayed with an empty request body.
+func loadArchiveItems(dir string) ([]replayItem, error) {
+	var items []replayItem
+	archived := map[string]*replayItem{}
+
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.EqualFold(filepath.Ext(path), ".har") {
+			loaded, err := loadHARItems(path)
+			if err != nil {
+				return err
+			}
+			items = append(items, loaded...)
+			return nil
+		}
+
+		name := strings.TrimSuffix(d.Name(), ".xml")
+		key, isResponse := strings.CutSuffix(name, "-response")
+		method, rest, ok := strings.Cut(key, "-")
+		if !ok || method == "" || strings.ToUpper(method) != method {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		item, ok := archived[key]
+		if !ok {
+			item = &replayItem{
+				at:     info.ModTime(),
+				method: method,
+				url:    "http://replay/" + archivePath(rest),
+			}
+			archived[key] = item
+		}
+		if isResponse {
+			item.response = content
+		} else {
+			item.at = info.ModTime()
+			item.body = content
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range archived {
+		items = append(items, *item)
+	}
+	return items, nil
+}
+
+// archiveEndpoints are endpoint names with an underscore of their own, which
+// archivePath keeps.
+var archiveEndpoints = []string{"idu_raw", "odu_raw", "equipment_events"}
+
+// archivePath reverses the sanitizing done by CreateFilePath as far as
+// possible, turning "systems_123_status" back into "systems/123/status" and
+// "systems_123_idu_raw" into "systems/123/idu_raw".
+func archivePath(name string) string {
+	parts := strings.Split(name, "_")
+	var segments []string
+	for i := 0; i < len(parts); i++ {
+		if i+1 < len(parts) && slices.Contains(archiveEndpoints, parts[i]+"_"+parts[i+1]) {
+			segments = append(segments, parts[i]+"_"+parts[i+1])
+			i++
+			continue
+		}
+		segments = append(segments, parts[i])
+	}
+	return strings.Join(segments, "/")
+}
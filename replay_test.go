@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"hvac-proxy/hvac"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const replayStatus = `<status><localTime>2025-11-21T19:49:44-05:00</localTime><oat>41</oat><filtrlvl>90</filtrlvl><idu><cfm>100</cfm></idu><zones><zone id="1"><rt>70</rt><rh>40</rh><htsp>68</htsp><clsp>75</clsp></zone></zones></status>`
+
+func TestRunReplay_HAR(t *testing.T) {
+	defer hvac.Configure(hvac.Settings())
+
+	capDir := t.TempDir()
+	c := hvac.NewCapture(hvac.CaptureConfig{Dir: capDir})
+	c.Record(hvac.Exchange{
+		Started:      time.Now(),
+		Method:       "POST",
+		URL:          "http://www.api.ing.carrier.com/systems/123/status",
+		RequestBody:  []byte(replayStatus),
+		StatusCode:   200,
+		ResponseBody: []byte(`<status><pingRate>12</pingRate></status>`),
+	})
+	require.NoError(t, c.Flush())
+	files, _ := filepath.Glob(filepath.Join(capDir, "*.har"))
+	require.Len(t, files, 1)
+
+	out := t.TempDir()
+	assert.Equal(t, 0, runReplay([]string{"-data", out, files[0]}))
+
+	metrics, err := os.ReadFile(filepath.Join(out, "metrics_last.txt"))
+	require.NoError(t, err)
+	assert.Contains(t, string(metrics), "outdoorAirTemp 41.0")
+	assert.FileExists(t, filepath.Join(out, "POST-systems_123_status.xml"))
+	assert.FileExists(t, filepath.Join(out, "POST-systems_123_status-response.xml"))
+}
+
+func TestLoadArchiveItems(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "POST-systems_123_status.xml"), []byte(replayStatus), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "POST-systems_123_status-response.xml"), []byte("<status/>"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "GET-systems_123_config-response.xml"), []byte("<config/>"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "metrics_last.txt"), []byte("ignored"), 0644))
+
+	items, err := loadArchiveItems(dir)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+
+	byURL := map[string]replayItem{}
+	for _, item := range items {
+		byURL[item.method+" "+item.url] = item
+	}
+	status := byURL["POST http://replay/systems/123/status"]
+	assert.Equal(t, replayStatus, string(status.body))
+	assert.Equal(t, "<status/>", string(status.response))
+
+	config := byURL["GET http://replay/systems/123/config"]
+	assert.Empty(t, config.body)
+	assert.Equal(t, "<config/>", string(config.response))
+}
+
+func TestRunReplay_ArchiveDiagnostics(t *testing.T) {
+	defer hvac.Configure(hvac.Settings())
+	dir := t.TempDir()
+	diag := `<idu_raw version="1.2"><type>furnace</type><blowerRPM>1050</blowerRPM></idu_raw>`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "POST-systems_123_idu_raw.xml"), []byte(diag), 0644))
+	_, events, cancel := hvac.Events.Subscribe(0)
+	defer cancel()
+
+	items, err := loadArchiveItems(dir)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, "http://replay/systems/123/idu_raw", items[0].url)
+
+	assert.Equal(t, 0, runReplay([]string{"-data", t.TempDir(), dir}))
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == "diagnostics" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("replayed diagnostics weren't parsed")
+		}
+	}
+}
+
+func TestReplayItems_Speed(t *testing.T) {
+	useDataDir(t)
+
+	now := time.Now()
+	items := []replayItem{
+		{at: now, method: "GET", url: "http://replay/a"},
+		{at: now.Add(time.Second), method: "GET", url: "http://replay/b"},
+	}
+
+	start := time.Now()
+	replayItems(items, 10)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	start = time.Now()
+	replayItems(items, 0)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
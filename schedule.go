@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hvac-proxy/hvac"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of the thermostat's weekly program.
+const (
+	defaultProgramPeriods = 5                // Periods per day when the config document has none for the day
+	programStep           = 15 * time.Minute // Period start times are on this boundary
+)
+
+// programActivities are the activities a program period can start, when
+// the zone's config does not list its own.
+var programActivities = []string{"home", "away", "sleep", "wake"}
+
+// programXML is the program element of a zone in the config document.
+type programXML struct {
+	XMLName xml.Name          `xml:"program"`
+	Days    []hvac.ProgramDay `xml:"day"`
+}
+
+// zoneSchedule is a zone's weekly program as served by the API: the one in
+// the latest config document, or the pending change if there is one.
+type zoneSchedule struct {
+	Zone      int               `json:"zone"`
+	Name      string            `json:"name"`
+	Days      []hvac.ProgramDay `json:"days"`
+	Summary   []string          `json:"summary"`            // One line per day, e.g. "Monday: 06:00 wake, 08:00 away"
+	Pending   bool              `json:"pending"`            // Whether the program is a change the thermostat has not applied yet
+	Queued    time.Time         `json:"queued,omitzero"`    // When the pending change was queued
+	Delivered time.Time         `json:"delivered,omitzero"` // When it was last sent to the thermostat
+}
+
+// scheduleMu serializes schedule edits, so concurrent edits of a zone are
+// not lost.
+var scheduleMu sync.Mutex
+
+// currentSchedule returns the program of a zone, with any pending change
+// applied, and the zone's config.
+func currentSchedule(id int) (*zoneSchedule, *hvac.ConfigZone, error) {
+	cfg := hvac.LatestSystemConfig()
+	if cfg == nil {
+		return nil, nil, errNoConfig
+	}
+	z := cfg.Zone(id)
+	if z == nil {
+		return nil, nil, fmt.Errorf("no zone %d in the config document", id)
+	}
+	s := &zoneSchedule{Zone: z.ID, Name: z.Name, Days: slices.Clone(z.Program)}
+	for _, p := range injector.Pending("") {
+		var prog programXML
+		if p.Zone == id && p.Element == "program" && xml.Unmarshal([]byte(p.XML), &prog) == nil {
+			s.Days, s.Pending, s.Queued, s.Delivered = prog.Days, true, p.Queued, p.Delivered
+		}
+	}
+	s.Summary = summarizeProgram(s.Days)
+	return s, z, nil
+}
+
+// errNoConfig is returned before a config document has been received.
+var errNoConfig = errors.New("no config document received yet")
+
+// summarizeProgram describes the enabled periods of each day.
+func summarizeProgram(days []hvac.ProgramDay) []string {
+	out := make([]string, 0, len(days))
+	for _, d := range days {
+		var periods []string
+		for _, p := range d.Periods {
+			if p.Enabled == "on" {
+				periods = append(periods, p.Time+" "+p.Activity)
+			}
+		}
+		if len(periods) == 0 {
+			periods = []string{"no periods"}
+		}
+		out = append(out, d.ID+": "+strings.Join(periods, ", "))
+	}
+	return out
+}
+
+// normalizeDay validates the periods of a day against the thermostat's
+// limits and returns them as the thermostat expects: enabled periods in
+// time order, then disabled ones, numbered from 1 and padded with disabled
+// periods to the number the day had.
+func normalizeDay(z *hvac.ConfigZone, prev hvac.ProgramDay, periods []hvac.Period) ([]hvac.Period, error) {
+	slots := len(prev.Periods)
+	if slots == 0 {
+		slots = defaultProgramPeriods
+	}
+	allowed := programActivities
+	if len(z.Activities) > 0 {
+		allowed = nil
+		for _, a := range z.Activities {
+			if a.ID != "manual" {
+				allowed = append(allowed, a.ID)
+			}
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("zone %d has no activities to program", z.ID)
+	}
+
+	var errs []error
+	if len(periods) > slots {
+		errs = append(errs, fmt.Errorf("%s allows at most %d periods, got %d", prev.ID, slots, len(periods)))
+	}
+	var enabled, disabled []hvac.Period
+	starts := map[string]bool{}
+	for i, p := range periods {
+		if p.Enabled == "" {
+			p.Enabled = "on"
+		}
+		t, err := time.Parse("15:04", p.Time)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("period %d: time must be HH:MM, got %q", i+1, p.Time))
+		case t.Sub(t.Truncate(programStep)) != 0:
+			errs = append(errs, fmt.Errorf("period %d: time must be a multiple of %v, got %s", i+1, programStep, p.Time))
+		}
+		if !slices.Contains(allowed, p.Activity) {
+			errs = append(errs, fmt.Errorf("period %d: activity must be one of %s, got %q", i+1, strings.Join(allowed, ", "), p.Activity))
+		}
+		switch p.Enabled {
+		case "on":
+			if starts[p.Time] {
+				errs = append(errs, fmt.Errorf("period %d: another period starts at %s", i+1, p.Time))
+			}
+			starts[p.Time] = true
+			enabled = append(enabled, p)
+		case "off":
+			disabled = append(disabled, p)
+		default:
+			errs = append(errs, fmt.Errorf("period %d: enabled must be on or off, got %q", i+1, p.Enabled))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	slices.SortStableFunc(enabled, func(a, b hvac.Period) int { return strings.Compare(a.Time, b.Time) })
+	out := append(enabled, disabled...)
+	for i := len(out); i < slots; i++ {
+		p := hvac.Period{Activity: allowed[0], Time: "00:00"}
+		if i < len(prev.Periods) {
+			p = prev.Periods[i]
+		}
+		p.Enabled = "off"
+		out = append(out, p)
+	}
+	for i := range out {
+		out[i].ID = i + 1
+	}
+	return out, nil
+}
+
+// programDay returns the index of the named weekday in a program, or -1.
+func programDay(days []hvac.ProgramDay, name string) int {
+	return slices.IndexFunc(days, func(d hvac.ProgramDay) bool { return strings.EqualFold(d.ID, name) })
+}
+
+// editSchedule applies an edit to one day of a zone's program, then queues
+// the result for the thermostat, or with ?preview=true only returns it.
+func editSchedule(w http.ResponseWriter, r *http.Request, edit func(periods []hvac.Period) ([]hvac.Period, error)) {
+	id, err := strconv.Atoi(r.PathValue("zone"))
+	if err != nil {
+		http.Error(w, "invalid zone", http.StatusBadRequest)
+		return
+	}
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	s, z, err := currentSchedule(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	i := programDay(s.Days, r.PathValue("day"))
+	if i < 0 {
+		http.Error(w, fmt.Sprintf("no %s in the program of zone %d", r.PathValue("day"), id), http.StatusNotFound)
+		return
+	}
+
+	day := s.Days[i]
+	var periods []hvac.Period
+	for _, p := range day.Periods {
+		if p.Enabled == "on" {
+			periods = append(periods, p)
+		}
+	}
+	periods, err = edit(periods)
+	if err == nil {
+		periods, err = normalizeDay(z, day, periods)
+	}
+	if errors.Is(err, errNoPeriod) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Days = slices.Clone(s.Days)
+	s.Days[i] = hvac.ProgramDay{ID: day.ID, Periods: periods}
+	s.Summary = summarizeProgram(s.Days)
+
+	if r.URL.Query().Get("preview") == "true" {
+		writeJSON(w, s)
+		return
+	}
+	data, err := xml.Marshal(programXML{Days: s.Days})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p := injector.Queue(configPatch{Zone: id, Element: "program", XML: string(data), Source: "schedule"})
+	activity.Event("schedule", "Queued %s program change for zone %d (%s)", day.ID, id, z.Name)
+	s.Pending, s.Queued, s.Delivered = true, p[0].Queued, time.Time{}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, s)
+}
+
+// errNoPeriod is returned when an edit names a period the day doesn't have.
+var errNoPeriod = errors.New("no such period")
+
+// decodePeriods decodes the JSON body of a schedule edit into v.
+func decodePeriods(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid schedule JSON: %w", err)
+	}
+	return nil
+}
+
+// periodIndex returns the index of the enabled period numbered by the
+// request path, counting from 1.
+func periodIndex(r *http.Request, periods []hvac.Period) (int, error) {
+	n, err := strconv.Atoi(r.PathValue("period"))
+	if err != nil || n < 1 || n > len(periods) {
+		return 0, fmt.Errorf("%w %q", errNoPeriod, r.PathValue("period"))
+	}
+	return n - 1, nil
+}
+
+// handleSchedules serves the programs of all zones.
+func handleSchedules(w http.ResponseWriter, r *http.Request) {
+	cfg := hvac.LatestSystemConfig()
+	if cfg == nil {
+		http.Error(w, errNoConfig.Error(), http.StatusNotFound)
+		return
+	}
+	out := []*zoneSchedule{}
+	for _, z := range cfg.Zones {
+		if z.Enabled != "on" {
+			continue
+		}
+		if s, _, err := currentSchedule(z.ID); err == nil {
+			out = append(out, s)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// handleSchedule serves the program of a zone.
+func handleSchedule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("zone"))
+	if err != nil {
+		http.Error(w, "invalid zone", http.StatusBadRequest)
+		return
+	}
+	s, _, err := currentSchedule(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// handlePutScheduleDay replaces the periods of a day.
+func handlePutScheduleDay(w http.ResponseWriter, r *http.Request) {
+	editSchedule(w, r, func([]hvac.Period) ([]hvac.Period, error) {
+		var body struct {
+			Periods []hvac.Period `json:"periods"`
+		}
+		err := decodePeriods(w, r, &body)
+		return body.Periods, err
+	})
+}
+
+// handleAddPeriod adds a period to a day.
+func handleAddPeriod(w http.ResponseWriter, r *http.Request) {
+	editSchedule(w, r, func(periods []hvac.Period) ([]hvac.Period, error) {
+		var p hvac.Period
+		if err := decodePeriods(w, r, &p); err != nil {
+			return nil, err
+		}
+		return append(periods, p), nil
+	})
+}
+
+// handlePutPeriod replaces a period of a day.
+func handlePutPeriod(w http.ResponseWriter, r *http.Request) {
+	editSchedule(w, r, func(periods []hvac.Period) ([]hvac.Period, error) {
+		i, err := periodIndex(r, periods)
+		if err != nil {
+			return nil, err
+		}
+		var p hvac.Period
+		if err := decodePeriods(w, r, &p); err != nil {
+			return nil, err
+		}
+		periods[i] = p
+		return periods, nil
+	})
+}
+
+// handleDeletePeriod removes a period from a day.
+func handleDeletePeriod(w http.ResponseWriter, r *http.Request) {
+	editSchedule(w, r, func(periods []hvac.Period) ([]hvac.Period, error) {
+		i, err := periodIndex(r, periods)
+		if err != nil {
+			return nil, err
+		}
+		return slices.Delete(periods, i, i+1), nil
+	})
+}
+
+// handleDiscardSchedule drops the pending program change of a zone.
+func handleDiscardSchedule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("zone"))
+	if err != nil {
+		http.Error(w, "invalid zone", http.StatusBadRequest)
+		return
+	}
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	n := injector.Discard(func(p configPatch) bool { return p.Zone == id && p.Element == "program" })
+	if n == 0 {
+		http.Error(w, "no pending schedule change", http.StatusNotFound)
+		return
+	}
+	activity.Event("schedule", "Discarded the pending program change for zone %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"hvac-proxy/hvac"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testScheduleConfig = `<config version="1.7"><mode>heat</mode><zones>
+<zone id="1"><name>Main</name><enabled>on</enabled>
+<activities><activity id="home"><htsp>68</htsp><clsp>75</clsp><fan>off</fan></activity><activity id="sleep"><htsp>64</htsp><clsp>78</clsp><fan>low</fan></activity><activity id="manual"><htsp>70</htsp><clsp>74</clsp><fan>off</fan></activity></activities>
+<program><day id="Monday"><period id="1"><activity>home</activity><time>06:00</time><enabled>on</enabled></period><period id="2"><activity>sleep</activity><time>22:00</time><enabled>on</enabled></period><period id="3"><activity>home</activity><time>00:00</time><enabled>off</enabled></period></day>
+<day id="Tuesday"><period id="1"><activity>home</activity><time>06:00</time><enabled>on</enabled></period><period id="2"><activity>sleep</activity><time>22:00</time><enabled>on</enabled></period><period id="3"><activity>home</activity><time>00:00</time><enabled>off</enabled></period></day></program></zone>
+<zone id="2"><name>Basement</name><enabled>off</enabled><program></program></zone>
+</zones></config>`
+
+// useScheduleConfig makes doc the latest config document for the duration
+// of a test.
+func useScheduleConfig(t *testing.T, doc string) {
+	useDataDir(t)
+	t.Cleanup(hvac.LoadSystemConfig)
+	req := httptest.NewRequest("POST", "/systems/123/config", strings.NewReader(doc))
+	hvac.SaveBody(req, []byte(doc), true)
+	require.NotNil(t, hvac.LatestSystemConfig())
+}
+
+func TestSchedule_API(t *testing.T) {
+	useScheduleConfig(t, testScheduleConfig)
+	c := useInjector(t)
+	authorize := useControl(t)
+	admin := newAdminMux()
+
+	do := func(method, path, body string) (*httptest.ResponseRecorder, zoneSchedule) {
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, authorize(httptest.NewRequest(method, path, strings.NewReader(body))))
+		var s zoneSchedule
+		_ = json.Unmarshal(rr.Body.Bytes(), &s)
+		return rr, s
+	}
+
+	rr, s := do("GET", "/api/v1/zones/1/schedule", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "Main", s.Name)
+	assert.False(t, s.Pending)
+	assert.Equal(t, []string{"Monday: 06:00 home, 22:00 sleep", "Tuesday: 06:00 home, 22:00 sleep"}, s.Summary)
+
+	rr, _ = do("GET", "/api/v1/schedules", "")
+	var all []zoneSchedule
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &all))
+	assert.Len(t, all, 1, "disabled zones are left out")
+
+	// Edits are validated against the thermostat's limits
+	rr, _ = do("PUT", "/api/v1/zones/1/schedule/monday", `{"periods": [{"activity": "manual", "time": "06:10"}, {"activity": "home", "time": "6am"}]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `period 1: time must be a multiple of 15m0s, got 06:10`)
+	assert.Contains(t, rr.Body.String(), `period 1: activity must be one of home, sleep, got "manual"`)
+	assert.Contains(t, rr.Body.String(), `period 2: time must be HH:MM, got "6am"`)
+	rr, _ = do("PUT", "/api/v1/zones/1/schedule/monday", `{"periods": [{"activity": "home", "time": "06:00"}, {"activity": "sleep", "time": "21:00"}, {"activity": "home", "time": "12:00"}, {"activity": "sleep", "time": "23:00"}]}`)
+	assert.Contains(t, rr.Body.String(), "Monday allows at most 3 periods, got 4")
+	rr, _ = do("PUT", "/api/v1/zones/1/schedule/Funday", `{"periods": []}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// A preview shows the result without queueing it
+	rr, s = do("PUT", "/api/v1/zones/1/schedule/monday?preview=true", `{"periods": [{"activity": "sleep", "time": "21:30"}, {"activity": "home", "time": "05:45"}]}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "Monday: 05:45 home, 21:30 sleep", s.Summary[0])
+	assert.Equal(t, hvac.Period{ID: 3, Activity: "home", Time: "00:00", Enabled: "off"}, s.Days[0].Periods[2], "padded to the day's periods")
+	assert.Empty(t, c.Pending(""))
+
+	rr, s = do("PUT", "/api/v1/zones/1/schedule/monday", `{"periods": [{"activity": "sleep", "time": "21:30"}, {"activity": "home", "time": "05:45"}]}`)
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	assert.True(t, s.Pending)
+	require.Len(t, c.Pending("schedule"), 1)
+
+	// Further edits build on the pending change
+	rr, s = do("POST", "/api/v1/zones/1/schedule/monday/periods", `{"activity": "home", "time": "17:00"}`)
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Equal(t, "Monday: 05:45 home, 17:00 home, 21:30 sleep", s.Summary[0])
+	rr, s = do("PUT", "/api/v1/zones/1/schedule/monday/periods/2", `{"activity": "sleep", "time": "17:15"}`)
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Equal(t, "Monday: 05:45 home, 17:15 sleep, 21:30 sleep", s.Summary[0])
+	rr, s = do("DELETE", "/api/v1/zones/1/schedule/monday/periods/3", "")
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Equal(t, "Monday: 05:45 home, 17:15 sleep", s.Summary[0])
+	assert.Equal(t, "Tuesday: 06:00 home, 22:00 sleep", s.Summary[1], "other days are kept")
+	rr, _ = do("DELETE", "/api/v1/zones/1/schedule/monday/periods/3", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	_, s = do("GET", "/api/v1/zones/1/schedule", "")
+	assert.True(t, s.Pending)
+	pending := c.Pending("schedule")
+	require.Len(t, pending, 1)
+	assert.Contains(t, pending[0].XML, `<day id="Monday"><period id="1"><activity>home</activity><time>05:45</time><enabled>on</enabled></period>`+
+		`<period id="2"><activity>sleep</activity><time>17:15</time><enabled>on</enabled></period>`+
+		`<period id="3"><activity>sleep</activity><time>21:30</time><enabled>off</enabled></period></day>`, "removed periods are disabled")
+
+	rr, _ = do("DELETE", "/api/v1/zones/1/schedule", "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Empty(t, c.Pending(""))
+	rr, _ = do("DELETE", "/api/v1/zones/1/schedule", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestNormalizeDay_NoActivities(t *testing.T) {
+	z := &hvac.ConfigZone{ID: 1, Activities: []hvac.Activity{{ID: "manual"}}}
+	_, err := normalizeDay(z, hvac.ProgramDay{ID: "Monday"}, nil)
+	assert.EqualError(t, err, "zone 1 has no activities to program")
+}
+
+func TestSchedule_NoConfig(t *testing.T) {
+	useDataDir(t)
+	hvac.LoadSystemConfig()
+	useInjector(t)
+
+	rr := httptest.NewRecorder()
+	newAdminMux().ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/zones/1/schedule", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Contains(t, rr.Body.String(), "no config document received yet")
+}
+
+func TestSchedule_DeliveredToThermostat(t *testing.T) {
+	useScheduleConfig(t, testScheduleConfig)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testScheduleConfig))
+	}))
+	defer srv.Close()
+	useUpstream(t, testUpstreamConfig())
+	useInjector(t)
+
+	authorize := useControl(t)
+
+	rr := httptest.NewRecorder()
+	newAdminMux().ServeHTTP(rr, authorize(httptest.NewRequest("PUT", "/api/v1/zones/1/schedule/Tuesday", strings.NewReader(`{"periods": [{"activity": "home", "time": "07:00"}]}`))))
+	require.Equal(t, http.StatusAccepted, rr.Code)
+
+	req := httptest.NewRequest("GET", "/systems/123/config", nil)
+	req.Host = strings.TrimPrefix(srv.URL, "http://")
+	rr = httptest.NewRecorder()
+	proxyHandler(rr, req)
+	cfg, err := hvac.ParseSystemConfig(rr.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Monday: 06:00 home, 22:00 sleep", "Tuesday: 07:00 home"}, summarizeProgram(cfg.Zone(1).Program))
+	assert.True(t, bytes.Contains(rr.Body.Bytes(), []byte(`<zone id="2"><name>Basement</name>`)))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hvac-proxy/hvac"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServerConfig controls the proxy's HTTP server and its shutdown.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"` // Time allowed to read request headers
+	ReadTimeout       time.Duration `yaml:"readTimeout"`       // Time allowed to read the whole request
+	WriteTimeout      time.Duration `yaml:"writeTimeout"`      // Time allowed to proxy and write the response
+	IdleTimeout       time.Duration `yaml:"idleTimeout"`       // Keep-alive idle time between requests
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout"`   // Time allowed to drain requests and flush work on shutdown
+}
+
+// defaultServerConfig returns the settings used when nothing is configured.
+// WriteTimeout leaves room for the upstream response timeout plus retries,
+// and draining plus flushing, each bounded by ShutdownTimeout, fits inside
+// Docker's default 10s stop grace period.
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      2 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		ShutdownTimeout:   4 * time.Second,
+	}
+}
+
+// newServer creates the HTTP server with the configured timeouts.
+func newServer(addr string, handler http.Handler, cfg ServerConfig) *http.Server {
+	done := make(chan struct{})
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), shutdownKey{}, (<-chan struct{})(done))
+		},
+	}
+	var once sync.Once
+	srv.RegisterOnShutdown(func() { once.Do(func() { close(done) }) })
+	return srv
+}
+
+// shutdownKey is the request context key for the channel closed when the
+// server starts shutting down.
+type shutdownKey struct{}
+
+// shuttingDown returns a channel that is closed when the server handling r
+// starts shutting down, so long-lived responses such as event streams end
+// instead of holding up the drain.
+func shuttingDown(r *http.Request) <-chan struct{} {
+	ch, _ := r.Context().Value(shutdownKey{}).(<-chan struct{})
+	return ch
+}
+
+// serve accepts connections on ln until ctx is cancelled, then stops
+// accepting and waits up to timeout for in-flight requests to finish.
+// Requests still running after that are cut off.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(ln) }()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down, draining in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		_ = srv.Close()
+		return fmt.Errorf("drain incomplete: %w", err)
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// listener pairs a server with the listener it accepts connections on.
+type listener struct {
+	srv *http.Server
+	ln  net.Listener
+}
+
+// serveAll serves every listener until ctx is cancelled or one of them
+// fails, then drains them all.
+func serveAll(ctx context.Context, servers []listener, timeout time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(servers))
+	for _, l := range servers {
+		go func() {
+			err := serve(ctx, l.srv, l.ln, timeout)
+			cancel()
+			errs <- err
+		}()
+	}
+	var all []error
+	for range servers {
+		if err := <-errs; err != nil {
+			all = append(all, err)
+		}
+	}
+	return errors.Join(all...)
+}
+
+// flush writes out queued work once no more requests are being served:
+// pending capture entries go to disk, every sink (the metrics file, MQTT,
+// InfluxDB, webhooks and the archive) is given until the deadline to write
+// out its queue, pending spans and final metrics are exported over OTLP, and
+// the MQTT client announces it is offline and disconnects.
+func flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if capture != nil {
+		if err := capture.Flush(); err != nil {
+			fmt.Printf("Failed to flush capture: %v\n", err)
+		}
+	}
+	if !hvac.FlushSinks(time.Until(deadline)) {
+		fmt.Println("Timed out writing out sink queues")
+	}
+	if otlp != nil {
+		otlp.Close(max(time.Until(deadline), time.Second))
+	}
+	hvac.CloseMQTT(max(time.Until(deadline), time.Second))
+}
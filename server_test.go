@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"hvac-proxy/hvac"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServe runs serve on a loopback listener and returns its address, the
+// cancel function standing in for a signal, and the channel serve returns on.
+func startServe(t *testing.T, handler http.Handler, timeout time.Duration) (string, context.CancelFunc, <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, newServer(ln.Addr().String(), handler, defaultServerConfig()), ln, timeout) }()
+	return "http://" + ln.Addr().String(), cancel, done
+}
+
+func TestServe_DrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	addr, cancel, done := startServe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("finished"))
+	}), time.Second)
+
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(addr + "/slow")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := io.ReadAll(resp.Body)
+		result <- string(body)
+	}()
+
+	<-started
+	cancel()
+	assert.Equal(t, "finished", <-result)
+	require.NoError(t, <-done)
+
+	// No new connections once drained
+	_, err := http.Get(addr + "/slow")
+	assert.Error(t, err)
+}
+
+func TestServe_DrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	addr, cancel, done := startServe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), 50*time.Millisecond)
+
+	go func() {
+		if resp, err := http.Get(addr + "/stuck"); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+
+	<-started
+	cancel()
+	err := <-done
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "drain incomplete")
+}
+
+func TestFlush_WritesPendingCapture(t *testing.T) {
+	dir := t.TempDir()
+	capture = hvac.NewCapture(hvac.CaptureConfig{BufferSize: 5, Dir: dir, FileEntries: 10})
+	defer func() { capture = nil }()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://www.api.ing.carrier.com/systems/123/profile", nil)
+	recordExchange(req, nil, time.Now(), http.StatusOK, http.Header{}, []byte("<profile/>"), 0, 0, "")
+
+	flush(time.Second)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestServeAll_StopsTogether(t *testing.T) {
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	adminLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy := newServer("", http.NotFoundHandler(), defaultServerConfig())
+	admin := newServer("", http.NotFoundHandler(), defaultServerConfig())
+
+	done := make(chan error, 1)
+	go func() { done <- serveAll(ctx, []listener{{proxy, proxyLn}, {admin, adminLn}}, time.Second) }()
+
+	// A failing listener shuts down the other one as well
+	_ = adminLn.Close()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("serveAll did not return")
+	}
+	_, err = http.Get("http://" + proxyLn.Addr().String())
+	assert.Error(t, err)
+}
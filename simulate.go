@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"hvac-proxy/hvac"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// simulator acts like an Infinity thermostat: it posts status documents,
+// polls the config document and runs simple thermal dynamics for its zones.
+type simulator struct {
+	client *http.Client
+	proxy  string // Base URL of the proxy, e.g. http://localhost:8080
+	host   string // Carrier API host sent in the Host header
+	serial string // System serial number used in endpoint paths
+
+	clock   time.Time // Simulated wall-clock time
+	baseOAT float64   // Daily mean outdoor temperature
+	oat     float64   // Current outdoor temperature
+	filter  int       // Filter life remaining in percent
+	runtime float64   // Blower runtime in hours
+	stage   int       // Positive for heating stages, negative for cooling
+	config  *hvac.SystemConfig
+	zones   []*simZone
+}
+
+// simZone is the simulated state of a single zone.
+type simZone struct {
+	id       int
+	temp     float64
+	rh       float64
+	activity string
+	htsp     float64
+	clsp     float64
+	fan      string
+}
+
+// Thermal model constants, per simulated hour.
+const (
+	simLossRate   = 0.10 // Fraction of the indoor/outdoor difference lost per hour
+	simStageRate  = 6.0  // Degrees per hour added or removed per equipment stage
+	simHysteresis = 0.5  // Degrees around the set point before equipment switches
+)
+
+// runSimulate implements the "simulate" subcommand.
+func runSimulate(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	proxy := fs.String("proxy", "http://localhost:8080", "base URL of the proxy")
+	host := fs.String("host", "www.api.ing.carrier.com", "Carrier API host sent in the Host header")
+	serial := fs.String("serial", "SIM0000001", "system serial number")
+	zones := fs.Int("zones", 1, "number of zones (1-8)")
+	oat := fs.Float64("oat", 40, "daily mean outdoor temperature in F")
+	interval := fs.Duration("interval", time.Minute, "status post cadence")
+	configInterval := fs.Duration("config-interval", 5*time.Minute, "config poll cadence")
+	speed := fs.Float64("speed", 1, "simulated time per real time; 60 runs one simulated minute per second")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: hvac-proxy simulate [flags]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *zones < 1 || *zones > 8 {
+		fmt.Println("zones must be between 1 and 8")
+		return 2
+	}
+	if *interval <= 0 || *configInterval <= 0 || *speed <= 0 {
+		fmt.Println("interval, config-interval and speed must be positive")
+		return 2
+	}
+
+	sim := newSimulator(*proxy, *host, *serial, *zones, *oat)
+	fmt.Printf("Simulating thermostat %s with %d zone(s) against %s\n", sim.serial, *zones, sim.proxy)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	statusTick := time.NewTicker(*interval)
+	configTick := time.NewTicker(*configInterval)
+	defer statusTick.Stop()
+	defer configTick.Stop()
+
+	sim.pollConfig()
+	sim.postStatus()
+	for {
+		select {
+		case <-stop:
+			return 0
+		case <-statusTick.C:
+			sim.step(time.Duration(float64(*interval) * *speed))
+			sim.postStatus()
+		case <-configTick.C:
+			sim.pollConfig()
+		}
+	}
+}
+
+// newSimulator creates a simulator with zones at a comfortable temperature
+// and the default config applied.
+func newSimulator(proxy, host, serial string, zones int, oat float64) *simulator {
+	sim := &simulator{
+		client:  &http.Client{Timeout: 30 * time.Second},
+		proxy:   strings.TrimSuffix(proxy, "/"),
+		host:    host,
+		serial:  serial,
+		clock:   time.Now(),
+		baseOAT: oat,
+		oat:     oat,
+		filter:  100,
+		config:  defaultSimConfig(zones),
+	}
+	for i := 1; i <= zones; i++ {
+		sim.zones = append(sim.zones, &simZone{id: i, temp: 69, rh: 40})
+	}
+	sim.applyConfig()
+	return sim
+}
+
+// defaultSimConfig returns a config with the usual Infinity activities and a
+// weekday program, used until a config document is received.
+func defaultSimConfig(zones int) *hvac.SystemConfig {
+	cfg := &hvac.SystemConfig{Version: "1.7", Mode: "auto"}
+	for i := 1; i <= zones; i++ {
+		z := hvac.ConfigZone{
+			ID:      i,
+			Name:    fmt.Sprintf("Zone %d", i),
+			Enabled: "on",
+			Hold:    "off",
+			Activities: []hvac.Activity{
+				{ID: "home", HTSP: 68, CLSP: 75, Fan: "off"},
+				{ID: "away", HTSP: 62, CLSP: 82, Fan: "off"},
+				{ID: "sleep", HTSP: 64, CLSP: 77, Fan: "off"},
+				{ID: "wake", HTSP: 68, CLSP: 75, Fan: "off"},
+				{ID: "manual", HTSP: 68, CLSP: 75, Fan: "off"},
+			},
+		}
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			z.Program = append(z.Program, hvac.ProgramDay{ID: d.String(), Periods: []hvac.Period{
+				{ID: 1, Activity: "wake", Time: "06:00", Enabled: "on"},
+				{ID: 2, Activity: "away", Time: "08:00", Enabled: "on"},
+				{ID: 3, Activity: "home", Time: "17:00", Enabled: "on"},
+				{ID: 4, Activity: "sleep", Time: "22:00", Enabled: "on"},
+				{ID: 5, Activity: "home", Time: "00:00", Enabled: "off"},
+			}})
+		}
+		cfg.Zones = append(cfg.Zones, z)
+	}
+	return cfg
+}
+
+// applyConfig updates the zone set points from the current config.
+func (s *simulator) applyConfig() {
+	for _, z := range s.zones {
+		cz := s.config.Zone(z.id)
+		if cz == nil {
+			continue
+		}
+		z.activity = cz.CurrentActivity(s.clock)
+		if a := cz.Activity(z.activity); a != nil {
+			z.htsp, z.clsp, z.fan = a.HTSP, a.CLSP, a.Fan
+		}
+	}
+}
+
+// step advances the simulation by dt of simulated time.
+func (s *simulator) step(dt time.Duration) {
+	s.clock = s.clock.Add(dt)
+	hours := dt.Hours()
+
+	// Outdoor temperature follows a daily cycle peaking mid-afternoon
+	phase := (float64(s.clock.Hour()) + float64(s.clock.Minute())/60 - 15) / 24 * 2 * math.Pi
+	s.oat = s.baseOAT + 8*math.Cos(phase)
+
+	s.applyConfig()
+	s.stage = s.nextStage()
+
+	for _, z := range s.zones {
+		z.temp += simLossRate * (s.oat - z.temp) * hours
+		z.temp += simStageRate * float64(s.stage) * hours
+		// Cooling dries the air, heating slowly lets it drift back
+		if s.stage < 0 {
+			z.rh = math.Max(30, z.rh-2*hours)
+		} else {
+			z.rh = math.Min(55, z.rh+0.5*hours)
+		}
+	}
+
+	// Filter life drops one percent per ten hours of blower runtime
+	if s.stage != 0 {
+		s.runtime += hours
+		s.filter = max(0, 100-int(s.runtime/10))
+	}
+}
+
+// nextStage decides the equipment stage from the zone demands, keeping the
+// current stage until every zone is past its set point by the hysteresis.
+func (s *simulator) nextStage() int {
+	mode := s.config.Mode
+	heating := mode == "heat" || mode == "auto"
+	cooling := mode == "cool" || mode == "auto"
+
+	var heatDeficit, coolExcess float64
+	satisfied := true
+	for _, z := range s.zones {
+		heatDeficit = math.Max(heatDeficit, z.htsp-z.temp)
+		coolExcess = math.Max(coolExcess, z.temp-z.clsp)
+		if (s.stage > 0 && z.temp < z.htsp+simHysteresis) || (s.stage < 0 && z.temp > z.clsp-simHysteresis) {
+			satisfied = false
+		}
+	}
+
+	switch {
+	case heating && heatDeficit > 2:
+		return 2
+	case heating && heatDeficit > simHysteresis:
+		return 1
+	case cooling && coolExcess > 2:
+		return -2
+	case cooling && coolExcess > simHysteresis:
+		return -1
+	case !satisfied && ((s.stage > 0 && heating) || (s.stage < 0 && cooling)):
+		return s.stage
+	}
+	return 0
+}
+
+// SIMULATED STATUS DOCUMENT
+// These structs produce a status document shaped like the ones posted by an
+// Infinity wall control.
+
+type simStatus struct {
+	XMLName      xml.Name        `xml:"status"`
+	Version      string          `xml:"version,attr"`
+	LocalTime    string          `xml:"localTime"`
+	OAT          int             `xml:"oat"`
+	Mode         string          `xml:"mode"`
+	CFGEM        string          `xml:"cfgem"`
+	VacatRunning string          `xml:"vacatrunning"`
+	FiltrLvl     int             `xml:"filtrlvl"`
+	HumLvl       int             `xml:"humlvl"`
+	Humid        string          `xml:"humid"`
+	IDU          simStatusIDU    `xml:"idu"`
+	ODU          simStatusODU    `xml:"odu"`
+	Zones        []simStatusZone `xml:"zones>zone"`
+}
+
+type simStatusIDU struct {
+	Type   string `xml:"type"`
+	OPStat string `xml:"opstat"`
+	CFM    int    `xml:"cfm"`
+}
+
+type simStatusODU struct {
+	Type   string `xml:"type"`
+	OPStat string `xml:"opstat"`
+	OPMode string `xml:"opmode"`
+}
+
+type simStatusZone struct {
+	ID               int    `xml:"id,attr"`
+	Name             string `xml:"name"`
+	Enabled          string `xml:"enabled"`
+	CurrentActivity  string `xml:"currentActivity"`
+	RT               string `xml:"rt"`
+	RH               int    `xml:"rh"`
+	Fan              string `xml:"fan"`
+	Hold             string `xml:"hold"`
+	HTSP             string `xml:"htsp"`
+	CLSP             string `xml:"clsp"`
+	ZoneConditioning string `xml:"zoneconditioning"`
+	DamperPosition   int    `xml:"damperposition"`
+}
+
+// statusXML renders the current simulation state as a status document.
+func (s *simulator) statusXML() []byte {
+	st := simStatus{
+		Version:      "1.37",
+		LocalTime:    s.clock.Format("2006-01-02T15:04:05-07:00"),
+		OAT:          int(math.Round(s.oat)),
+		Mode:         s.config.Mode,
+		CFGEM:        "F",
+		VacatRunning: "off",
+		FiltrLvl:     s.filter,
+		HumLvl:       100,
+		Humid:        "off",
+		IDU:          simStatusIDU{Type: "furnace2stg", OPStat: "off"},
+		ODU:          simStatusODU{Type: "proteusac", OPStat: "off", OPMode: "off"},
+	}
+
+	conditioning := "idle"
+	switch {
+	case s.stage > 0:
+		conditioning = "active_heat"
+		st.IDU.OPStat = map[int]string{1: "low", 2: "high"}[s.stage]
+		st.IDU.CFM = 600 * s.stage
+	case s.stage < 0:
+		conditioning = "active_cool"
+		st.IDU.OPStat = "on"
+		st.IDU.CFM = -500 * s.stage
+		st.ODU.OPStat = "on"
+		st.ODU.OPMode = fmt.Sprintf("cool stage %d", -s.stage)
+	}
+
+	for _, z := range s.zones {
+		name, hold := fmt.Sprintf("Zone %d", z.id), "off"
+		if cz := s.config.Zone(z.id); cz != nil {
+			name, hold = cz.Name, cz.Hold
+		}
+		st.Zones = append(st.Zones, simStatusZone{
+			ID:               z.id,
+			Name:             name,
+			Enabled:          "on",
+			CurrentActivity:  z.activity,
+			RT:               fmt.Sprintf("%.1f", z.temp),
+			RH:               int(math.Round(z.rh)),
+			Fan:              z.fan,
+			Hold:             hold,
+			HTSP:             fmt.Sprintf("%.1f", z.htsp),
+			CLSP:             fmt.Sprintf("%.1f", z.clsp),
+			ZoneConditioning: conditioning,
+			DamperPosition:   15,
+		})
+	}
+
+	data, _ := xml.Marshal(st)
+	return data
+}
+
+// postStatus posts the status document like the wall control does, as a
+// form-encoded "data" field, and polls config when the server reports changes.
+func (s *simulator) postStatus() {
+	form := url.Values{"data": {string(s.statusXML())}}.Encode()
+	resp, err := s.do("POST", "/systems/"+s.serial+"/status", []byte(form))
+	if err != nil {
+		fmt.Printf("Status post failed: %v\n", err)
+		return
+	}
+	fmt.Printf("Posted status: oat=%.1f stage=%d zone1=%.1f\n", s.oat, s.stage, s.zones[0].temp)
+
+	var reply struct {
+		ServerHasChanges bool `xml:"serverHasChanges"`
+		ConfigHasChanges bool `xml:"configHasChanges"`
+	}
+	if xml.Unmarshal(resp, &reply) == nil && (reply.ServerHasChanges || reply.ConfigHasChanges) {
+		s.pollConfig()
+	}
+}
+
+// pollConfig fetches the config document and applies it to the zones.
+func (s *simulator) pollConfig() {
+	resp, err := s.do("GET", "/systems/"+s.serial+"/config", nil)
+	if err != nil {
+		fmt.Printf("Config poll failed: %v\n", err)
+		return
+	}
+	cfg, err := hvac.ParseSystemConfig(hvac.DecodeBody(resp))
+	if err != nil {
+		fmt.Printf("Ignoring config response: %v\n", err)
+		return
+	}
+	s.config = cfg
+	s.applyConfig()
+	fmt.Printf("Applied config: mode=%s\n", cfg.Mode)
+}
+
+// do sends a request through the proxy with the Carrier host header.
+func (s *simulator) do(method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, s.proxy+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Host = s.host
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return data, nil
+}
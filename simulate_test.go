@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"hvac-proxy/hvac"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulator_Dynamics(t *testing.T) {
+	sim := newSimulator("http://localhost", "example.com", "SIM", 2, 20)
+	sim.config.Mode = "heat"
+	sim.config.Zones[0].Hold, sim.config.Zones[0].HoldActivity = "on", "home"
+	sim.config.Zones[1].Hold, sim.config.Zones[1].HoldActivity = "on", "home"
+	sim.zones[0].temp, sim.zones[1].temp = 60, 60
+
+	sim.step(time.Minute)
+	assert.Equal(t, 2, sim.stage, "large deficit runs high stage")
+
+	for i := 0; i < 600 && sim.stage != 0; i++ {
+		sim.step(time.Minute)
+	}
+	assert.Equal(t, 0, sim.stage, "heat stops once the set point is reached")
+	assert.GreaterOrEqual(t, sim.zones[0].temp, 68.0)
+
+	// With the equipment off, the house drifts toward the outdoor temperature
+	sim.config.Mode = "off"
+	before := sim.zones[0].temp
+	sim.step(time.Hour)
+	assert.Less(t, sim.zones[0].temp, before)
+}
+
+func TestSimulator_StatusDocument(t *testing.T) {
+	sim := newSimulator("http://localhost", "example.com", "SIM", 1, 40)
+	sim.stage = 1
+
+	status, err := parseStatus(sim.statusXML())
+	require.NoError(t, err)
+	assert.Equal(t, 600, status.IDU.CFM)
+	assert.Equal(t, "low", status.IDU.OPSTAT)
+	require.Len(t, status.Zones.Zones, 1)
+	assert.Equal(t, 1, status.Zones.Zones[0].ID)
+}
+
+func TestSimulator_ThroughProxy(t *testing.T) {
+	dataDir := useDataDir(t)
+
+	configXML := strings.Replace(testSimConfig(), "<mode>auto</mode>", "<mode>cool</mode>", 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/config") {
+			_, _ = w.Write([]byte(configXML))
+			return
+		}
+		_, _ = w.Write([]byte(`<status><serverHasChanges>true</serverHasChanges></status>`))
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(proxyHandler))
+	defer proxy.Close()
+
+	sim := newSimulator(proxy.URL, strings.TrimPrefix(upstream.URL, "http://"), "SIM", 1, 40)
+	sim.postStatus()
+
+	assert.Equal(t, "cool", sim.config.Mode, "serverHasChanges triggers a config poll")
+	require.True(t, hvac.FlushSinks(time.Second))
+	assert.FileExists(t, filepath.Join(dataDir, "metrics_last.txt"))
+}
+
+func parseStatus(data []byte) (*hvac.Status, error) {
+	var status hvac.Status
+	err := xml.Unmarshal(data, &status)
+	return &status, err
+}
+
+func testSimConfig() string {
+	data, _ := xml.Marshal(defaultSimConfig(1))
+	return string(data)
+}
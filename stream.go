@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hvac-proxy/hvac"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// This file serves "/api/v1/stream", which pushes events from hvac.Events to
+// clients as Server-Sent Events or, for WebSocket upgrade requests, as JSON
+// text messages. Clients resume after a reconnect by sending the last event
+// ID they saw, and receive the buffered events they missed.
+
+// streamKeepAlive is how often an idle stream sends a keep-alive so proxies
+// and browsers do not time it out.
+const streamKeepAlive = 15 * time.Second
+
+// streamRetry is the reconnect delay suggested to SSE clients.
+const streamRetry = 3 * time.Second
+
+var upgrader = websocket.Upgrader{}
+
+// handleStream serves the event stream. The optional "types" query parameter
+// limits it to a comma-separated list of event types. The last event ID is
+// taken from the Last-Event-ID header or the "lastEventId" query parameter.
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	lastID, err := lastEventID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var types []string
+	if v := r.URL.Query().Get("types"); v != "" {
+		types = strings.Split(v, ",")
+	}
+	wanted := func(e hvac.Event) bool {
+		return types == nil || slices.Contains(types, e.Type)
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		streamWebSocket(w, r, lastID, wanted)
+		return
+	}
+	streamSSE(w, r, lastID, wanted)
+}
+
+func lastEventID(r *http.Request) (uint64, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("lastEventId")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid last event ID %q", v)
+	}
+	return id, nil
+}
+
+// streamSSE writes events as text/event-stream until the client goes away or
+// the server shuts down.
+func streamSSE(w http.ResponseWriter, r *http.Request, lastID uint64, wanted func(hvac.Event) bool) {
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's write timeout.
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	replay, events, cancel := hvac.Events.Subscribe(lastID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+
+	write := func(e hvac.Event) error {
+		if !wanted(e) {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+	for _, e := range replay {
+		if write(e) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok || write(e) != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown(r):
+			return
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// streamWebSocket writes events as JSON text messages until the client
+// closes the connection or the server shuts down. Messages from the client
+// are ignored.
+func streamWebSocket(w http.ResponseWriter, r *http.Request, lastID uint64, wanted func(hvac.Event) bool) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has already replied with an error
+	}
+	defer func() { _ = conn.Close() }()
+
+	replay, events, cancel := hvac.Events.Subscribe(lastID)
+	defer cancel()
+
+	// Read until the client goes away so close and ping frames are handled.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(e hvac.Event) error {
+		if !wanted(e) {
+			return nil
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(streamKeepAlive))
+		return conn.WriteJSON(e)
+	}
+	for _, e := range replay {
+		if write(e) != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok || write(e) != nil {
+				return
+			}
+		case <-ticker.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamKeepAlive)) != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-shuttingDown(r):
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"hvac-proxy/hvac"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startStreamServer serves the admin mux through newServer, so the stream
+// sees the same shutdown signal it does in production.
+func startStreamServer(t *testing.T) (*http.Server, string) {
+	ts := httptest.NewUnstartedServer(nil)
+	srv := newServer("", newAdminMux(), defaultServerConfig())
+	ts.Config = srv
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return srv, ts.URL
+}
+
+// readSSE returns the next event from an SSE stream, skipping comments.
+func readSSE(t *testing.T, r *bufio.Reader) (id, typ string, e hvac.Event) {
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e))
+		case line == "" && id != "":
+			return id, typ, e
+		}
+	}
+}
+
+func TestStream_SSEReplay(t *testing.T) {
+	_, url := startStreamServer(t)
+
+	first := hvac.Events.Publish("event", activityEvent{Kind: "config", Message: "one"})
+	hvac.Events.Publish("config", configChange{Result: "applied"})
+	hvac.Events.Publish("event", activityEvent{Kind: "config", Message: "two"})
+
+	req, err := http.NewRequest("GET", url+"/api/v1/stream?types=event", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(first.ID, 10))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	body := bufio.NewReader(resp.Body)
+	id, typ, e := readSSE(t, body)
+	assert.Equal(t, strconv.FormatUint(first.ID+2, 10), id, "replays only the missed events of the wanted types")
+	assert.Equal(t, "event", typ)
+	assert.Equal(t, "two", e.Data.(map[string]any)["message"])
+
+	activity.Event("breaker", "live")
+	_, _, e = readSSE(t, body)
+	assert.Equal(t, "live", e.Data.(map[string]any)["message"])
+}
+
+func TestStream_EndsOnShutdown(t *testing.T) {
+	srv, url := startStreamServer(t)
+
+	resp, err := http.Get(url + "/api/v1/stream")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.NoError(t, srv.Shutdown(ctx), "open streams do not hold up the drain")
+}
+
+func TestStream_WebSocket(t *testing.T) {
+	_, url := startStreamServer(t)
+	subscribers := hvac.Events.Subscribers()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/api/v1/stream?types=status", nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// Wait for the subscription before publishing.
+	require.Eventually(t, func() bool { return hvac.Events.Subscribers() > subscribers }, time.Second, 10*time.Millisecond)
+	hvac.Events.Publish("event", activityEvent{Message: "filtered out"})
+	hvac.Events.Publish("status", hvac.Status{OAT: 42})
+
+	var e hvac.Event
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	require.NoError(t, conn.ReadJSON(&e))
+	assert.Equal(t, "status", e.Type)
+	assert.Equal(t, 42.0, e.Data.(map[string]any)["outdoorAirTemp"])
+}
+
+func TestStream_BadLastEventID(t *testing.T) {
+	rr := httptest.NewRecorder()
+	newAdminMux().ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/stream?lastEventId=abc", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestAuditLog_PublishesControlEvents(t *testing.T) {
+	useAuth(t, AuthConfig{Tokens: []AuthToken{{Name: "automation", Token: testToken, Scopes: []string{scopeControl}}}})
+	_, events, cancel := hvac.Events.Subscribe(0)
+	defer cancel()
+
+	req := httptest.NewRequest("POST", "/api/v1/thing", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	testAdminHandler().ServeHTTP(httptest.NewRecorder(), req)
+
+	e := <-events
+	assert.Equal(t, "control", e.Type)
+	entry := e.Data.(auditEntry)
+	assert.Equal(t, "automation", entry.Principal)
+	assert.Equal(t, http.StatusAccepted, entry.Status)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hvac-proxy/hvac"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamConfig controls how the proxy talks to the Carrier servers.
+type UpstreamConfig struct {
+	ConnectTimeout        time.Duration `yaml:"connectTimeout"`   // TCP connect timeout
+	TLSTimeout            time.Duration `yaml:"tlsTimeout"`       // TLS handshake timeout
+	ResponseHeaderTimeout time.Duration `yaml:"responseTimeout"`  // Time to wait for response headers
+	Retries               int           `yaml:"retries"`          // Extra attempts for idempotent requests
+	RetryBackoff          time.Duration `yaml:"retryBackoff"`     // Delay before the first retry, doubled after each
+	BreakerThreshold      int           `yaml:"breakerThreshold"` // Consecutive failures that open the breaker
+	BreakerCooldown       time.Duration `yaml:"breakerCooldown"`  // Time the breaker stays open before a trial request
+	Fallback              bool          `yaml:"fallback"`         // Serve the last saved response when upstream fails
+}
+
+// defaultUpstreamConfig returns the settings used when nothing is configured.
+func defaultUpstreamConfig() UpstreamConfig {
+	return UpstreamConfig{
+		ConnectTimeout:        5 * time.Second,
+		TLSTimeout:            5 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		Retries:               2,
+		RetryBackoff:          500 * time.Millisecond,
+		BreakerThreshold:      5,
+		BreakerCooldown:       30 * time.Second,
+	}
+}
+
+// errBreakerOpen is returned while the circuit breaker for a host is open.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// Breaker states.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = map[int]string{
+	breakerClosed:   "closed",
+	breakerOpen:     "open",
+	breakerHalfOpen: "half-open",
+}
+
+// breaker is a per-host circuit breaker. It opens after a number of
+// consecutive failures, rejects requests while open, and lets a single
+// trial request through once the cooldown has passed.
+type breaker struct {
+	state    int
+	failures int
+	openedAt time.Time
+	trial    bool
+	changes  map[string]int // Transitions by target state name
+}
+
+// upstreamClient forwards requests upstream with timeouts, bounded retries
+// and a circuit breaker per host.
+type upstreamClient struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	cfg       UpstreamConfig
+	client    *http.Client
+	breakers  map[string]*breaker
+	requests  map[string]int // Completed attempts by result
+	retries   int
+	fallbacks int
+}
+
+// newUpstreamClient creates a client with a dedicated transport.
+func newUpstreamClient(cfg UpstreamConfig) *upstreamClient {
+	return &upstreamClient{
+		cfg:      cfg,
+		client:   newUpstreamHTTPClient(cfg),
+		now:      time.Now,
+		breakers: map[string]*breaker{},
+		requests: map[string]int{},
+	}
+}
+
+func newUpstreamHTTPClient(cfg UpstreamConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.TLSTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   4,
+	}
+	return &http.Client{Transport: transport}
+}
+
+// config returns the current settings.
+func (u *upstreamClient) config() UpstreamConfig {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.cfg
+}
+
+// reconfigure applies new settings, keeping breaker state and counters.
+// Requests already in flight finish with the previous transport.
+func (u *upstreamClient) reconfigure(cfg UpstreamConfig) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	prev := u.cfg
+	u.cfg = cfg
+	if cfg.ConnectTimeout != prev.ConnectTimeout || cfg.TLSTimeout != prev.TLSTimeout ||
+		cfg.ResponseHeaderTimeout != prev.ResponseHeaderTimeout {
+		u.client.CloseIdleConnections()
+		u.client = newUpstreamHTTPClient(cfg)
+	}
+}
+
+// isIdempotent reports whether a request may safely be retried.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isRetryableStatus reports whether an upstream status indicates a
+// transient failure worth retrying.
+func isRetryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// Do sends the request upstream. The body is replayed on every attempt.
+// Network errors and 5xx responses count as failures for the breaker.
+func (u *upstreamClient) Do(ctx context.Context, method, url string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	host := req.URL.Host
+
+	u.mu.Lock()
+	cfg, client := u.cfg, u.client
+	u.mu.Unlock()
+
+	attempts := 1
+	if isIdempotent(method) {
+		attempts += cfg.Retries
+	}
+	backoff := cfg.RetryBackoff
+
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		if !u.allow(host) {
+			return nil, errBreakerOpen
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		resp, err = client.Do(req)
+
+		failed := err != nil || resp.StatusCode >= 500
+		u.record(host, err, resp, failed)
+
+		retry := attempt < attempts && ctx.Err() == nil && (err != nil || isRetryableStatus(resp.StatusCode))
+		if !retry {
+			return resp, err
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+
+		u.mu.Lock()
+		u.retries++
+		u.mu.Unlock()
+		log.Printf("[RETRY] %s %s attempt %d/%d: %s", method, url, attempt+1, attempts, describeFailure(err, resp))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func describeFailure(err error, resp *http.Response) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+// allow reports whether a request to host may be attempted, moving an open
+// breaker to half-open once the cooldown has passed.
+func (u *upstreamClient) allow(host string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.cfg.BreakerThreshold <= 0 {
+		return true
+	}
+	b := u.breaker(host)
+	switch b.state {
+	case breakerOpen:
+		if u.now().Sub(b.openedAt) < u.cfg.BreakerCooldown {
+			return false
+		}
+		u.transition(host, b, breakerHalfOpen)
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		// Only one trial request at a time
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// record updates the request counters and the breaker after an attempt.
+func (u *upstreamClient) record(host string, err error, resp *http.Response, failed bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	switch {
+	case err != nil:
+		u.requests["error"]++
+	default:
+		u.requests[strconv.Itoa(resp.StatusCode/100)+"xx"]++
+	}
+
+	if u.cfg.BreakerThreshold <= 0 {
+		return
+	}
+	b := u.breaker(host)
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		if b.state != breakerClosed {
+			u.transition(host, b, breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= u.cfg.BreakerThreshold) {
+		b.openedAt = u.now()
+		u.transition(host, b, breakerOpen)
+	}
+}
+
+func (u *upstreamClient) breaker(host string) *breaker {
+	b, ok := u.breakers[host]
+	if !ok {
+		b = &breaker{changes: map[string]int{}}
+		u.breakers[host] = b
+	}
+	return b
+}
+
+// transition changes the breaker state, logs it and raises or clears an
+// alert. Callers hold u.mu.
+func (u *upstreamClient) transition(host string, b *breaker, state int) {
+	prev := b.state
+	from, to := breakerStateNames[prev], breakerStateNames[state]
+	b.state = state
+	b.changes[to]++
+	log.Printf("[BREAKER] %s: %s → %s (consecutive failures: %d)", host, from, to, b.failures)
+	activity.Event("breaker", "Circuit breaker for %s is %s", host, to)
+	// Alert when the host starts failing and when it recovers, not on
+	// every trial in between
+	if prev == breakerClosed || state == breakerClosed {
+		hvac.Events.Publish("alert", hvac.Alert{
+			Source:   "breaker/" + host,
+			Severity: "warning",
+			Active:   state != breakerClosed,
+			Message:  fmt.Sprintf("Circuit breaker for %s is %s", host, to),
+		})
+	}
+}
+
+// fellBack counts a response served from the saved fallback.
+func (u *upstreamClient) fellBack() {
+	u.mu.Lock()
+	u.fallbacks++
+	u.mu.Unlock()
+}
+
+// counters returns a copy of the attempt counts by result, and the retry
+// and fallback counts.
+func (u *upstreamClient) counters() (map[string]int, int, int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return maps.Clone(u.requests), u.retries, u.fallbacks
+}
+
+// metrics renders the upstream counters and breaker states for "/metrics".
+func (u *upstreamClient) metrics() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP hvac_proxy_upstream_requests_total upstream attempts by result\n")
+	b.WriteString("# TYPE hvac_proxy_upstream_requests_total counter\n")
+	for _, result := range sortedKeys(u.requests) {
+		b.WriteString(fmt.Sprintf("hvac_proxy_upstream_requests_total{result=%q} %d\n", result, u.requests[result]))
+	}
+
+	b.WriteString("# HELP hvac_proxy_upstream_retries_total upstream retry attempts\n")
+	b.WriteString("# TYPE hvac_proxy_upstream_retries_total counter\n")
+	b.WriteString(fmt.Sprintf("hvac_proxy_upstream_retries_total %d\n", u.retries))
+
+	b.WriteString("# HELP hvac_proxy_upstream_fallbacks_total responses served from saved files after upstream failure\n")
+	b.WriteString("# TYPE hvac_proxy_upstream_fallbacks_total counter\n")
+	b.WriteString(fmt.Sprintf("hvac_proxy_upstream_fallbacks_total %d\n", u.fallbacks))
+
+	b.WriteString("# HELP hvac_proxy_upstream_breaker_state circuit breaker state (0 closed, 1 open, 2 half-open)\n")
+	b.WriteString("# TYPE hvac_proxy_upstream_breaker_state gauge\n")
+	hosts := sortedKeys(u.breakers)
+	for _, host := range hosts {
+		b.WriteString(fmt.Sprintf("hvac_proxy_upstream_breaker_state{host=%q} %d\n", host, u.breakers[host].state))
+	}
+
+	b.WriteString("# HELP hvac_proxy_upstream_breaker_transitions_total circuit breaker state changes\n")
+	b.WriteString("# TYPE hvac_proxy_upstream_breaker_transitions_total counter\n")
+	for _, host := range hosts {
+		changes := u.breakers[host].changes
+		for _, to := range sortedKeys(changes) {
+			b.WriteString(fmt.Sprintf("hvac_proxy_upstream_breaker_transitions_total{host=%q,to=%q} %d\n", host, to, changes[to]))
+		}
+	}
+	return b.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// upstreamErrorStatus maps an upstream error onto the status returned to the
+// thermostat.
+func upstreamErrorStatus(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errBreakerOpen):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testUpstreamConfig() UpstreamConfig {
+	cfg := defaultUpstreamConfig()
+	cfg.RetryBackoff = time.Millisecond
+	cfg.ResponseHeaderTimeout = 200 * time.Millisecond
+	return cfg
+}
+
+// useUpstream swaps the package upstream client for the duration of a test.
+func useUpstream(t *testing.T, cfg UpstreamConfig) *upstreamClient {
+	prev := upstream
+	upstream = newUpstreamClient(cfg)
+	t.Cleanup(func() { upstream = prev })
+	return upstream
+}
+
+func TestUpstream_RetriesIdempotent(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	u := newUpstreamClient(testUpstreamConfig())
+	resp, err := u.Do(t.Context(), "GET", srv.URL+"/manifest", http.Header{}, nil)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), calls.Load())
+	assert.Contains(t, u.metrics(), "hvac_proxy_upstream_retries_total 2")
+}
+
+func TestUpstream_NoRetryForPost(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	u := newUpstreamClient(testUpstreamConfig())
+	resp, err := u.Do(t.Context(), "POST", srv.URL+"/systems/1/status", http.Header{}, []byte("data=x"))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestUpstream_Breaker(t *testing.T) {
+	var healthy atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := testUpstreamConfig()
+	cfg.Retries = 0
+	cfg.BreakerThreshold = 2
+	u := newUpstreamClient(cfg)
+	now := time.Now()
+	u.now = func() time.Time { return now }
+
+	post := func() error {
+		resp, err := u.Do(t.Context(), "POST", srv.URL+"/status", http.Header{}, nil)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	require.NoError(t, post())
+	require.NoError(t, post())
+	assert.ErrorIs(t, post(), errBreakerOpen, "breaker opens after threshold")
+	assert.Contains(t, u.metrics(), `hvac_proxy_upstream_breaker_transitions_total{host="`+strings.TrimPrefix(srv.URL, "http://")+`",to="open"} 1`)
+
+	// After the cooldown a trial request goes through and closes the breaker
+	healthy.Store(true)
+	now = now.Add(cfg.BreakerCooldown)
+	require.NoError(t, post())
+	require.NoError(t, post())
+	assert.Contains(t, u.metrics(), `to="closed"} 1`)
+	assert.Contains(t, u.metrics(), `hvac_proxy_upstream_breaker_state{host="`+strings.TrimPrefix(srv.URL, "http://")+`"} 0`)
+}
+
+// TestUpstream_ReconfigureWhileAllowing catches unlocked reads of the
+// settings when run with -race.
+func TestUpstream_ReconfigureWhileAllowing(t *testing.T) {
+	cfg := testUpstreamConfig()
+	u := newUpstreamClient(cfg)
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Go(func() {
+			for j := range 1000 {
+				if i == 0 {
+					cfg.BreakerThreshold = j % 3
+					u.reconfigure(cfg)
+				} else {
+					u.allow("example.com")
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestProxyHandler_UpstreamTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	cfg := testUpstreamConfig()
+	cfg.Retries = 0
+	useUpstream(t, cfg)
+
+	req := httptest.NewRequest("GET", "/slow", nil)
+	req.Host = strings.TrimPrefix(srv.URL, "http://")
+	rr := httptest.NewRecorder()
+	proxyHandler(rr, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+}
+
+func TestProxyHandler_Fallback(t *testing.T) {
+	dataDir := useDataDir(t)
+
+	var healthy atomic.Bool
+	healthy.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("<config><mode>heat</mode></config>"))
+	}))
+	defer srv.Close()
+
+	cfg := testUpstreamConfig()
+	cfg.Fallback = true
+	u := useUpstream(t, cfg)
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/systems/1/config", nil)
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, get().Code)
+	assert.FileExists(t, filepath.Join(dataDir, "GET-systems_1_config-response.xml"))
+
+	healthy.Store(false)
+	rr := get()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "saved", rr.Header().Get("X-Hvac-Proxy-Fallback"))
+	assert.Contains(t, rr.Body.String(), "<mode>heat</mode>")
+	assert.Contains(t, u.metrics(), "hvac_proxy_upstream_fallbacks_total 1")
+}
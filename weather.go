@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hvac-proxy/hvac"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WeatherConfig controls answering the thermostat's weather forecast
+// requests from local data.
+type WeatherConfig struct {
+	File   string        `yaml:"file"`   // JSON or CSV file with the current conditions and forecast
+	Topic  string        `yaml:"topic"`  // MQTT topic with JSON or bare temperature readings from a weather station
+	Merge  bool          `yaml:"merge"`  // Forward the request and merge local data into the upstream forecast
+	MaxAge time.Duration `yaml:"maxAge"` // Local data older than this is not used
+}
+
+// Enabled reports whether a local weather source is configured.
+func (c WeatherConfig) Enabled() bool {
+	return c.File != "" || c.Topic != ""
+}
+
+// defaultWeatherConfig returns the settings used when nothing is configured.
+func defaultWeatherConfig() WeatherConfig {
+	return WeatherConfig{MaxAge: 3 * time.Hour}
+}
+
+// validateWeather checks the weather settings.
+func validateWeather(c *WeatherConfig, mqttBroker string, check func(bool, string, string, ...any)) {
+	check(c.File == "" || c.Topic == "", "weather.file", "file and topic must not both be set")
+	check(c.Topic == "" || mqttBroker != "", "weather.topic", "requires mqtt.broker")
+	check(c.MaxAge > 0, "weather.maxAge", "must be positive")
+}
+
+// weatherForecastPath matches the forecast requests answered locally.
+const weatherForecastPath = "/weather/*/forecast"
+
+// weatherReport is local weather data: current conditions and a forecast
+// by day, starting today. Temperatures are in °F. Fields left out keep the
+// upstream values when merging.
+type weatherReport struct {
+	Time        time.Time    `json:"time"`        // When the data was observed; the file time or receipt time if zero
+	Temperature *float64     `json:"temperature"` // Current temperature, which widens today's range
+	Condition   string       `json:"condition"`   // Current conditions, e.g. "Sunny", shown for today
+	StatusID    *int         `json:"statusID"`    // Carrier icon code for the current conditions
+	Forecast    []weatherDay `json:"forecast"`
+}
+
+// weatherDay is the forecast for a day.
+type weatherDay struct {
+	Min       *float64 `json:"min"`
+	Max       *float64 `json:"max"`
+	Condition string   `json:"condition"`
+	StatusID  *int     `json:"statusID"`
+	POP       *int     `json:"pop"` // Chance of precipitation in percent
+}
+
+// parseWeatherJSON parses a JSON weather report. A bare number, as many
+// weather stations publish, is the current temperature.
+func parseWeatherJSON(data []byte) (weatherReport, error) {
+	var rep weatherReport
+	if t, err := strconv.ParseFloat(string(bytes.TrimSpace(data)), 64); err == nil {
+		rep.Temperature = &t
+		return rep, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rep); err != nil {
+		return rep, fmt.Errorf("invalid weather JSON: %w", err)
+	}
+	return rep, nil
+}
+
+// parseWeatherCSV parses a forecast with a header row naming the columns
+// min, max, condition, status_id and pop, in any order, and a row per day
+// starting today. Empty cells are left out.
+func parseWeatherCSV(data []byte) (weatherReport, error) {
+	var rep weatherReport
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return rep, fmt.Errorf("invalid weather CSV: %w", err)
+	}
+	if len(rows) == 0 {
+		return rep, errors.New("invalid weather CSV: no header row")
+	}
+	header := rows[0]
+	for i, name := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(name))
+		switch header[i] {
+		case "min", "max", "condition", "status_id", "pop":
+		default:
+			return rep, fmt.Errorf("invalid weather CSV: unknown column %q", name)
+		}
+	}
+	for n, row := range rows[1:] {
+		var d weatherDay
+		for i, cell := range row {
+			cell = strings.TrimSpace(cell)
+			if cell == "" {
+				continue
+			}
+			switch header[i] {
+			case "min", "max":
+				v, err := strconv.ParseFloat(cell, 64)
+				if err != nil {
+					return rep, fmt.Errorf("invalid weather CSV: row %d: %s must be a number, got %q", n+2, header[i], cell)
+				}
+				if header[i] == "min" {
+					d.Min = &v
+				} else {
+					d.Max = &v
+				}
+			case "status_id", "pop":
+				v, err := strconv.Atoi(cell)
+				if err != nil {
+					return rep, fmt.Errorf("invalid weather CSV: row %d: %s must be an integer, got %q", n+2, header[i], cell)
+				}
+				if header[i] == "pop" {
+					d.POP = &v
+				} else {
+					d.StatusID = &v
+				}
+			case "condition":
+				d.Condition = cell
+			}
+		}
+		rep.Forecast = append(rep.Forecast, d)
+	}
+	return rep, nil
+}
+
+// day returns the local data for the given day, with the current
+// conditions applied to today.
+func (rep *weatherReport) day(i int) (weatherDay, bool) {
+	var d weatherDay
+	ok := i < len(rep.Forecast)
+	if ok {
+		d = rep.Forecast[i]
+	}
+	if i != 0 {
+		return d, ok
+	}
+	if rep.Condition != "" {
+		d.Condition = rep.Condition
+	}
+	if rep.StatusID != nil {
+		d.StatusID = rep.StatusID
+	}
+	d.widen(rep.Temperature)
+	return d, ok || rep.Condition != "" || rep.StatusID != nil || rep.Temperature != nil
+}
+
+// widen extends the day's range to include the temperature t, if any.
+func (d *weatherDay) widen(t *float64) {
+	if t == nil {
+		return
+	}
+	if d.Min == nil || *t < *d.Min {
+		d.Min = t
+	}
+	if d.Max == nil || *t > *d.Max {
+		d.Max = t
+	}
+}
+
+// weatherService holds the latest local weather data and answers forecast
+// requests from it.
+type weatherService struct {
+	cfg WeatherConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	report   *weatherReport
+	modTime  time.Time      // Of the file when it was last read
+	served   map[string]int // Forecast responses by source: local, merged, upstream
+	errors   int            // Invalid files and messages
+	lastDays []servedDay    // Days of the last forecast served
+}
+
+// servedDay is a day of a forecast served to the thermostat, for metrics.
+type servedDay struct {
+	ID       string
+	Min, Max *float64
+	POP      *int
+}
+
+// weather answers forecast requests when a local source is configured.
+var weather *weatherService
+
+func newWeatherService(cfg WeatherConfig) *weatherService {
+	return &weatherService{cfg: cfg, now: time.Now, served: map[string]int{}}
+}
+
+// initWeather enables local weather when configured, subscribing to the
+// weather station's topic if one is set.
+func initWeather(cfg WeatherConfig) {
+	if !cfg.Enabled() {
+		return
+	}
+	weather = newWeatherService(cfg)
+	hvac.RegisterMetrics("weather", weather.metrics)
+	if cfg.Topic != "" && hvac.SubscribeMQTT(cfg.Topic, weather.receive) {
+		fmt.Printf("Reading local weather from MQTT topic %s\n", cfg.Topic)
+	} else if cfg.File != "" {
+		fmt.Printf("Reading local weather from %s\n", cfg.File)
+	}
+}
+
+// receive records a message from the weather station's topic.
+func (s *weatherService) receive(payload []byte) {
+	rep, err := parseWeatherJSON(payload)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors++
+		log.Printf("[WEATHER] Ignoring message on %s: %v", s.cfg.Topic, err)
+		return
+	}
+	if rep.Time.IsZero() {
+		rep.Time = s.now()
+	}
+	s.report = &rep
+}
+
+// current returns the local data if it is recent enough, reading the file
+// again when it has changed. Callers hold s.mu.
+func (s *weatherService) current() *weatherReport {
+	if s.cfg.File != "" {
+		s.load()
+	}
+	if s.report == nil || s.now().Sub(s.report.Time) > s.cfg.MaxAge {
+		return nil
+	}
+	return s.report
+}
+
+// load reads the weather file if it changed since it was last read, keeping
+// the previous data if it cannot be read. Callers hold s.mu.
+func (s *weatherService) load() {
+	info, err := os.Stat(s.cfg.File)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return
+	}
+	s.modTime = info.ModTime()
+	data, err := os.ReadFile(s.cfg.File)
+	var rep weatherReport
+	if err == nil {
+		if strings.EqualFold(filepath.Ext(s.cfg.File), ".csv") {
+			rep, err = parseWeatherCSV(data)
+		} else {
+			rep, err = parseWeatherJSON(data)
+		}
+	}
+	if err != nil {
+		s.errors++
+		log.Printf("[WEATHER] Failed to read %s: %v", s.cfg.File, err)
+		return
+	}
+	if rep.Time.IsZero() {
+		rep.Time = info.ModTime()
+	}
+	s.report = &rep
+}
+
+// isForecast reports whether r asks for the weather forecast.
+func isForecast(r *http.Request) bool {
+	ok, _ := path.Match(weatherForecastPath, r.URL.Path)
+	return ok && r.Method == http.MethodGet
+}
+
+// answer writes a forecast built from local data and returns it, or returns
+// nil if there is none. Unless upstream failed, it only answers when not
+// merging.
+func (s *weatherService) answer(w http.ResponseWriter, r *http.Request, upstreamFailed bool) []byte {
+	if !isForecast(r) || (s.cfg.Merge && !upstreamFailed) {
+		return nil
+	}
+	s.mu.Lock()
+	rep := s.current()
+	var doc []byte
+	if rep != nil {
+		doc = rep.document(s.now())
+		s.record("local", doc)
+	}
+	s.mu.Unlock()
+	if doc == nil {
+		return nil
+	}
+	log.Printf("[WEATHER] %s %s → serving local forecast", r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Hvac-Proxy-Weather", "local")
+	_, _ = w.Write(doc)
+	return doc
+}
+
+// merge returns an upstream forecast with local data merged in when
+// merging is enabled and local data is recent, or else unchanged. Source
+// says where the forecast came from, "upstream" or "cache", for the metrics.
+func (s *weatherService) merge(w http.ResponseWriter, r *http.Request, body []byte, source string) []byte {
+	if !isForecast(r) {
+		return body
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rep := s.current()
+	if !s.cfg.Merge || rep == nil {
+		s.record(source, body)
+		return body
+	}
+	body = rep.mergeInto(body)
+	s.record("merged", body)
+	w.Header().Set("X-Hvac-Proxy-Weather", "merged")
+	return body
+}
+
+// record counts a forecast served and keeps its days for the metrics.
+// Callers hold s.mu.
+func (s *weatherService) record(source string, doc []byte) {
+	s.served[source]++
+	var forecast struct {
+		Days []struct {
+			ID  string `xml:"id,attr"`
+			Min string `xml:"min_temp"`
+			Max string `xml:"max_temp"`
+			POP string `xml:"pop"`
+		} `xml:"day"`
+	}
+	if xml.Unmarshal(doc, &forecast) != nil {
+		return
+	}
+	s.lastDays = s.lastDays[:0]
+	for _, d := range forecast.Days {
+		day := servedDay{ID: d.ID}
+		if v, err := strconv.ParseFloat(strings.TrimSpace(d.Min), 64); err == nil {
+			day.Min = &v
+		}
+		if v, err := strconv.ParseFloat(strings.TrimSpace(d.Max), 64); err == nil {
+			day.Max = &v
+		}
+		if v, err := strconv.Atoi(strings.TrimSpace(d.POP)); err == nil {
+			day.POP = &v
+		}
+		s.lastDays = append(s.lastDays, day)
+	}
+}
+
+// document renders the local data as a forecast document in the layout of
+// the Carrier weather service.
+func (rep *weatherReport) document(now time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<weather_forecast version="1.42"><timestamp>%s</timestamp>`, now.Format(time.RFC3339))
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for i := 0; ; i++ {
+		d, ok := rep.day(i)
+		if !ok {
+			break
+		}
+		fmt.Fprintf(&b, `<day id="%d"><timestamp>%s</timestamp>`, i, today.AddDate(0, 0, i).Format(time.RFC3339))
+		if d.Min != nil {
+			fmt.Fprintf(&b, `<min_temp units="f">%s</min_temp>`, formatTemp(*d.Min))
+		}
+		if d.Max != nil {
+			fmt.Fprintf(&b, `<max_temp units="f">%s</max_temp>`, formatTemp(*d.Max))
+		}
+		if d.StatusID != nil {
+			fmt.Fprintf(&b, `<status_id>%d</status_id>`, *d.StatusID)
+		}
+		if d.Condition != "" {
+			b.WriteString("<status_message>")
+			_ = xml.EscapeText(&b, []byte(d.Condition))
+			b.WriteString("</status_message>")
+		}
+		if d.POP != nil {
+			fmt.Fprintf(&b, `<pop>%d</pop>`, *d.POP)
+		}
+		b.WriteString("</day>")
+	}
+	b.WriteString("</weather_forecast>")
+	return b.Bytes()
+}
+
+// forecastDay matches a day of a forecast document and captures its id.
+var forecastDay = regexp.MustCompile(`(?s)<day\b[^>]*\bid="(\d+)"[^>]*>.*?</day>`)
+
+// mergeInto replaces the values of each upstream day that the local data
+// has, leaving everything else in the document as it was. Today's range is
+// widened to include the current temperature.
+func (rep *weatherReport) mergeInto(doc []byte) []byte {
+	return forecastDay.ReplaceAllFunc(doc, func(block []byte) []byte {
+		id, _ := strconv.Atoi(string(forecastDay.FindSubmatch(block)[1]))
+		d, ok := rep.day(id)
+		if !ok {
+			return block
+		}
+		if id == 0 && rep.Temperature != nil {
+			// Without a local forecast for today, widen the upstream range
+			var local weatherDay
+			if len(rep.Forecast) > 0 {
+				local = rep.Forecast[0]
+			}
+			if up, ok := elementFloat(block, "min_temp"); ok && local.Min == nil {
+				local.Min = &up
+			}
+			if up, ok := elementFloat(block, "max_temp"); ok && local.Max == nil {
+				local.Max = &up
+			}
+			local.widen(rep.Temperature)
+			d.Min, d.Max = local.Min, local.Max
+		}
+		if d.Min != nil {
+			block = setElement(block, "min_temp", formatTemp(*d.Min))
+		}
+		if d.Max != nil {
+			block = setElement(block, "max_temp", formatTemp(*d.Max))
+		}
+		if d.StatusID != nil {
+			block = setElement(block, "status_id", strconv.Itoa(*d.StatusID))
+		}
+		if d.Condition != "" {
+			var text bytes.Buffer
+			_ = xml.EscapeText(&text, []byte(d.Condition))
+			block = setElement(block, "status_message", text.String())
+		}
+		if d.POP != nil {
+			block = setElement(block, "pop", strconv.Itoa(*d.POP))
+		}
+		return block
+	})
+}
+
+// formatTemp formats a temperature as a whole number of degrees, as the
+// thermostat displays it.
+func formatTemp(t float64) string {
+	return strconv.FormatFloat(t, 'f', 0, 64)
+}
+
+// metrics renders the forecasts served by source, the values of the last
+// one and the age of the local data for "/metrics".
+func (s *weatherService) metrics() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("# HELP hvac_weather_forecasts_served_total forecast responses by source (local, merged, upstream or cache)\n")
+	b.WriteString("# TYPE hvac_weather_forecasts_served_total counter\n")
+	for _, source := range []string{"local", "merged", "upstream", "cache"} {
+		b.WriteString(fmt.Sprintf("hvac_weather_forecasts_served_total{source=%q} %d\n", source, s.served[source]))
+	}
+	b.WriteString("# HELP hvac_weather_forecast_temperature forecast temperature served for each day in F\n")
+	b.WriteString("# TYPE hvac_weather_forecast_temperature gauge\n")
+	for _, d := range s.lastDays {
+		if d.Min != nil {
+			b.WriteString(fmt.Sprintf("hvac_weather_forecast_temperature{day=%q,bound=\"min\"} %s\n", d.ID, strconv.FormatFloat(*d.Min, 'f', -1, 64)))
+		}
+		if d.Max != nil {
+			b.WriteString(fmt.Sprintf("hvac_weather_forecast_temperature{day=%q,bound=\"max\"} %s\n", d.ID, strconv.FormatFloat(*d.Max, 'f', -1, 64)))
+		}
+	}
+	b.WriteString("# HELP hvac_weather_forecast_precipitation_probability chance of precipitation served for each day in percent\n")
+	b.WriteString("# TYPE hvac_weather_forecast_precipitation_probability gauge\n")
+	for _, d := range s.lastDays {
+		if d.POP != nil {
+			b.WriteString(fmt.Sprintf("hvac_weather_forecast_precipitation_probability{day=%q} %d\n", d.ID, *d.POP))
+		}
+	}
+	if s.report != nil {
+		if t := s.report.Temperature; t != nil {
+			b.WriteString("# HELP hvac_weather_local_temperature latest current temperature from the local source in F\n")
+			b.WriteString("# TYPE hvac_weather_local_temperature gauge\n")
+			b.WriteString(fmt.Sprintf("hvac_weather_local_temperature %s\n", strconv.FormatFloat(*t, 'f', -1, 64)))
+		}
+		b.WriteString("# HELP hvac_weather_local_age_seconds age of the local weather data\n")
+		b.WriteString("# TYPE hvac_weather_local_age_seconds gauge\n")
+		b.WriteString(fmt.Sprintf("hvac_weather_local_age_seconds %d\n", int(s.now().Sub(s.report.Time).Seconds())))
+	}
+	b.WriteString("# HELP hvac_weather_local_errors_total local weather files and messages that could not be read\n")
+	b.WriteString("# TYPE hvac_weather_local_errors_total counter\n")
+	b.WriteString(fmt.Sprintf("hvac_weather_local_errors_total %d\n", s.errors))
+	return b.String()
+}
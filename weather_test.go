@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testUpstreamForecast = `<weather_forecast version="1.42" xmlns:atom="http://www.w3.org/2005/Atom">` +
+	`<atom:link rel="self" href="http://www.api.ing.carrier.com/weather/55555/forecast"/>` +
+	`<timestamp>2024-04-05T06:00:00-05:00</timestamp>` +
+	`<day id="0"><timestamp>2024-04-05T00:00:00-05:00</timestamp><min_temp units="f">48</min_temp><max_temp units="f">66</max_temp>` +
+	`<status_id>34</status_id><status_message>Mostly Sunny</status_message><pop>10</pop></day>` +
+	`<day id="1"><timestamp>2024-04-06T00:00:00-05:00</timestamp><min_temp units="f">50</min_temp><max_temp units="f">70</max_temp>` +
+	`<status_id>30</status_id><status_message>Partly Cloudy</status_message><pop>20</pop></day>` +
+	`</weather_forecast>`
+
+// useWeather enables local weather for the duration of a test.
+func useWeather(t *testing.T, cfg WeatherConfig) *weatherService {
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = time.Hour
+	}
+	prev := weather
+	weather = newWeatherService(cfg)
+	t.Cleanup(func() { weather = prev })
+	return weather
+}
+
+func TestParseWeather(t *testing.T) {
+	rep, err := parseWeatherJSON([]byte(" 71.5\n"))
+	require.NoError(t, err)
+	require.NotNil(t, rep.Temperature)
+	assert.Equal(t, 71.5, *rep.Temperature)
+
+	rep, err = parseWeatherJSON([]byte(`{"temperature": 58, "condition": "Rain", "forecast": [{"min": 45, "max": 60, "pop": 80}, {"max": 64}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, "Rain", rep.Condition)
+	require.Len(t, rep.Forecast, 2)
+	assert.Equal(t, 80, *rep.Forecast[0].POP)
+	assert.Nil(t, rep.Forecast[1].Min)
+
+	_, err = parseWeatherJSON([]byte(`{"temp": 58}`))
+	assert.Error(t, err, "unknown fields are rejected")
+
+	rep, err = parseWeatherCSV([]byte("min,max,condition,pop\n45,60,Rain,80\n,64,,\n"))
+	require.NoError(t, err)
+	require.Len(t, rep.Forecast, 2)
+	assert.Equal(t, 45.0, *rep.Forecast[0].Min)
+	assert.Equal(t, "Rain", rep.Forecast[0].Condition)
+	assert.Nil(t, rep.Forecast[1].Min)
+	assert.Equal(t, 64.0, *rep.Forecast[1].Max)
+
+	_, err = parseWeatherCSV([]byte("low,high\n45,60\n"))
+	assert.ErrorContains(t, err, `unknown column "low"`)
+	_, err = parseWeatherCSV([]byte("min,max\n45,warm\n"))
+	assert.ErrorContains(t, err, "row 2: max must be a number")
+}
+
+func TestWeatherReport_Document(t *testing.T) {
+	rep, err := parseWeatherJSON([]byte(`{"temperature": 70, "condition": "Sunny & Warm", "forecast": [{"min": 45, "max": 60}, {"min": 50, "max": 72, "pop": 5}]}`))
+	require.NoError(t, err)
+	now := time.Date(2024, 4, 5, 15, 0, 0, 0, time.UTC)
+	doc := string(rep.document(now))
+
+	assert.True(t, strings.HasPrefix(doc, `<weather_forecast version="1.42"><timestamp>2024-04-05T15:00:00Z</timestamp>`))
+	assert.Contains(t, doc, `<day id="0"><timestamp>2024-04-05T00:00:00Z</timestamp><min_temp units="f">45</min_temp><max_temp units="f">70</max_temp><status_message>Sunny &amp; Warm</status_message></day>`,
+		"the current temperature widens today's range")
+	assert.Contains(t, doc, `<day id="1"><timestamp>2024-04-06T00:00:00Z</timestamp><min_temp units="f">50</min_temp><max_temp units="f">72</max_temp><pop>5</pop></day>`)
+
+	// A weather station's reading alone is a forecast for today
+	station, err := parseWeatherJSON([]byte("61.4"))
+	require.NoError(t, err)
+	assert.Contains(t, string(station.document(now)), `<min_temp units="f">61</min_temp><max_temp units="f">61</max_temp></day></weather_forecast>`)
+}
+
+func TestWeatherReport_Merge(t *testing.T) {
+	rep, err := parseWeatherJSON([]byte(`{"temperature": 71, "condition": "Sunny", "statusID": 32, "forecast": [{}, {"pop": 60}]}`))
+	require.NoError(t, err)
+	doc := string(rep.mergeInto([]byte(testUpstreamForecast)))
+
+	assert.Contains(t, doc, `<atom:link rel="self" href="http://www.api.ing.carrier.com/weather/55555/forecast"/>`, "the rest of the document is kept")
+	assert.Contains(t, doc, `<day id="0"><timestamp>2024-04-05T00:00:00-05:00</timestamp><min_temp units="f">48</min_temp><max_temp units="f">71</max_temp>`+
+		`<status_id>32</status_id><status_message>Sunny</status_message><pop>10</pop></day>`)
+	assert.Contains(t, doc, `<min_temp units="f">50</min_temp><max_temp units="f">70</max_temp><status_id>30</status_id><status_message>Partly Cloudy</status_message><pop>60</pop>`)
+}
+
+func TestProxyHandler_LocalWeather(t *testing.T) {
+	useDataDir(t)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, _ = w.Write([]byte(testUpstreamForecast))
+	}))
+	defer srv.Close()
+	useUpstream(t, testUpstreamConfig())
+
+	file := filepath.Join(t.TempDir(), "weather.csv")
+	require.NoError(t, os.WriteFile(file, []byte("min,max,condition\n40,55,Snow\n"), 0644))
+	s := useWeather(t, WeatherConfig{File: file})
+
+	get := func(p string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", p, nil)
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		return rr
+	}
+
+	rr := get("/weather/55555/forecast")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "local", rr.Header().Get("X-Hvac-Proxy-Weather"))
+	assert.Contains(t, rr.Body.String(), "<status_message>Snow</status_message>")
+	assert.Equal(t, int32(0), calls.Load(), "answered without going upstream")
+
+	rr = get("/systems/123/status")
+	assert.Empty(t, rr.Header().Get("X-Hvac-Proxy-Weather"), "other requests are forwarded")
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Data older than the maximum age is not used
+	s.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	rr = get("/weather/55555/forecast")
+	assert.Empty(t, rr.Header().Get("X-Hvac-Proxy-Weather"))
+	assert.Equal(t, testUpstreamForecast, rr.Body.String())
+
+	m := s.metrics()
+	assert.Contains(t, m, `hvac_weather_forecasts_served_total{source="local"} 1`)
+	assert.Contains(t, m, `hvac_weather_forecasts_served_total{source="upstream"} 1`)
+	assert.Contains(t, m, `hvac_weather_forecast_temperature{day="1",bound="max"} 70`)
+	assert.Contains(t, m, `hvac_weather_forecast_precipitation_probability{day="0"} 10`)
+}
+
+func TestProxyHandler_MergedWeather(t *testing.T) {
+	useDataDir(t)
+	var healthy atomic.Bool
+	healthy.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(testUpstreamForecast))
+	}))
+	defer srv.Close()
+	cfg := testUpstreamConfig()
+	cfg.Retries = 0
+	useUpstream(t, cfg)
+	s := useWeather(t, WeatherConfig{Topic: "weather/outdoor", Merge: true})
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/weather/55555/forecast", nil)
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		rr := httptest.NewRecorder()
+		proxyHandler(rr, req)
+		return rr
+	}
+
+	rr := get()
+	assert.Empty(t, rr.Header().Get("X-Hvac-Proxy-Weather"), "nothing to merge before the station reports")
+
+	s.receive([]byte("not a reading"))
+	s.receive([]byte(`{"temperature": 44.6}`))
+	rr = get()
+	assert.Equal(t, "merged", rr.Header().Get("X-Hvac-Proxy-Weather"))
+	assert.Contains(t, rr.Body.String(), `<min_temp units="f">45</min_temp><max_temp units="f">66</max_temp>`)
+
+	// When upstream fails, the forecast is answered locally
+	healthy.Store(false)
+	rr = get()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "local", rr.Header().Get("X-Hvac-Proxy-Weather"))
+
+	m := s.metrics()
+	assert.Contains(t, m, `hvac_weather_forecasts_served_total{source="merged"} 1`)
+	assert.Contains(t, m, `hvac_weather_forecasts_served_total{source="local"} 1`)
+	assert.Contains(t, m, "hvac_weather_local_temperature 44.6")
+	assert.Contains(t, m, "hvac_weather_local_errors_total 1")
+}
+
+func TestWeatherConfig_Env(t *testing.T) {
+	t.Setenv("WEATHER_TOPIC", "weather/outdoor")
+	t.Setenv("WEATHER_MERGE", "true")
+	t.Setenv("WEATHER_MAX_AGE", "30m")
+	cfg, err := loadConfig("")
+	require.NoError(t, err)
+
+	assert.Equal(t, WeatherConfig{Topic: "weather/outdoor", Merge: true, MaxAge: 30 * time.Minute}, cfg.Weather)
+	assert.ErrorContains(t, cfg.Validate(), "weather.topic: requires mqtt.broker")
+
+	cfg.MQTT.Broker = "tcp://localhost:1883"
+	require.NoError(t, cfg.Validate())
+	cfg.Weather.File = "/etc/hvac/weather.json"
+	assert.ErrorContains(t, cfg.Validate(), "weather.file: file and topic must not both be set")
+}
+
+func TestProxyHandler_CachedWeather(t *testing.T) {
+	useDataDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testUpstreamForecast))
+	}))
+	defer srv.Close()
+	useUpstream(t, testUpstreamConfig())
+	useCache(t, CacheConfig{TTLs: []CacheTTL{{"/weather/*/forecast", time.Hour}}})
+	s := useWeather(t, WeatherConfig{Topic: "weather/outdoor", Merge: true})
+
+	for range 2 {
+		req := httptest.NewRequest("GET", "/weather/55555/forecast", nil)
+		req.Host = strings.TrimPrefix(srv.URL, "http://")
+		proxyHandler(httptest.NewRecorder(), req)
+	}
+
+	m := s.metrics()
+	assert.Contains(t, m, `hvac_weather_forecasts_served_total{source="upstream"} 1`)
+	assert.Contains(t, m, `hvac_weather_forecasts_served_total{source="cache"} 1`)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hvac-proxy/hvac"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebhookConfig controls the optional webhook sinks, which POST events from
+// the bus as JSON to HTTP endpoints.
+type WebhookConfig struct {
+	Endpoints    []WebhookEndpoint `yaml:"endpoints"`
+	QueueSize    int               `yaml:"queueSize"`    // Events waiting per endpoint; more are dropped
+	Timeout      time.Duration     `yaml:"timeout"`      // Time allowed per delivery attempt
+	Retries      int               `yaml:"retries"`      // Extra attempts per event
+	RetryBackoff time.Duration     `yaml:"retryBackoff"` // Wait before the first retry, doubled each time
+}
+
+// WebhookEndpoint is a URL that receives events.
+type WebhookEndpoint struct {
+	URL     string            `yaml:"url"`
+	Events  []string          `yaml:"events"`  // Event types to send, e.g. status or alert; empty sends all
+	Headers map[string]string `yaml:"headers"` // Extra request headers
+	Secret  string            `yaml:"secret"`  // Signs each body with HMAC-SHA256 in X-Hvac-Signature
+}
+
+// defaultWebhookConfig returns the settings used when nothing is configured.
+func defaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		QueueSize:    100,
+		Timeout:      10 * time.Second,
+		Retries:      3,
+		RetryBackoff: 2 * time.Second,
+	}
+}
+
+// validateWebhooks checks the webhook settings when any are configured.
+func validateWebhooks(c *WebhookConfig, check func(ok bool, field, format string, args ...any)) {
+	if len(c.Endpoints) == 0 {
+		return
+	}
+	for i, ep := range c.Endpoints {
+		field := "webhooks.endpoints[" + strconv.Itoa(i) + "].url"
+		u, err := url.Parse(ep.URL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", field, "must be an http(s) URL, got %q", ep.URL)
+	}
+	check(c.QueueSize > 0, "webhooks.queueSize", "must be positive")
+	check(c.Timeout > 0, "webhooks.timeout", "must be positive")
+	check(c.Retries >= 0, "webhooks.retries", "must not be negative")
+	check(c.RetryBackoff >= 0, "webhooks.retryBackoff", "must not be negative")
+}
+
+// webhookSink delivers events to one endpoint, one request per event.
+type webhookSink struct {
+	endpoint WebhookEndpoint
+	client   *http.Client
+}
+
+func (s *webhookSink) Accepts(e hvac.Event) bool {
+	return len(s.endpoint.Events) == 0 || slices.Contains(s.endpoint.Events, e.Type)
+}
+
+func (s *webhookSink) Write(ctx context.Context, events []hvac.Event) error {
+	for _, e := range events {
+		if err := s.post(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sends one event. Client errors other than 408 and 429 mean the
+// endpoint will not accept the event, so it is not retried.
+func (s *webhookSink) post(ctx context.Context, e hvac.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("%w: %v", hvac.ErrPermanent, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", hvac.ErrPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "hvac-proxy/"+Version)
+	req.Header.Set("X-Hvac-Event", e.Type)
+	req.Header.Set("X-Hvac-Event-Id", strconv.FormatUint(e.ID, 10))
+	if s.endpoint.Secret != "" {
+		req.Header.Set("X-Hvac-Signature", "sha256="+webhookSignature(s.endpoint.Secret, body))
+	}
+	for k, v := range s.endpoint.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		return fmt.Errorf("%w: webhook returned %s", hvac.ErrPermanent, resp.Status)
+	}
+}
+
+// webhookSignature is the hex HMAC-SHA256 of body keyed with secret.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSinks holds the removers of the registered webhook sinks, so a
+// reload can drop endpoints that were deleted.
+var webhookSinks []func()
+
+// initWebhooks registers a sink per configured endpoint, replacing the
+// sinks of a previous configuration.
+func initWebhooks(cfg WebhookConfig) {
+	if len(webhookSinks) > len(cfg.Endpoints) {
+		// Sinks still configured are replaced by name below
+		for _, remove := range webhookSinks[len(cfg.Endpoints):] {
+			remove()
+		}
+		webhookSinks = webhookSinks[:len(cfg.Endpoints)]
+	}
+	client := &http.Client{}
+	for i, ep := range cfg.Endpoints {
+		name := "webhook-" + strconv.Itoa(i+1)
+		remove := hvac.Events.AddSink(name, &webhookSink{endpoint: ep, client: client}, hvac.SinkConfig{
+			QueueSize:    cfg.QueueSize,
+			BatchSize:    1,
+			Timeout:      cfg.Timeout,
+			Retries:      cfg.Retries,
+			RetryBackoff: cfg.RetryBackoff,
+		})
+		if i < len(webhookSinks) {
+			webhookSinks[i] = remove
+		} else {
+			webhookSinks = append(webhookSinks, remove)
+		}
+		events := "all events"
+		if len(ep.Events) > 0 {
+			events = strings.Join(ep.Events, ", ")
+		}
+		fmt.Printf("Sending %s to webhook %s as %s\n", events, redactQuery(ep.URL), name)
+	}
+}
+
+// redactQuery hides the query string of a URL, which often carries a token.
+func redactQuery(raw string) string {
+	if i := strings.IndexByte(raw, '?'); i >= 0 {
+		return raw[:i] + "?REDACTED"
+	}
+	return raw
+}
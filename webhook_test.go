@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"hvac-proxy/hvac"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookStandIn records webhook deliveries and answers with status.
+type webhookStandIn struct {
+	mu     sync.Mutex
+	status int
+	reqs   []*http.Request
+	bodies [][]byte
+}
+
+func (s *webhookStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reqs = append(s.reqs, r)
+	s.bodies = append(s.bodies, body)
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+	}
+}
+
+func (s *webhookStandIn) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.reqs)
+}
+
+// useWebhookSink registers a sink for endpoint on a private bus.
+func useWebhookSink(t *testing.T, endpoint WebhookEndpoint) *hvac.EventBus {
+	bus := hvac.NewEventBus(16)
+	t.Cleanup(bus.AddSink("webhook-1", &webhookSink{endpoint: endpoint, client: &http.Client{}}, hvac.SinkConfig{
+		QueueSize:    10,
+		BatchSize:    1,
+		Timeout:      5 * time.Second,
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+	}))
+	return bus
+}
+
+func TestWebhookSink_Delivers(t *testing.T) {
+	standIn := &webhookStandIn{}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+	bus := useWebhookSink(t, WebhookEndpoint{
+		URL:     srv.URL + "/hook",
+		Events:  []string{"alert"},
+		Headers: map[string]string{"Authorization": "Bearer abc"},
+		Secret:  "s3cret",
+	})
+
+	bus.Publish("status", "ignored")
+	bus.Publish("alert", hvac.Alert{Source: "breaker/hvac.example.com", Severity: "warning", Active: true, Message: "Circuit open"})
+	require.True(t, bus.FlushSinks(5*time.Second))
+
+	require.Equal(t, 1, standIn.count(), "only subscribed event types are sent")
+	req, body := standIn.reqs[0], standIn.bodies[0]
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "/hook", req.URL.Path)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "alert", req.Header.Get("X-Hvac-Event"))
+	assert.Equal(t, "2", req.Header.Get("X-Hvac-Event-Id"))
+	assert.Equal(t, "Bearer abc", req.Header.Get("Authorization"))
+	assert.Equal(t, "sha256="+webhookSignature("s3cret", body), req.Header.Get("X-Hvac-Signature"))
+
+	var event struct {
+		Type string     `json:"type"`
+		Data hvac.Alert `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(body, &event))
+	assert.Equal(t, "alert", event.Type)
+	assert.Equal(t, "Circuit open", event.Data.Message)
+}
+
+func TestWebhookSink_RetriesServerErrors(t *testing.T) {
+	standIn := &webhookStandIn{status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+	bus := useWebhookSink(t, WebhookEndpoint{URL: srv.URL, Events: []string{"status"}})
+
+	bus.Publish("status", "a")
+	require.True(t, bus.FlushSinks(5*time.Second))
+	assert.Equal(t, 3, standIn.count(), "first attempt plus two retries")
+	assert.Contains(t, bus.SinkMetrics(), `hvac_proxy_sink_events_total{sink="webhook-1",outcome="failed"} 1`)
+}
+
+func TestWebhookSink_ClientErrorsAreNotRetried(t *testing.T) {
+	standIn := &webhookStandIn{status: http.StatusNotFound}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+	bus := useWebhookSink(t, WebhookEndpoint{URL: srv.URL, Events: []string{"status"}})
+
+	bus.Publish("status", "a")
+	require.True(t, bus.FlushSinks(5*time.Second))
+	assert.Equal(t, 1, standIn.count())
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// From RFC 4231 test case 2
+	assert.Equal(t, "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		webhookSignature("Jefe", []byte("what do ya want for nothing?")))
+}
+
+func TestWebhookConfig_Validate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Webhooks.Endpoints = []WebhookEndpoint{{URL: "https://example.com/hook"}, {URL: "mqtt://broker"}}
+	cfg.Webhooks.Timeout = 0
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "webhooks.endpoints[1].url")
+	assert.NotContains(t, err.Error(), "webhooks.endpoints[0].url")
+	assert.Contains(t, err.Error(), "webhooks.timeout: must be positive")
+
+	cfg = defaultConfig()
+	cfg.Webhooks.Timeout = 0
+	assert.NoError(t, cfg.Validate(), "only checked when endpoints are configured")
+}
+
+func TestWebhookConfig_Env(t *testing.T) {
+	t.Setenv("WEBHOOK_URLS", "https://a.example.com/hook, https://b.example.com/hook?token=abc")
+	t.Setenv("WEBHOOK_EVENTS", "alert,systemconfig")
+	t.Setenv("WEBHOOK_SECRET", "s3cret")
+	t.Setenv("WEBHOOK_RETRIES", "5")
+	cfg, err := loadConfig("")
+	require.NoError(t, err)
+
+	require.Len(t, cfg.Webhooks.Endpoints, 2)
+	assert.Equal(t, "https://b.example.com/hook?token=abc", cfg.Webhooks.Endpoints[1].URL)
+	assert.Equal(t, []string{"alert", "systemconfig"}, cfg.Webhooks.Endpoints[1].Events)
+	assert.Equal(t, "s3cret", cfg.Webhooks.Endpoints[0].Secret)
+	assert.Equal(t, 5, cfg.Webhooks.Retries)
+	assert.Equal(t, "REDACTED", cfg.Redacted().Webhooks.Endpoints[0].Secret)
+	assert.Equal(t, "s3cret", cfg.Webhooks.Endpoints[0].Secret, "redacting leaves the config alone")
+
+	assert.Equal(t, "https://b.example.com/hook?REDACTED", redactQuery(cfg.Webhooks.Endpoints[1].URL))
+}
+
+func TestApplyConfig_ReplacesWebhooks(t *testing.T) {
+	useDataDir(t)
+	useUpstream(t, testUpstreamConfig())
+	t.Cleanup(func() { initWebhooks(WebhookConfig{}) })
+	first, second := &webhookStandIn{}, &webhookStandIn{}
+	srv1, srv2 := httptest.NewServer(first), httptest.NewServer(second)
+	defer srv1.Close()
+	defer srv2.Close()
+
+	prev := defaultConfig()
+	next := prev
+	next.Webhooks.Endpoints = []WebhookEndpoint{{URL: srv1.URL, Events: []string{"alert"}}, {URL: srv2.URL, Events: []string{"alert"}}}
+	assert.Empty(t, applyConfig(&prev, &next), "webhooks apply at runtime")
+	hvac.Events.Publish("alert", hvac.Alert{Source: "test", Active: true})
+	require.True(t, hvac.Events.FlushSinks(5*time.Second))
+	assert.Equal(t, 1, first.count())
+	assert.Equal(t, 1, second.count())
+
+	// Dropping the first endpoint moves the second into its place
+	later := next
+	later.Webhooks.Endpoints = next.Webhooks.Endpoints[1:]
+	assert.Empty(t, applyConfig(&next, &later))
+	assert.NotContains(t, hvac.Events.SinkMetrics(), `sink="webhook-2"`)
+	hvac.Events.Publish("alert", hvac.Alert{Source: "test", Active: false})
+	require.True(t, hvac.Events.FlushSinks(5*time.Second))
+	assert.Equal(t, 1, first.count())
+	assert.Equal(t, 2, second.count())
+}
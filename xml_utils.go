@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// These helpers edit single text elements of upstream documents in place,
+// leaving the rest of the document byte for byte as it was.
+
+var (
+	elementPatternsMu sync.Mutex
+	elementPatterns   = map[string]*regexp.Regexp{} // By element name
+)
+
+// elementPattern matches an element with only text content, keeping its
+// attributes. Patterns are compiled once per name.
+func elementPattern(name string) *regexp.Regexp {
+	elementPatternsMu.Lock()
+	defer elementPatternsMu.Unlock()
+	re, ok := elementPatterns[name]
+	if !ok {
+		re = regexp.MustCompile(`(<` + regexp.QuoteMeta(name) + `(?:\s[^>]*)?>)[^<]*(</` + regexp.QuoteMeta(name) + `>)`)
+		elementPatterns[name] = re
+	}
+	return re
+}
+
+// setElement replaces the text of the first <name> element in doc.
+func setElement(doc []byte, name, value string) []byte {
+	re := elementPattern(name)
+	loc := re.FindSubmatchIndex(doc)
+	if loc == nil {
+		return doc
+	}
+	var out bytes.Buffer
+	out.Write(doc[:loc[3]])
+	out.WriteString(value)
+	out.Write(doc[loc[4]:])
+	return out.Bytes()
+}
+
+// elementFloat returns the number in the first <name> element in doc.
+func elementFloat(doc []byte, name string) (float64, bool) {
+	m := elementPattern(name).FindSubmatchIndex(doc)
+	if m == nil {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(doc[m[3]:m[4]])), 64)
+	return v, err == nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetElement(t *testing.T) {
+	doc := []byte(`<status><pingRate unit="s">12</pingRate><serverHasChanges>false</serverHasChanges></status>`)
+	assert.Equal(t, `<status><pingRate unit="s">30</pingRate><serverHasChanges>true</serverHasChanges></status>`,
+		string(setElement(setElement(doc, "serverHasChanges", "true"), "pingRate", "30")))
+	assert.Equal(t, doc, setElement(doc, "configHasChanges", "true"), "missing elements are left out")
+
+	v, ok := elementFloat(doc, "pingRate")
+	assert.True(t, ok)
+	assert.Equal(t, 12.0, v)
+	assert.Same(t, elementPattern("pingRate"), elementPattern("pingRate"), "compiled once")
+}